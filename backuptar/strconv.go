@@ -1,4 +1,5 @@
-//go:build windows
+//go:build windows || linux
+// +build windows linux
 
 package backuptar
 
@@ -0,0 +1,267 @@
+//go:build windows || linux
+// +build windows linux
+
+package backuptar
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/Microsoft/go-winio/wim"
+)
+
+// WIMFileHeader returns the tar header for a file in a WIM image, using the
+// same PAX records as WriteTarFileFromBackupStream.
+func WIMFileHeader(name string, f *wim.File) (*tar.Header, error) {
+	hdr := &tar.Header{
+		Format:     tar.FormatPAX,
+		Name:       name,
+		Size:       f.Size,
+		Typeflag:   tar.TypeReg,
+		ModTime:    f.LastWriteTime.Time(),
+		ChangeTime: f.LastWriteTime.Time(),
+		AccessTime: f.LastAccessTime.Time(),
+		PAXRecords: make(map[string]string),
+	}
+	hdr.PAXRecords[hdrFileAttributes] = fmt.Sprintf("%d", f.Attributes)
+	hdr.PAXRecords[hdrCreationTime] = formatPAXTime(f.CreationTime.Time())
+
+	switch {
+	case f.Attributes&wim.FILE_ATTRIBUTE_REPARSE_POINT != 0:
+		rp, err := f.ReparsePoint()
+		if err != nil {
+			return nil, err
+		}
+		if rp.Link == nil {
+			return nil, fmt.Errorf("%s: %w", name, &winio.UnsupportedReparsePointError{Tag: rp.Tag})
+		}
+		hdr.Mode |= cISLNK
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Size = 0
+		hdr.Linkname = rp.Link.Target
+		if rp.Link.IsMountPoint {
+			hdr.PAXRecords[hdrMountPoint] = "1"
+		}
+	case f.IsDir():
+		hdr.Mode |= cISDIR
+		hdr.Size = 0
+		hdr.Typeflag = tar.TypeDir
+	default:
+		hdr.Mode |= cISREG
+	}
+
+	if len(f.SecurityDescriptor) != 0 {
+		hdr.PAXRecords[hdrRawSecurityDescriptor] = base64.StdEncoding.EncodeToString(f.SecurityDescriptor)
+	}
+	for _, ea := range f.ExtendedAttributes {
+		hdr.PAXRecords[hdrEaPrefix+ea.Name] = base64.StdEncoding.EncodeToString(ea.Value)
+	}
+	return hdr, nil
+}
+
+// WriteTarFileFromWIMFile writes a file from a WIM image to a tar writer,
+// followed by its alternate data streams, in the same format as
+// WriteTarFileFromBackupStream. Sparse files are written with their full
+// contents.
+func WriteTarFileFromWIMFile(t *tar.Writer, name string, f *wim.File) error {
+	hdr, err := WIMFileHeader(name, f)
+	if err != nil {
+		return err
+	}
+	err = t.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeReg {
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(t, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: copying contents: %w", name, err)
+		}
+	}
+
+	for _, s := range f.Streams {
+		shdr := &tar.Header{
+			Format:     hdr.Format,
+			Name:       name + ":" + s.Name,
+			Mode:       hdr.Mode,
+			Typeflag:   tar.TypeReg,
+			Size:       s.Size,
+			ModTime:    hdr.ModTime,
+			AccessTime: hdr.AccessTime,
+			ChangeTime: hdr.ChangeTime,
+		}
+		err = t.WriteHeader(shdr)
+		if err != nil {
+			return err
+		}
+		r, err := s.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(t, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: copying stream %s: %w", name, s.Name, err)
+		}
+	}
+	return nil
+}
+
+// WriteTarFromWIMImage writes the contents of a WIM image to a tar writer
+// using WriteTarFileFromWIMFile, with paths relative to the image root.
+// Files in the same hard link group after the first are written as hard
+// links to it.
+func WriteTarFromWIMImage(t *tar.Writer, img *wim.Image) error {
+	root, err := img.Open()
+	if err != nil {
+		return err
+	}
+	return writeTarFromWIMDir(t, "", root, make(map[int64]string))
+}
+
+func writeTarFromWIMDir(t *tar.Writer, dir string, d *wim.File, links map[int64]string) error {
+	files, err := d.Readdir()
+	if err != nil {
+		return err
+	}
+	return writeTarFromWIMFiles(t, dir, files, links)
+}
+
+func writeTarFromWIMFiles(t *tar.Writer, dir string, files []*wim.File, links map[int64]string) error {
+	for _, f := range files {
+		name := path.Join(dir, f.Name)
+		if f.LinkID != 0 && !f.IsDir() {
+			if target, ok := links[f.LinkID]; ok {
+				err := t.WriteHeader(&tar.Header{
+					Format:   tar.FormatPAX,
+					Name:     name,
+					Typeflag: tar.TypeLink,
+					Linkname: target,
+					ModTime:  f.LastWriteTime.Time(),
+				})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			links[f.LinkID] = name
+		}
+		err := WriteTarFileFromWIMFile(t, name, f)
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			err = writeTarFromWIMDir(t, name, f, links)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Paths in a Windows container layer.
+const (
+	layerFilesPath     = "Files"
+	layerHivesPath     = "Hives"
+	layerUtilityVMPath = "UtilityVM"
+	layerConfigPath    = `Windows\System32\config`
+)
+
+// layerHives maps the registry hives in a base layer's Hives directory to
+// the files in Windows\System32\config they are copied from.
+var layerHives = []struct {
+	name string
+	file string
+}{
+	{"DefaultUser_Delta", "DEFAULT"},
+	{"Sam_Delta", "SAM"},
+	{"Security_Delta", "SECURITY"},
+	{"Software_Delta", "SOFTWARE"},
+	{"System_Delta", "SYSTEM"},
+}
+
+// WriteBaseLayerFromWIMImage writes a WIM image to a tar writer as a Windows
+// container base layer, in the layout imported by hcsshim: the image's files
+// are written under Files/, followed by copies of its registry hives under
+// Hives/. If the root of the image has a UtilityVM directory, it is written
+// under UtilityVM/ instead of Files/, and should contain the utility VM's
+// own Files directory.
+//
+// WriteBaseLayerFromWIMImage returns an error wrapping fs.ErrNotExist if any
+// of the DEFAULT, SAM, SECURITY, SOFTWARE and SYSTEM hives is missing from
+// the image.
+func WriteBaseLayerFromWIMImage(t *tar.Writer, img *wim.Image) error {
+	config, err := img.Lookup(layerConfigPath)
+	if err != nil {
+		return err
+	}
+	hives := make([]*wim.File, len(layerHives))
+	for i, h := range layerHives {
+		hives[i], err = img.Lookup(layerConfigPath + `\` + h.file)
+		if err != nil {
+			return err
+		}
+	}
+
+	root, err := img.Open()
+	if err != nil {
+		return err
+	}
+	files, err := root.Readdir()
+	if err != nil {
+		return err
+	}
+	var uvm *wim.File
+	for i, f := range files {
+		if f.IsDir() && strings.EqualFold(f.Name, layerUtilityVMPath) {
+			uvm = f
+			files = append(files[:i:i], files[i+1:]...)
+			break
+		}
+	}
+
+	links := make(map[int64]string)
+	err = WriteTarFileFromWIMFile(t, layerFilesPath, root)
+	if err != nil {
+		return err
+	}
+	err = writeTarFromWIMFiles(t, layerFilesPath, files, links)
+	if err != nil {
+		return err
+	}
+
+	err = WriteTarFileFromWIMFile(t, layerHivesPath, config)
+	if err != nil {
+		return err
+	}
+	for i, h := range layerHives {
+		err = WriteTarFileFromWIMFile(t, path.Join(layerHivesPath, h.name), hives[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	if uvm != nil {
+		err = WriteTarFileFromWIMFile(t, layerUtilityVMPath, uvm)
+		if err != nil {
+			return err
+		}
+		err = writeTarFromWIMDir(t, layerUtilityVMPath, uvm, links)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
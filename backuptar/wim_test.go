@@ -0,0 +1,263 @@
+//go:build windows || linux
+// +build windows linux
+
+package backuptar
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/Microsoft/go-winio/wim"
+)
+
+func TestWriteTarFromWIMImage(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"dir":          &fstest.MapFile{Mode: fs.ModeDir | 0755, ModTime: mtime},
+		"dir/file.txt": &fstest.MapFile{Data: []byte("hello"), Mode: 0644, ModTime: mtime},
+		"dir/link.txt": &fstest.MapFile{Data: []byte("hello"), Mode: 0644, ModTime: mtime},
+		"symlink":      &fstest.MapFile{Mode: fs.ModeSymlink, ModTime: mtime},
+	}
+	sd := []byte{1, 0, 4, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	rp := winio.EncodeReparsePoint(&winio.ReparsePoint{Target: `dir\file.txt`})
+	meta := func(name string, fi fs.FileInfo) (*wim.FileMetadata, error) {
+		m := &wim.FileMetadata{
+			Attributes:         wim.FILE_ATTRIBUTE_ARCHIVE,
+			SecurityDescriptor: sd,
+			LastWriteTime:      wim.NewFiletime(mtime),
+		}
+		switch name {
+		case ".", "dir":
+			m.Attributes = wim.FILE_ATTRIBUTE_DIRECTORY
+		case "dir/file.txt", "dir/link.txt":
+			m.LinkID = 1
+			if name == "dir/file.txt" {
+				m.Streams = []wim.AlternateStream{{Name: "ads", Open: func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader([]byte("stream"))), nil
+				}}}
+				m.ExtendedAttributes = []winio.ExtendedAttribute{{Name: "foo", Value: []byte("bar")}}
+			}
+		case "symlink":
+			m.ReparseTag = 0xA000000C
+			m.ReparseData = rp[8:]
+		}
+		return m, nil
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.wim"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := wim.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddImage(fsys, wim.ImageInfo{Name: "test"}, meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := wim.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := WriteTarFromWIMImage(tw, r.Image[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	hdrs := make(map[string]*tar.Header)
+	contents := make(map[string]string)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF { //nolint:errorlint
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		hdrs[hdr.Name] = hdr
+		contents[hdr.Name] = string(b)
+	}
+
+	want := []string{"dir", "dir/file.txt", "dir/file.txt:ads", "dir/link.txt", "symlink"}
+	if len(names) != len(want) {
+		t.Fatalf("expected entries %v, got %v", want, names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("expected entries %v, got %v", want, names)
+		}
+	}
+
+	if hdr := hdrs["dir"]; hdr.Typeflag != tar.TypeDir || hdr.PAXRecords[hdrFileAttributes] != strconv.Itoa(wim.FILE_ATTRIBUTE_DIRECTORY) {
+		t.Errorf("unexpected dir header %+v", hdr)
+	}
+	hdr := hdrs["dir/file.txt"]
+	if hdr.Typeflag != tar.TypeReg || contents["dir/file.txt"] != "hello" || !hdr.ModTime.Equal(mtime) {
+		t.Errorf("unexpected file header %+v", hdr)
+	}
+	if v := hdr.PAXRecords[hdrRawSecurityDescriptor]; v != base64.StdEncoding.EncodeToString(sd) {
+		t.Errorf("unexpected security descriptor record %q", v)
+	}
+	if v := hdr.PAXRecords[hdrEaPrefix+"foo"]; v != base64.StdEncoding.EncodeToString([]byte("bar")) {
+		t.Errorf("unexpected EA record %q", v)
+	}
+	if contents["dir/file.txt:ads"] != "stream" {
+		t.Errorf("unexpected stream contents %q", contents["dir/file.txt:ads"])
+	}
+	if hdr := hdrs["dir/link.txt"]; hdr.Typeflag != tar.TypeLink || hdr.Linkname != "dir/file.txt" {
+		t.Errorf("unexpected hard link header %+v", hdr)
+	}
+	if hdr := hdrs["symlink"]; hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != `dir\file.txt` {
+		t.Errorf("unexpected symlink header %+v", hdr)
+	}
+}
+
+func TestWriteBaseLayerFromWIMImage(t *testing.T) {
+	dir := &fstest.MapFile{Mode: fs.ModeDir | 0755}
+	fsys := fstest.MapFS{
+		"Windows":                            dir,
+		"Windows/System32":                   dir,
+		"Windows/System32/config":            dir,
+		"Windows/System32/cmd.exe":           &fstest.MapFile{Data: []byte("cmd"), Mode: 0644},
+		"UtilityVM":                          dir,
+		"UtilityVM/Files":                    dir,
+		"UtilityVM/Files/EFI":                dir,
+		"UtilityVM/Files/EFI/Microsoft.efi":  &fstest.MapFile{Data: []byte("efi"), Mode: 0644},
+		"Windows/System32/config/DEFAULT":    &fstest.MapFile{Data: []byte("default"), Mode: 0644},
+		"Windows/System32/config/SAM":        &fstest.MapFile{Data: []byte("sam"), Mode: 0644},
+		"Windows/System32/config/SECURITY":   &fstest.MapFile{Data: []byte("security"), Mode: 0644},
+		"Windows/System32/config/SOFTWARE":   &fstest.MapFile{Data: []byte("software"), Mode: 0644},
+		"Windows/System32/config/SYSTEM":     &fstest.MapFile{Data: []byte("system"), Mode: 0644},
+		"Windows/System32/config/SYSTEM.LOG": &fstest.MapFile{Data: []byte("log"), Mode: 0644},
+	}
+	writeLayer := func(fsys fstest.MapFS) (*bytes.Buffer, error) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "test.wim"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		w, err := wim.NewWriter(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddImage(fsys, wim.ImageInfo{Name: "test"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := wim.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := WriteBaseLayerFromWIMImage(tw, r.Image[0]); err != nil {
+			return nil, err
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return &buf, nil
+	}
+
+	buf, err := writeLayer(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(buf)
+	contents := make(map[string]string)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF { //nolint:errorlint
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		contents[hdr.Name] = string(b)
+		if hdr.Typeflag == tar.TypeDir && hdr.PAXRecords[hdrFileAttributes] == "" {
+			t.Errorf("%s: missing file attributes", hdr.Name)
+		}
+	}
+
+	want := []string{
+		"Files",
+		"Files/Windows",
+		"Files/Windows/System32",
+		"Files/Windows/System32/cmd.exe",
+		"Files/Windows/System32/config",
+		"Files/Windows/System32/config/DEFAULT",
+		"Files/Windows/System32/config/SAM",
+		"Files/Windows/System32/config/SECURITY",
+		"Files/Windows/System32/config/SOFTWARE",
+		"Files/Windows/System32/config/SYSTEM",
+		"Files/Windows/System32/config/SYSTEM.LOG",
+		"Hives",
+		"Hives/DefaultUser_Delta",
+		"Hives/Sam_Delta",
+		"Hives/Security_Delta",
+		"Hives/Software_Delta",
+		"Hives/System_Delta",
+		"UtilityVM",
+		"UtilityVM/Files",
+		"UtilityVM/Files/EFI",
+		"UtilityVM/Files/EFI/Microsoft.efi",
+	}
+	if len(names) != len(want) {
+		t.Fatalf("expected entries %v, got %v", want, names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("expected entries %v, got %v", want, names)
+		}
+	}
+	for name, want := range map[string]string{
+		"Hives/DefaultUser_Delta":           "default",
+		"Hives/System_Delta":                "system",
+		"Files/Windows/System32/cmd.exe":    "cmd",
+		"UtilityVM/Files/EFI/Microsoft.efi": "efi",
+	} {
+		if contents[name] != want {
+			t.Errorf("%s: expected %q, got %q", name, want, contents[name])
+		}
+	}
+
+	delete(fsys, "Windows/System32/config/SAM")
+	if _, err := writeLayer(fsys); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist for a missing hive, got %v", err)
+	}
+}
@@ -1,11 +1,9 @@
-//go:build windows
-// +build windows
-
 package winio
 
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"strings"
 	"unicode/utf16"
@@ -27,6 +25,8 @@ type reparseDataBuffer struct {
 	PrintNameLength      uint16
 }
 
+var errInvalidReparsePoint = errors.New("invalid reparse point data")
+
 // ReparsePoint describes a Win32 symlink or mount point.
 type ReparsePoint struct {
 	Target       string
@@ -46,6 +46,9 @@ func (e *UnsupportedReparsePointError) Error() string {
 // DecodeReparsePoint decodes a Win32 REPARSE_DATA_BUFFER structure containing either a symlink
 // or a mount point.
 func DecodeReparsePoint(b []byte) (*ReparsePoint, error) {
+	if len(b) < 8 {
+		return nil, errInvalidReparsePoint
+	}
 	tag := binary.LittleEndian.Uint32(b[0:4])
 	return DecodeReparsePointData(tag, b[8:])
 }
@@ -59,11 +62,17 @@ func DecodeReparsePointData(tag uint32, b []byte) (*ReparsePoint, error) {
 	default:
 		return nil, &UnsupportedReparsePointError{tag}
 	}
-	nameOffset := 8 + binary.LittleEndian.Uint16(b[4:6])
+	if len(b) < 8 {
+		return nil, errInvalidReparsePoint
+	}
+	nameOffset := 8 + int(binary.LittleEndian.Uint16(b[4:6]))
 	if !isMountPoint {
 		nameOffset += 4
 	}
-	nameLength := binary.LittleEndian.Uint16(b[6:8])
+	nameLength := int(binary.LittleEndian.Uint16(b[6:8]))
+	if nameOffset+nameLength > len(b) {
+		return nil, errInvalidReparsePoint
+	}
 	name := make([]uint16, nameLength/2)
 	err := binary.Read(bytes.NewReader(b[nameOffset:nameOffset+nameLength]), binary.LittleEndian, &name)
 	if err != nil {
@@ -0,0 +1,58 @@
+//go:build windows || linux
+// +build windows linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Microsoft/go-winio/wim"
+)
+
+func runCat(name string, args []string) error {
+	flags := newFlagSet(name)
+	index := flags.Int("image", 1, "the 1-based `index` of the image")
+	stream := flags.String("stream", "", "write the alternate data stream with this `name` instead")
+	verify := flags.Bool("verify", false, "check the SHA-1 hash of the data")
+	parse(flags, args, 2, 2)
+
+	r, cleanup, err := openWIM(flags.Arg(0), wim.ReaderOptions{VerifyHashes: *verify})
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	img, err := image(r, *index)
+	if err != nil {
+		return err
+	}
+	f, err := img.Lookup(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	var open func() (io.ReadCloser, error)
+	if *stream == "" {
+		if f.IsDir() {
+			return fmt.Errorf("%s is a directory", flags.Arg(1))
+		}
+		open = f.Open
+	} else {
+		for _, s := range f.Streams {
+			if s.Name == *stream {
+				open = s.Open
+			}
+		}
+		if open == nil {
+			return fmt.Errorf("%s has no stream %q", flags.Arg(1), *stream)
+		}
+	}
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(os.Stdout, rc)
+	return err
+}
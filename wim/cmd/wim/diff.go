@@ -0,0 +1,111 @@
+//go:build windows || linux
+// +build windows linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Microsoft/go-winio/wim"
+)
+
+type diffEntry struct {
+	Path string `json:"path"`
+	// Change is "added", "removed" or "modified".
+	Change string `json:"change"`
+	// What lists the kinds of modification: "content", "attributes",
+	// "security", "streams" or "timestamps".
+	What []string `json:"what,omitempty"`
+}
+
+func runDiff(name string, args []string) error {
+	flags := newFlagSet(name)
+	index := flags.Int("image", 1, "the 1-based `index` of the image in a.wim")
+	index2 := flags.Int("image2", 0, "the 1-based `index` of the image in b.wim (default the same as -image)")
+	ignoreTimes := flags.Bool("ignore-times", false, "ignore timestamp changes")
+	jsonOut := flags.Bool("json", false, "print JSON")
+	parse(flags, args, 2, 2)
+	if *index2 == 0 {
+		*index2 = *index
+	}
+
+	ra, closeA, err := openWIM(flags.Arg(0), wim.ReaderOptions{})
+	if err != nil {
+		return err
+	}
+	defer closeA()
+	rb, closeB, err := openWIM(flags.Arg(1), wim.ReaderOptions{})
+	if err != nil {
+		return err
+	}
+	defer closeB()
+	a, err := image(ra, *index)
+	if err != nil {
+		return err
+	}
+	b, err := image(rb, *index2)
+	if err != nil {
+		return err
+	}
+
+	entries := []diffEntry{}
+	changed := false
+	d := wim.Diff(a, b)
+	for {
+		c, err := d.Next()
+		if err == io.EOF { //nolint:errorlint
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if *ignoreTimes {
+			c.Flags &^= wim.TimestampsChanged
+			if c.Kind == wim.FileModified && c.Flags == 0 {
+				continue
+			}
+		}
+		changed = true
+		e := diffEntry{Path: c.Path, Change: c.Kind.String()}
+		if c.Flags != 0 {
+			e.What = strings.Split(c.Flags.String(), ",")
+		}
+		if *jsonOut {
+			entries = append(entries, e)
+			continue
+		}
+		switch c.Kind {
+		case wim.FileAdded:
+			fmt.Printf("A %s\n", e.Path)
+		case wim.FileRemoved:
+			fmt.Printf("D %s\n", e.Path)
+		default:
+			fmt.Printf("M %s (%s)\n", e.Path, strings.Join(e.What, ", "))
+		}
+	}
+	if *jsonOut {
+		err = printJSON(entries)
+		if err != nil {
+			return err
+		}
+	}
+	if changed {
+		return errSilent
+	}
+	return nil
+}
+
+// collectFiles returns the files of img by path.
+func collectFiles(img *wim.Image) (map[string]*wim.File, error) {
+	files := make(map[string]*wim.File)
+	err := img.Walk(func(p string, f *wim.File, err error) error {
+		if err != nil {
+			return err
+		}
+		files[p] = f
+		return nil
+	})
+	return files, err
+}
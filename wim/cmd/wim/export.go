@@ -0,0 +1,120 @@
+//go:build windows || linux
+// +build windows linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/Microsoft/go-winio/wim"
+)
+
+func runExport(name string, args []string) error {
+	flags := newFlagSet(name)
+	index := flags.Int("image", 1, "the 1-based `index` of the image")
+	imageName := flags.String("name", "", "the `name` of the exported image when appending (default the source image's name)")
+	appendTo := flags.Bool("append", false, "add the image to dst.wim instead of creating a new WIM")
+	parse(flags, args, 2, 2)
+
+	r, cleanup, err := openWIM(flags.Arg(0), wim.ReaderOptions{Concurrency: 4})
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	img, err := image(r, *index)
+	if err != nil {
+		return err
+	}
+	if !*appendTo {
+		if *imageName != "" {
+			return errors.New("-name requires -append")
+		}
+		f, err := os.Create(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		bw := bufio.NewWriter(f)
+		err = wim.ExportImage(bw, r, *index)
+		if err != nil {
+			return err
+		}
+		err = bw.Flush()
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	// Appending re-encodes the image through a Writer, which shares data
+	// already present in dst.wim.
+	files, err := collectFiles(img)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(flags.Arg(1), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dst, err := wim.NewReader(f)
+	if err != nil {
+		return err
+	}
+	w, err := wim.NewAppendWriter(f, dst)
+	if err != nil {
+		return err
+	}
+
+	info := img.ImageInfo
+	info.Index = 0
+	if *imageName != "" {
+		info.Name = *imageName
+	}
+	err = w.AddImage(img.FS(), info, func(p string, _ fs.FileInfo) (*wim.FileMetadata, error) {
+		return fileMetadata(files[p])
+	})
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// fileMetadata returns the metadata to write f to another WIM.
+func fileMetadata(f *wim.File) (*wim.FileMetadata, error) {
+	m := &wim.FileMetadata{
+		Attributes:         f.Attributes,
+		SecurityDescriptor: f.SecurityDescriptor,
+		CreationTime:       f.CreationTime,
+		LastAccessTime:     f.LastAccessTime,
+		LastWriteTime:      f.LastWriteTime,
+		ShortName:          f.ShortName,
+		LinkID:             f.LinkID,
+		ExtendedAttributes: f.ExtendedAttributes,
+	}
+	if f.Attributes&wim.FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+		m.ReparseTag = f.ReparseTag
+		m.ReparseReserved = f.ReparseReserved
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		m.ReparseData, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range f.Streams {
+		m.Streams = append(m.Streams, wim.AlternateStream{Name: s.Name, Open: s.Open})
+	}
+	return m, nil
+}
@@ -0,0 +1,60 @@
+//go:build windows || linux
+// +build windows linux
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/Microsoft/go-winio/backuptar"
+	"github.com/Microsoft/go-winio/wim"
+)
+
+func runExtract(name string, args []string) error {
+	flags := newFlagSet(name)
+	index := flags.Int("image", 1, "the 1-based `index` of the image")
+	tarOut := flags.Bool("tar", false, `write a tar file to dest, or to standard output if dest is "-"`)
+	layer := flags.Bool("layer", false, "with -tar, write the image as a Windows container base layer")
+	noXattrs := flags.Bool("no-xattrs", false, "do not store Windows metadata in extended attributes (Linux only)")
+	verify := flags.Bool("verify", false, "check the SHA-1 hash of each file")
+	parse(flags, args, 2, 2)
+	if *layer && !*tarOut {
+		return errors.New("-layer requires -tar")
+	}
+
+	r, cleanup, err := openWIM(flags.Arg(0), wim.ReaderOptions{VerifyHashes: *verify, Concurrency: 4})
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	img, err := image(r, *index)
+	if err != nil {
+		return err
+	}
+	if !*tarOut {
+		return extractDir(img, flags.Arg(1), *noXattrs)
+	}
+
+	var w io.Writer = os.Stdout
+	if dest := flags.Arg(1); dest != "-" {
+		f, err := os.Create(dest)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	t := tar.NewWriter(w)
+	if *layer {
+		err = backuptar.WriteBaseLayerFromWIMImage(t, img)
+	} else {
+		err = backuptar.WriteTarFromWIMImage(t, img)
+	}
+	if err != nil {
+		return err
+	}
+	return t.Close()
+}
@@ -0,0 +1,7 @@
+package main
+
+import "github.com/Microsoft/go-winio/wim"
+
+func extractDir(img *wim.Image, dir string, noXattrs bool) error {
+	return img.ExtractTo(dir, &wim.ExtractOptions{NoXattrs: noXattrs})
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/Microsoft/go-winio/wim"
+)
+
+func extractDir(*wim.Image, string, bool) error {
+	return errors.New("extracting to a directory is only supported on Linux; use -tar")
+}
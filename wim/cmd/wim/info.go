@@ -0,0 +1,165 @@
+//go:build windows || linux
+// +build windows linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/go-winio/wim"
+)
+
+type infoOutput struct {
+	GUID       string         `json:"guid"`
+	Flags      string         `json:"flags,omitempty"`
+	ChunkSize  int            `json:"chunkSize,omitempty"`
+	PartNumber int            `json:"partNumber"`
+	TotalParts int            `json:"totalParts"`
+	BootIndex  int            `json:"bootIndex"`
+	TotalBytes int64          `json:"totalBytes"`
+	Images     []imageSummary `json:"images"`
+}
+
+type imageSummary struct {
+	Index         int          `json:"index"`
+	Name          string       `json:"name"`
+	Description   string       `json:"description,omitempty"`
+	DirCount      int64        `json:"dirCount"`
+	FileCount     int64        `json:"fileCount"`
+	TotalBytes    int64        `json:"totalBytes"`
+	HardLinkBytes int64        `json:"hardLinkBytes"`
+	CreationTime  time.Time    `json:"creationTime"`
+	ModTime       time.Time    `json:"modTime"`
+	Windows       *windowsInfo `json:"windows,omitempty"`
+}
+
+type windowsInfo struct {
+	ProductName      string   `json:"productName,omitempty"`
+	EditionID        string   `json:"editionId,omitempty"`
+	InstallationType string   `json:"installationType,omitempty"`
+	Arch             string   `json:"arch"`
+	Version          string   `json:"version"`
+	Languages        []string `json:"languages,omitempty"`
+	DefaultLanguage  string   `json:"defaultLanguage,omitempty"`
+	SystemRoot       string   `json:"systemRoot,omitempty"`
+}
+
+// archName returns the name of a PROCESSOR_ARCHITECTURE value.
+func archName(arch byte) string {
+	switch arch {
+	case 0:
+		return "x86"
+	case 5:
+		return "arm"
+	case 6:
+		return "ia64"
+	case 9:
+		return "amd64"
+	case 12:
+		return "arm64"
+	}
+	return fmt.Sprintf("unknown (%d)", arch)
+}
+
+func summarize(img *wim.Image) imageSummary {
+	s := imageSummary{
+		Index:         img.Index,
+		Name:          img.Name,
+		Description:   img.Description,
+		DirCount:      img.DirCount,
+		FileCount:     img.FileCount,
+		TotalBytes:    img.TotalBytes,
+		HardLinkBytes: img.HardLinkBytes,
+		CreationTime:  filetime(img.CreationTime),
+		ModTime:       filetime(img.ModTime),
+	}
+	if w := img.Windows; w != nil {
+		v := w.Version
+		s.Windows = &windowsInfo{
+			ProductName:      w.ProductName,
+			EditionID:        w.EditionID,
+			InstallationType: w.InstallationType,
+			Arch:             archName(w.Arch),
+			Version:          fmt.Sprintf("%d.%d.%d.%d", v.Major, v.Minor, v.Build, v.SPBuild),
+			Languages:        w.Languages,
+			DefaultLanguage:  w.DefaultLanguage,
+			SystemRoot:       w.SystemRoot,
+		}
+	}
+	return s
+}
+
+func runInfo(name string, args []string) error {
+	flags := newFlagSet(name)
+	jsonOut := flags.Bool("json", false, "print JSON")
+	registry := flags.Bool("registry", false, "read Windows information from the registry hives in each image")
+	parse(flags, args, 1, 1)
+
+	r, cleanup, err := openWIM(flags.Arg(0), wim.ReaderOptions{})
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	hdr := r.Header()
+	out := infoOutput{
+		GUID:       hdr.WIMGuid.String(),
+		Flags:      hdr.Flags.String(),
+		ChunkSize:  hdr.ChunkSize,
+		PartNumber: hdr.PartNumber,
+		TotalParts: hdr.TotalParts,
+		BootIndex:  hdr.BootIndex,
+		TotalBytes: r.Info.TotalBytes,
+		Images:     []imageSummary{},
+	}
+	for _, img := range r.Image {
+		if *registry {
+			w, err := img.ReadWindowsInfo()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "wim %s: image %d: %s\n", name, img.Index, err)
+			} else {
+				img.Windows = w
+			}
+		}
+		out.Images = append(out.Images, summarize(img))
+	}
+	if *jsonOut {
+		return printJSON(out)
+	}
+
+	fmt.Printf("GUID:         %s\n", out.GUID)
+	fmt.Printf("Part:         %d/%d\n", out.PartNumber, out.TotalParts)
+	if out.Flags != "" {
+		fmt.Printf("Flags:        %s\n", out.Flags)
+	}
+	if out.ChunkSize != 0 {
+		fmt.Printf("Chunk size:   %d\n", out.ChunkSize)
+	}
+	fmt.Printf("Boot index:   %d\n", out.BootIndex)
+	fmt.Printf("Images:       %d\n", len(out.Images))
+	for _, s := range out.Images {
+		fmt.Printf("\nIndex:        %d\n", s.Index)
+		fmt.Printf("Name:         %s\n", s.Name)
+		if s.Description != "" {
+			fmt.Printf("Description:  %s\n", s.Description)
+		}
+		fmt.Printf("Directories:  %d\n", s.DirCount)
+		fmt.Printf("Files:        %d\n", s.FileCount)
+		fmt.Printf("Total bytes:  %d\n", s.TotalBytes)
+		fmt.Printf("Created:      %s\n", s.CreationTime.Format(time.RFC3339))
+		fmt.Printf("Modified:     %s\n", s.ModTime.Format(time.RFC3339))
+		if w := s.Windows; w != nil {
+			fmt.Printf("Product:      %s\n", w.ProductName)
+			fmt.Printf("Edition:      %s\n", w.EditionID)
+			fmt.Printf("Architecture: %s\n", w.Arch)
+			fmt.Printf("Version:      %s\n", w.Version)
+			if len(w.Languages) != 0 {
+				fmt.Printf("Languages:    %s\n", strings.Join(w.Languages, ", "))
+			}
+		}
+	}
+	return nil
+}
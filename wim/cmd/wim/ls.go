@@ -0,0 +1,125 @@
+//go:build windows || linux
+// +build windows linux
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/go-winio/wim"
+)
+
+type fileEntry struct {
+	Path           string        `json:"path"`
+	Size           int64         `json:"size"`
+	Attributes     uint32        `json:"attributes"`
+	CreationTime   time.Time     `json:"creationTime"`
+	LastWriteTime  time.Time     `json:"lastWriteTime"`
+	LastAccessTime time.Time     `json:"lastAccessTime"`
+	Hash           string        `json:"hash,omitempty"`
+	ShortName      string        `json:"shortName,omitempty"`
+	LinkID         int64         `json:"linkId,omitempty"`
+	ReparseTag     uint32        `json:"reparseTag,omitempty"`
+	SecurityID     uint32        `json:"securityId"`
+	Streams        []streamEntry `json:"streams,omitempty"`
+}
+
+type streamEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash,omitempty"`
+}
+
+func newFileEntry(p string, f *wim.File) fileEntry {
+	e := fileEntry{
+		Path:           p,
+		Size:           f.Size,
+		Attributes:     f.Attributes,
+		CreationTime:   filetime(f.CreationTime),
+		LastWriteTime:  filetime(f.LastWriteTime),
+		LastAccessTime: filetime(f.LastAccessTime),
+		Hash:           hashString(f.Hash),
+		ShortName:      f.ShortName,
+		LinkID:         f.LinkID,
+		ReparseTag:     f.ReparseTag,
+		SecurityID:     f.SecurityID,
+	}
+	for _, s := range f.Streams {
+		e.Streams = append(e.Streams, streamEntry{Name: s.Name, Size: s.Size, Hash: hashString(s.Hash)})
+	}
+	return e
+}
+
+func runLs(name string, args []string) error {
+	flags := newFlagSet(name)
+	index := flags.Int("image", 1, "the 1-based `index` of the image")
+	long := flags.Bool("l", false, "print attributes, sizes and modification times")
+	recursive := flags.Bool("r", false, "list subdirectories recursively")
+	jsonOut := flags.Bool("json", false, "print JSON")
+	parse(flags, args, 1, 2)
+
+	r, cleanup, err := openWIM(flags.Arg(0), wim.ReaderOptions{})
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	img, err := image(r, *index)
+	if err != nil {
+		return err
+	}
+	// Paths are printed relative to the image root, as by Image.Walk.
+	p := strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(flags.Arg(1), `\`, "/")), "/")
+	if p == "" {
+		p = "."
+	}
+	f, err := img.Lookup(p)
+	if err != nil {
+		return err
+	}
+
+	entries := []fileEntry{}
+	print := func(p string, f *wim.File) {
+		switch {
+		case *jsonOut:
+			entries = append(entries, newFileEntry(p, f))
+		case *long:
+			fmt.Printf("%s %12d %s %s\n", attrString(f.Attributes), f.Size, filetime(f.LastWriteTime).Format("2006-01-02 15:04:05"), p)
+		default:
+			fmt.Println(p)
+		}
+	}
+	if f.IsDir() {
+		err = list(p, f, *recursive, print)
+	} else {
+		print(p, f)
+	}
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(entries)
+	}
+	return nil
+}
+
+// list calls fn for each file in the directory d at path p.
+func list(p string, d *wim.File, recursive bool, fn func(string, *wim.File)) error {
+	files, err := d.Readdir()
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	for _, f := range files {
+		fp := path.Join(p, f.Name)
+		fn(fp, f)
+		if recursive && f.IsDir() {
+			err = list(fp, f, recursive, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+//go:build windows || linux
+// +build windows linux
+
+// Command wim inspects, extracts and converts WIM files.
+//
+// Usage:
+//
+//	wim <command> [flags] <arguments>
+//
+// Run "wim help" for the list of commands, and "wim <command> -h" for the
+// flags of a command. Commands that print information accept -json to
+// produce machine-readable output.
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/go-winio/wim"
+)
+
+type command struct {
+	name    string
+	args    string // the positional arguments, for usage messages
+	summary string
+	run     func(name string, args []string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"info", "file.wim", "print information about the WIM and its images", runInfo},
+		{"ls", "file.wim [path]", "list the files in an image", runLs},
+		{"cat", "file.wim path", "write the contents of a file to standard output", runCat},
+		{"extract", "file.wim dest", "extract an image to a directory or tar file", runExtract},
+		{"verify", "file.wim", "check the WIM's integrity table and file hashes", runVerify},
+		{"diff", "a.wim b.wim", "print the differences between two images", runDiff},
+		{"export", "src.wim dst.wim", "copy an image to another WIM", runExport},
+	}
+}
+
+// errSilent is returned by a command that has already reported its failure,
+// so main only sets the exit status.
+var errSilent = errors.New("silent failure")
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		usage()
+		if len(os.Args) < 2 {
+			os.Exit(2)
+		}
+		return
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			err := c.run(c.name, os.Args[2:])
+			if err != nil {
+				if err != errSilent { //nolint:errorlint
+					fmt.Fprintf(os.Stderr, "wim %s: %s\n", c.name, err)
+				}
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "wim: unknown command %q\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: wim <command> [flags] <arguments>")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.summary)
+	}
+}
+
+// newFlagSet returns the flag set of the named command.
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		for _, c := range commands {
+			if c.name == name {
+				fmt.Fprintf(flags.Output(), "usage: wim %s [flags] %s\n\n%s.\n\nflags:\n", name, c.args, c.summary)
+			}
+		}
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parse parses the command line of a command, which must have between min
+// and max positional arguments.
+func parse(flags *flag.FlagSet, args []string, min, max int) {
+	_ = flags.Parse(args)
+	if flags.NArg() < min || flags.NArg() > max {
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// openWIM opens the WIM file at name. The returned Reader's file is closed
+// by calling cleanup.
+func openWIM(name string, opts wim.ReaderOptions) (r *wim.Reader, cleanup func(), err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err = wim.NewReaderWithOptions(f, opts)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return r, func() { f.Close() }, nil
+}
+
+// image returns the image with the given 1-based index.
+func image(r *wim.Reader, index int) (*wim.Image, error) {
+	if index < 1 || index > len(r.Image) {
+		return nil, fmt.Errorf("image %d not found; the WIM has %d images", index, len(r.Image))
+	}
+	return r.Image[index-1], nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func hashString(h wim.SHA1Hash) string {
+	if h == (wim.SHA1Hash{}) {
+		return ""
+	}
+	return hex.EncodeToString(h[:])
+}
+
+func filetime(ft wim.Filetime) time.Time {
+	return ft.Time().UTC()
+}
+
+// attrString formats the common file attributes, one letter each.
+func attrString(a uint32) string {
+	var b strings.Builder
+	for _, attr := range []struct {
+		mask   uint32
+		letter byte
+	}{
+		{wim.FILE_ATTRIBUTE_DIRECTORY, 'd'},
+		{wim.FILE_ATTRIBUTE_READONLY, 'r'},
+		{wim.FILE_ATTRIBUTE_HIDDEN, 'h'},
+		{wim.FILE_ATTRIBUTE_SYSTEM, 's'},
+		{wim.FILE_ATTRIBUTE_ARCHIVE, 'a'},
+		{wim.FILE_ATTRIBUTE_REPARSE_POINT, 'l'},
+		{wim.FILE_ATTRIBUTE_COMPRESSED, 'c'},
+		{wim.FILE_ATTRIBUTE_ENCRYPTED, 'e'},
+		{wim.FILE_ATTRIBUTE_SPARSE_FILE, 'p'},
+	} {
+		if a&attr.mask != 0 {
+			b.WriteByte(attr.letter)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	return b.String()
+}
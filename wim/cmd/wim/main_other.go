@@ -0,0 +1,6 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+package main
+
+func main() {}
@@ -0,0 +1,114 @@
+//go:build windows || linux
+// +build windows linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Microsoft/go-winio/wim"
+)
+
+type verifyOutput struct {
+	// Integrity is "ok", "missing" if the WIM has no integrity table, or
+	// "failed".
+	Integrity      string   `json:"integrity"`
+	IntegrityError string   `json:"integrityError,omitempty"`
+	HashesChecked  bool     `json:"hashesChecked"`
+	HashErrors     []string `json:"hashErrors,omitempty"`
+}
+
+func runVerify(name string, args []string) error {
+	flags := newFlagSet(name)
+	hashes := flags.Bool("hashes", false, "also read every file and stream in every image and check its SHA-1 hash")
+	jsonOut := flags.Bool("json", false, "print JSON")
+	parse(flags, args, 1, 1)
+
+	r, cleanup, err := openWIM(flags.Arg(0), wim.ReaderOptions{VerifyHashes: true, Concurrency: 4})
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	out := verifyOutput{Integrity: "ok", HashesChecked: *hashes}
+	err = r.Verify(context.Background())
+	if errors.Is(err, wim.ErrNoIntegrityTable) {
+		out.Integrity = "missing"
+	} else if err != nil {
+		out.Integrity = "failed"
+		out.IntegrityError = err.Error()
+	}
+	if *hashes {
+		for _, img := range r.Image {
+			err := checkHashes(img, func(p string, err error) {
+				out.HashErrors = append(out.HashErrors, fmt.Sprintf("image %d: %s: %s", img.Index, p, err))
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if *jsonOut {
+		err = printJSON(out)
+		if err != nil {
+			return err
+		}
+	} else {
+		switch out.Integrity {
+		case "missing":
+			fmt.Println("integrity: no integrity table")
+		case "failed":
+			fmt.Printf("integrity: %s\n", out.IntegrityError)
+		default:
+			fmt.Println("integrity: ok")
+		}
+		if *hashes {
+			for _, e := range out.HashErrors {
+				fmt.Println(e)
+			}
+			if len(out.HashErrors) == 0 {
+				fmt.Println("hashes: ok")
+			}
+		}
+	}
+	if out.Integrity == "failed" || len(out.HashErrors) != 0 {
+		return errSilent
+	}
+	return nil
+}
+
+// checkHashes reads all file and stream data in img, calling report for each
+// one that cannot be read or does not match its hash. It returns an error if
+// the image's metadata cannot be read.
+func checkHashes(img *wim.Image, report func(p string, err error)) error {
+	return img.Walk(func(p string, f *wim.File, err error) error {
+		if err != nil {
+			return err
+		}
+		if !f.IsDir() {
+			if err := drain(f.Open); err != nil {
+				report(p, err)
+			}
+		}
+		for _, s := range f.Streams {
+			if err := drain(s.Open); err != nil {
+				report(p+":"+s.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+func drain(open func() (io.ReadCloser, error)) error {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
@@ -4,31 +4,223 @@
 package wim
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 
+	"github.com/Microsoft/go-winio/wim/lzms"
 	"github.com/Microsoft/go-winio/wim/lzx"
+	"github.com/Microsoft/go-winio/wim/xpress"
 )
 
-const chunkSize = 32768 // Compressed resource chunk size
+const chunkSize = 32768 // Default compressed resource chunk size
 
-type compressedReader struct {
-	r            *io.SectionReader
-	d            io.ReadCloser
-	chunks       []int64
-	curChunk     int
+// Chunk size limits for each compression format. XPRESS chunks are limited by
+// the decompressor, and LZX chunks by the largest LZX window.
+const (
+	minChunkSize       = 4096
+	maxXpressChunkSize = 1 << 16
+	maxLzxChunkSize    = 1 << 21
+)
+
+// compressionType is the compression format used for compressed resources.
+type compressionType int
+
+const (
+	compressionNone compressionType = iota
+	compressionXpress
+	compressionLzx
+	compressionLzms
+)
+
+func (c compressionType) String() string {
+	switch c {
+	case compressionNone:
+		return "none"
+	case compressionXpress:
+		return "XPRESS"
+	case compressionLzx:
+		return "LZX"
+	case compressionLzms:
+		return "LZMS"
+	}
+	return fmt.Sprintf("compression type %d", int(c))
+}
+
+// validChunkSize reports whether resources compressed with c may use chunks
+// of the given size, which must be a power of two.
+func (c compressionType) validChunkSize(size int64) bool {
+	if size&(size-1) != 0 {
+		return false
+	}
+	switch c {
+	case compressionXpress:
+		return size >= minChunkSize && size <= maxXpressChunkSize
+	case compressionLzx:
+		return size >= chunkSize && size <= maxLzxChunkSize
+	case compressionLzms:
+		return size >= chunkSize && size <= maxSolidChunkSize
+	}
+	return false
+}
+
+// newReader returns a reader that decompresses a single chunk of a resource
+// with the given chunk size.
+func (c compressionType) newReader(r io.Reader, uncompressedSize int, chunkSize int64) (io.ReadCloser, error) {
+	switch c {
+	case compressionXpress:
+		return xpress.NewReader(r, uncompressedSize)
+	case compressionLzx:
+		return lzx.NewReaderSize(r, uncompressedSize, int(chunkSize))
+	case compressionLzms:
+		return lzms.NewReader(r, uncompressedSize)
+	}
+	return nil, fmt.Errorf("unsupported %s", c)
+}
+
+// solidHeader is the header at the start of each resource in a solid
+// resource batch. It is followed by the compressed size of each chunk.
+type solidHeader struct {
+	OriginalSize uint64
+	ChunkSize    uint32
+	Compression  uint32
+}
+
+const solidHeaderSize = 16
+
+// maxSolidChunkSize bounds the chunk size of solid resources; ESD files
+// typically use 64MB chunks.
+const maxSolidChunkSize = 1 << 30
+
+// chunkCache holds the most recently decompressed chunk of a solid resource.
+// Solid chunks are large and shared by many streams, which are usually read
+// in order, so this avoids decompressing the same chunk once per stream.
+type chunkCache struct {
+	m    sync.Mutex
+	key  chunkKey
+	data []byte
+}
+
+// chunkKey identifies a chunk by the WIM part and file offset it is stored at.
+type chunkKey struct {
+	part   int
+	offset int64
+}
+
+func newChunkCache() *chunkCache {
+	return &chunkCache{key: chunkKey{offset: -1}}
+}
+
+func (c *chunkCache) get(key chunkKey, decompress func() ([]byte, error)) ([]byte, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.key == key {
+		return c.data, nil
+	}
+	data, err := decompress()
+	if err != nil {
+		return nil, err
+	}
+	c.key = key
+	c.data = data
+	return data, nil
+}
+
+// byteBudget limits the total number of bytes decompressed by a Reader. A nil
+// *byteBudget imposes no limit.
+type byteBudget struct {
+	used  int64 // accessed atomically; first for 64-bit alignment
+	limit int64
+}
+
+// take accounts for n decompressed bytes.
+func (b *byteBudget) take(n int64) error {
+	if b != nil && atomic.AddInt64(&b.used, n) > b.limit {
+		return &ParseError{Oper: "decompression", Err: fmt.Errorf("%w: more than %d bytes decompressed", ErrLimitExceeded, b.limit)}
+	}
+	return nil
+}
+
+// checkChunkSize rejects chunks larger than the whole budget before they are
+// decompressed, so that the chunk size in an untrusted WIM does not by
+// itself determine how much memory is allocated.
+func (b *byteBudget) checkChunkSize(size int64) error {
+	if b != nil && size > b.limit {
+		return &ParseError{Oper: "decompression", Err: fmt.Errorf("%w: chunk size %d exceeds %d bytes", ErrLimitExceeded, size, b.limit)}
+	}
+	return nil
+}
+
+// chunkTable describes the chunks of a compressed resource.
+type chunkTable struct {
+	r            *io.SectionReader // the resource
+	chunks       []int64           // offset of each chunk within r
 	originalSize int64
+	chunkSize    int64
+	compression  compressionType
+	budget       *byteBudget
+}
+
+// checkSize rejects resources that are larger than the whole budget.
+func (b *byteBudget) checkSize(size int64) error {
+	if b != nil && size > b.limit {
+		return &ParseError{Oper: "decompression", Err: fmt.Errorf("%w: resource size %d exceeds %d bytes", ErrLimitExceeded, size, b.limit)}
+	}
+	return nil
 }
 
-func newCompressedReader(r *io.SectionReader, originalSize int64, offset int64) (*compressedReader, error) {
-	nchunks := (originalSize + chunkSize - 1) / chunkSize
+// numChunks returns the number of chunks holding size bytes.
+func numChunks(size, chunkSize int64) int64 {
+	n := size / chunkSize
+	if size%chunkSize != 0 {
+		n++
+	}
+	return n
+}
+
+// readChunkTable reads the chunk table of a compressed resource. The size of
+// r must have been checked against the size of the WIM, since it bounds the
+// size of the table.
+func readChunkTable(r *io.SectionReader, originalSize int64, compression compressionType, chunkSize int64, budget *byteBudget) (*chunkTable, error) {
+	if originalSize < 0 {
+		return nil, &ParseError{Oper: "chunk table", Err: errors.New("invalid compressed resource size")}
+	}
+	err := budget.checkSize(originalSize)
+	if err != nil {
+		return nil, err
+	}
+	nchunks := numChunks(originalSize, chunkSize)
+	t := &chunkTable{
+		r:            r,
+		originalSize: originalSize,
+		chunkSize:    chunkSize,
+		compression:  compression,
+		budget:       budget,
+	}
+	if nchunks == 0 {
+		return t, nil
+	}
+	entrySize := int64(4)
+	if originalSize > 0xffffffff {
+		entrySize = 8
+	}
+	// Check the table size before allocating it. Each chunk but the first
+	// has a table entry, and each chunk takes at least one byte.
+	if nchunks > (r.Size()+entrySize)/(entrySize+1) {
+		return nil, &ParseError{Oper: "chunk table", Err: fmt.Errorf("%d chunks do not fit in a compressed resource of %d bytes", nchunks, r.Size())}
+	}
 	var base int64
 	chunks := make([]int64, nchunks)
-	if originalSize <= 0xffffffff {
+	r = io.NewSectionReader(r, 0, r.Size())
+	if entrySize == 4 {
 		// 32-bit chunk offsets
 		base = (nchunks - 1) * 4
 		chunks32 := make([]uint32, nchunks-1)
-		err := binary.Read(r, binary.LittleEndian, chunks32)
+		err = binary.Read(r, binary.LittleEndian, chunks32)
 		if err != nil {
 			return nil, err
 		}
@@ -38,7 +230,7 @@ func newCompressedReader(r *io.SectionReader, originalSize int64, offset int64)
 	} else {
 		// 64-bit chunk offsets
 		base = (nchunks - 1) * 8
-		err := binary.Read(r, binary.LittleEndian, chunks[1:])
+		err = binary.Read(r, binary.LittleEndian, chunks[1:])
 		if err != nil {
 			return nil, err
 		}
@@ -47,71 +239,285 @@ func newCompressedReader(r *io.SectionReader, originalSize int64, offset int64)
 	for i, c := range chunks {
 		chunks[i] = c + base
 	}
+	t.chunks = chunks
+	return t, nil
+}
+
+// readSolidChunkTable reads the chunk table of one resource of a solid
+// resource batch. Unlike other compressed resources, solid resources record
+// their own chunk size and compression format, and the chunk table holds the
+// size of every chunk.
+func readSolidChunkTable(r *io.SectionReader, budget *byteBudget) (*chunkTable, error) {
+	var hdr solidHeader
+	r = io.NewSectionReader(r, 0, r.Size())
+	err := binary.Read(r, binary.LittleEndian, &hdr)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.ChunkSize < minChunkSize || hdr.ChunkSize > maxSolidChunkSize || hdr.ChunkSize&(hdr.ChunkSize-1) != 0 {
+		return nil, fmt.Errorf("invalid solid resource chunk size %d", hdr.ChunkSize)
+	}
+	err = budget.checkChunkSize(int64(hdr.ChunkSize))
+	if err != nil {
+		return nil, err
+	}
+	compression := compressionType(hdr.Compression)
+	if compression > compressionLzms {
+		return nil, fmt.Errorf("unsupported solid resource %s", compression)
+	}
+	chunkSize := int64(hdr.ChunkSize)
+	originalSize := int64(hdr.OriginalSize)
+	if originalSize < 0 {
+		return nil, errors.New("invalid solid resource size")
+	}
+	err = budget.checkSize(originalSize)
+	if err != nil {
+		return nil, err
+	}
+	// Check the table size before allocating it.
+	nchunks := numChunks(originalSize, chunkSize)
+	if nchunks > (r.Size()-solidHeaderSize)/4 {
+		return nil, &ParseError{Oper: "solid resource", Err: fmt.Errorf("%d chunks do not fit in a resource of %d bytes", nchunks, r.Size())}
+	}
+
+	sizes := make([]uint32, nchunks)
+	err = binary.Read(r, binary.LittleEndian, sizes)
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([]int64, nchunks)
+	off := solidHeaderSize + nchunks*4
+	for i, n := range sizes {
+		chunks[i] = off
+		off += int64(n)
+		if off > r.Size() {
+			return nil, errors.New("solid resource chunks exceed resource size")
+		}
+	}
 
-	cr := &compressedReader{
+	return &chunkTable{
 		r:            r,
 		chunks:       chunks,
 		originalSize: originalSize,
+		chunkSize:    chunkSize,
+		compression:  compression,
+		budget:       budget,
+	}, nil
+}
+
+func (t *chunkTable) chunkOffset(n int) int64 {
+	if n == len(t.chunks) {
+		return t.r.Size()
 	}
+	return t.chunks[n]
+}
+
+func (t *chunkTable) compressedSize(n int) int {
+	return int(t.chunkOffset(n+1) - t.chunkOffset(n))
+}
+
+func (t *chunkTable) uncompressedSize(n int) int {
+	if n < len(t.chunks)-1 {
+		return int(t.chunkSize)
+	}
+	size := int(t.originalSize % t.chunkSize)
+	if size == 0 {
+		size = int(t.chunkSize)
+	}
+	return size
+}
 
-	err := cr.reset(int(offset / chunkSize))
+// chunkReader returns a reader for the uncompressed data of chunk n.
+func (t *chunkTable) chunkReader(n int) (io.ReadCloser, error) {
+	size := t.compressedSize(n)
+	uncompressedSize := t.uncompressedSize(n)
+	err := t.budget.take(int64(uncompressedSize))
 	if err != nil {
 		return nil, err
 	}
+	section := io.NewSectionReader(t.r, t.chunkOffset(n), int64(size))
+	if size == uncompressedSize {
+		return io.NopCloser(section), nil
+	}
+	if t.compression == compressionNone {
+		return nil, fmt.Errorf("chunk %d of uncompressed solid resource has size %d, expected %d", n, size, uncompressedSize)
+	}
+	return t.compression.newReader(section, uncompressedSize, t.chunkSize)
+}
 
-	suboff := offset % chunkSize
-	if suboff != 0 {
-		_, err := io.CopyN(io.Discard, cr.d, suboff)
+// readChunk returns the uncompressed data of chunk n, using cache if it is
+// not nil. base is the location of the resource.
+func (t *chunkTable) readChunk(n int, base chunkKey, cache *chunkCache) ([]byte, error) {
+	decompress := func() ([]byte, error) {
+		d, err := t.chunkReader(n)
 		if err != nil {
 			return nil, err
 		}
+		defer d.Close()
+		data := make([]byte, t.uncompressedSize(n))
+		_, err = io.ReadFull(d, data)
+		return data, err
 	}
-	return cr, nil
+	if cache == nil {
+		return decompress()
+	}
+	return cache.get(chunkKey{part: base.part, offset: base.offset + t.chunkOffset(n)}, decompress)
+}
+
+// chunkResult is the result of decompressing a chunk in the background.
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// prefetcher decompresses the chunks following the one being read on
+// background goroutines. At most window chunks are in flight or buffered at
+// any time, which bounds memory use.
+type prefetcher struct {
+	t      *chunkTable
+	window int
+	queue  []chan chunkResult // results for chunks first, first+1, ...
+	first  int
+	next   int // the next chunk to start decompressing
 }
 
-func (r *compressedReader) chunkOffset(n int) int64 {
-	if n == len(r.chunks) {
-		return r.r.Size()
+func (p *prefetcher) fill() {
+	for len(p.queue) < p.window && p.next < len(p.t.chunks) {
+		ch := make(chan chunkResult, 1)
+		go func(n int) {
+			data, err := p.t.readChunk(n, chunkKey{}, nil)
+			ch <- chunkResult{data, err}
+		}(p.next)
+		p.queue = append(p.queue, ch)
+		p.next++
 	}
-	return r.chunks[n]
 }
 
-func (r *compressedReader) chunkSize(n int) int {
-	return int(r.chunkOffset(n+1) - r.chunkOffset(n))
+// get returns the data of chunk n. When reading out of order, the chunks
+// still in flight are waited for and discarded.
+func (p *prefetcher) get(n int) ([]byte, error) {
+	if len(p.queue) == 0 || p.first != n {
+		p.stop()
+		p.first = n
+		p.next = n
+	}
+	p.fill()
+	res := <-p.queue[0]
+	p.queue = p.queue[1:]
+	p.first++
+	p.fill()
+	return res.data, res.err
 }
 
-func (r *compressedReader) uncompressedSize(n int) int {
-	if n < len(r.chunks)-1 {
-		return chunkSize
+// stop waits for the chunks in flight and discards them, so that no
+// goroutines outlive the queue.
+func (p *prefetcher) stop() {
+	for _, ch := range p.queue {
+		<-ch
 	}
-	size := int(r.originalSize % chunkSize)
-	if size == 0 {
-		size = chunkSize
+	p.queue = nil
+}
+
+// compressedReader reads a compressed resource sequentially.
+type compressedReader struct {
+	t        *chunkTable
+	d        io.ReadCloser
+	curChunk int
+
+	// Set for solid resources only.
+	base  chunkKey // location of the resource
+	cache *chunkCache
+
+	// Set when decompressing ahead of the reader.
+	prefetch *prefetcher
+}
+
+// newCompressedReader returns a reader for a compressed resource, starting at
+// offset. If concurrency is greater than 1, up to that many chunks are
+// decompressed in parallel ahead of the reader, as long as they fit in the
+// budget.
+func newCompressedReader(r *io.SectionReader, originalSize int64, offset int64, compression compressionType, chunkSize int64, concurrency int, budget *byteBudget) (*compressedReader, error) {
+	t, err := readChunkTable(r, originalSize, compression, chunkSize, budget)
+	if err != nil {
+		return nil, err
 	}
-	return size
+	cr := &compressedReader{t: t}
+	if budget != nil && int64(concurrency) > budget.limit/chunkSize {
+		concurrency = int(budget.limit / chunkSize)
+	}
+	if concurrency > 1 && len(t.chunks) > 1 {
+		cr.prefetch = &prefetcher{t: t, window: concurrency}
+	}
+	err = cr.seek(offset)
+	if err != nil {
+		cr.Close()
+		return nil, err
+	}
+	return cr, nil
+}
+
+// newSolidReader returns a reader for one resource of a solid resource
+// batch, which is located at base.
+func newSolidReader(r *io.SectionReader, base chunkKey, offset int64, cache *chunkCache, budget *byteBudget) (*compressedReader, error) {
+	t, err := readSolidChunkTable(r, budget)
+	if err != nil {
+		return nil, err
+	}
+	cr := &compressedReader{t: t, base: base, cache: cache}
+	return cr, cr.seek(offset)
+}
+
+func (r *compressedReader) seek(offset int64) error {
+	if offset == r.t.originalSize {
+		// Positioned at the end, which may be past the last chunk.
+		r.curChunk = len(r.t.chunks)
+		r.d = io.NopCloser(&bytes.Reader{})
+		return nil
+	}
+	err := r.reset(int(offset / r.t.chunkSize))
+	if err != nil {
+		return err
+	}
+
+	suboff := offset % r.t.chunkSize
+	if suboff != 0 {
+		_, err := io.CopyN(io.Discard, r.d, suboff)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (r *compressedReader) reset(n int) error {
-	if n >= len(r.chunks) {
+	if n >= len(r.t.chunks) {
 		return io.EOF
 	}
 	if r.d != nil {
 		r.d.Close()
 	}
 	r.curChunk = n
-	size := r.chunkSize(n)
-	uncompressedSize := r.uncompressedSize(n)
-	section := io.NewSectionReader(r.r, r.chunkOffset(n), int64(size))
-	if size != uncompressedSize {
-		d, err := lzx.NewReader(section, uncompressedSize)
+	if r.prefetch != nil {
+		data, err := r.prefetch.get(n)
 		if err != nil {
 			return err
 		}
-		r.d = d
-	} else {
-		r.d = io.NopCloser(section)
+		r.d = io.NopCloser(bytes.NewReader(data))
+		return nil
 	}
-
+	if r.cache != nil && r.t.compressedSize(n) != r.t.uncompressedSize(n) {
+		data, err := r.t.readChunk(n, r.base, r.cache)
+		if err != nil {
+			return err
+		}
+		r.d = io.NopCloser(bytes.NewReader(data))
+		return nil
+	}
+	d, err := r.t.chunkReader(n)
+	if err != nil {
+		return err
+	}
+	r.d = d
 	return nil
 }
 
@@ -135,5 +541,9 @@ func (r *compressedReader) Close() error {
 		err = r.d.Close()
 		r.d = nil
 	}
+	if r.prefetch != nil {
+		r.prefetch.stop()
+		r.prefetch = nil
+	}
 	return err
 }
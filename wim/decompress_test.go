@@ -0,0 +1,371 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/go-winio/wim/internal/lzmstest"
+	"github.com/Microsoft/go-winio/wim/internal/xpresstest"
+	"github.com/Microsoft/go-winio/wim/lzx"
+)
+
+// appendSolidResource appends a solid resource holding data in stored chunks
+// and returns its descriptor.
+func appendSolidResource(t *testing.T, buf *bytes.Buffer, data []byte, chunkSize int) solidResource {
+	t.Helper()
+	return appendSolidChunks(t, buf, data, chunkSize, nil)
+}
+
+// appendLzmsSolidResource appends a solid resource holding data in LZMS
+// chunks and returns its descriptor.
+func appendLzmsSolidResource(t *testing.T, buf *bytes.Buffer, data []byte, chunkSize int) solidResource {
+	t.Helper()
+	return appendSolidChunks(t, buf, data, chunkSize, lzmstest.Compress)
+}
+
+// appendSolidChunks appends a solid resource holding data in chunks of the
+// given size, each compressed with compress, or stored if compress is nil.
+func appendSolidChunks(t *testing.T, buf *bytes.Buffer, data []byte, chunkSize int, compress func([]byte) []byte) solidResource {
+	t.Helper()
+	var chunks [][]byte
+	for i := 0; i < len(data); i += chunkSize {
+		end := i + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		c := data[i:end]
+		if compress != nil {
+			c = compress(c)
+			if len(c) >= end-i {
+				t.Fatalf("chunk %d is not compressible", i/chunkSize)
+			}
+		}
+		chunks = append(chunks, c)
+	}
+	offset := int64(buf.Len())
+	hdr := solidHeader{OriginalSize: uint64(len(data)), ChunkSize: uint32(chunkSize), Compression: uint32(compressionLzms)}
+	if err := binary.Write(buf, binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range chunks {
+		if err := binary.Write(buf, binary.LittleEndian, uint32(len(c))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range chunks {
+		buf.Write(c)
+	}
+	size := int64(buf.Len()) - offset
+	return solidResource{
+		resourceDescriptor: newResourceDescriptor(resFlagSolid|resFlagCompressed, offset, size, solidResourceMagic),
+		originalSize:       int64(len(data)),
+	}
+}
+
+func TestSolidReader(t *testing.T) {
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 600)
+	const split = 10000
+	batch := &solidBatch{res: []solidResource{
+		appendSolidResource(t, &buf, data[:split], 4096),
+		appendSolidResource(t, &buf, data[split:], 8192),
+	}}
+	f := bytes.NewReader(buf.Bytes())
+	r := &Reader{r: f, parts: []io.ReaderAt{f}, cache: newChunkCache()}
+
+	size := int64(len(data))
+	for _, tc := range []struct{ offset, size int64 }{
+		{0, size},
+		{3, 5},
+		{4090, 10},
+		{split - 10, 20},
+		{split, 4},
+		{split + 8190, 100},
+		{size - 25, 25},
+	} {
+		b := &blob{
+			resourceDescriptor: newResourceDescriptor(resFlagSolid, tc.offset, tc.size, tc.size),
+			solid:              batch,
+		}
+		got := readAll(t, func() (io.ReadCloser, error) { return r.blobReader(b) })
+		if want := data[tc.offset : tc.offset+tc.size]; !bytes.Equal(got, want) {
+			t.Errorf("offset %d size %d: content mismatch", tc.offset, tc.size)
+		}
+	}
+
+	b := &blob{resourceDescriptor: newResourceDescriptor(resFlagSolid, size-5, 10, 10), solid: batch}
+	if _, err := r.blobReader(b); err == nil {
+		t.Error("expected error reading past the end of the batch")
+	}
+}
+
+func TestSolidReaderLzms(t *testing.T) {
+	const chunkSize = 1 << 15
+	var data []byte
+	for i := 0; len(data) < 3*chunkSize+chunkSize/2; i++ {
+		// Calls to the same target within a chunk are translated by the x86
+		// filter.
+		data = append(data, fmt.Sprintf("solid LZMS line %d, call ", i)...)
+		data = append(data, 0xe8, 0, 0, 0, 0, '\n')
+		binary.LittleEndian.PutUint32(data[len(data)-5:], uint32(0x1234-(len(data)-6)%chunkSize))
+	}
+	var buf bytes.Buffer
+	batch := &solidBatch{res: []solidResource{
+		appendLzmsSolidResource(t, &buf, data[:chunkSize+100], chunkSize),
+		appendLzmsSolidResource(t, &buf, data[chunkSize+100:], chunkSize),
+	}}
+	f := bytes.NewReader(buf.Bytes())
+	r := &Reader{r: f, parts: []io.ReaderAt{f}, cache: newChunkCache()}
+
+	for _, tc := range []struct{ offset, size int64 }{
+		{0, int64(len(data))},
+		{chunkSize - 10, 20},
+		{chunkSize + 50, 100},
+		{2*chunkSize + 7, chunkSize},
+		{int64(len(data)) - 5, 5},
+	} {
+		b := &blob{
+			resourceDescriptor: newResourceDescriptor(resFlagSolid, tc.offset, tc.size, tc.size),
+			solid:              batch,
+		}
+		got := readAll(t, func() (io.ReadCloser, error) { return r.blobReader(b) })
+		if !bytes.Equal(got, data[tc.offset:tc.offset+tc.size]) {
+			t.Errorf("offset %d size %d: content mismatch", tc.offset, tc.size)
+		}
+	}
+}
+
+// appendCompressedResource appends a compressed resource holding data in
+// stored chunks and returns its descriptor.
+func appendCompressedResource(t *testing.T, buf *bytes.Buffer, data []byte, chunkSize int) resourceDescriptor {
+	t.Helper()
+	offset := int64(buf.Len())
+	for i := chunkSize; i < len(data); i += chunkSize {
+		if err := binary.Write(buf, binary.LittleEndian, uint32(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.Write(data)
+	return newResourceDescriptor(resFlagCompressed, offset, int64(buf.Len())-offset, int64(len(data)))
+}
+
+func TestCompressedReaderConcurrency(t *testing.T) {
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 100)
+	res := appendCompressedResource(t, &buf, data, 64)
+	f := bytes.NewReader(buf.Bytes())
+
+	for _, concurrency := range []int{0, 1, 2, 8} {
+		r := &Reader{
+			r:           f,
+			parts:       []io.ReaderAt{f},
+			compression: compressionLzx,
+			chunkSize:   64,
+			opts:        ReaderOptions{Concurrency: concurrency},
+		}
+		for _, offset := range []int64{0, 100, 64 * 10, int64(len(data))} {
+			got := readAll(t, func() (io.ReadCloser, error) { return r.resourceReaderWithOffset(&res, offset) })
+			if !bytes.Equal(got, data[offset:]) {
+				t.Errorf("concurrency %d offset %d: content mismatch", concurrency, offset)
+			}
+		}
+	}
+}
+
+// slowReaderAt delays reads other than those at the offsets in fast.
+type slowReaderAt struct {
+	r    io.ReaderAt
+	fast map[int64]bool
+}
+
+func (s *slowReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if !s.fast[off] {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s.r.ReadAt(b, off)
+}
+
+func TestCompressedReaderCloseWaits(t *testing.T) {
+	const chunkSize, nchunks, concurrency = 64, 50, 8
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte("0123456789abcdef"), chunkSize*nchunks/16)
+	res := appendCompressedResource(t, &buf, data, chunkSize)
+	tableSize := int64(nchunks-1) * 4
+	f := &slowReaderAt{r: bytes.NewReader(buf.Bytes())}
+	r := &Reader{
+		parts:       []io.ReaderAt{f},
+		compression: compressionLzx,
+		chunkSize:   chunkSize,
+		opts:        ReaderOptions{Concurrency: concurrency},
+	}
+
+	base := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		// Only the chunk table and the chunk being read are fast, so the
+		// other chunks are still in flight when the reader is closed.
+		n := int64(i * 7 % nchunks)
+		f.fast = map[int64]bool{res.Offset: true, res.Offset + tableSize + n*chunkSize: true}
+		rc, err := r.resourceReaderWithOffset(&res, n*chunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 10)
+		if _, err := io.ReadFull(rc, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data[n*chunkSize:n*chunkSize+10]) {
+			t.Fatalf("chunk %d: content mismatch", n)
+		}
+		rc.Close()
+	}
+	// Goroutines that have delivered their chunk may not have exited yet.
+	if n := runtime.NumGoroutine(); n > base+concurrency {
+		t.Errorf("%d goroutines running after closing the readers, expected at most %d", n, base+concurrency)
+	}
+}
+
+// appendLzxResource appends a compressed resource holding data in LZX
+// chunks of the given size, each compressed with a matching window, and
+// returns its descriptor.
+func appendLzxResource(t *testing.T, buf *bytes.Buffer, data []byte, chunkSize int) resourceDescriptor {
+	t.Helper()
+	return appendChunks(t, buf, data, chunkSize, func(chunk []byte) []byte {
+		var c bytes.Buffer
+		w, err := lzx.NewWriterSize(&c, lzx.DefaultCompression, chunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return c.Bytes()
+	})
+}
+
+// appendChunks appends a compressed resource holding data in chunks of the
+// given size, each compressed with compress, and returns its descriptor.
+func appendChunks(t *testing.T, buf *bytes.Buffer, data []byte, chunkSize int, compress func([]byte) []byte) resourceDescriptor {
+	t.Helper()
+	var chunks [][]byte
+	for i := 0; i < len(data); i += chunkSize {
+		end := i + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		c := compress(data[i:end])
+		if len(c) >= end-i {
+			t.Fatalf("chunk %d is not compressible", i/chunkSize)
+		}
+		chunks = append(chunks, c)
+	}
+	offset := int64(buf.Len())
+	off := 0
+	for _, c := range chunks[:len(chunks)-1] {
+		off += len(c)
+		if err := binary.Write(buf, binary.LittleEndian, uint32(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range chunks {
+		buf.Write(c)
+	}
+	return newResourceDescriptor(resFlagCompressed, offset, int64(buf.Len())-offset, int64(len(data)))
+}
+
+func TestLargeLzxChunks(t *testing.T) {
+	const size = 1 << 16
+	data := bytes.Repeat([]byte("large LZX chunks "), 3*size/16)
+
+	var buf bytes.Buffer
+	res := appendLzxResource(t, &buf, data, size)
+	f := bytes.NewReader(buf.Bytes())
+	r := &Reader{r: f, parts: []io.ReaderAt{f}, compression: compressionLzx, chunkSize: size}
+	for _, offset := range []int64{0, size + 5} {
+		got := readAll(t, func() (io.ReadCloser, error) { return r.resourceReaderWithOffset(&res, offset) })
+		if !bytes.Equal(got, data[offset:]) {
+			t.Errorf("offset %d: content mismatch", offset)
+		}
+	}
+}
+
+func TestXpressChunks(t *testing.T) {
+	const size = 1 << 16
+	var data []byte
+	for i := 0; len(data) < 3*size; i++ {
+		data = append(data, fmt.Sprintf("file%d.dll ", i*i%1000)...)
+	}
+	data = data[:3*size-100]
+
+	var buf bytes.Buffer
+	res := appendChunks(t, &buf, data, size, xpresstest.Compress)
+	f := bytes.NewReader(buf.Bytes())
+	r := &Reader{r: f, parts: []io.ReaderAt{f}, compression: compressionXpress, chunkSize: size}
+	for _, offset := range []int64{0, size - 1, 2*size + 5} {
+		got := readAll(t, func() (io.ReadCloser, error) { return r.resourceReaderWithOffset(&res, offset) })
+		if !bytes.Equal(got, data[offset:]) {
+			t.Errorf("offset %d: content mismatch", offset)
+		}
+	}
+}
+
+func TestChunkTableLimits(t *testing.T) {
+	data := make([]byte, 100)
+	section := io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+	var perr *ParseError
+	if _, err := readChunkTable(section, 1<<50, compressionLzx, chunkSize, nil); !errors.As(err, &perr) {
+		t.Errorf("expected a ParseError for more chunks than fit in the resource, got %v", err)
+	}
+	if _, err := readChunkTable(section, 1<<20, compressionLzx, chunkSize, &byteBudget{limit: 1 << 19}); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected ErrLimitExceeded for a resource larger than the limit, got %v", err)
+	}
+
+	for _, hdr := range []solidHeader{
+		{OriginalSize: 1 << 40, ChunkSize: minChunkSize},
+		{OriginalSize: math.MaxInt64, ChunkSize: minChunkSize},
+		{OriginalSize: 100, ChunkSize: 8},
+	} {
+		var buf bytes.Buffer
+		_ = binary.Write(&buf, binary.LittleEndian, &hdr)
+		buf.Write(data)
+		if _, err := readSolidChunkTable(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())), nil); err == nil {
+			t.Errorf("expected error for solid resource of size %d with chunk size %d", hdr.OriginalSize, hdr.ChunkSize)
+		}
+	}
+}
+
+func TestValidChunkSize(t *testing.T) {
+	for _, tc := range []struct {
+		c     compressionType
+		size  int64
+		valid bool
+	}{
+		{compressionXpress, 4096, true},
+		{compressionXpress, 1 << 16, true},
+		{compressionXpress, 1 << 17, false},
+		{compressionLzx, 1 << 14, false},
+		{compressionLzx, 1 << 15, true},
+		{compressionLzx, 1 << 21, true},
+		{compressionLzx, 1 << 22, false},
+		{compressionLzx, 3 << 15, false},
+		{compressionLzms, 1 << 17, true},
+		{compressionLzms, 1 << 26, true},
+		{compressionNone, 1 << 15, false},
+	} {
+		if got := tc.c.validChunkSize(tc.size); got != tc.valid {
+			t.Errorf("%s chunk size %d: got %v, want %v", tc.c, tc.size, got, tc.valid)
+		}
+	}
+}
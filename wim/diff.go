@@ -0,0 +1,259 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ChangeKind is the kind of a Change.
+type ChangeKind int
+
+// Kinds of changes.
+const (
+	FileAdded ChangeKind = iota + 1
+	FileRemoved
+	FileModified
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case FileAdded:
+		return "added"
+	case FileRemoved:
+		return "removed"
+	case FileModified:
+		return "modified"
+	}
+	return "unknown"
+}
+
+// ChangeFlags describes how a modified file differs between two images.
+type ChangeFlags uint32
+
+const (
+	// ContentChanged is set when the file's data differs, as determined by
+	// its size and SHA-1 hash. For reparse points, the data is the reparse
+	// data.
+	ContentChanged ChangeFlags = 1 << iota
+	// AttributesChanged is set when the file's attributes or reparse tag
+	// differ.
+	AttributesChanged
+	// SecurityChanged is set when the file's security descriptor differs.
+	SecurityChanged
+	// StreamsChanged is set when the names, sizes or hashes of the file's
+	// alternate data streams differ.
+	StreamsChanged
+	// TimestampsChanged is set when the file's creation or last write time
+	// differs. Last access times are not compared.
+	TimestampsChanged
+)
+
+var changeFlagNames = []string{"content", "attributes", "security", "streams", "timestamps"}
+
+// String returns the names of the flags that are set, separated by commas.
+func (f ChangeFlags) String() string {
+	var names []string
+	for i, name := range changeFlagNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Change describes a file that differs between two images.
+type Change struct {
+	// Path is the path of the file relative to the image root, as passed to
+	// a WalkFunc by Walk.
+	Path string
+	Kind ChangeKind
+	// Flags describes the differences of a modified file.
+	Flags ChangeFlags
+	// Old is the file in the first image, and nil if the file was added.
+	Old *File
+	// New is the file in the second image, and nil if the file was removed.
+	New *File
+}
+
+// DiffReader reports the differences between two images one file at a time,
+// so that only the directories along the current path are held in memory.
+type DiffReader struct {
+	a, b    *Image
+	started bool
+	stack   []*diffDir
+	err     error
+}
+
+// diffDir holds the remaining entries of a directory in both images, sorted
+// by name. Entries of a directory that exists in one image only are all in a
+// or all in b.
+type diffDir struct {
+	path string
+	a, b []*File
+}
+
+// Diff returns a DiffReader that compares image a to image b. File data is
+// compared by hash, without reading it. The images may be in the same or in
+// different WIMs.
+func Diff(a, b *Image) *DiffReader {
+	return &DiffReader{a: a, b: b}
+}
+
+// Next returns the next difference between the images. Changes are returned
+// in depth-first order, with the files of each directory ordered by name,
+// and a directory's change precedes the changes within it. All descendants
+// of an added or removed directory are reported as added or removed. Next
+// returns io.EOF when there are no more differences.
+func (d *DiffReader) Next() (*Change, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	c, err := d.next()
+	if err != nil {
+		d.err = err
+		return nil, err
+	}
+	return c, nil
+}
+
+func (d *DiffReader) next() (*Change, error) {
+	if !d.started {
+		d.started = true
+		ra, err := d.a.Open()
+		if err != nil {
+			return nil, err
+		}
+		rb, err := d.b.Open()
+		if err != nil {
+			return nil, err
+		}
+		c, err := d.compare(".", ra, rb)
+		if c != nil || err != nil {
+			return c, err
+		}
+	}
+
+	for len(d.stack) > 0 {
+		dir := d.stack[len(d.stack)-1]
+		var fa, fb *File
+		switch {
+		case len(dir.a) == 0 && len(dir.b) == 0:
+			d.stack = d.stack[:len(d.stack)-1]
+			continue
+		case len(dir.b) == 0 || (len(dir.a) != 0 && dir.a[0].Name < dir.b[0].Name):
+			fa, dir.a = dir.a[0], dir.a[1:]
+		case len(dir.a) == 0 || dir.b[0].Name < dir.a[0].Name:
+			fb, dir.b = dir.b[0], dir.b[1:]
+		default:
+			fa, fb = dir.a[0], dir.b[0]
+			dir.a, dir.b = dir.a[1:], dir.b[1:]
+		}
+		p := dir.path + fileName(fa, fb)
+		c, err := d.compare(p, fa, fb)
+		if c != nil || err != nil {
+			return c, err
+		}
+	}
+	return nil, io.EOF
+}
+
+func fileName(a, b *File) string {
+	if a != nil {
+		return a.Name
+	}
+	return b.Name
+}
+
+// compare compares the file at path p in both images, either of which may be
+// nil, and pushes the directory contents to compare next. It returns nil if
+// the files do not differ.
+func (d *DiffReader) compare(p string, a, b *File) (*Change, error) {
+	dir := &diffDir{path: p + "/"}
+	if p == "." {
+		dir.path = ""
+	}
+	var err error
+	if a != nil && a.IsDir() {
+		dir.a, err = sortedReaddir(a)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if b != nil && b.IsDir() {
+		dir.b, err = sortedReaddir(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(dir.a) != 0 || len(dir.b) != 0 {
+		d.stack = append(d.stack, dir)
+	}
+
+	c := &Change{Path: p, Old: a, New: b}
+	switch {
+	case a == nil:
+		c.Kind = FileAdded
+	case b == nil:
+		c.Kind = FileRemoved
+	default:
+		c.Kind = FileModified
+		c.Flags = compareFiles(a, b)
+		if c.Flags == 0 {
+			return nil, nil
+		}
+	}
+	return c, nil
+}
+
+func sortedReaddir(f *File) ([]*File, error) {
+	files, err := f.Readdir()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// compareFiles returns the differences between a and b.
+func compareFiles(a, b *File) ChangeFlags {
+	var flags ChangeFlags
+	if a.Hash != b.Hash || a.Size != b.Size {
+		flags |= ContentChanged
+	}
+	if a.Attributes != b.Attributes || a.ReparseTag != b.ReparseTag {
+		flags |= AttributesChanged
+	}
+	if !bytes.Equal(a.SecurityDescriptor, b.SecurityDescriptor) {
+		flags |= SecurityChanged
+	}
+	if !equalStreams(a.Streams, b.Streams) {
+		flags |= StreamsChanged
+	}
+	if a.CreationTime != b.CreationTime || a.LastWriteTime != b.LastWriteTime {
+		flags |= TimestampsChanged
+	}
+	return flags
+}
+
+// equalStreams reports whether a and b have the same streams, in any order.
+func equalStreams(a, b []*Stream) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := make(map[string]*Stream, len(a))
+	for _, s := range a {
+		m[s.Name] = s
+	}
+	for _, s := range b {
+		sa := m[s.Name]
+		if sa == nil || sa.Hash != s.Hash || sa.Size != s.Size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	fa := testFS()
+	fb := testFS()
+	fb["Windows/System32/cmd.exe"] = &fstest.MapFile{Data: []byte("new cmd"), Mode: 0644, ModTime: fa["Windows/System32/cmd.exe"].ModTime}
+	delete(fb, "empty")
+	fb["new"] = &fstest.MapFile{Mode: fs.ModeDir | 0755}
+	fb["new/file.txt"] = &fstest.MapFile{Data: []byte("file")}
+	fb["empty.txt"] = &fstest.MapFile{Mode: 0644, ModTime: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	ra, err := NewReader(writeTestWIM(t, fa, testMetadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb, err := NewReader(writeTestWIM(t, fb, func(name string, fi fs.FileInfo) (*FileMetadata, error) {
+		m, err := testMetadata(name, fi)
+		switch name {
+		case "Windows/notepad.exe":
+			m.Streams = nil
+			m.Attributes |= FILE_ATTRIBUTE_HIDDEN
+		case "link":
+			m.SecurityDescriptor = []byte{1, 0, 4, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+		}
+		return m, err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type change struct {
+		Path  string
+		Kind  ChangeKind
+		Flags ChangeFlags
+	}
+	want := []change{
+		{"Windows/System32/cmd.exe", FileModified, ContentChanged},
+		{"Windows/notepad.exe", FileModified, AttributesChanged | StreamsChanged},
+		{"empty", FileRemoved, 0},
+		{"empty.txt", FileModified, TimestampsChanged},
+		{"link", FileModified, SecurityChanged},
+		{"new", FileAdded, 0},
+		{"new/file.txt", FileAdded, 0},
+	}
+	var got []change
+	d := Diff(ra.Image[0], rb.Image[0])
+	for {
+		c, err := d.Next()
+		if err == io.EOF { //nolint:errorlint
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (c.Old == nil) != (c.Kind == FileAdded) || (c.New == nil) != (c.Kind == FileRemoved) {
+			t.Errorf("%s: unexpected files for %s change", c.Path, c.Kind)
+		}
+		got = append(got, change{c.Path, c.Kind, c.Flags})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+
+	c, err := Diff(ra.Image[0], ra.Image[0]).Next()
+	if err != io.EOF { //nolint:errorlint
+		t.Errorf("expected no differences comparing an image to itself, got %v, %v", c, err)
+	}
+}
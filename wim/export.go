@@ -0,0 +1,180 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// exportCopy is a resource to copy from the source WIM.
+type exportCopy struct {
+	part int
+	res  resourceDescriptor
+}
+
+// ExportImage writes a new WIM to dst containing only the image with the
+// given 1-based index from src. The image's metadata and file data are
+// copied as they are stored in src, without being decompressed or
+// recompressed, so the new WIM uses the compression format and chunk size of
+// src. Solid resources are copied whole if any of their streams is used by
+// the image.
+//
+// The new WIM has a new GUID and an integrity table. If the image is the
+// bootable image of src, it is also marked bootable in the new WIM.
+func ExportImage(dst io.Writer, src *Reader, index int) error {
+	if index < 1 || index > len(src.Image) {
+		return fmt.Errorf("image index %d out of range", index)
+	}
+	img := src.Image[index-1]
+
+	// Find the data referenced by the image, in the order it is first used.
+	refs := make(map[SHA1Hash]*streamDescriptor)
+	var hashes []SHA1Hash
+	ref := func(h SHA1Hash) {
+		if h == (SHA1Hash{}) {
+			return
+		}
+		if sd, ok := refs[h]; ok {
+			sd.RefCount++
+			return
+		}
+		refs[h] = &streamDescriptor{PartNumber: 1, RefCount: 1, Hash: h}
+		hashes = append(hashes, h)
+	}
+	err := img.Walk(func(_ string, f *File, err error) error {
+		if err != nil {
+			return err
+		}
+		ref(f.Hash)
+		for _, s := range f.Streams {
+			ref(s.Hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Lay out the new WIM: the metadata resource, the non-solid streams, and
+	// then each solid batch followed by its streams.
+	offset := int64(wimHeaderSize)
+	var (
+		copies []exportCopy
+		table  []*streamDescriptor
+	)
+	place := func(part int, res resourceDescriptor) resourceDescriptor {
+		copies = append(copies, exportCopy{part: part, res: res})
+		res.FlagsAndCompressedSize &^= uint64(resFlagSpanned) << 56
+		res.Offset = offset
+		offset += res.CompressedSize()
+		return res
+	}
+	metadata := &streamDescriptor{
+		resourceDescriptor: place(0, img.offset),
+		PartNumber:         1,
+		RefCount:           1,
+		Hash:               img.hash,
+	}
+	table = append(table, metadata)
+
+	var batches []*solidBatch
+	batchStreams := make(map[*solidBatch][]*streamDescriptor)
+	for _, h := range hashes {
+		b := src.fileData[h]
+		sd := refs[h]
+		if b.solid == nil {
+			sd.resourceDescriptor = place(b.part, b.resourceDescriptor)
+			table = append(table, sd)
+			continue
+		}
+		// Streams keep their offsets within the batch's data.
+		sd.resourceDescriptor = b.resourceDescriptor
+		sd.FlagsAndCompressedSize &^= uint64(resFlagSpanned) << 56
+		if _, ok := batchStreams[b.solid]; !ok {
+			batches = append(batches, b.solid)
+		}
+		batchStreams[b.solid] = append(batchStreams[b.solid], sd)
+	}
+	for _, batch := range batches {
+		for _, sr := range batch.res {
+			table = append(table, &streamDescriptor{
+				resourceDescriptor: place(sr.part, sr.resourceDescriptor),
+				PartNumber:         1,
+			})
+		}
+		table = append(table, batchStreams[batch]...)
+	}
+
+	var tableData bytes.Buffer
+	for _, sd := range table {
+		_ = binary.Write(&tableData, binary.LittleEndian, sd)
+	}
+	hdr := wimHeader{
+		ImageTag:        wimImageTag,
+		Size:            wimHeaderSize,
+		Version:         src.hdr.Version,
+		Flags:           src.hdr.Flags & (HeaderFlagCompressed | HeaderFlagRpFix | HeaderFlagCompressXpress | HeaderFlagCompressLzx | HeaderFlagCompressLzms),
+		CompressionSize: src.hdr.CompressionSize,
+		PartNumber:      1,
+		TotalParts:      1,
+		ImageCount:      1,
+		OffsetTable:     newResourceDescriptor(0, offset, int64(tableData.Len()), int64(tableData.Len())),
+	}
+	offset += int64(tableData.Len())
+	err = binary.Read(rand.Reader, binary.LittleEndian, &hdr.WIMGuid)
+	if err != nil {
+		return err
+	}
+	if int(src.hdr.BootIndex) == index {
+		hdr.BootIndex = 1
+		hdr.BootMetadata = metadata.resourceDescriptor
+	}
+
+	info := WIMInfo{TotalBytes: offset, Unknown: src.Info.Unknown}
+	info.Images = append(info.Images, img.ImageInfo)
+	info.Images[0].Index = 1
+	xmlData, err := info.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	hdr.XMLData = newResourceDescriptor(0, offset, int64(len(xmlData)), int64(len(xmlData)))
+	offset += int64(len(xmlData))
+
+	// The integrity table is computed as the data is written, so its size
+	// is needed for the header before its contents are known.
+	n := (hdr.OffsetTable.Offset + hdr.OffsetTable.CompressedSize() - wimHeaderSize + defaultIntegrityChunkSize - 1) / defaultIntegrityChunkSize
+	integritySize := integrityTableHeaderSize + n*20
+	hdr.Integrity = newResourceDescriptor(0, offset, integritySize, integritySize)
+
+	err = binary.Write(dst, binary.LittleEndian, &hdr)
+	if err != nil {
+		return err
+	}
+	ih := newIntegrityHasher(defaultIntegrityChunkSize)
+	w := io.MultiWriter(dst, ih)
+	for _, c := range copies {
+		size := c.res.CompressedSize()
+		n, err := io.Copy(w, io.NewSectionReader(src.parts[c.part], c.res.Offset, size))
+		if err != nil {
+			return err
+		}
+		if n != size {
+			return &ParseError{Oper: "export", Err: io.ErrUnexpectedEOF}
+		}
+	}
+	_, err = w.Write(tableData.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(xmlData)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(ih.table())
+	return err
+}
@@ -0,0 +1,103 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestExportImage(t *testing.T) {
+	fsys := testFS()
+	f := writeTestWIM(t, fsys, testMetadata)
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys2 := testFS()
+	fsys2["Windows/notepad.exe"] = &fstest.MapFile{Data: []byte("notepad 2"), Mode: 0644}
+	w, err := NewAppendWriter(f, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddImage(fsys2, ImageInfo{Name: "test 2"}, testMetadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err = NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ExportImage(io.Discard, r, 3); err == nil {
+		t.Error("expected error for out of range image index")
+	}
+
+	var buf bytes.Buffer
+	if err := ExportImage(&buf, r, 2); err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewReaderWithOptions(bytes.NewReader(buf.Bytes()), ReaderOptions{VerifyHashes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if e.hdr.WIMGuid == r.hdr.WIMGuid {
+		t.Error("expected a new WIM GUID")
+	}
+	if len(e.Image) != 1 || e.Image[0].Name != "test 2" || e.Image[0].Index != 1 {
+		t.Fatalf("unexpected images %+v", e.Info.Images)
+	}
+	// The first image's notepad.exe contents are not exported.
+	if len(e.fileData) != len(r.fileData)-1 {
+		t.Errorf("expected %d streams, got %d", len(r.fileData)-1, len(e.fileData))
+	}
+	root, err := e.Image[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	windows := findFile(t, root, "Windows")
+	for _, name := range []string{"notepad.exe", "System32/cmd.exe"} {
+		file := windows
+		for _, elem := range strings.Split(name, "/") {
+			file = findFile(t, file, elem)
+		}
+		if b := readAll(t, file.Open); !bytes.Equal(b, fsys2["Windows/"+name].Data) {
+			t.Errorf("%s: content mismatch", name)
+		}
+	}
+}
+
+func TestExportImageMultiPart(t *testing.T) {
+	fsys := testFS()
+	part1, part2 := splitTestWIM(t, testWIMBytes(t))
+	r, err := NewMultiPartReader([]io.ReaderAt{bytes.NewReader(part1), bytes.NewReader(part2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ExportImage(&buf, r, 1); err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := e.Image[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := findFile(t, findFile(t, findFile(t, root, "Windows"), "System32"), "cmd.exe")
+	if b := readAll(t, cmd.Open); !bytes.Equal(b, fsys["Windows/System32/cmd.exe"].Data) {
+		t.Error("cmd.exe: content mismatch")
+	}
+}
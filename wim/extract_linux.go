@@ -0,0 +1,242 @@
+//go:build linux
+// +build linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// Extended attribute names used by ExtractTo to store Windows metadata. They
+// are the names ntfs-3g uses, so that extracting onto an NTFS volume mounted
+// with ntfs-3g restores the metadata itself. Other file systems do not support
+// these attributes in the system namespace, so on them each attribute is
+// stored under the same name in the user namespace, such as user.ntfs_attrib.
+const (
+	XattrAttributes         = "system.ntfs_attrib"       // file attributes, as a little-endian uint32
+	XattrSecurityDescriptor = "system.ntfs_acl"          // self-relative security descriptor
+	XattrReparseData        = "system.ntfs_reparse_data" // REPARSE_DATA_BUFFER
+	XattrExtendedAttributes = "system.ntfs_ea"           // FILE_FULL_EA_INFORMATION buffer
+	XattrShortName          = "system.ntfs_dos_name"     // 8.3 short name
+	XattrCreationTime       = "system.ntfs_crtime"       // creation time, as a little-endian FILETIME
+)
+
+// XattrStreamPrefix is followed by the name of an alternate data stream to
+// form the name of the extended attribute holding the stream's data, such as
+// user.ntfs_stream.Zone.Identifier. The prefix keeps streams from colliding
+// with the metadata attributes and with other user attributes.
+const XattrStreamPrefix = "user.ntfs_stream."
+
+// xattrNameMax is the maximum length of an extended attribute name on Linux.
+const xattrNameMax = 255
+
+// ExtractOptions contains optional settings for ExtractTo.
+type ExtractOptions struct {
+	// NoXattrs disables storing Windows metadata and alternate data streams
+	// in extended attributes.
+	NoXattrs bool
+}
+
+// ExtractTo extracts the image to the directory dir, creating it if
+// necessary. Unless disabled by opts, Windows metadata and alternate data
+// streams are stored in extended attributes named by the Xattr constants,
+// and files in the same hard link group are extracted as hard links.
+//
+// Reparse points are extracted as empty files or directories, with the
+// reparse buffer stored in the XattrReparseData attribute.
+func (img *Image) ExtractTo(dir string, opts *ExtractOptions) error {
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+	root, err := img.Open()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	e := &extractor{opts: opts, links: make(map[int64]string)}
+	return e.extract(root, dir)
+}
+
+type extractor struct {
+	opts       *ExtractOptions
+	links      map[int64]string // the extracted path of each hard link group
+	userXattrs bool             // the system namespace is not supported
+}
+
+func (e *extractor) extract(f *File, p string) error {
+	isDir := f.Attributes&FILE_ATTRIBUTE_DIRECTORY != 0
+	switch {
+	case isDir:
+		err := os.Mkdir(p, 0755)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	case f.LinkID != 0 && e.links[f.LinkID] != "":
+		return os.Link(e.links[f.LinkID], p)
+	default:
+		err := e.writeFile(f, p)
+		if err != nil {
+			return err
+		}
+		if f.LinkID != 0 {
+			e.links[f.LinkID] = p
+		}
+	}
+
+	if !e.opts.NoXattrs {
+		err := e.setXattrs(f, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.IsDir() {
+		files, err := f.Readdir()
+		if err != nil {
+			return err
+		}
+		for _, child := range files {
+			if !validExtractName(child.Name) {
+				return &ParseError{Oper: "directory entry", Path: child.Name, Err: fmt.Errorf("invalid file name in %s", p)}
+			}
+			err = e.extract(child, filepath.Join(p, child.Name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Set permissions and times last, since they may prevent further
+	// changes to the file or be changed by them.
+	if !isDir && f.Attributes&FILE_ATTRIBUTE_READONLY != 0 {
+		err := os.Chmod(p, 0444)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Chtimes(p, f.LastAccessTime.Time(), f.LastWriteTime.Time())
+}
+
+func validExtractName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+func (*extractor) writeFile(f *File, p string) error {
+	out, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if f.Attributes&FILE_ATTRIBUTE_REPARSE_POINT == 0 {
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(out, r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	return out.Close()
+}
+
+func (e *extractor) setXattrs(f *File, p string) error {
+	set := func(name string, value []byte) error {
+		if e.userXattrs && strings.HasPrefix(name, "system.") {
+			name = "user." + strings.TrimPrefix(name, "system.")
+		}
+		err := unix.Setxattr(p, name, value, 0)
+		if err == unix.EOPNOTSUPP && !e.userXattrs && strings.HasPrefix(name, "system.") { //nolint:errorlint // errno
+			e.userXattrs = true
+			name = "user." + strings.TrimPrefix(name, "system.")
+			err = unix.Setxattr(p, name, value, 0)
+		}
+		if err != nil {
+			return &os.PathError{Op: "setxattr " + name, Path: p, Err: err}
+		}
+		return nil
+	}
+
+	var attrs [4]byte
+	binary.LittleEndian.PutUint32(attrs[:], f.Attributes)
+	err := set(XattrAttributes, attrs[:])
+	if err != nil {
+		return err
+	}
+	var crtime bytes.Buffer
+	_ = binary.Write(&crtime, binary.LittleEndian, &f.CreationTime)
+	err = set(XattrCreationTime, crtime.Bytes())
+	if err != nil {
+		return err
+	}
+	if len(f.SecurityDescriptor) != 0 {
+		err = set(XattrSecurityDescriptor, f.SecurityDescriptor)
+		if err != nil {
+			return err
+		}
+	}
+	if f.ShortName != "" {
+		err = set(XattrShortName, []byte(f.ShortName))
+		if err != nil {
+			return err
+		}
+	}
+	if len(f.ExtendedAttributes) != 0 {
+		eas, err := winio.EncodeExtendedAttributes(f.ExtendedAttributes)
+		if err != nil {
+			return err
+		}
+		err = set(XattrExtendedAttributes, eas)
+		if err != nil {
+			return err
+		}
+	}
+	if f.Attributes&FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+		// Unlike ReparsePoint, this does not require symbolic links and
+		// junctions to be well formed.
+		rp, err := f.reparseBuffer()
+		if err != nil {
+			return err
+		}
+		err = set(XattrReparseData, rp)
+		if err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for _, s := range f.Streams {
+		name := XattrStreamPrefix + s.Name
+		if s.Name == "" || strings.Contains(s.Name, "\x00") || len(name) > xattrNameMax || names[name] {
+			return &ParseError{Oper: "stream", Path: s.Name, Err: fmt.Errorf("cannot store stream of %s in an extended attribute", p)}
+		}
+		names[name] = true
+		r, err := s.Open()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		err = set(name, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
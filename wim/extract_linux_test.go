@@ -0,0 +1,140 @@
+//go:build linux
+// +build linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// getXattr returns the extended attribute name of p. As in ExtractTo,
+// attributes in the system namespace may be stored in the user namespace.
+func getXattr(t *testing.T, p, name string) []byte {
+	t.Helper()
+	b := make([]byte, 4096)
+	n, err := unix.Getxattr(p, name, b)
+	if err != nil && strings.HasPrefix(name, "system.") {
+		n, err = unix.Getxattr(p, "user."+strings.TrimPrefix(name, "system."), b)
+	}
+	if err != nil {
+		t.Fatalf("%s: getxattr %s: %v", p, name, err)
+	}
+	return b[:n]
+}
+
+func TestExtractTo(t *testing.T) {
+	dir := t.TempDir()
+	if err := unix.Setxattr(dir, "user.test", []byte("x"), 0); err != nil {
+		t.Skipf("user extended attributes are not supported: %v", err)
+	}
+
+	fsys := testFS()
+	meta := func(name string, fi fs.FileInfo) (*FileMetadata, error) {
+		m, err := testMetadata(name, fi)
+		if m != nil && (name == "Windows/System32/cmd.exe" || name == "Windows/System32/copy.exe") {
+			m.LinkID = 1
+		}
+		return m, err
+	}
+	f := writeTestWIM(t, fsys, meta)
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = filepath.Join(dir, "image")
+	if err := r.Image[0].ExtractTo(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := filepath.Join(dir, "Windows/System32/cmd.exe")
+	b, err := os.ReadFile(cmd)
+	if err != nil || !bytes.Equal(b, fsys["Windows/System32/cmd.exe"].Data) {
+		t.Errorf("cmd.exe: content mismatch, %v", err)
+	}
+	fi1, err := os.Stat(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi2, err := os.Stat(filepath.Join(dir, "Windows/System32/copy.exe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Error("expected cmd.exe and copy.exe to be hard linked")
+	}
+
+	notepad := filepath.Join(dir, "Windows/notepad.exe")
+	fi, err := os.Stat(notepad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0444 || !fi.ModTime().Equal(fsys["Windows/notepad.exe"].ModTime) {
+		t.Errorf("unexpected notepad.exe mode %v, time %v", fi.Mode(), fi.ModTime())
+	}
+	if b := getXattr(t, notepad, XattrAttributes); binary.LittleEndian.Uint32(b) != FILE_ATTRIBUTE_READONLY {
+		t.Errorf("unexpected attributes %x", b)
+	}
+	if b := getXattr(t, notepad, XattrSecurityDescriptor); !bytes.Equal(b, testSD) {
+		t.Errorf("unexpected security descriptor %x", b)
+	}
+	if b := getXattr(t, notepad, XattrShortName); string(b) != "NOTEPAD.EXE" {
+		t.Errorf("unexpected short name %q", b)
+	}
+	if b := getXattr(t, notepad, XattrStreamPrefix+"Zone.Identifier"); string(b) != "[ZoneTransfer]" {
+		t.Errorf("unexpected stream %q", b)
+	}
+	if b := getXattr(t, notepad, XattrExtendedAttributes); !bytes.Contains(b, []byte("KERNEL.PURGE.ESBCACHE")) {
+		t.Errorf("unexpected extended attributes %x", b)
+	}
+
+	link := filepath.Join(dir, "link")
+	b = getXattr(t, link, XattrReparseData)
+	if len(b) < 8 || binary.LittleEndian.Uint32(b) != reparseTagSymlink || string(b[8:]) != "reparse data" {
+		t.Errorf("unexpected reparse data %x", b)
+	}
+
+	// Extracting over an existing tree fails rather than overwriting files.
+	if err := r.Image[0].ExtractTo(dir, &ExtractOptions{NoXattrs: true}); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected fs.ErrExist, got %v", err)
+	}
+}
+
+func TestExtractToStreamNames(t *testing.T) {
+	dir := t.TempDir()
+	if err := unix.Setxattr(dir, "user.test", []byte("x"), 0); err != nil {
+		t.Skipf("user extended attributes are not supported: %v", err)
+	}
+
+	for _, names := range [][]string{
+		{"Zone.Identifier", "Zone.Identifier"},
+		{strings.Repeat("x", 250)},
+	} {
+		meta := func(name string, fi fs.FileInfo) (*FileMetadata, error) {
+			m, err := testMetadata(name, fi)
+			if m != nil && name == "Windows/notepad.exe" {
+				m.Streams = nil
+				for _, s := range names {
+					m.Streams = append(m.Streams, AlternateStream{Name: s, Open: bytesOpener(nil)})
+				}
+			}
+			return m, err
+		}
+		r, err := NewReader(writeTestWIM(t, testFS(), meta))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var perr *ParseError
+		if err := r.Image[0].ExtractTo(t.TempDir(), nil); !errors.As(err, &perr) {
+			t.Errorf("streams %.20q: expected a ParseError, got %v", names, err)
+		}
+	}
+}
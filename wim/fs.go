@@ -0,0 +1,271 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FS returns a file system view of the image. The returned fs.FS also
+// implements fs.ReadDirFS, fs.ReadFileFS and fs.StatFS. The Sys method of
+// each fs.FileInfo returns the file's *FileHeader.
+//
+// Reparse points are reported as symbolic links or irregular files, and
+// reading them returns their reparse data.
+func (img *Image) FS() fs.FS {
+	return &imageFS{img: img}
+}
+
+type imageFS struct {
+	img *Image
+}
+
+var (
+	_ fs.ReadDirFS  = &imageFS{}
+	_ fs.ReadFileFS = &imageFS{}
+	_ fs.StatFS     = &imageFS{}
+)
+
+// lookup returns the file at name, which must be a valid fs.FS path.
+func (fsys *imageFS) lookup(op, name string) (*File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	f, err := fsys.img.Open()
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if name == "." {
+		return f, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !f.IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		files, err := f.Readdir()
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		var next *File
+		for _, child := range files {
+			if child.Name == elem {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		f = next
+	}
+	return f, nil
+}
+
+func (fsys *imageFS) Open(name string) (fs.File, error) {
+	f, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	fi := &fileInfo{f: f, name: baseName(name)}
+	if f.IsDir() {
+		return &openDir{fi: fi}, nil
+	}
+	return &openFile{fi: fi}, nil
+}
+
+func (fsys *imageFS) Stat(name string) (fs.FileInfo, error) {
+	f, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{f: f, name: baseName(name)}, nil
+}
+
+func (fsys *imageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readDirEntries(f)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+func (fsys *imageFS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.lookup("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if f.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return b, nil
+}
+
+func baseName(name string) string {
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+func readDirEntries(f *File) ([]fs.DirEntry, error) {
+	files, err := f.Readdir()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(files))
+	for i, child := range files {
+		entries[i] = &fileInfo{f: child, name: child.Name}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// fileInfo implements fs.FileInfo and fs.DirEntry for a File.
+type fileInfo struct {
+	f    *File
+	name string
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) IsDir() bool        { return fi.f.IsDir() }
+func (fi *fileInfo) ModTime() time.Time { return fi.f.LastWriteTime.Time() }
+func (fi *fileInfo) Sys() interface{}   { return &fi.f.FileHeader }
+
+func (fi *fileInfo) Size() int64 {
+	if fi.f.IsDir() {
+		return 0
+	}
+	return fi.f.Size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	var mode fs.FileMode
+	switch {
+	case fi.f.IsDir():
+		mode = fs.ModeDir | 0755
+	case fi.f.Attributes&FILE_ATTRIBUTE_READONLY != 0:
+		mode = 0444
+	default:
+		mode = 0644
+	}
+	if fi.f.Attributes&FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+		switch fi.f.ReparseTag {
+		case reparseTagSymlink, reparseTagMountPoint:
+			mode |= fs.ModeSymlink
+		default:
+			mode |= fs.ModeIrregular
+		}
+	}
+	return mode
+}
+
+func (fi *fileInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+func (fi *fileInfo) pathError(op string, err error) error {
+	return &fs.PathError{Op: op, Path: fi.name, Err: err}
+}
+
+// openFile is an fs.File for a file that is not a directory. Its data is
+// opened on the first Read.
+type openFile struct {
+	fi     *fileInfo
+	r      io.ReadCloser
+	closed bool
+}
+
+func (f *openFile) Stat() (fs.FileInfo, error) { return f.fi, nil }
+
+func (f *openFile) Read(b []byte) (int, error) {
+	if f.closed {
+		return 0, f.fi.pathError("read", fs.ErrClosed)
+	}
+	if f.r == nil {
+		r, err := f.fi.f.Open()
+		if err != nil {
+			return 0, f.fi.pathError("read", err)
+		}
+		f.r = r
+	}
+	return f.r.Read(b)
+}
+
+func (f *openFile) Close() error {
+	if f.closed {
+		return f.fi.pathError("close", fs.ErrClosed)
+	}
+	f.closed = true
+	if f.r != nil {
+		return f.r.Close()
+	}
+	return nil
+}
+
+// openDir is an fs.ReadDirFile for a directory.
+type openDir struct {
+	fi      *fileInfo
+	entries []fs.DirEntry
+	read    bool
+	closed  bool
+}
+
+func (d *openDir) Stat() (fs.FileInfo, error) { return d.fi, nil }
+
+func (d *openDir) Read([]byte) (int, error) {
+	return 0, d.fi.pathError("read", errors.New("is a directory"))
+}
+
+func (d *openDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, d.fi.pathError("readdir", fs.ErrClosed)
+	}
+	if !d.read {
+		entries, err := readDirEntries(d.fi.f)
+		if err != nil {
+			return nil, d.fi.pathError("readdir", err)
+		}
+		d.entries = entries
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *openDir) Close() error {
+	if d.closed {
+		return d.fi.pathError("close", fs.ErrClosed)
+	}
+	d.closed = true
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestImageFS(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(testWIMBytes(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := r.Image[0].FS()
+	if err := fstest.TestFS(fsys, "Windows/System32/cmd.exe", "Windows/notepad.exe", "empty", "empty.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := fs.ReadFile(fsys, "Windows/notepad.exe")
+	if err != nil || string(b) != "notepad" {
+		t.Errorf("unexpected notepad.exe content %q, %v", b, err)
+	}
+	fi, err := fs.Stat(fsys, "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("expected symlink mode, got %v", fi.Mode())
+	}
+	if hdr, ok := fi.Sys().(*FileHeader); !ok || hdr.ReparseTag != reparseTagSymlink {
+		t.Errorf("unexpected Sys() %#v", fi.Sys())
+	}
+	if _, err := fs.Stat(fsys, "Windows/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	winioguid "github.com/Microsoft/go-winio/pkg/guid"
+)
+
+// Header contains information from the header of a WIM. For a split WIM, it
+// is the header of the first part.
+type Header struct {
+	Version      uint32
+	Flags        HeaderFlags
+	ChunkSize    int            // the chunk size of compressed resources, or 0 if the WIM is not compressed
+	WIMGuid      winioguid.GUID // shared by the parts of a split WIM
+	PartNumber   int            // the 1-based number of the part in a split WIM
+	TotalParts   int            // the number of parts in a split WIM, or 1
+	ImageCount   int
+	BootIndex    int              // the 1-based index of the bootable image, or 0 if there is none
+	BootMetadata ResourceLocation // the location of the bootable image's metadata resource
+}
+
+// ResourceLocation describes where a resource is stored in a WIM.
+type ResourceLocation struct {
+	Offset         int64
+	CompressedSize int64
+	OriginalSize   int64
+}
+
+var headerFlagNames = []struct {
+	flag HeaderFlags
+	name string
+}{
+	{HeaderFlagCompressed, "compressed"},
+	{HeaderFlagReadOnly, "read-only"},
+	{HeaderFlagSpanned, "spanned"},
+	{HeaderFlagResourceOnly, "resource-only"},
+	{HeaderFlagMetadataOnly, "metadata-only"},
+	{HeaderFlagWriteInProgress, "write-in-progress"},
+	{HeaderFlagRpFix, "rp-fix"},
+	{HeaderFlagCompressXpress, "xpress"},
+	{HeaderFlagCompressLzx, "lzx"},
+	{HeaderFlagCompressLzms, "lzms"},
+}
+
+// String returns the names of the flags that are set, separated by commas.
+// Unknown flags are included as a hexadecimal number.
+func (f HeaderFlags) String() string {
+	var names []string
+	for _, n := range headerFlagNames {
+		if f&n.flag != 0 {
+			names = append(names, n.name)
+			f &^= n.flag
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(f)))
+	}
+	return strings.Join(names, ",")
+}
+
+// Header returns information from the header of the WIM.
+func (r *Reader) Header() Header {
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, &r.hdr.WIMGuid)
+	var a [16]byte
+	copy(a[:], b.Bytes())
+	return Header{
+		Version:    r.hdr.Version,
+		Flags:      r.hdr.Flags,
+		ChunkSize:  int(r.chunkSize),
+		WIMGuid:    winioguid.FromWindowsArray(a),
+		PartNumber: int(r.hdr.PartNumber),
+		TotalParts: int(r.hdr.TotalParts),
+		ImageCount: int(r.hdr.ImageCount),
+		BootIndex:  int(r.hdr.BootIndex),
+		BootMetadata: ResourceLocation{
+			Offset:         r.hdr.BootMetadata.Offset,
+			CompressedSize: r.hdr.BootMetadata.CompressedSize(),
+			OriginalSize:   r.hdr.BootMetadata.OriginalSize,
+		},
+	}
+}
+
+// BootImage returns the bootable image, or nil if the WIM has none.
+func (r *Reader) BootImage() *Image {
+	if r.hdr.BootIndex == 0 {
+		return nil
+	}
+	return r.Image[r.hdr.BootIndex-1]
+}
@@ -0,0 +1,156 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// rewriteHeader decodes the header of the WIM in b, passes it to fn, and
+// stores the result.
+func rewriteHeader(t *testing.T, b []byte, fn func(*wimHeader)) {
+	t.Helper()
+	var hdr wimHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	fn(&hdr)
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, &hdr)
+	copy(b, buf.Bytes())
+}
+
+// filterOffsetTable returns a copy of the WIM in b whose offset table only
+// holds the entries for which keep returns true. The new table is appended
+// to the WIM.
+func filterOffsetTable(t *testing.T, b []byte, keep func(*streamDescriptor) bool) []byte {
+	t.Helper()
+	var hdr wimHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	table := b[hdr.OffsetTable.Offset : hdr.OffsetTable.Offset+hdr.OffsetTable.CompressedSize()]
+	var newTable bytes.Buffer
+	for i := 0; i < len(table); i += binary.Size(streamDescriptor{}) {
+		var sd streamDescriptor
+		if err := binary.Read(bytes.NewReader(table[i:]), binary.LittleEndian, &sd); err != nil {
+			t.Fatal(err)
+		}
+		if keep(&sd) {
+			_ = binary.Write(&newTable, binary.LittleEndian, &sd)
+		}
+	}
+	out := append(append([]byte(nil), b...), newTable.Bytes()...)
+	rewriteHeader(t, out, func(hdr *wimHeader) {
+		hdr.OffsetTable = newResourceDescriptor(0, int64(len(b)), int64(newTable.Len()), int64(newTable.Len()))
+	})
+	return out
+}
+
+func TestHeader(t *testing.T) {
+	b := testWIMBytes(t)
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := r.Header()
+	if hdr.ImageCount != 1 || hdr.PartNumber != 1 || hdr.TotalParts != 1 || hdr.ChunkSize != 0 {
+		t.Errorf("unexpected header %+v", hdr)
+	}
+	if hdr.WIMGuid.String() != r.hdr.WIMGuid.String() {
+		t.Errorf("GUID %s, expected %s", hdr.WIMGuid, r.hdr.WIMGuid)
+	}
+	if hdr.BootIndex != 0 || r.BootImage() != nil {
+		t.Error("expected no bootable image")
+	}
+
+	rewriteHeader(t, b, func(h *wimHeader) {
+		h.Flags |= HeaderFlagRpFix | HeaderFlagReadOnly
+		h.BootIndex = 1
+		h.BootMetadata = r.Image[0].offset
+	})
+	r, err = NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr = r.Header()
+	if hdr.BootIndex != 1 || r.BootImage() != r.Image[0] {
+		t.Errorf("expected image 1 to be bootable, got boot index %d", hdr.BootIndex)
+	}
+	if hdr.BootMetadata.Offset != r.Image[0].offset.Offset || hdr.BootMetadata.OriginalSize != r.Image[0].offset.OriginalSize {
+		t.Errorf("unexpected boot metadata %+v", hdr.BootMetadata)
+	}
+	if s := hdr.Flags.String(); s != "read-only,rp-fix" {
+		t.Errorf("unexpected flags %q", s)
+	}
+
+	rewriteHeader(t, b, func(h *wimHeader) { h.BootIndex = 2 })
+	if _, err := NewReader(bytes.NewReader(b)); err == nil {
+		t.Error("expected error for an invalid boot index")
+	}
+}
+
+func TestResourceWIM(t *testing.T) {
+	fsys := testFS()
+	b := testWIMBytes(t)
+	metadataOnly := filterOffsetTable(t, b, func(sd *streamDescriptor) bool {
+		return sd.Flags()&resFlagMetadata != 0
+	})
+	rewriteHeader(t, metadataOnly, func(h *wimHeader) { h.Flags |= HeaderFlagMetadataOnly })
+	resourceOnly := filterOffsetTable(t, b, func(sd *streamDescriptor) bool {
+		return sd.Flags()&resFlagMetadata == 0
+	})
+	rewriteHeader(t, resourceOnly, func(h *wimHeader) {
+		h.Flags |= HeaderFlagResourceOnly
+		h.ImageCount = 0
+		h.WIMGuid.Data1++
+	})
+
+	// The resource-only WIM can be read on its own, but has no images.
+	r, err := NewReader(bytes.NewReader(resourceOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Image) != 0 || len(r.fileData) == 0 {
+		t.Errorf("unexpected resource-only WIM with %d images and %d streams", len(r.Image), len(r.fileData))
+	}
+
+	// Without its resources, the metadata-only WIM's files cannot be found.
+	r, err = NewReader(bytes.NewReader(metadataOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Image[0].Walk(func(_ string, _ *File, err error) error { return err }); err == nil {
+		t.Error("expected error for missing file data")
+	}
+
+	r, err = NewReaderWithOptions(bytes.NewReader(metadataOnly), ReaderOptions{
+		Resources: []io.ReaderAt{bytes.NewReader(resourceOnly)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := r.Image[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := findFile(t, findFile(t, findFile(t, root, "Windows"), "System32"), "cmd.exe")
+	if b := readAll(t, cmd.Open); !bytes.Equal(b, fsys["Windows/System32/cmd.exe"].Data) {
+		t.Error("cmd.exe: content mismatch")
+	}
+
+	rewriteHeader(t, resourceOnly, func(h *wimHeader) {
+		h.Flags |= HeaderFlagCompressed | HeaderFlagCompressLzx
+		h.CompressionSize = chunkSize
+	})
+	_, err = NewReaderWithOptions(bytes.NewReader(metadataOnly), ReaderOptions{
+		Resources: []io.ReaderAt{bytes.NewReader(resourceOnly)},
+	})
+	if err == nil {
+		t.Error("expected error for mismatched compression")
+	}
+}
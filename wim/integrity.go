@@ -0,0 +1,241 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // not used for secure application
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ErrNoIntegrityTable is returned by Verify when the WIM has no integrity table.
+var ErrNoIntegrityTable = errors.New("WIM has no integrity table")
+
+// defaultIntegrityChunkSize is the integrity table chunk size used by Windows.
+const defaultIntegrityChunkSize = 10 * 1024 * 1024
+
+// maxIntegrityChunkSize bounds the integrity table chunk size accepted by
+// Verify, which reads a whole chunk into memory at a time.
+const maxIntegrityChunkSize = 64 * 1024 * 1024
+
+// integrityTableHeader precedes the SHA-1 hash of each chunk in the integrity
+// table. The chunks cover the WIM from the end of the header to the end of
+// the offset table.
+type integrityTableHeader struct {
+	Size       uint32
+	NumEntries uint32
+	ChunkSize  uint32
+}
+
+const integrityTableHeaderSize = 12
+
+// IntegrityError is returned by Verify when a chunk of the WIM does not match
+// the hash recorded in its integrity table.
+type IntegrityError struct {
+	Part   int   // The 1-based number of the WIM part.
+	Chunk  int   // The index of the chunk in the integrity table.
+	Offset int64 // The file offset of the chunk.
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("WIM integrity check failed: part %d chunk %d at offset %d", e.Part, e.Chunk, e.Offset)
+}
+
+// HashMismatchError is returned when reading file or stream data whose
+// SHA-1 hash does not match the hash recorded in the WIM.
+type HashMismatchError struct {
+	Name     string
+	Expected SHA1Hash
+	Actual   SHA1Hash
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("WIM data for %q has SHA-1 hash %x, expected %x", e.Name, e.Actual, e.Expected)
+}
+
+// Verify checks the contents of the WIM against its integrity table. For a
+// split WIM, each part is verified against its own table. It returns
+// ErrNoIntegrityTable if a part has no integrity table, and an
+// *IntegrityError for the first chunk that does not match.
+func (r *Reader) Verify(ctx context.Context) error {
+	for i := range r.parts {
+		err := r.verifyPart(ctx, i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Reader) verifyPart(ctx context.Context, part int) error {
+	hdr := &r.partHdrs[part]
+	if hdr.Integrity.CompressedSize() == 0 {
+		return ErrNoIntegrityTable
+	}
+	err := r.checkExtent(part, &hdr.Integrity)
+	if err != nil {
+		return &ParseError{Oper: "integrity table", Err: err}
+	}
+	rsrc, err := r.partResourceReader(part, &hdr.Integrity, 0)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(rsrc)
+	rsrc.Close()
+	if err != nil {
+		return &ParseError{Oper: "integrity table", Err: err}
+	}
+
+	var th integrityTableHeader
+	err = binary.Read(bytes.NewReader(b), binary.LittleEndian, &th)
+	if err != nil {
+		return &ParseError{Oper: "integrity table", Err: err}
+	}
+	start := int64(wimHeaderSize)
+	end := hdr.OffsetTable.Offset + hdr.OffsetTable.CompressedSize()
+	if th.ChunkSize == 0 || end < start {
+		return &ParseError{Oper: "integrity table", Err: errors.New("invalid chunk size")}
+	}
+	if th.ChunkSize > maxIntegrityChunkSize {
+		return &ParseError{Oper: "integrity table", Err: fmt.Errorf("unsupported chunk size %d", th.ChunkSize)}
+	}
+	n := (end - start + int64(th.ChunkSize) - 1) / int64(th.ChunkSize)
+	if int64(th.NumEntries) != n || int64(len(b)) < integrityTableHeaderSize+n*20 {
+		return &ParseError{Oper: "integrity table", Err: fmt.Errorf("expected %d entries, found %d", n, th.NumEntries)}
+	}
+	hashes := b[integrityTableHeaderSize:]
+
+	f := r.parts[part]
+	bufSize := int64(th.ChunkSize)
+	if bufSize > end-start {
+		bufSize = end - start
+	}
+	buf := make([]byte, bufSize)
+	for i := 0; int64(i) < n; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		offset := start + int64(i)*int64(th.ChunkSize)
+		size := end - offset
+		if size > int64(th.ChunkSize) {
+			size = int64(th.ChunkSize)
+		}
+		_, err := f.ReadAt(buf[:size], offset)
+		if err != nil {
+			if err == io.EOF { //nolint:errorlint
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		sum := sha1.Sum(buf[:size]) //nolint:gosec // not used for secure application
+		if !bytes.Equal(sum[:], hashes[i*20:i*20+20]) {
+			return &IntegrityError{Part: part + 1, Chunk: i, Offset: offset}
+		}
+	}
+	return nil
+}
+
+// buildIntegrityTable computes an integrity table for the region of f from
+// the end of the header up to end, which is the end of the offset table.
+func buildIntegrityTable(f io.ReaderAt, end int64, chunkSize uint32) ([]byte, error) {
+	start := int64(wimHeaderSize)
+	ih := newIntegrityHasher(chunkSize)
+	_, err := io.Copy(ih, io.NewSectionReader(f, start, end-start))
+	if err != nil {
+		return nil, err
+	}
+	return ih.table(), nil
+}
+
+// integrityHasher computes an integrity table for the data written to it,
+// which starts at the end of the header.
+type integrityHasher struct {
+	chunkSize uint32
+	h         hash.Hash
+	n         uint32 // bytes written to h
+	sums      []byte
+}
+
+func newIntegrityHasher(chunkSize uint32) *integrityHasher {
+	return &integrityHasher{
+		chunkSize: chunkSize,
+		h:         sha1.New(), //nolint:gosec // not used for secure application
+	}
+}
+
+func (ih *integrityHasher) Write(b []byte) (int, error) {
+	written := len(b)
+	for len(b) > 0 {
+		n := len(b)
+		if rem := int(ih.chunkSize - ih.n); n > rem {
+			n = rem
+		}
+		ih.h.Write(b[:n])
+		ih.n += uint32(n)
+		b = b[n:]
+		if ih.n == ih.chunkSize {
+			ih.sums = ih.h.Sum(ih.sums)
+			ih.h.Reset()
+			ih.n = 0
+		}
+	}
+	return written, nil
+}
+
+// table returns the integrity table for the data written so far.
+func (ih *integrityHasher) table() []byte {
+	sums := ih.sums
+	if ih.n != 0 {
+		sums = ih.h.Sum(sums)
+	}
+	n := len(sums) / 20
+	var table bytes.Buffer
+	_ = binary.Write(&table, binary.LittleEndian, &integrityTableHeader{
+		Size:       uint32(integrityTableHeaderSize + n*20),
+		NumEntries: uint32(n),
+		ChunkSize:  ih.chunkSize,
+	})
+	table.Write(sums)
+	return table.Bytes()
+}
+
+// openBlob returns a reader for the data of a file or stream, which verifies
+// the data against hash if the Reader was configured to.
+func (r *Reader) openBlob(b *blob, hash SHA1Hash, name string) (io.ReadCloser, error) {
+	rc, err := r.blobReader(b)
+	if err != nil {
+		return nil, err
+	}
+	if !r.opts.VerifyHashes || hash == (SHA1Hash{}) {
+		return rc, nil
+	}
+	return &verifyingReader{hr: newHashingReader(rc), c: rc, hash: hash, name: name}, nil
+}
+
+// verifyingReader checks the SHA-1 hash of the data once it is fully read.
+type verifyingReader struct {
+	hr   *hashingReader
+	c    io.Closer
+	hash SHA1Hash
+	name string
+}
+
+func (r *verifyingReader) Read(b []byte) (int, error) {
+	n, err := r.hr.Read(b)
+	if err == io.EOF { //nolint:errorlint
+		if sum := r.hr.Sum(); sum != r.hash {
+			return n, &HashMismatchError{Name: r.name, Expected: r.hash, Actual: sum}
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return r.c.Close()
+}
@@ -0,0 +1,128 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// addIntegrityTable appends an integrity table to the WIM in b.
+func addIntegrityTable(t *testing.T, b []byte, chunkSize uint32) []byte {
+	t.Helper()
+	var hdr wimHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	table, err := buildIntegrityTable(bytes.NewReader(b), hdr.OffsetTable.Offset+hdr.OffsetTable.CompressedSize(), chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr.Integrity = newResourceDescriptor(0, int64(len(b)), int64(len(table)), int64(len(table)))
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, &hdr)
+	b = append(b, table...)
+	copy(b, buf.Bytes())
+	return b
+}
+
+func TestVerify(t *testing.T) {
+	b := testWIMBytes(t)
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Verify(context.Background()); !errors.Is(err, ErrNoIntegrityTable) {
+		t.Fatalf("expected ErrNoIntegrityTable, got %v", err)
+	}
+
+	b = addIntegrityTable(t, b, 4096)
+	r, err = NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.Verify(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	b[wimHeaderSize+5000] ^= 0xff
+	r, err = NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ierr *IntegrityError
+	if err := r.Verify(context.Background()); !errors.As(err, &ierr) || ierr.Chunk != 1 {
+		t.Fatalf("expected integrity error for chunk 1, got %v", err)
+	}
+}
+
+func TestVerifyChunkSize(t *testing.T) {
+	// A chunk larger than the WIM is allowed as long as the chunk size is
+	// reasonable.
+	b := addIntegrityTable(t, testWIMBytes(t), 1<<24)
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	b = addIntegrityTable(t, testWIMBytes(t), 1<<31)
+	r, err = NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var perr *ParseError
+	if err := r.Verify(context.Background()); !errors.As(err, &perr) {
+		t.Errorf("expected a ParseError for a huge chunk size, got %v", err)
+	}
+}
+
+func TestVerifyHashes(t *testing.T) {
+	b := testWIMBytes(t)
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := r.Image[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notepad := findFile(t, findFile(t, root, "Windows"), "notepad.exe")
+	b[r.fileData[notepad.Hash].Offset] = 'N'
+
+	for _, verify := range []bool{false, true} {
+		r, err := NewReaderWithOptions(bytes.NewReader(b), ReaderOptions{VerifyHashes: verify})
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := r.Image[0].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		notepad := findFile(t, findFile(t, root, "Windows"), "notepad.exe")
+		rc, err := notepad.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(rc)
+		rc.Close()
+		var herr *HashMismatchError
+		if verify && (!errors.As(err, &herr) || herr.Name != "notepad.exe") {
+			t.Errorf("expected hash mismatch error, got %v", err)
+		} else if !verify && err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+}
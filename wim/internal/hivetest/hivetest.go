@@ -0,0 +1,248 @@
+// Package hivetest builds small registry hive files for tests.
+package hivetest
+
+import (
+	"encoding/binary"
+	"time"
+	"unicode/utf16"
+)
+
+// Value types used by the helper functions.
+const (
+	typeSZ       = 1
+	typeBinary   = 3
+	typeDWORD    = 4
+	typeMultiSZ  = 7
+	typeQWORD    = 11
+	bigDataLimit = 16344 // values larger than this are stored in segments
+)
+
+// Key is a registry key to write to a hive.
+type Key struct {
+	Name    string
+	ModTime time.Time
+	Values  []Value
+	Subkeys []*Key
+}
+
+// Value is a registry value to write to a hive.
+type Value struct {
+	Name string
+	Type uint32
+	Data []byte
+}
+
+// String returns an SZ value.
+func String(name, s string) Value {
+	return Value{Name: name, Type: typeSZ, Data: encodeUTF16(s + "\x00")}
+}
+
+// Binary returns a BINARY value.
+func Binary(name string, b []byte) Value {
+	return Value{Name: name, Type: typeBinary, Data: b}
+}
+
+// MultiString returns a MULTI_SZ value.
+func MultiString(name string, ss ...string) Value {
+	var s string
+	for _, e := range ss {
+		s += e + "\x00"
+	}
+	return Value{Name: name, Type: typeMultiSZ, Data: encodeUTF16(s + "\x00")}
+}
+
+// DWord returns a DWORD value.
+func DWord(name string, v uint32) Value {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return Value{Name: name, Type: typeDWORD, Data: b}
+}
+
+// QWord returns a QWORD value.
+func QWord(name string, v uint64) Value {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return Value{Name: name, Type: typeQWORD, Data: b}
+}
+
+func encodeUTF16(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+// encodeName returns the name as Latin-1 if it is ASCII, and as UTF-16
+// otherwise, along with whether it is Latin-1.
+func encodeName(s string) ([]byte, bool) {
+	for _, c := range s {
+		if c >= 0x80 {
+			return encodeUTF16(s), false
+		}
+	}
+	return []byte(s), true
+}
+
+type builder struct {
+	b []byte // hive bins data, starting with a single bin header
+}
+
+// alloc stores data in a new allocated cell and returns its offset.
+func (b *builder) alloc(data []byte) uint32 {
+	off := uint32(len(b.b))
+	size := (4 + len(data) + 7) &^ 7
+	cell := make([]byte, size)
+	binary.LittleEndian.PutUint32(cell, uint32(-int32(size)))
+	copy(cell[4:], data)
+	b.b = append(b.b, cell...)
+	return off
+}
+
+func (b *builder) offsets(offs []uint32) []byte {
+	d := make([]byte, 4*len(offs))
+	for i, off := range offs {
+		binary.LittleEndian.PutUint32(d[4*i:], off)
+	}
+	return d
+}
+
+// subkeyList writes a fast leaf for up to four keys, and an index root of
+// index leaves otherwise.
+func (b *builder) subkeyList(keys []*Key, offs []uint32) uint32 {
+	if len(offs) <= 4 {
+		d := []byte{'l', 'f', 0, 0}
+		binary.LittleEndian.PutUint16(d[2:], uint16(len(offs)))
+		for i, off := range offs {
+			var e [8]byte
+			binary.LittleEndian.PutUint32(e[:], off)
+			copy(e[4:], keys[i].Name) // the name hint
+			d = append(d, e[:]...)
+		}
+		return b.alloc(d)
+	}
+	var leaves []uint32
+	for i := 0; i < len(offs); i += 4 {
+		end := i + 4
+		if end > len(offs) {
+			end = len(offs)
+		}
+		d := []byte{'l', 'i', byte(end - i), 0}
+		d = append(d, b.offsets(offs[i:end])...)
+		leaves = append(leaves, b.alloc(d))
+	}
+	d := []byte{'r', 'i', byte(len(leaves)), 0}
+	return b.alloc(append(d, b.offsets(leaves)...))
+}
+
+func (b *builder) value(v *Value) uint32 {
+	vk := make([]byte, 20)
+	copy(vk, "vk")
+	name, latin1 := encodeName(v.Name)
+	binary.LittleEndian.PutUint16(vk[2:], uint16(len(name)))
+	binary.LittleEndian.PutUint32(vk[4:], uint32(len(v.Data)))
+	switch {
+	case len(v.Data) <= 4:
+		vk[7] |= 0x80
+		copy(vk[8:12], v.Data)
+	case len(v.Data) > bigDataLimit:
+		var segs []uint32
+		for i := 0; i < len(v.Data); i += bigDataLimit {
+			end := i + bigDataLimit
+			if end > len(v.Data) {
+				end = len(v.Data)
+			}
+			segs = append(segs, b.alloc(v.Data[i:end]))
+		}
+		db := []byte{'d', 'b', byte(len(segs)), byte(len(segs) >> 8), 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(db[4:], b.alloc(b.offsets(segs)))
+		binary.LittleEndian.PutUint32(vk[8:], b.alloc(db))
+	default:
+		binary.LittleEndian.PutUint32(vk[8:], b.alloc(v.Data))
+	}
+	binary.LittleEndian.PutUint32(vk[12:], v.Type)
+	if latin1 {
+		vk[16] = 1
+	}
+	return b.alloc(append(vk, name...))
+}
+
+func (b *builder) key(k *Key, root bool) uint32 {
+	var subkeys []uint32
+	for _, sk := range k.Subkeys {
+		subkeys = append(subkeys, b.key(sk, false))
+	}
+	var values []uint32
+	for i := range k.Values {
+		values = append(values, b.value(&k.Values[i]))
+	}
+
+	nk := make([]byte, 76)
+	copy(nk, "nk")
+	name, latin1 := encodeName(k.Name)
+	var flags uint16
+	if root {
+		flags |= 0x4
+	}
+	if latin1 {
+		flags |= 0x20
+	}
+	binary.LittleEndian.PutUint16(nk[2:], flags)
+	if !k.ModTime.IsZero() {
+		binary.LittleEndian.PutUint64(nk[4:], uint64(k.ModTime.UnixNano()/100+116444736000000000))
+	}
+	binary.LittleEndian.PutUint32(nk[20:], uint32(len(subkeys)))
+	binary.LittleEndian.PutUint32(nk[28:], 0xffffffff)
+	if len(subkeys) != 0 {
+		binary.LittleEndian.PutUint32(nk[28:], b.subkeyList(k.Subkeys, subkeys))
+	}
+	binary.LittleEndian.PutUint32(nk[32:], 0xffffffff)
+	binary.LittleEndian.PutUint32(nk[36:], uint32(len(values)))
+	binary.LittleEndian.PutUint32(nk[40:], 0xffffffff)
+	if len(values) != 0 {
+		binary.LittleEndian.PutUint32(nk[40:], b.alloc(b.offsets(values)))
+	}
+	binary.LittleEndian.PutUint32(nk[44:], 0xffffffff)
+	binary.LittleEndian.PutUint32(nk[48:], 0xffffffff)
+	binary.LittleEndian.PutUint16(nk[72:], uint16(len(name)))
+	return b.alloc(append(nk, name...))
+}
+
+// Build returns a hive file containing root and its subkeys.
+func Build(root *Key) []byte {
+	b := &builder{b: make([]byte, 32)}
+	rootOff := b.key(root, true)
+
+	// Pad the bin to a multiple of 4KiB with a free cell.
+	if pad := -len(b.b) & 4095; pad != 0 {
+		free := make([]byte, pad)
+		binary.LittleEndian.PutUint32(free, uint32(pad))
+		b.b = append(b.b, free...)
+	}
+	copy(b.b, "hbin")
+	binary.LittleEndian.PutUint32(b.b[8:], uint32(len(b.b)))
+
+	base := make([]byte, 4096)
+	copy(base, "regf")
+	binary.LittleEndian.PutUint32(base[4:], 1)  // primary sequence number
+	binary.LittleEndian.PutUint32(base[8:], 1)  // secondary sequence number
+	binary.LittleEndian.PutUint32(base[20:], 1) // major version
+	binary.LittleEndian.PutUint32(base[24:], 5) // minor version
+	binary.LittleEndian.PutUint32(base[32:], 1) // file format
+	binary.LittleEndian.PutUint32(base[36:], rootOff)
+	binary.LittleEndian.PutUint32(base[40:], uint32(len(b.b)))
+	binary.LittleEndian.PutUint32(base[44:], 1) // clustering factor
+	var sum uint32
+	for i := 0; i < 508; i += 4 {
+		sum ^= binary.LittleEndian.Uint32(base[i:])
+	}
+	switch sum {
+	case 0:
+		sum = 1
+	case 0xffffffff:
+		sum = 0xfffffffe
+	}
+	binary.LittleEndian.PutUint32(base[508:], sum)
+	return append(base, b.b...)
+}
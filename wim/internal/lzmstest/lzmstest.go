@@ -0,0 +1,607 @@
+// Package lzmstest builds LZMS-compressed data for tests.
+//
+// The encoder is written separately from the decompressor in package lzms
+// and shares no code with it, so that the decompressor can be tested against
+// streams whose contents are chosen item by item.
+package lzmstest
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	probBits       = 6
+	probDenom      = 1 << probBits
+	initialZeros   = 48
+	initialRecent  = 0x0000000055555555
+	maxCodeLen     = 15
+	numLiteralSyms = 256
+	numLengthSyms  = 54
+	numPowerSyms   = 8
+)
+
+// The slot bases are defined by the run lengths of the deltas between
+// adjacent bases, which double after each run.
+var (
+	offsetRunLens = []int{9, 0, 9, 7, 10, 15, 15, 20, 20, 30, 33, 40, 42, 45, 60, 73, 80, 85, 95, 105, 6}
+	lengthRunLens = []int{27, 4, 6, 4, 5, 2, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 1}
+
+	offsetBases, offsetExtra = slotBases(offsetRunLens, 0x7fffffff)
+	lengthBases, lengthExtra = slotBases(lengthRunLens, 0x400108ab)
+)
+
+// slotBases returns the base of each slot, followed by final, and the number
+// of extra bits needed to reach the next base from each slot.
+func slotBases(runLens []int, final uint32) ([]uint32, []uint8) {
+	var bases []uint32
+	base, delta := uint32(0), uint32(1)
+	for _, n := range runLens {
+		for i := 0; i < n; i++ {
+			base += delta
+			bases = append(bases, base)
+		}
+		delta *= 2
+	}
+	bases = append(bases, final)
+	extra := make([]uint8, len(bases)-1)
+	for i := range extra {
+		d := bases[i+1] - bases[i]
+		for d > 1 {
+			extra[i]++
+			d >>= 1
+		}
+	}
+	return bases, extra
+}
+
+// slot returns the slot of v in bases.
+func slot(bases []uint32, v uint32) int {
+	return sort.Search(len(bases)-1, func(i int) bool { return bases[i+1] > v })
+}
+
+// numOffsetSlots returns the number of offset slots used for data of the
+// given size.
+func numOffsetSlots(size int) int {
+	if size < 2 {
+		return 0
+	}
+	return slot(offsetBases, uint32(size-1)) + 1
+}
+
+// Kind is the kind of an Item.
+type Kind int
+
+// Kinds of items.
+const (
+	Literal Kind = iota
+	LZ
+	Delta
+)
+
+// Item is a literal or match in an LZMS stream.
+type Item struct {
+	Kind    Kind
+	Literal byte
+	// Rep is 0 for an explicit offset, or 1 to 3 to repeat the first, second
+	// or third most recent offset of the same kind of match.
+	Rep       int
+	Offset    uint32 // the explicit offset of an LZ match
+	Power     uint32 // the explicit power of a delta match
+	RawOffset uint32 // the explicit raw offset of a delta match
+	Length    uint32
+}
+
+// model tracks the probability of a zero bit from the last 64 bits coded
+// with it.
+type model struct {
+	zeros  int
+	recent uint64
+}
+
+func newModels(n int) []model {
+	m := make([]model, n)
+	for i := range m {
+		m[i] = model{zeros: initialZeros, recent: initialRecent}
+	}
+	return m
+}
+
+func (m *model) prob() uint32 {
+	switch m.zeros {
+	case 0:
+		return 1
+	case probDenom:
+		return probDenom - 1
+	}
+	return uint32(m.zeros)
+}
+
+func (m *model) update(bit uint32) {
+	oldest := m.recent >> 63
+	m.recent = m.recent<<1 | uint64(bit)
+	if oldest == 0 {
+		m.zeros--
+	}
+	if bit == 0 {
+		m.zeros++
+	}
+}
+
+// rangeEncoder writes range-coded bits as 16-bit little-endian words, in
+// the style of the LZMA range encoder.
+type rangeEncoder struct {
+	low       uint64
+	rng       uint32
+	cache     uint16
+	cacheSize int
+	words     []uint16
+	skipFirst bool
+}
+
+func (rc *rangeEncoder) shiftLow() {
+	if uint32(rc.low) < 0xffff0000 || rc.low>>32 != 0 {
+		carry := uint16(rc.low >> 32)
+		w := rc.cache
+		for ; rc.cacheSize > 0; rc.cacheSize-- {
+			if rc.skipFirst {
+				// The first word is always zero and is not stored.
+				rc.skipFirst = false
+			} else {
+				rc.words = append(rc.words, w+carry)
+			}
+			w = 0xffff
+		}
+		rc.cache = uint16(rc.low >> 16)
+	}
+	rc.cacheSize++
+	rc.low = (rc.low & 0xffff) << 16
+}
+
+func (rc *rangeEncoder) encode(bit uint32, m *model) {
+	if rc.rng <= 0xffff {
+		rc.rng <<= 16
+		rc.shiftLow()
+	}
+	bound := (rc.rng >> probBits) * m.prob()
+	if bit == 0 {
+		rc.rng = bound
+	} else {
+		rc.low += uint64(bound)
+		rc.rng -= bound
+	}
+	m.update(bit)
+}
+
+func (rc *rangeEncoder) flush() {
+	for i := 0; i < 4; i++ {
+		rc.shiftLow()
+	}
+}
+
+// bitWriter collects bits, most significant first, into 16-bit words. The
+// words are stored in reverse order at the end of the output, since the
+// decompressor reads them backwards.
+type bitWriter struct {
+	buf   uint64
+	nbits uint
+	words []uint16
+}
+
+func (bw *bitWriter) write(v uint32, n uint) {
+	for n > 16 {
+		n -= 16
+		bw.write(v>>n, 16)
+		v &= 1<<n - 1
+	}
+	bw.buf = bw.buf<<n | uint64(v)
+	bw.nbits += n
+	for bw.nbits >= 16 {
+		bw.nbits -= 16
+		bw.words = append(bw.words, uint16(bw.buf>>bw.nbits))
+	}
+}
+
+func (bw *bitWriter) flush() {
+	if bw.nbits != 0 {
+		bw.words = append(bw.words, uint16(bw.buf<<(16-bw.nbits)))
+		bw.nbits = 0
+	}
+}
+
+// huffman is an adaptive Huffman code that is rebuilt from the symbol
+// frequencies after every rebuildFreq symbols.
+type huffman struct {
+	freqs        []uint32
+	lens         []uint8
+	codes        []uint32
+	rebuildFreq  int
+	untilRebuild int
+}
+
+func newHuffman(numSyms, rebuildFreq int) *huffman {
+	h := &huffman{
+		freqs:       make([]uint32, numSyms),
+		rebuildFreq: rebuildFreq,
+	}
+	for i := range h.freqs {
+		h.freqs[i] = 1
+	}
+	h.rebuild()
+	return h
+}
+
+func (h *huffman) rebuild() {
+	h.lens = CodeLens(h.freqs, maxCodeLen)
+	h.codes = canonicalCodes(h.lens)
+	for i := range h.freqs {
+		h.freqs[i] = h.freqs[i]/2 + 1
+	}
+	h.untilRebuild = h.rebuildFreq
+}
+
+func (h *huffman) encode(bw *bitWriter, sym int) {
+	bw.write(h.codes[sym], uint(h.lens[sym]))
+	h.freqs[sym]++
+	h.untilRebuild--
+	if h.untilRebuild == 0 {
+		h.rebuild()
+	}
+}
+
+// CodeLens returns length-limited Huffman code lengths for the symbol
+// frequencies, built the way the LZMS compressor builds them: symbols are
+// sorted by frequency and then by value, the tree is built with two queues
+// preferring leaves on ties, and over-long codes are shortened by moving
+// leaves to the deepest level that still has room.
+func CodeLens(freqs []uint32, maxLen int) []uint8 {
+	type leaf struct {
+		freq uint32
+		sym  int
+	}
+	lens := make([]uint8, len(freqs))
+	var leaves []leaf
+	for sym, f := range freqs {
+		if f != 0 {
+			leaves = append(leaves, leaf{f, sym})
+		}
+	}
+	sort.Slice(leaves, func(i, j int) bool {
+		if leaves[i].freq != leaves[j].freq {
+			return leaves[i].freq < leaves[j].freq
+		}
+		return leaves[i].sym < leaves[j].sym
+	})
+	n := len(leaves)
+	switch n {
+	case 0:
+		return lens
+	case 1:
+		lens[leaves[0].sym] = 1
+		return lens
+	}
+
+	// Build the internal nodes in order, recording each one's parent.
+	type node struct {
+		freq   uint32
+		parent int
+	}
+	nodes := make([]node, 0, n-1)
+	nextLeaf, nextNode := 0, 0
+	take := func() uint32 {
+		if nextLeaf < n && (nextNode == len(nodes) || leaves[nextLeaf].freq <= nodes[nextNode].freq) {
+			nextLeaf++
+			return leaves[nextLeaf-1].freq
+		}
+		nodes[nextNode].parent = len(nodes)
+		nextNode++
+		return nodes[nextNode-1].freq
+	}
+	for len(nodes) < n-1 {
+		f := take()
+		f += take()
+		nodes = append(nodes, node{freq: f})
+	}
+
+	// Each internal node below the root turns one code of its depth into
+	// two codes one longer.
+	counts := make([]int, maxLen+2)
+	counts[1] = 2
+	depth := make([]int, len(nodes))
+	for i := len(nodes) - 2; i >= 0; i-- {
+		depth[i] = depth[nodes[i].parent] + 1
+		l := depth[i]
+		if l >= maxLen {
+			l = maxLen - 1
+			for counts[l] == 0 {
+				l--
+			}
+		}
+		counts[l]--
+		counts[l+1] += 2
+	}
+
+	j := 0
+	for l := maxLen; l >= 1; l-- {
+		for c := 0; c < counts[l]; c++ {
+			lens[leaves[j].sym] = uint8(l)
+			j++
+		}
+	}
+	return lens
+}
+
+// canonicalCodes assigns consecutive codes to the symbols in order of code
+// length and then symbol value.
+func canonicalCodes(lens []uint8) []uint32 {
+	codes := make([]uint32, len(lens))
+	code := uint32(0)
+	for l := uint8(1); l <= maxCodeLen; l++ {
+		for sym, sl := range lens {
+			if sl == l {
+				codes[sym] = code
+				code++
+			}
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// Encoder writes an LZMS stream item by item. It does not check that the
+// items are valid for the data.
+type Encoder struct {
+	rc rangeEncoder
+	bw bitWriter
+
+	mainState, matchState, lzState, deltaState uint32
+	lzRepStates, deltaRepStates                [2]uint32
+
+	mainProbs, matchProbs, lzProbs, deltaProbs []model
+	lzRepProbs, deltaRepProbs                  [2][]model
+
+	literal, lzOffset, length, deltaOffset, deltaPower *huffman
+}
+
+// NewEncoder returns an Encoder for data that decompresses to size bytes.
+func NewEncoder(size int) *Encoder {
+	nslots := numOffsetSlots(size)
+	e := &Encoder{
+		rc:          rangeEncoder{rng: 0xffffffff, cacheSize: 1, skipFirst: true},
+		mainProbs:   newModels(16),
+		matchProbs:  newModels(32),
+		lzProbs:     newModels(64),
+		deltaProbs:  newModels(64),
+		literal:     newHuffman(numLiteralSyms, 1024),
+		lzOffset:    newHuffman(nslots, 1024),
+		length:      newHuffman(numLengthSyms, 512),
+		deltaOffset: newHuffman(nslots, 1024),
+		deltaPower:  newHuffman(numPowerSyms, 512),
+	}
+	for i := range e.lzRepProbs {
+		e.lzRepProbs[i] = newModels(64)
+		e.deltaRepProbs[i] = newModels(64)
+	}
+	return e
+}
+
+func (e *Encoder) bit(state *uint32, probs []model, bit uint32) {
+	e.rc.encode(bit, &probs[*state])
+	*state = (*state<<1 | bit) & uint32(len(probs)-1)
+}
+
+func (e *Encoder) rep(states *[2]uint32, probs *[2][]model, rep int) {
+	e.bit(&states[0], probs[0], boolBit(rep > 1))
+	if rep > 1 {
+		e.bit(&states[1], probs[1], boolBit(rep > 2))
+	}
+}
+
+func boolBit(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (e *Encoder) slotted(h *huffman, bases []uint32, extra []uint8, v uint32) {
+	s := slot(bases, v)
+	h.encode(&e.bw, s)
+	e.bw.write(v-bases[s], uint(extra[s]))
+}
+
+// Encode writes an item.
+func (e *Encoder) Encode(it Item) {
+	if it.Kind == Literal {
+		e.bit(&e.mainState, e.mainProbs, 0)
+		e.literal.encode(&e.bw, int(it.Literal))
+		return
+	}
+	e.bit(&e.mainState, e.mainProbs, 1)
+	if it.Kind == LZ {
+		e.bit(&e.matchState, e.matchProbs, 0)
+		e.bit(&e.lzState, e.lzProbs, boolBit(it.Rep != 0))
+		if it.Rep == 0 {
+			e.slotted(e.lzOffset, offsetBases, offsetExtra, it.Offset)
+		} else {
+			e.rep(&e.lzRepStates, &e.lzRepProbs, it.Rep)
+		}
+	} else {
+		e.bit(&e.matchState, e.matchProbs, 1)
+		e.bit(&e.deltaState, e.deltaProbs, boolBit(it.Rep != 0))
+		if it.Rep == 0 {
+			e.deltaPower.encode(&e.bw, int(it.Power))
+			e.slotted(e.deltaOffset, offsetBases, offsetExtra, it.RawOffset)
+		} else {
+			e.rep(&e.deltaRepStates, &e.deltaRepProbs, it.Rep)
+		}
+	}
+	e.slotted(e.length, lengthBases, lengthExtra, it.Length)
+}
+
+// Finish returns the compressed stream.
+func (e *Encoder) Finish() []byte {
+	e.rc.flush()
+	e.bw.flush()
+	out := make([]byte, 0, 2*(len(e.rc.words)+len(e.bw.words)))
+	for _, w := range e.rc.words {
+		out = append(out, byte(w), byte(w>>8))
+	}
+	for i := len(e.bw.words) - 1; i >= 0; i-- {
+		w := e.bw.words[i]
+		out = append(out, byte(w), byte(w>>8))
+	}
+	return out
+}
+
+// Expand returns the data produced by the items, before the x86 filter is
+// undone. Repeated offsets are taken from move-to-front lists of four
+// entries per kind of match, initially 1 to 4, in which the entry used by
+// the previous item is skipped if it was of the same kind.
+func Expand(items []Item) []byte {
+	var out []byte
+	lzRecent := []uint64{1, 2, 3, 4}
+	deltaRecent := []uint64{1, 2, 3, 4}
+	prev := Literal
+	use := func(recent []uint64, it Item, kind Kind, explicit uint64) uint64 {
+		if it.Rep == 0 {
+			copy(recent[1:], recent[:3])
+			recent[0] = explicit
+			return explicit
+		}
+		i := it.Rep - 1
+		if prev == kind {
+			i++
+		}
+		v := recent[i]
+		copy(recent[1:i+1], recent[:i])
+		recent[0] = v
+		return v
+	}
+	for _, it := range items {
+		switch it.Kind {
+		case Literal:
+			out = append(out, it.Literal)
+		case LZ:
+			off := int(use(lzRecent, it, LZ, uint64(it.Offset)))
+			for i := uint32(0); i < it.Length; i++ {
+				out = append(out, out[len(out)-off])
+			}
+		case Delta:
+			pair := use(deltaRecent, it, Delta, uint64(it.Power)<<32|uint64(it.RawOffset))
+			span := 1 << (pair >> 32)
+			raw := int(uint32(pair)) << (pair >> 32)
+			for i := uint32(0); i < it.Length; i++ {
+				n := len(out)
+				out = append(out, out[n-span]+out[n-raw]-out[n-span-raw])
+			}
+		}
+		prev = it.Kind
+	}
+	return out
+}
+
+// X86Filter translates the relative targets of x86 branch and load
+// instructions to absolute ones, as the LZMS compressor does before
+// compressing a chunk. A target is only translated within 1023 bytes (511
+// for calls) of the last instruction whose target, by its low 16 bits, was
+// used within the previous 65535 bytes.
+func X86Filter(data []byte) {
+	const (
+		maxTranslation = 1023
+		idWindow       = 65535
+	)
+	if len(data) <= 17 {
+		return
+	}
+	var lastUsage [65536]int
+	for i := range lastUsage {
+		lastUsage[i] = -idWindow - 1
+	}
+	lastX86 := -maxTranslation - 1
+	// The byte at the end of the search is replaced by a call opcode while
+	// filtering, including when it is part of a target being translated.
+	end := len(data) - 16
+	saved := data[end]
+	data[end] = 0xe8
+	defer func() { data[end] = saved }()
+	for i := 0; i < end; {
+		opLen := 0
+		limit := maxTranslation
+		switch {
+		case data[i] == 0x48 && data[i+1] == 0x8b && (data[i+2] == 0x05 || data[i+2] == 0x0d):
+			opLen = 3
+		case (data[i] == 0x48 || data[i] == 0x4c) && data[i+1] == 0x8d && data[i+2]&7 == 5:
+			opLen = 3
+		case data[i] == 0xe8:
+			opLen = 1
+			limit /= 2
+		case data[i] == 0xe9:
+			i += 5
+			continue
+		case data[i] == 0xf0 && data[i+1] == 0x83 && data[i+2] == 0x05:
+			opLen = 3
+		case data[i] == 0xff && data[i+1] == 0x15:
+			opLen = 2
+		}
+		if opLen == 0 {
+			i++
+			continue
+		}
+		p := i + opLen
+		target16 := uint16(i) + binary.LittleEndian.Uint16(data[p:])
+		if i-lastX86 <= limit {
+			binary.LittleEndian.PutUint32(data[p:], binary.LittleEndian.Uint32(data[p:])+uint32(i))
+		}
+		last := p + 3
+		if last-lastUsage[target16] <= idWindow {
+			lastX86 = last
+		}
+		lastUsage[target16] = last
+		i = p + 4
+	}
+}
+
+// Compress returns data compressed as a single LZMS chunk, using literals
+// and LZ matches with explicit or repeated offsets.
+func Compress(data []byte) []byte {
+	filtered := append([]byte(nil), data...)
+	X86Filter(filtered)
+
+	const minMatch, maxMatch = 3, 1 << 12
+	e := NewEncoder(len(data))
+	head := make(map[uint32]int)
+	var recent uint32
+	prev := Literal
+	for i := 0; i < len(filtered); {
+		bestLen, bestOff := 0, 0
+		if i+minMatch <= len(filtered) {
+			key := uint32(filtered[i]) | uint32(filtered[i+1])<<8 | uint32(filtered[i+2])<<16
+			if j, ok := head[key]; ok {
+				n := 0
+				for i+n < len(filtered) && n < maxMatch && filtered[j+n] == filtered[i+n] {
+					n++
+				}
+				bestLen, bestOff = n, i-j
+			}
+			head[key] = i
+		}
+		if bestLen < minMatch {
+			e.Encode(Item{Kind: Literal, Literal: filtered[i]})
+			prev = Literal
+			i++
+			continue
+		}
+		it := Item{Kind: LZ, Offset: uint32(bestOff), Length: uint32(bestLen)}
+		// The most recent offset cannot be repeated by the next match, so
+		// only use a repeat after an intervening literal.
+		if uint32(bestOff) == recent && prev == Literal {
+			it = Item{Kind: LZ, Rep: 1, Length: uint32(bestLen)}
+		}
+		e.Encode(it)
+		recent = uint32(bestOff)
+		prev = LZ
+		i += bestLen
+	}
+	return e.Finish()
+}
@@ -0,0 +1,195 @@
+// Package xpresstest compresses data in the WIM variant of the XPRESS Huffman
+// format for tests.
+//
+// The compressor follows the encoder described in [MS-XCA] section 2.2 and
+// shares no code with the decompressor in package xpress. It uses a greedy
+// hash chain match finder, so its output resembles that of real encoders
+// rather than hand-picked items.
+package xpresstest
+
+import (
+	"encoding/binary"
+
+	"github.com/Microsoft/go-winio/wim/internal/lzmstest"
+)
+
+const (
+	numSymbols  = 512
+	maxCodeLen  = 15
+	minMatchLen = 3
+	maxOffset   = 1<<16 - 1
+	maxChain    = 64 // match candidates examined per position
+	hashBits    = 15
+)
+
+// item is a literal byte or a match.
+type item struct {
+	literal byte
+	length  int // zero for literals
+	offset  int
+}
+
+// symbol returns the Huffman symbol encoding it.
+func (it item) symbol() int {
+	if it.length == 0 {
+		return int(it.literal)
+	}
+	l := it.length - minMatchLen
+	if l > 15 {
+		l = 15
+	}
+	return 256 + offsetBits(it.offset)<<4 + l
+}
+
+func offsetBits(offset int) int {
+	n := 0
+	for offset > 1 {
+		n++
+		offset >>= 1
+	}
+	return n
+}
+
+func hash3(b []byte) int {
+	v := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+	return int((v * 0x9e3779b1) >> (32 - hashBits))
+}
+
+// parse splits data into literals and the longest matches found by a hash
+// chain search.
+func parse(data []byte) []item {
+	head := make([]int, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int, len(data))
+	insert := func(i int) {
+		if i+minMatchLen <= len(data) {
+			h := hash3(data[i:])
+			prev[i] = head[h]
+			head[h] = i
+		}
+	}
+
+	var items []item
+	for i := 0; i < len(data); {
+		best, bestOffset := 0, 0
+		if i+minMatchLen <= len(data) {
+			cand := head[hash3(data[i:])]
+			for n := 0; cand >= 0 && i-cand <= maxOffset && n < maxChain; n++ {
+				l := 0
+				for i+l < len(data) && data[cand+l] == data[i+l] {
+					l++
+				}
+				if l > best {
+					best, bestOffset = l, i-cand
+				}
+				cand = prev[cand]
+			}
+		}
+		if best < minMatchLen {
+			items = append(items, item{literal: data[i]})
+			insert(i)
+			i++
+			continue
+		}
+		items = append(items, item{length: best, offset: bestOffset})
+		for end := i + best; i < end; i++ {
+			insert(i)
+		}
+	}
+	return items
+}
+
+// bitWriter interleaves 16-bit little-endian words of Huffman-coded bits
+// with the extra length bytes. As in the decompressor, which reads two words
+// ahead, a word is reserved in the output before the bits filling it are
+// written, and bytes written in the meantime follow the reserved words.
+type bitWriter struct {
+	out                 []byte
+	nextBits, nextBits2 int // reserved word positions
+	bitBuf              uint32
+	bitCount            uint
+}
+
+func newBitWriter(out []byte) *bitWriter {
+	n := len(out)
+	return &bitWriter{out: append(out, 0, 0, 0, 0), nextBits: n, nextBits2: n + 2}
+}
+
+func (w *bitWriter) writeBits(v uint32, n uint) {
+	w.bitBuf = w.bitBuf<<n | v
+	w.bitCount += n
+	if w.bitCount > 16 {
+		w.bitCount -= 16
+		binary.LittleEndian.PutUint16(w.out[w.nextBits:], uint16(w.bitBuf>>w.bitCount))
+		w.nextBits = w.nextBits2
+		w.nextBits2 = len(w.out)
+		w.out = append(w.out, 0, 0)
+	}
+}
+
+func (w *bitWriter) writeByte(b byte) {
+	w.out = append(w.out, b)
+}
+
+func (w *bitWriter) flush() []byte {
+	binary.LittleEndian.PutUint16(w.out[w.nextBits:], uint16(w.bitBuf<<(16-w.bitCount)))
+	return w.out
+}
+
+// Compress returns data compressed as a single XPRESS chunk. It panics if data
+// is longer than the 64KB XPRESS chunk limit.
+func Compress(data []byte) []byte {
+	if len(data) > 1<<16 {
+		panic("xpresstest: data too long")
+	}
+	items := parse(data)
+	freqs := make([]uint32, numSymbols)
+	for _, it := range items {
+		freqs[it.symbol()]++
+	}
+	lens := lzmstest.CodeLens(freqs, maxCodeLen)
+	codes := canonicalCodes(lens)
+
+	out := make([]byte, numSymbols/2)
+	for sym, l := range lens {
+		out[sym/2] |= l << (4 * (sym % 2))
+	}
+	w := newBitWriter(out)
+	for _, it := range items {
+		sym := it.symbol()
+		w.writeBits(codes[sym], uint(lens[sym]))
+		if it.length == 0 {
+			continue
+		}
+		if l := it.length - minMatchLen; l >= 15 {
+			if l-15 < 255 {
+				w.writeByte(byte(l - 15))
+			} else {
+				w.writeByte(255)
+				w.writeByte(byte(l))
+				w.writeByte(byte(l >> 8))
+			}
+		}
+		n := offsetBits(it.offset)
+		w.writeBits(uint32(it.offset-1<<n), uint(n))
+	}
+	return w.flush()
+}
+
+// canonicalCodes assigns codes of each length in symbol order.
+func canonicalCodes(lens []uint8) []uint32 {
+	codes := make([]uint32, len(lens))
+	code := uint32(0)
+	for l := uint8(1); l <= maxCodeLen; l++ {
+		for sym, sl := range lens {
+			if sl == l {
+				codes[sym] = code
+				code++
+			}
+		}
+		code <<= 1
+	}
+	return codes
+}
@@ -0,0 +1,781 @@
+// Package lzms implements a decompressor for the LZMS compression algorithm
+// used in WIM and ESD files.
+//
+// LZMS combines LZ77-style and delta matches with adaptive Huffman codes and
+// an adaptive range coder. The range-coded bits are read forwards from the
+// start of the compressed data, while the Huffman-coded bits are read
+// backwards from its end.
+package lzms
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+const (
+	numLZReps    = 3
+	numDeltaReps = 3
+
+	probabilityBits        = 6
+	probabilityDenominator = 1 << probabilityBits
+	initialProbability     = 48
+	initialRecentBits      = 0x0000000055555555
+
+	numMainProbs     = 16
+	numMatchProbs    = 32
+	numLZProbs       = 64
+	numLZRepProbs    = 64
+	numDeltaProbs    = 64
+	numDeltaRepProbs = 64
+
+	numLiteralSyms    = 256
+	numLengthSyms     = 54
+	numDeltaPowerSyms = 8
+	maxNumOffsetSyms  = 799
+	maxCodeLen        = 15
+
+	literalRebuildFreq     = 1024
+	lzOffsetRebuildFreq    = 1024
+	lengthRebuildFreq      = 512
+	deltaOffsetRebuildFreq = 1024
+	deltaPowerRebuildFreq  = 512
+
+	x86MaxTranslationOffset = 1023
+	x86IDWindowSize         = 65535
+
+	maxChunkSize = 1 << 30
+)
+
+var errCorrupt = errors.New("LZMS data corrupt")
+
+// The offset and length slot bases are not given by a formula. Instead, they
+// are generated from run lengths of the deltas between adjacent slot bases,
+// which increase by powers of two.
+var (
+	offsetSlotDeltaRunLens = [...]uint8{
+		9, 0, 9, 7, 10, 15, 15, 20,
+		20, 30, 33, 40, 42, 45, 60, 73,
+		80, 85, 95, 105, 6,
+	}
+	lengthSlotDeltaRunLens = [...]uint8{
+		27, 4, 6, 4, 5, 2, 1, 1,
+		1, 1, 1, 0, 0, 0, 0, 0,
+		1,
+	}
+
+	offsetSlotBase  [maxNumOffsetSyms + 1]uint32
+	extraOffsetBits [maxNumOffsetSyms]uint8
+	lengthSlotBase  [numLengthSyms + 1]uint32
+	extraLengthBits [numLengthSyms]uint8
+)
+
+func init() {
+	decodeSlotBases(offsetSlotBase[:], extraOffsetBits[:], offsetSlotDeltaRunLens[:], 0x7fffffff)
+	decodeSlotBases(lengthSlotBase[:], extraLengthBits[:], lengthSlotDeltaRunLens[:], 0x400108ab)
+}
+
+func decodeSlotBases(bases []uint32, extra []uint8, runLens []uint8, final uint32) {
+	delta := uint32(1)
+	base := uint32(0)
+	slot := 0
+	for order, n := range runLens {
+		for ; n > 0; n-- {
+			base += delta
+			if slot > 0 {
+				extra[slot-1] = uint8(order)
+			}
+			bases[slot] = base
+			slot++
+		}
+		delta <<= 1
+	}
+	bases[slot] = final
+	extra[slot-1] = uint8(bits.Len32(final-bases[slot-1]) - 1)
+}
+
+// numOffsetSlots returns the number of offset slots needed for matches
+// within a buffer of the given size.
+func numOffsetSlots(size int) int {
+	if size < 2 {
+		return 0
+	}
+	maxOffset := uint32(size - 1)
+	return sort.Search(maxNumOffsetSyms, func(i int) bool { return offsetSlotBase[i+1] > maxOffset }) + 1
+}
+
+// probEntry tracks the probability of a zero bit, based on the last 64 bits
+// decoded with it.
+type probEntry struct {
+	zeros  uint32
+	recent uint64
+}
+
+func (p *probEntry) init() {
+	p.zeros = initialProbability
+	p.recent = initialRecentBits
+}
+
+func (p *probEntry) probability() uint32 {
+	prob := p.zeros
+	// 0% and 100% probabilities are not allowed.
+	if prob == 0 {
+		prob++
+	} else if prob == probabilityDenominator {
+		prob--
+	}
+	return prob
+}
+
+func (p *probEntry) update(bit uint32) {
+	p.zeros = uint32(int32(p.zeros) + int32(p.recent>>(probabilityDenominator-1)) - int32(bit))
+	p.recent = p.recent<<1 | uint64(bit)
+}
+
+// rangeDecoder decodes range-coded bits from the start of the input.
+type rangeDecoder struct {
+	in   []byte
+	next int
+	rng  uint32
+	code uint32
+}
+
+func (rd *rangeDecoder) init(in []byte) {
+	rd.in = in
+	rd.rng = 0xffffffff
+	rd.code = uint32(binary.LittleEndian.Uint16(in))<<16 | uint32(binary.LittleEndian.Uint16(in[2:]))
+	rd.next = 4
+}
+
+func (rd *rangeDecoder) decodeBit(p *probEntry) uint32 {
+	prob := p.probability()
+	if rd.rng&0xffff0000 == 0 {
+		rd.rng <<= 16
+		rd.code <<= 16
+		if rd.next < len(rd.in) {
+			rd.code |= uint32(binary.LittleEndian.Uint16(rd.in[rd.next:]))
+			rd.next += 2
+		}
+	}
+	bound := (rd.rng >> probabilityBits) * prob
+	if rd.code < bound {
+		rd.rng = bound
+		p.update(0)
+		return 0
+	}
+	rd.rng -= bound
+	rd.code -= bound
+	p.update(1)
+	return 1
+}
+
+// bitReader reads bits from 16-bit little-endian words, starting at the end
+// of the input and moving backwards. Reads past the start of the input
+// return zeroes.
+type bitReader struct {
+	in    []byte
+	next  int
+	buf   uint64
+	nbits uint
+}
+
+func (br *bitReader) init(in []byte) {
+	br.in = in
+	br.next = len(in)
+}
+
+func (br *bitReader) ensure(n uint) {
+	for br.nbits < n {
+		if br.next >= 2 {
+			br.next -= 2
+			br.buf |= uint64(binary.LittleEndian.Uint16(br.in[br.next:])) << (64 - 16 - br.nbits)
+		}
+		br.nbits += 16
+	}
+}
+
+func (br *bitReader) peek(n uint) uint32 {
+	return uint32(br.buf >> (64 - n))
+}
+
+func (br *bitReader) remove(n uint) {
+	br.buf <<= n
+	br.nbits -= n
+}
+
+func (br *bitReader) read(n uint) uint32 {
+	if n == 0 {
+		return 0
+	}
+	br.ensure(n)
+	v := br.peek(n)
+	br.remove(n)
+	return v
+}
+
+const (
+	tableBits = 10
+	slowEntry = 0xffff
+	lenShift  = 10
+	symMask   = 1<<lenShift - 1
+)
+
+// huffmanDecoder decodes symbols using an adaptive Huffman code, which is
+// rebuilt from the symbol frequencies after every rebuildFreq symbols.
+type huffmanDecoder struct {
+	numSyms      int
+	rebuildFreq  int
+	untilRebuild int
+	freqs        []uint32
+	lens         []uint8
+	sorted       []uint16 // symbols sorted by code length, then symbol
+	limit        [maxCodeLen + 2]uint32
+	firstCode    [maxCodeLen + 1]uint32
+	firstIndex   [maxCodeLen + 1]int
+	table        [1 << tableBits]uint16
+	scratch      []uint32
+}
+
+func (h *huffmanDecoder) init(numSyms, rebuildFreq int) {
+	h.numSyms = numSyms
+	h.rebuildFreq = rebuildFreq
+	h.freqs = make([]uint32, numSyms)
+	h.lens = make([]uint8, numSyms)
+	h.sorted = make([]uint16, numSyms)
+	h.scratch = make([]uint32, numSyms)
+	for i := range h.freqs {
+		h.freqs[i] = 1
+	}
+	h.rebuild()
+}
+
+func (h *huffmanDecoder) rebuild() {
+	makeCodeLens(h.freqs, h.lens, h.scratch)
+
+	var count [maxCodeLen + 1]int
+	for _, l := range h.lens {
+		count[l]++
+	}
+	count[0] = 0
+	code := uint32(0)
+	index := 0
+	for l := 1; l <= maxCodeLen; l++ {
+		h.firstCode[l] = code
+		h.firstIndex[l] = index
+		code += uint32(count[l])
+		index += count[l]
+		// limit[l] is the first left-justified code that is longer than l.
+		h.limit[l] = code << (maxCodeLen - l)
+		code <<= 1
+	}
+	h.limit[maxCodeLen+1] = 1 << maxCodeLen
+
+	next := h.firstIndex
+	for sym, l := range h.lens {
+		if l != 0 {
+			h.sorted[next[l]] = uint16(sym)
+			next[l]++
+		}
+	}
+
+	for i := range h.table {
+		h.table[i] = slowEntry
+	}
+	pos := 0
+	for l := 1; l <= tableBits; l++ {
+		n := 1 << (tableBits - l)
+		for _, sym := range h.sorted[h.firstIndex[l] : h.firstIndex[l]+count[l]] {
+			v := uint16(l)<<lenShift | sym
+			for i := pos; i < pos+n && i < len(h.table); i++ {
+				h.table[i] = v
+			}
+			pos += n
+		}
+	}
+
+	// Dilute the frequencies so that the code adapts to recent data.
+	for i := range h.freqs {
+		h.freqs[i] = h.freqs[i]>>1 + 1
+	}
+	h.untilRebuild = h.rebuildFreq
+}
+
+func (h *huffmanDecoder) decode(br *bitReader) (int, error) {
+	br.ensure(maxCodeLen)
+	v := br.peek(maxCodeLen)
+	var sym int
+	if e := h.table[v>>(maxCodeLen-tableBits)]; e != slowEntry {
+		br.remove(uint(e >> lenShift))
+		sym = int(e & symMask)
+	} else {
+		l := tableBits + 1
+		for l <= maxCodeLen && v >= h.limit[l] {
+			l++
+		}
+		if l > maxCodeLen {
+			return 0, errCorrupt
+		}
+		i := h.firstIndex[l] + int(v>>(maxCodeLen-l)-h.firstCode[l])
+		br.remove(uint(l))
+		sym = int(h.sorted[i])
+	}
+	h.freqs[sym]++
+	h.untilRebuild--
+	if h.untilRebuild == 0 {
+		h.rebuild()
+	}
+	return sym, nil
+}
+
+// makeCodeLens computes length-limited Huffman code lengths for the given
+// symbol frequencies. The construction must match the one used by the
+// compressor exactly, including how ties are broken and how the lengths
+// are limited, since the code itself is never transmitted.
+func makeCodeLens(freqs []uint32, lens []uint8, a []uint32) {
+	const symBits = 10
+	const symMask = 1<<symBits - 1
+
+	// Sort the used symbols by frequency, then by symbol value.
+	n := 0
+	for sym, f := range freqs {
+		if f != 0 {
+			a[n] = f<<symBits | uint32(sym)
+			n++
+		} else {
+			lens[sym] = 0
+		}
+	}
+	used := a[:n]
+	sort.Slice(used, func(i, j int) bool { return used[i] < used[j] })
+
+	switch n {
+	case 0:
+		return
+	case 1:
+		lens[used[0]&symMask] = 1
+		return
+	}
+
+	// Build the Huffman tree in place. The low bits of each entry keep the
+	// sorted symbol; the high bits hold first the frequency, then the index
+	// of the parent node.
+	i, b, e := 0, 0, 0
+	for n-e > 1 {
+		var m, k int
+		if i != n && (b == e || used[i]>>symBits <= used[b]>>symBits) {
+			m = i
+			i++
+		} else {
+			m = b
+			b++
+		}
+		if i != n && (b == e || used[i]>>symBits <= used[b]>>symBits) {
+			k = i
+			i++
+		} else {
+			k = b
+			b++
+		}
+		freq := used[m]&^symMask + used[k]&^symMask
+		used[m] = used[m]&symMask | uint32(e)<<symBits
+		used[k] = used[k]&symMask | uint32(e)<<symBits
+		used[e] = used[e]&symMask | freq
+		e++
+	}
+
+	// Compute the number of codes of each length, visiting parents before
+	// their children and limiting the lengths to maxCodeLen.
+	var lenCounts [maxCodeLen + 1]int
+	lenCounts[1] = 2
+	root := n - 2
+	used[root] &= symMask
+	for node := root - 1; node >= 0; node-- {
+		parent := used[node] >> symBits
+		depth := used[parent]>>symBits + 1
+		used[node] = used[node]&symMask | depth<<symBits
+		l := int(depth)
+		if l >= maxCodeLen {
+			l = maxCodeLen
+			for {
+				l--
+				if lenCounts[l] != 0 {
+					break
+				}
+			}
+		}
+		lenCounts[l]--
+		lenCounts[l+1] += 2
+	}
+
+	// Assign the longest codes to the least frequent symbols.
+	j := 0
+	for l := maxCodeLen; l >= 1; l-- {
+		for c := lenCounts[l]; c > 0; c-- {
+			lens[used[j]&symMask] = uint8(l)
+			j++
+		}
+	}
+}
+
+type decompressor struct {
+	r            io.Reader
+	uncompressed int
+	outReader    *bytes.Reader
+
+	rd rangeDecoder
+	br bitReader
+
+	mainState      uint32
+	matchState     uint32
+	lzState        uint32
+	lzRepStates    [numLZReps - 1]uint32
+	deltaState     uint32
+	deltaRepStates [numDeltaReps - 1]uint32
+
+	mainProbs     [numMainProbs]probEntry
+	matchProbs    [numMatchProbs]probEntry
+	lzProbs       [numLZProbs]probEntry
+	lzRepProbs    [numLZReps - 1][numLZRepProbs]probEntry
+	deltaProbs    [numDeltaProbs]probEntry
+	deltaRepProbs [numDeltaReps - 1][numDeltaRepProbs]probEntry
+
+	literal     huffmanDecoder
+	lzOffset    huffmanDecoder
+	length      huffmanDecoder
+	deltaOffset huffmanDecoder
+	deltaPower  huffmanDecoder
+}
+
+func initProbs(probs []probEntry) {
+	for i := range probs {
+		probs[i].init()
+	}
+}
+
+func (d *decompressor) decodeBit(state *uint32, numStates uint32, probs []probEntry) uint32 {
+	bit := d.rd.decodeBit(&probs[*state])
+	*state = (*state<<1 | bit) & (numStates - 1)
+	return bit
+}
+
+func (d *decompressor) decodeOffset(h *huffmanDecoder) (uint32, error) {
+	slot, err := h.decode(&d.br)
+	if err != nil {
+		return 0, err
+	}
+	return offsetSlotBase[slot] + d.br.read(uint(extraOffsetBits[slot])), nil
+}
+
+func (d *decompressor) decodeLength() (uint32, error) {
+	slot, err := d.length.decode(&d.br)
+	if err != nil {
+		return 0, err
+	}
+	return lengthSlotBase[slot] + d.br.read(uint(extraLengthBits[slot])), nil
+}
+
+// decompress decodes in into out, which must be sized to the uncompressed size.
+func (d *decompressor) decompress(in []byte, out []byte) error {
+	if len(in) < 4 || len(in)%2 != 0 {
+		return errCorrupt
+	}
+	d.rd.init(in)
+	d.br.init(in)
+
+	initProbs(d.mainProbs[:])
+	initProbs(d.matchProbs[:])
+	initProbs(d.lzProbs[:])
+	for i := range d.lzRepProbs {
+		initProbs(d.lzRepProbs[i][:])
+	}
+	initProbs(d.deltaProbs[:])
+	for i := range d.deltaRepProbs {
+		initProbs(d.deltaRepProbs[i][:])
+	}
+
+	nslots := numOffsetSlots(len(out))
+	d.literal.init(numLiteralSyms, literalRebuildFreq)
+	d.lzOffset.init(nslots, lzOffsetRebuildFreq)
+	d.length.init(numLengthSyms, lengthRebuildFreq)
+	d.deltaOffset.init(nslots, deltaOffsetRebuildFreq)
+	d.deltaPower.init(numDeltaPowerSyms, deltaPowerRebuildFreq)
+
+	// The recent offset queues have an extra entry, since the offset of
+	// the previous item cannot be repeated by the immediately following
+	// item and is skipped over.
+	var recentLZOffsets [numLZReps + 1]uint32
+	var recentDeltaPairs [numDeltaReps + 1]uint64
+	for i := range recentLZOffsets {
+		recentLZOffsets[i] = uint32(i + 1)
+	}
+	for i := range recentDeltaPairs {
+		recentDeltaPairs[i] = uint64(i + 1)
+	}
+
+	// The type of the previous item: 0 for a literal, 1 for an LZ match, and
+	// 2 for a delta match.
+	prevItemType := 0
+
+	o := 0
+	for o < len(out) {
+		if d.decodeBit(&d.mainState, numMainProbs, d.mainProbs[:]) == 0 {
+			// Literal
+			sym, err := d.literal.decode(&d.br)
+			if err != nil {
+				return err
+			}
+			out[o] = byte(sym)
+			o++
+			prevItemType = 0
+			continue
+		}
+
+		if d.decodeBit(&d.matchState, numMatchProbs, d.matchProbs[:]) == 0 {
+			// LZ match
+			var offset uint32
+			if d.decodeBit(&d.lzState, numLZProbs, d.lzProbs[:]) == 0 {
+				// Explicit offset
+				var err error
+				offset, err = d.decodeOffset(&d.lzOffset)
+				if err != nil {
+					return err
+				}
+				recentLZOffsets[3] = recentLZOffsets[2]
+				recentLZOffsets[2] = recentLZOffsets[1]
+				recentLZOffsets[1] = recentLZOffsets[0]
+			} else {
+				// Repeat offset
+				skip := prevItemType & 1
+				switch {
+				case d.decodeBit(&d.lzRepStates[0], numLZRepProbs, d.lzRepProbs[0][:]) == 0:
+					offset = recentLZOffsets[0+skip]
+					recentLZOffsets[0+skip] = recentLZOffsets[0]
+				case d.decodeBit(&d.lzRepStates[1], numLZRepProbs, d.lzRepProbs[1][:]) == 0:
+					offset = recentLZOffsets[1+skip]
+					recentLZOffsets[1+skip] = recentLZOffsets[1]
+					recentLZOffsets[1] = recentLZOffsets[0]
+				default:
+					offset = recentLZOffsets[2+skip]
+					recentLZOffsets[2+skip] = recentLZOffsets[2]
+					recentLZOffsets[2] = recentLZOffsets[1]
+					recentLZOffsets[1] = recentLZOffsets[0]
+				}
+			}
+			recentLZOffsets[0] = offset
+			prevItemType = 1
+
+			length, err := d.decodeLength()
+			if err != nil {
+				return err
+			}
+			if uint64(offset) > uint64(o) || uint64(length) > uint64(len(out)-o) {
+				return errCorrupt
+			}
+			for end := o + int(length); o < end; o++ {
+				out[o] = out[o-int(offset)]
+			}
+			continue
+		}
+
+		// Delta match
+		var power, rawOffset uint32
+		if d.decodeBit(&d.deltaState, numDeltaProbs, d.deltaProbs[:]) == 0 {
+			// Explicit offset
+			p, err := d.deltaPower.decode(&d.br)
+			if err != nil {
+				return err
+			}
+			power = uint32(p)
+			rawOffset, err = d.decodeOffset(&d.deltaOffset)
+			if err != nil {
+				return err
+			}
+			recentDeltaPairs[3] = recentDeltaPairs[2]
+			recentDeltaPairs[2] = recentDeltaPairs[1]
+			recentDeltaPairs[1] = recentDeltaPairs[0]
+		} else {
+			// Repeat offset
+			skip := prevItemType >> 1
+			var pair uint64
+			switch {
+			case d.decodeBit(&d.deltaRepStates[0], numDeltaRepProbs, d.deltaRepProbs[0][:]) == 0:
+				pair = recentDeltaPairs[0+skip]
+				recentDeltaPairs[0+skip] = recentDeltaPairs[0]
+			case d.decodeBit(&d.deltaRepStates[1], numDeltaRepProbs, d.deltaRepProbs[1][:]) == 0:
+				pair = recentDeltaPairs[1+skip]
+				recentDeltaPairs[1+skip] = recentDeltaPairs[1]
+				recentDeltaPairs[1] = recentDeltaPairs[0]
+			default:
+				pair = recentDeltaPairs[2+skip]
+				recentDeltaPairs[2+skip] = recentDeltaPairs[2]
+				recentDeltaPairs[2] = recentDeltaPairs[1]
+				recentDeltaPairs[1] = recentDeltaPairs[0]
+			}
+			power = uint32(pair >> 32)
+			rawOffset = uint32(pair)
+		}
+		recentDeltaPairs[0] = uint64(power)<<32 | uint64(rawOffset)
+		prevItemType = 2
+
+		length, err := d.decodeLength()
+		if err != nil {
+			return err
+		}
+		offset1 := uint64(1) << power
+		offset2 := uint64(rawOffset) << power
+		offset := offset1 + offset2
+		if offset > uint64(o) || uint64(length) > uint64(len(out)-o) {
+			return errCorrupt
+		}
+		for end := o + int(length); o < end; o++ {
+			out[o] = out[o-int(offset1)] + out[o-int(offset2)] - out[o-int(offset)]
+		}
+	}
+
+	undoX86Filter(out)
+	return nil
+}
+
+// undoX86Filter reverses the translation of relative x86 branch and load
+// targets to absolute addresses that was performed before compression.
+//
+// Translation is only performed in regions that appear to contain x86 code,
+// which is detected by finding two instructions that reference the same
+// target (by the low 16 bits of its address) within a small window.
+func undoX86Filter(data []byte) {
+	size := len(data)
+	if size <= 17 {
+		return
+	}
+
+	var lastTargetUsages [65536]int32
+	for i := range lastTargetUsages {
+		lastTargetUsages[i] = -x86IDWindowSize - 1
+	}
+	lastX86Pos := int32(-x86MaxTranslationOffset - 1)
+
+	// The byte at the tail is temporarily replaced with an opcode so that
+	// the search for the next opcode always terminates there.
+	tail := size - 16
+	saved := data[tail]
+	data[tail] = 0xe8
+	p := 0
+	for {
+		for p < tail && !isOpcode(data[p]) {
+			p++
+		}
+		if p >= tail {
+			break
+		}
+
+		maxTransOffset := int32(x86MaxTranslationOffset)
+		opcodeLen := 0
+		switch data[p] {
+		case 0x48:
+			if data[p+1] == 0x8b {
+				if data[p+2] == 0x5 || data[p+2] == 0xd {
+					// Load relative (x86_64)
+					opcodeLen = 3
+				}
+			} else if data[p+1] == 0x8d {
+				if data[p+2]&0x7 == 0x5 {
+					// Load effective address relative (x86_64)
+					opcodeLen = 3
+				}
+			}
+		case 0x4c:
+			if data[p+1] == 0x8d {
+				if data[p+2]&0x7 == 0x5 {
+					// Load effective address relative (x86_64)
+					opcodeLen = 3
+				}
+			}
+		case 0xe8:
+			// Call relative. Require more confidence that this is x86
+			// code before translating it.
+			opcodeLen = 1
+			maxTransOffset /= 2
+		case 0xe9:
+			// Jump relative. This is never translated.
+			p += 5
+			continue
+		case 0xf0:
+			if data[p+1] == 0x83 && data[p+2] == 0x05 {
+				// Lock add relative
+				opcodeLen = 3
+			}
+		case 0xff:
+			if data[p+1] == 0x15 {
+				// Call indirect relative
+				opcodeLen = 2
+			}
+		}
+		if opcodeLen == 0 {
+			p++
+			continue
+		}
+
+		i := int32(p)
+		p += opcodeLen
+		if i-lastX86Pos <= maxTransOffset {
+			n := binary.LittleEndian.Uint32(data[p:])
+			binary.LittleEndian.PutUint32(data[p:], n-uint32(i))
+		}
+		target16 := uint16(i) + binary.LittleEndian.Uint16(data[p:])
+
+		i += int32(opcodeLen) + 4 - 1
+		if i-lastTargetUsages[target16] <= x86IDWindowSize {
+			lastX86Pos = i
+		}
+		lastTargetUsages[target16] = i
+		p += 4
+	}
+	data[tail] = saved
+}
+
+func isOpcode(b byte) bool {
+	switch b {
+	case 0x48, 0x4c, 0xe8, 0xe9, 0xf0, 0xff:
+		return true
+	}
+	return false
+}
+
+func (d *decompressor) Read(b []byte) (int, error) {
+	// Read and uncompress everything.
+	if d.outReader == nil {
+		in, err := io.ReadAll(d.r)
+		if err != nil {
+			return 0, err
+		}
+		out := make([]byte, d.uncompressed)
+		err = d.decompress(in, out)
+		if err != nil {
+			return 0, err
+		}
+		d.outReader = bytes.NewReader(out)
+	}
+
+	// Just read directly from the output.
+	return d.outReader.Read(b)
+}
+
+func (*decompressor) Close() error {
+	return nil
+}
+
+// NewReader returns a new io.ReadCloser that decompresses an
+// LZMS stream until uncompressedSize bytes have been returned.
+func NewReader(r io.Reader, uncompressedSize int) (io.ReadCloser, error) {
+	if uncompressedSize > maxChunkSize {
+		return nil, errors.New("uncompressed size is limited to 1GB")
+	}
+	d := &decompressor{
+		uncompressed: uncompressedSize,
+		r:            r,
+	}
+	return d, nil
+}
@@ -0,0 +1,339 @@
+package lzms
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/Microsoft/go-winio/wim/internal/lzmstest"
+)
+
+func TestSlotBases(t *testing.T) {
+	for i, want := range []uint32{1, 2, 3, 4, 5, 6, 7, 8, 9, 0xd, 0x11, 0x15} {
+		if offsetSlotBase[i] != want {
+			t.Errorf("offset slot %d: expected base %#x, got %#x", i, want, offsetSlotBase[i])
+		}
+	}
+	if offsetSlotBase[maxNumOffsetSyms] != 0x7fffffff {
+		t.Errorf("unexpected final offset slot base %#x", offsetSlotBase[maxNumOffsetSyms])
+	}
+	for i := 0; i < maxNumOffsetSyms-1; i++ {
+		if offsetSlotBase[i]+1<<extraOffsetBits[i] < offsetSlotBase[i+1] {
+			t.Errorf("offset slot %d does not reach slot %d", i, i+1)
+		}
+	}
+	for i := 0; i < numLengthSyms-1; i++ {
+		if lengthSlotBase[i]+1<<extraLengthBits[i] < lengthSlotBase[i+1] {
+			t.Errorf("length slot %d does not reach slot %d", i, i+1)
+		}
+	}
+	if n := numOffsetSlots(32768); offsetSlotBase[n-1] > 32767 || offsetSlotBase[n] <= 32767 {
+		t.Errorf("unexpected number of offset slots %d", n)
+	}
+}
+
+func TestMakeCodeLens(t *testing.T) {
+	freqs := make([]uint32, numLiteralSyms)
+	for i := range freqs {
+		// Use a very skewed distribution so that lengths must be limited.
+		freqs[i] = 1
+		if i < 30 {
+			freqs[i] = 1 << i
+		}
+	}
+	lens := make([]uint8, len(freqs))
+	makeCodeLens(freqs, lens, make([]uint32, len(freqs)))
+	kraft := 0
+	for sym, l := range lens {
+		if l == 0 || l > maxCodeLen {
+			t.Fatalf("symbol %d has invalid length %d", sym, l)
+		}
+		kraft += 1 << (maxCodeLen - l)
+	}
+	if kraft != 1<<maxCodeLen {
+		t.Errorf("code is not complete: %d", kraft)
+	}
+}
+
+// decompress decompresses in into size bytes, failing the test if the
+// decompressor panics.
+func decompress(t *testing.T, in []byte, size int) (out []byte, err error) {
+	t.Helper()
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("panic decompressing %d bytes: %v", len(in), r)
+		}
+	}()
+	out = make([]byte, size)
+	var d decompressor
+	err = d.decompress(in, out)
+	return out, err
+}
+
+func TestCodeLensMatchEncoder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		freqs := make([]uint32, 1+rng.Intn(numLiteralSyms))
+		for j := range freqs {
+			switch rng.Intn(3) {
+			case 0:
+				freqs[j] = 1
+			case 1:
+				freqs[j] = uint32(rng.Intn(16)) + 1
+			default:
+				freqs[j] = 1 << uint(rng.Intn(12))
+			}
+		}
+		lens := make([]uint8, len(freqs))
+		makeCodeLens(freqs, lens, make([]uint32, len(freqs)))
+		if want := lzmstest.CodeLens(freqs, maxCodeLen); !bytes.Equal(lens, want) {
+			t.Fatalf("freqs %v: got lengths %v, want %v", freqs, lens, want)
+		}
+	}
+}
+
+func literals(s string) []lzmstest.Item {
+	var items []lzmstest.Item
+	for _, c := range []byte(s) {
+		items = append(items, lzmstest.Item{Kind: lzmstest.Literal, Literal: c})
+	}
+	return items
+}
+
+func lz(offset, length uint32) lzmstest.Item {
+	return lzmstest.Item{Kind: lzmstest.LZ, Offset: offset, Length: length}
+}
+
+func lzRep(rep int, length uint32) lzmstest.Item {
+	return lzmstest.Item{Kind: lzmstest.LZ, Rep: rep, Length: length}
+}
+
+func delta(power, rawOffset, length uint32) lzmstest.Item {
+	return lzmstest.Item{Kind: lzmstest.Delta, Power: power, RawOffset: rawOffset, Length: length}
+}
+
+func deltaRep(rep int, length uint32) lzmstest.Item {
+	return lzmstest.Item{Kind: lzmstest.Delta, Rep: rep, Length: length}
+}
+
+func join(parts ...[]lzmstest.Item) []lzmstest.Item {
+	var items []lzmstest.Item
+	for _, p := range parts {
+		items = append(items, p...)
+	}
+	return items
+}
+
+func one(it lzmstest.Item) []lzmstest.Item {
+	return []lzmstest.Item{it}
+}
+
+// randomItems returns a script of n valid items using every kind of item.
+func randomItems(rng *rand.Rand, n int) []lzmstest.Item {
+	const letters = "abcdefghijklmnopqrstuvwxyz .,"
+	var items []lzmstest.Item
+	size := 0
+	for i := 0; i < 512; i++ {
+		items = append(items, lzmstest.Item{Kind: lzmstest.Literal, Literal: letters[rng.Intn(len(letters))]})
+		size++
+	}
+	for len(items) < n {
+		var it lzmstest.Item
+		length := uint32(1 + rng.Intn(64))
+		if rng.Intn(20) == 0 {
+			length = uint32(rng.Intn(5000)) + 1
+		}
+		switch rng.Intn(6) {
+		case 0, 1:
+			it = lzmstest.Item{Kind: lzmstest.Literal, Literal: byte(rng.Intn(256))}
+			length = 1
+		case 2:
+			it = lz(uint32(1+rng.Intn(size)), length)
+		case 3:
+			it = lzRep(1+rng.Intn(3), length)
+		case 4:
+			it = delta(uint32(rng.Intn(4)), uint32(1+rng.Intn(60)), length)
+		case 5:
+			it = deltaRep(1+rng.Intn(3), length)
+		}
+		items = append(items, it)
+		size += int(length)
+	}
+	return items
+}
+
+func TestDecompressItems(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		items []lzmstest.Item
+	}{
+		{"literals", literals("hello, world")},
+		{"lz", join(
+			literals("abc"), one(lz(3, 9)),
+			literals("d"), one(lz(1, 300)),
+			literals("efghijklmnopqrstuvwxyz"), one(lz(326, 5)), one(lz(20, 40000)),
+		)},
+		{"lz repeats", join(
+			literals("abcdefghijklmnop"),
+			one(lz(2, 3)), one(lz(5, 4)), one(lz(11, 2)),
+			// After a literal, the most recent offset is repeated first.
+			literals("q"), one(lzRep(1, 3)), literals("r"), one(lzRep(2, 3)), literals("s"), one(lzRep(3, 3)),
+			// After a match, its own offset is skipped.
+			one(lzRep(1, 4)), one(lzRep(2, 5)), one(lzRep(3, 6)), one(lzRep(1, 7)),
+		)},
+		{"delta", join(
+			literals("\x00\x02\x04\x06\x08\x0a\x0c\x0e\x10\x20\x30\x40\x50\x60\x70\x80"),
+			one(delta(0, 1, 20)),
+			one(delta(2, 3, 10)), one(delta(1, 5, 7)),
+			literals("x"), one(deltaRep(1, 4)), literals("y"), one(deltaRep(2, 4)), literals("z"), one(deltaRep(3, 4)),
+			one(deltaRep(1, 5)), one(deltaRep(2, 6)), one(deltaRep(3, 7)),
+			// An LZ match in between does not affect which delta offsets
+			// are skipped, nor does a delta match affect LZ offsets.
+			one(lz(7, 3)), one(deltaRep(1, 3)), one(lzRep(1, 3)), one(delta(3, 2, 8)), one(lzRep(1, 2)),
+		)},
+		{"random", randomItems(rand.New(rand.NewSource(1)), 20000)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want := lzmstest.Expand(tc.items)
+			undoX86Filter(want)
+			e := lzmstest.NewEncoder(len(want))
+			for _, it := range tc.items {
+				e.Encode(it)
+			}
+			in := e.Finish()
+			got, err := decompress(t, in, len(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestUndoX86Filter(t *testing.T) {
+	// A call to 0x100 at 0 and at 10 mark the data as x86 code, so that the
+	// call at 20 and the load at 30 were translated. The jump at 40 is
+	// skipped.
+	data := make([]byte, 64)
+	copy(data[0:], "\xe8\x00\x01\x00\x00")
+	copy(data[10:], "\xe8\xf6\x00\x00\x00")
+	copy(data[20:], "\xe8\x64\x00\x00\x00")
+	copy(data[30:], "\x48\x8b\x05\x2e\x00\x00\x00")
+	copy(data[40:], "\xe9\x34\x12\x00\x00")
+	want := append([]byte(nil), data...)
+	copy(want[20:], "\xe8\x50\x00\x00\x00")
+	copy(want[30:], "\x48\x8b\x05\x10\x00\x00\x00")
+	undoX86Filter(data)
+	if !bytes.Equal(data, want) {
+		t.Errorf("got %x, want %x", data, want)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	code := make([]byte, 1<<16)
+	for i := 0; i < len(code); {
+		switch rng.Intn(4) {
+		case 0:
+			i += copy(code[i:], "\xe8")
+		case 1:
+			i += copy(code[i:], "\x48\x8d\x05")
+		case 2:
+			i += copy(code[i:], "\xff\x15")
+		default:
+			code[i] = byte(rng.Intn(256))
+			i++
+			continue
+		}
+		if i+4 <= len(code) {
+			binary.LittleEndian.PutUint32(code[i:], uint32(0x1000-i%0x2000))
+			i += 4
+		}
+	}
+	filtered := append([]byte(nil), code...)
+	lzmstest.X86Filter(filtered)
+	if bytes.Equal(filtered, code) {
+		t.Fatal("nothing was translated")
+	}
+	undoX86Filter(filtered)
+	if !bytes.Equal(filtered, code) {
+		t.Error("x86 filter was not undone")
+	}
+}
+
+func TestDecompressCompressed(t *testing.T) {
+	var data []byte
+	for i := 0; len(data) < 100000; i++ {
+		data = append(data, fmt.Sprintf("line %d: call \xe8%c\x01\x00\x00 target\n", i, byte(i%7))...)
+	}
+	in := lzmstest.Compress(data)
+	if len(in) >= len(data)/2 {
+		t.Fatalf("poor compression: %d bytes from %d", len(in), len(data))
+	}
+	r, err := NewReader(bytes.NewReader(in), len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("content mismatch")
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	encode := func(size int, items ...lzmstest.Item) []byte {
+		e := lzmstest.NewEncoder(size)
+		for _, it := range items {
+			e.Encode(it)
+		}
+		return e.Finish()
+	}
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		size int
+	}{
+		{"empty", nil, 10},
+		{"short", []byte{0, 0}, 10},
+		{"odd", make([]byte, 7), 10},
+		{"offset before start", encode(10, literals("a")[0], lz(2, 9)), 10},
+		{"delta before start", encode(10, literals("ab")[0], delta(0, 1, 8)), 10},
+		{"repeat before start", encode(10, literals("ab")[0], lzRep(3, 8)), 10},
+		{"length past end", encode(10, literals("a")[0], lz(1, 10)), 10},
+	} {
+		if _, err := decompress(t, tc.in, tc.size); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+
+	data := make([]byte, 50000)
+	for i := range data {
+		data[i] = "abcdefgh"[i%8] + byte(i/8%3)
+	}
+	in := lzmstest.Compress(data)
+	for n := 0; n < len(in); n += 2 {
+		if got, err := decompress(t, in[:n], len(data)); err == nil && bytes.Equal(got, data) {
+			t.Fatalf("truncated to %d bytes: no error", n)
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	bad := make([]byte, len(in))
+	for i := 0; i < 1000; i++ {
+		copy(bad, in)
+		for j := rng.Intn(4); j >= 0; j-- {
+			bad[rng.Intn(len(bad))] ^= byte(1 + rng.Intn(255))
+		}
+		decompress(t, bad, len(data))
+	}
+	for i := 0; i < 200; i++ {
+		bad := make([]byte, 2*rng.Intn(200))
+		rng.Read(bad)
+		decompress(t, bad, 1+rng.Intn(4096))
+	}
+}
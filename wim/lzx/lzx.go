@@ -1,5 +1,5 @@
-// Package lzx implements a decompressor for the the WIM variant of the
-// LZX compression algorithm.
+// Package lzx implements a compressor and decompressor for the WIM variant
+// of the LZX compression algorithm.
 //
 // The LZX algorithm is an earlier variant of LZX DELTA, which is documented
 // at https://msdn.microsoft.com/en-us/library/cc483133(v=exchg.80).aspx.
@@ -9,20 +9,23 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
 const (
-	maincodecount = 496
 	maincodesplit = 256
 	lencodecount  = 249
-	lenshift      = 9
-	codemask      = 0x1ff
+	lenshift      = 10
+	codemask      = 0x3ff
 	tablebits     = 9
 	tablesize     = 1 << tablebits
 
-	maxBlockSize = 32768
-	windowSize   = 32768
+	defaultBlockSize = 32768
+	windowSize       = 32768 // the default window size
+	maxWindowSize    = 1 << 21
+	maxPositionSlots = 50 // position slots for a 2MB window
+	maxFooterBits    = 17
 
 	maxTreePathLen = 16
 
@@ -34,18 +37,35 @@ const (
 	uncompressedBlock  = 3
 )
 
-var footerBits = [...]byte{
-	0, 0, 0, 0, 1, 1, 2, 2,
-	3, 3, 4, 4, 5, 5, 6, 6,
-	7, 7, 8, 8, 9, 9, 10, 10,
-	11, 11, 12, 12, 13, 13, 14,
+// footerBits is the number of footer bits of each position slot, and
+// basePosition the first formatted offset it encodes.
+var (
+	footerBits   [maxPositionSlots + 1]byte
+	basePosition [maxPositionSlots + 1]uint32
+)
+
+func init() {
+	for i := range footerBits {
+		if i >= 4 {
+			footerBits[i] = byte(i-2) / 2
+			if footerBits[i] > maxFooterBits {
+				footerBits[i] = maxFooterBits
+			}
+		}
+		if i > 0 {
+			basePosition[i] = basePosition[i-1] + 1<<footerBits[i-1]
+		}
+	}
 }
 
-var basePosition = [...]uint16{
-	0, 1, 2, 3, 4, 6, 8, 12,
-	16, 24, 32, 48, 64, 96, 128, 192,
-	256, 384, 512, 768, 1024, 1536, 2048, 3072,
-	4096, 6144, 8192, 12288, 16384, 24576, 32768,
+// positionSlotCount returns the number of position slots needed to address
+// offsets within a window of the given size.
+func positionSlotCount(window int) int {
+	n := 0
+	for int(basePosition[n]) < window {
+		n++
+	}
+	return n
 }
 
 var (
@@ -66,12 +86,12 @@ type decompressor struct {
 	unaligned    bool
 	nbits        byte
 	c            uint32
-	lru          [3]uint16
+	lru          [3]uint32
 	uncompressed int
 	windowReader *bytes.Reader
-	mainlens     [maincodecount]byte
+	mainlens     []byte
 	lenlens      [lencodecount]byte
-	window       [windowSize]byte
+	window       []byte
 	b            []byte
 	bv           int
 	bo           int
@@ -322,7 +342,17 @@ func (f *decompressor) readTree(lens []byte) error {
 	return nil
 }
 
-func (f *decompressor) readBlockHeader() (byte, uint16, error) {
+// getFooter retrieves the next n bits from the byte stream, like getBits,
+// but n may be up to maxFooterBits.
+func (f *decompressor) getFooter(n byte) uint32 {
+	if n > 16 {
+		hi := uint32(f.getBits(n - 16))
+		return hi<<16 | uint32(f.getBits(16))
+	}
+	return uint32(f.getBits(n))
+}
+
+func (f *decompressor) readBlockHeader() (byte, int, error) {
 	// If the previous block was an unaligned uncompressed block, restore
 	// 2-byte alignment.
 	if f.unaligned {
@@ -336,12 +366,16 @@ func (f *decompressor) readBlockHeader() (byte, uint16, error) {
 
 	blockType := f.getBits(3)
 	full := f.getBits(1)
-	var blockSize uint16
+	var blockSize int
 	if full != 0 {
-		blockSize = maxBlockSize
+		blockSize = defaultBlockSize
 	} else {
-		blockSize = f.getBits(16)
-		if blockSize > maxBlockSize {
+		blockSize = int(f.getBits(16))
+		if len(f.window) > windowSize {
+			// Larger windows use 24-bit block sizes.
+			blockSize = blockSize<<8 | int(f.getBits(8))
+		}
+		if blockSize > len(f.window) {
 			return 0, 0, errCorrupt
 		}
 	}
@@ -373,9 +407,9 @@ func (f *decompressor) readBlockHeader() (byte, uint16, error) {
 			return 0, 0, err
 		}
 
-		f.lru[0] = uint16(binary.LittleEndian.Uint32(f.b[f.bo : f.bo+4]))
-		f.lru[1] = uint16(binary.LittleEndian.Uint32(f.b[f.bo+4 : f.bo+8]))
-		f.lru[2] = uint16(binary.LittleEndian.Uint32(f.b[f.bo+8 : f.bo+12]))
+		f.lru[0] = binary.LittleEndian.Uint32(f.b[f.bo : f.bo+4])
+		f.lru[1] = binary.LittleEndian.Uint32(f.b[f.bo+4 : f.bo+8])
+		f.lru[2] = binary.LittleEndian.Uint32(f.b[f.bo+8 : f.bo+12])
 		f.bo += 12
 
 	default:
@@ -431,7 +465,7 @@ func (f *decompressor) readTrees(readAligned bool) (main *huffman, length *huffm
 
 // readCompressedBlock decodes a compressed block, writing into the window
 // starting at start and ending at end, and using the provided huffman trees.
-func (f *decompressor) readCompressedBlock(start, end uint16, hmain, hlength, haligned *huffman) (int, error) {
+func (f *decompressor) readCompressedBlock(start, end int, hmain, hlength, haligned *huffman) (int, error) {
 	i := start
 	for i < end {
 		main := f.getCode(hmain)
@@ -447,17 +481,17 @@ func (f *decompressor) readCompressedBlock(start, end uint16, hmain, hlength, ha
 
 		// This is a match backward in the window. Determine
 		// the offset and dlength.
-		matchlen := (main - 256) % 8
+		matchlen := int((main - 256) % 8)
 		slot := (main - 256) / 8
 
 		// The length is either the low bits of the code,
 		// or if this is 7, is encoded with the length tree.
 		if matchlen == 7 {
-			matchlen += f.getCode(hlength)
+			matchlen += int(f.getCode(hlength))
 		}
 		matchlen += 2
 
-		var matchoffset uint16
+		var matchoffset uint32
 		if slot < 3 { //nolint:nestif // todo: simplify nested complexity
 			// The offset is one of the LRU values.
 			matchoffset = f.lru[slot]
@@ -467,18 +501,18 @@ func (f *decompressor) readCompressedBlock(start, end uint16, hmain, hlength, ha
 			// The offset is encoded as a combination of the
 			// slot and more bits from the bit stream.
 			offsetbits := footerBits[slot]
-			var verbatimbits, alignedbits uint16
+			var verbatimbits, alignedbits uint32
 			if offsetbits > 0 {
 				if haligned != nil && offsetbits >= 3 {
 					// This is an aligned offset block. Combine
 					// the bits written verbatim with the aligned
 					// offset tree code.
-					verbatimbits = f.getBits(offsetbits-3) * 8
-					alignedbits = f.getCode(haligned)
+					verbatimbits = f.getFooter(offsetbits-3) * 8
+					alignedbits = uint32(f.getCode(haligned))
 				} else {
 					// There are no aligned offset bits to read,
 					// only verbatim bits.
-					verbatimbits = f.getBits(offsetbits)
+					verbatimbits = f.getFooter(offsetbits)
 					alignedbits = 0
 				}
 			}
@@ -489,25 +523,28 @@ func (f *decompressor) readCompressedBlock(start, end uint16, hmain, hlength, ha
 			f.lru[0] = matchoffset
 		}
 
-		if matchoffset <= i && matchlen <= end-i {
+		if matchoffset <= uint32(i) && matchlen <= end-i {
 			copyend := i + matchlen
 			for ; i < copyend; i++ {
-				f.window[i] = f.window[i-matchoffset]
+				f.window[i] = f.window[i-int(matchoffset)]
 			}
 		} else {
 			f.fail(errCorrupt)
 			break
 		}
 	}
-	return int(i - start), f.err
+	return i - start, f.err
 }
 
 // readBlock decodes the current block and returns the number of uncompressed bytes.
-func (f *decompressor) readBlock(start uint16) (int, error) {
+func (f *decompressor) readBlock(start int) (int, error) {
 	blockType, size, err := f.readBlockHeader()
 	if err != nil {
 		return 0, err
 	}
+	if start+size > len(f.window) {
+		return 0, errCorrupt
+	}
 
 	if blockType == uncompressedBlock {
 		if size%2 == 1 {
@@ -516,15 +553,14 @@ func (f *decompressor) readBlock(start uint16) (int, error) {
 		}
 		copied := 0
 		if f.bo < f.bv {
-			copied = int(size)
-			s := int(start)
+			copied = size
 			if copied > f.bv-f.bo {
 				copied = f.bv - f.bo
 			}
-			copy(f.window[s:s+copied], f.b[f.bo:f.bo+copied])
+			copy(f.window[start:start+copied], f.b[f.bo:f.bo+copied])
 			f.bo += copied
 		}
-		n, err := io.ReadFull(f.r, f.window[start+uint16(copied):start+size])
+		n, err := io.ReadFull(f.r, f.window[start+copied:start+size])
 		return copied + n, err
 	}
 
@@ -565,7 +601,7 @@ func (f *decompressor) Read(b []byte) (int, error) {
 	if f.windowReader == nil {
 		n := 0
 		for n < f.uncompressed {
-			k, err := f.readBlock(uint16(n))
+			k, err := f.readBlock(n)
 			if err != nil {
 				return 0, err
 			}
@@ -586,12 +622,24 @@ func (*decompressor) Close() error {
 // NewReader returns a new io.ReadCloser that decompresses a
 // WIM LZX stream until uncompressedSize bytes have been returned.
 func NewReader(r io.Reader, uncompressedSize int) (io.ReadCloser, error) {
-	if uncompressedSize > windowSize {
-		return nil, errors.New("uncompressed size is limited to 32KB")
+	return NewReaderSize(r, uncompressedSize, windowSize)
+}
+
+// NewReaderSize is like NewReader, but decompresses a stream compressed with
+// the given window size, which is the WIM's chunk size. It must be a power
+// of two between 32KB and 2MB.
+func NewReaderSize(r io.Reader, uncompressedSize int, window int) (io.ReadCloser, error) {
+	if window < windowSize || window > maxWindowSize || window&(window-1) != 0 {
+		return nil, fmt.Errorf("unsupported window size %d", window)
+	}
+	if uncompressedSize > window {
+		return nil, fmt.Errorf("uncompressed size is limited to the window size %d", window)
 	}
 	f := &decompressor{
-		lru:          [3]uint16{1, 1, 1},
+		lru:          [3]uint32{1, 1, 1},
 		uncompressed: uncompressedSize,
+		mainlens:     make([]byte, maincodesplit+8*positionSlotCount(window)),
+		window:       make([]byte, window),
 		b:            make([]byte, 4096),
 		r:            r,
 	}
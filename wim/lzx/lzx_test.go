@@ -0,0 +1,262 @@
+package lzx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func compressChunk(t *testing.T, b []byte, level int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testInputs() map[string][]byte {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 20001)
+	rng.Read(random)
+
+	var text bytes.Buffer
+	words := []string{"the", "quick", "brown", "fox", "jumps", "over", "lazy", "dog", "WIM", "image"}
+	for text.Len() < windowSize {
+		text.WriteString(words[rng.Intn(len(words))])
+		text.WriteByte(' ')
+	}
+
+	// x86-like code with call instructions whose targets are translated.
+	var code bytes.Buffer
+	for code.Len() < windowSize-5 {
+		code.WriteByte(0xe8)
+		_ = binary.Write(&code, binary.LittleEndian, int32(rng.Intn(4096)-2048))
+		code.Write([]byte{0x90, 0x48, 0x89, 0xc3})
+	}
+
+	// Repeated 16-byte records, so match offsets are multiples of 16 and
+	// favor an aligned offset block.
+	pool := make([]byte, 16*500)
+	rng.Read(pool)
+	var records bytes.Buffer
+	for records.Len() < windowSize {
+		n := rng.Intn(500)
+		records.Write(pool[n*16 : n*16+16])
+	}
+
+	return map[string][]byte{
+		"records":   records.Bytes(),
+		"one byte":  {'a'},
+		"short":     []byte("abcabcabcabcabcabcabc"),
+		"random":    random,
+		"text":      text.Bytes()[:windowSize],
+		"text odd":  text.Bytes()[:12345],
+		"zeroes":    make([]byte, windowSize),
+		"long runs": bytes.Repeat(append(bytes.Repeat([]byte{'x'}, 300), bytes.Repeat([]byte{'y'}, 1000)...), 20),
+		"code":      code.Bytes()[:windowSize-5],
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, in := range testInputs() {
+		for level := DefaultCompression; level <= BestCompression; level++ {
+			t.Run(fmt.Sprintf("%s/%d", name, level), func(t *testing.T) {
+				c := compressChunk(t, in, level)
+				r, err := NewReader(bytes.NewReader(c), len(in))
+				if err != nil {
+					t.Fatal(err)
+				}
+				out, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(out, in) {
+					t.Fatalf("round trip mismatch for %d bytes compressed to %d", len(in), len(c))
+				}
+				if len(c) > uncompressedBlockSize(len(in)) {
+					t.Errorf("compressed size %d larger than an uncompressed block", len(c))
+				}
+			})
+		}
+	}
+}
+
+func TestCompressionLevels(t *testing.T) {
+	in := testInputs()["text"]
+	fast := len(compressChunk(t, in, BestSpeed))
+	best := len(compressChunk(t, in, BestCompression))
+	if best > fast || fast >= len(in)/2 {
+		t.Errorf("unexpected compressed sizes: best speed %d, best compression %d", fast, best)
+	}
+}
+
+func TestAlignedOffsetBlock(t *testing.T) {
+	c := compressChunk(t, testInputs()["records"], DefaultCompression)
+	// The block type is in the top 3 bits of the first 16-bit word.
+	if blockType := c[1] >> 5; blockType != alignedOffsetBlock {
+		t.Errorf("expected aligned offset block, got block type %d", blockType)
+	}
+}
+
+func TestE8RoundTrip(t *testing.T) {
+	in := testInputs()["code"]
+	b := append([]byte(nil), in...)
+	encodeE8(b, 0)
+	if bytes.Equal(b, in) {
+		t.Fatal("no translation performed")
+	}
+	decodeE8(b, 0)
+	if !bytes.Equal(b, in) {
+		t.Fatal("translation is not reversible")
+	}
+}
+
+func TestWriterLimit(t *testing.T) {
+	w, err := NewWriter(io.Discard, DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, windowSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte{0}); err == nil {
+		t.Error("expected error writing more than 32KB")
+	}
+	if _, err := NewWriter(io.Discard, 10); err == nil {
+		t.Error("expected error for invalid level")
+	}
+}
+
+func TestHuffmanLengths(t *testing.T) {
+	// Fibonacci frequencies produce a maximally deep tree.
+	freqs := make([]uint32, 30)
+	a, b := uint32(1), uint32(1)
+	for i := range freqs {
+		freqs[i] = a
+		a, b = b, a+b
+	}
+	lens := huffmanLengths(freqs, 7)
+	var kraft float64
+	for _, l := range lens {
+		if l == 0 || l > 7 {
+			t.Fatalf("invalid length %d", l)
+		}
+		kraft += 1 / float64(uint(1)<<l)
+	}
+	if kraft != 1 {
+		t.Errorf("code is not complete: %v", kraft)
+	}
+	if h := buildTable(lens); h == nil {
+		t.Error("decoder rejected code lengths")
+	}
+}
+
+func TestWindowSizes(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for _, window := range []int{windowSize, 1 << 16, 1 << 20, maxWindowSize} {
+		// A random block repeated once, so matches reach back half the window.
+		half := make([]byte, window/2-1)
+		rng.Read(half)
+		in := append(append([]byte(nil), half...), half...)
+		for _, level := range []int{NoCompression, BestSpeed, DefaultCompression} {
+			t.Run(fmt.Sprintf("%d/%d", window, level), func(t *testing.T) {
+				var buf bytes.Buffer
+				w, err := NewWriterSize(&buf, level, window)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := w.Write(in); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if level == DefaultCompression && buf.Len() > len(in)*3/4 {
+					t.Errorf("long-distance match not found: compressed %d bytes to %d", len(in), buf.Len())
+				}
+				r, err := NewReaderSize(&buf, len(in), window)
+				if err != nil {
+					t.Fatal(err)
+				}
+				out, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(out, in) {
+					t.Fatal("round trip mismatch")
+				}
+			})
+		}
+	}
+	for _, window := range []int{1 << 14, 3 << 15, 1 << 22} {
+		if _, err := NewReaderSize(bytes.NewReader(nil), 0, window); err == nil {
+			t.Errorf("expected error for window size %d", window)
+		}
+		if _, err := NewWriterSize(io.Discard, DefaultCompression, window); err == nil {
+			t.Errorf("expected error for window size %d", window)
+		}
+	}
+}
+
+// TestLargeWindowVector decodes a hand-assembled stream for a 64KB window,
+// built without the compressor. It has two blocks:
+//
+//   - An uncompressed block of 45000 bytes, whose size takes 24 bits since
+//     the window is larger than 32KB: type 3, not full-sized, 0x00af and
+//     0xc8, four bits of padding, then R0-R2 and the data.
+//   - A verbatim block of 258 bytes (0x0001, 0x02). Each tree is sent with a
+//     pre-tree giving symbols 0, 16, 17 and 18 two-bit codes. The main tree
+//     has 256 + 8*32 symbols, since a 64KB window has 32 position slots;
+//     only '!' and 503 (slot 30, length header 7) have one-bit codes. The
+//     length tree gives one-bit codes to 247 and 248. The block holds a
+//     match (main 503, length 248, 14 footer bits 7234) of length 257 at
+//     offset 32768 + 7234 - 2 = 40000, then a literal '!'.
+func TestLargeWindowVector(t *testing.T) {
+	const (
+		window  = 1 << 16
+		rawSize = 45000
+	)
+	in, err := hex.DecodeString("0a6080fc" + "010000000100000001000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, rawSize)
+	for i := range want {
+		want[i] = 'a' + byte(i%23+i/1000%3)
+	}
+	in = append(in, want...)
+	verbatim, err := hex.DecodeString("0020221000000000000002000d22ffafffff40dc0000000000004400" +
+		"ff41ffffd9fd00080000000000008808ff3fffffeeba0021")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in = append(in, verbatim...)
+	for i := 0; i < 257; i++ {
+		want = append(want, want[len(want)-40000])
+	}
+	want = append(want, '!')
+
+	r, err := NewReaderSize(bytes.NewReader(in), len(want), window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, want) {
+		t.Error("content mismatch")
+	}
+}
@@ -0,0 +1,657 @@
+package lzx
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Compression levels accepted by NewWriter.
+const (
+	NoCompression      = 0
+	BestSpeed          = 1
+	BestCompression    = 9
+	DefaultCompression = -1
+)
+
+const (
+	minMatch     = 2
+	maxMatch     = 257
+	pretreeCount = 20
+	alignedCount = 8
+
+	hashBits = 15
+
+	// Maximum code lengths, limited by the decoder or by the number of bits
+	// used to store the lengths.
+	maxMainCodeLen    = maxTreePathLen
+	maxPretreeCodeLen = 15
+	maxAlignedCodeLen = 7
+)
+
+// levelParams controls the effort spent searching for matches.
+type levelParams struct {
+	chain int  // the maximum number of hash chain entries to search
+	nice  int  // stop searching when a match of this length is found
+	lazy  bool // check whether the next position has a longer match
+}
+
+var levels = [...]levelParams{
+	1: {chain: 4, nice: 8},
+	2: {chain: 8, nice: 16},
+	3: {chain: 16, nice: 32},
+	4: {chain: 16, nice: 32, lazy: true},
+	5: {chain: 32, nice: 64, lazy: true},
+	6: {chain: 64, nice: 128, lazy: true},
+	7: {chain: 128, nice: maxMatch, lazy: true},
+	8: {chain: 512, nice: maxMatch, lazy: true},
+	9: {chain: 4096, nice: maxMatch, lazy: true},
+}
+
+// Writer compresses data into a single WIM LZX chunk. Each chunk holds at
+// most one window of uncompressed data, 32KB by default, and can be
+// decompressed independently with NewReader or NewReaderSize. The compressed
+// chunk is written by Close.
+type Writer struct {
+	w      io.Writer
+	level  int
+	window int
+	buf    []byte
+	closed bool
+}
+
+// NewWriter returns a new Writer that compresses data written to it at the
+// given level, which is either DefaultCompression or an integer between
+// NoCompression and BestCompression. Higher levels search harder for
+// matches; NoCompression stores the data in an uncompressed block.
+func NewWriter(w io.Writer, level int) (*Writer, error) {
+	return NewWriterSize(w, level, windowSize)
+}
+
+// NewWriterSize is like NewWriter, but compresses with the given window
+// size, which is the WIM's chunk size. It must be a power of two between
+// 32KB and 2MB.
+func NewWriterSize(w io.Writer, level int, window int) (*Writer, error) {
+	if level < DefaultCompression || level > BestCompression {
+		return nil, fmt.Errorf("lzx: invalid compression level %d", level)
+	}
+	if window < windowSize || window > maxWindowSize || window&(window-1) != 0 {
+		return nil, fmt.Errorf("lzx: unsupported window size %d", window)
+	}
+	if level == DefaultCompression {
+		level = 6
+	}
+	return &Writer{w: w, level: level, window: window, buf: make([]byte, 0, window)}, nil
+}
+
+// Write buffers b for compression. It fails if the total amount of data
+// written exceeds the window size.
+func (w *Writer) Write(b []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("lzx: write to closed writer")
+	}
+	if len(b) > w.window-len(w.buf) {
+		return 0, fmt.Errorf("uncompressed size is limited to the window size %d", w.window)
+	}
+	w.buf = append(w.buf, b...)
+	return len(b), nil
+}
+
+// Close compresses the buffered data and writes it to the underlying writer.
+// It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	_, err := w.w.Write(compress(w.buf, w.level, w.window))
+	return err
+}
+
+// Reset discards the Writer's state and makes it equivalent to the result of
+// NewWriterSize with dst and the original level and window size.
+func (w *Writer) Reset(dst io.Writer) {
+	w.w = dst
+	w.buf = w.buf[:0]
+	w.closed = false
+}
+
+// compress returns the LZX encoding of b, which must be at most window bytes
+// long.
+func compress(b []byte, level int, window int) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	encodeE8(data, 0)
+
+	if level != NoCompression {
+		items := parse(data, levels[level], window)
+		out := encodeBlock(len(data), items, window)
+		if len(out) < uncompressedBlockSize(len(data)) {
+			return out
+		}
+	}
+	return encodeUncompressedBlock(data, window)
+}
+
+// encodeE8 performs the 0xe8 x86 instruction translation that decodeE8
+// reverses, converting relative call targets to absolute ones.
+func encodeE8(b []byte, off int64) {
+	if off > maxe8offset || len(b) < 10 {
+		return
+	}
+	for i := 0; i < len(b)-10; i++ {
+		if b[i] == 0xe8 {
+			currentPtr := int32(off) + int32(i)
+			rel := int32(binary.LittleEndian.Uint32(b[i+1 : i+5]))
+			if rel >= -currentPtr && rel < e8filesize {
+				var abs int32
+				if rel < e8filesize-currentPtr {
+					abs = rel + currentPtr
+				} else {
+					abs = rel - e8filesize
+				}
+				binary.LittleEndian.PutUint32(b[i+1:i+5], uint32(abs))
+			}
+			i += 4
+		}
+	}
+}
+
+// bitWriter writes bits most significant bit first into 16-bit little-endian
+// words, as read by the decompressor.
+type bitWriter struct {
+	out []byte
+	acc uint32
+	n   uint // the number of bits in acc, always < 16 between calls
+}
+
+// writeBits writes the low n bits of v. n must be <= 16.
+func (bw *bitWriter) writeBits(v uint32, n uint) {
+	bw.acc = bw.acc<<n | v&(1<<n-1)
+	bw.n += n
+	if bw.n >= 16 {
+		word := uint16(bw.acc >> (bw.n - 16))
+		bw.out = append(bw.out, byte(word), byte(word>>8))
+		bw.n -= 16
+		bw.acc &= 1<<bw.n - 1
+	}
+}
+
+// flush pads the output with zero bits to a 16-bit boundary.
+func (bw *bitWriter) flush() {
+	if bw.n != 0 {
+		bw.writeBits(0, 16-bw.n)
+	}
+}
+
+// writeFooter is like writeBits, but n may be up to maxFooterBits.
+func (bw *bitWriter) writeFooter(v uint32, n uint) {
+	if n > 16 {
+		bw.writeBits(v>>16, n-16)
+		n = 16
+	}
+	bw.writeBits(v, n)
+}
+
+func (bw *bitWriter) writeBlockHeader(blockType byte, size int, window int) {
+	bw.writeBits(uint32(blockType), 3)
+	if size == defaultBlockSize {
+		bw.writeBits(1, 1)
+	} else if window > windowSize {
+		bw.writeBits(0, 1)
+		bw.writeBits(uint32(size>>8), 16)
+		bw.writeBits(uint32(size), 8)
+	} else {
+		bw.writeBits(0, 1)
+		bw.writeBits(uint32(size), 16)
+	}
+}
+
+func uncompressedBlockSize(n int) int {
+	return 4 + 12 + n + n%2
+}
+
+func encodeUncompressedBlock(b []byte, window int) []byte {
+	var bw bitWriter
+	bw.writeBlockHeader(uncompressedBlock, len(b), window)
+	// The decompressor discards a full 16-bit word if the header ends on a
+	// word boundary.
+	if bw.n == 0 {
+		bw.writeBits(0, 16)
+	}
+	bw.flush()
+	// The initial LRU values.
+	var lru [12]byte
+	for i := 0; i < 3; i++ {
+		binary.LittleEndian.PutUint32(lru[i*4:], 1)
+	}
+	out := append(bw.out, lru[:]...)
+	out = append(out, b...)
+	if len(b)%2 != 0 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// item is a literal or a match, encoded as the symbols and extra bits that
+// represent it.
+type item struct {
+	main       uint16 // main tree symbol
+	length     int16  // length tree symbol, or -1
+	footer     uint32 // position footer bits
+	footerBits byte
+}
+
+func positionSlot(formatted int) int {
+	return sort.Search(maxPositionSlots, func(i int) bool { return int(basePosition[i]) > formatted }) - 1
+}
+
+// matchItem encodes a match, updating the LRU offsets as the decompressor
+// does.
+func matchItem(length, offset int, lru *[3]int) item {
+	var it item
+	var slot int
+	switch offset {
+	case lru[0]:
+		slot = 0
+	case lru[1]:
+		slot = 1
+		lru[0], lru[1] = lru[1], lru[0]
+	case lru[2]:
+		slot = 2
+		lru[0], lru[2] = lru[2], lru[0]
+	default:
+		formatted := offset + 2
+		slot = positionSlot(formatted)
+		it.footer = uint32(formatted) - basePosition[slot]
+		it.footerBits = footerBits[slot]
+		lru[2], lru[1], lru[0] = lru[1], lru[0], offset
+	}
+	lh := length - minMatch
+	it.length = -1
+	if lh >= 7 {
+		it.length = int16(lh - 7)
+		lh = 7
+	}
+	it.main = uint16(maincodesplit + slot*8 + lh)
+	return it
+}
+
+// matchFinder finds matches using hash chains of 3-byte sequences.
+type matchFinder struct {
+	b         []byte
+	p         levelParams
+	maxOffset int // the largest offset that fits in the last position slot
+	head      [1 << hashBits]int32
+	prev      []int32
+}
+
+func (m *matchFinder) hash(i int) uint32 {
+	v := uint32(m.b[i])<<16 | uint32(m.b[i+1])<<8 | uint32(m.b[i+2])
+	return v * 2654435761 >> (32 - hashBits)
+}
+
+func (m *matchFinder) insert(i int) {
+	if i+2 < len(m.b) {
+		h := m.hash(i)
+		m.prev[i] = m.head[h]
+		m.head[h] = int32(i)
+	}
+}
+
+func (m *matchFinder) matchLen(from, i, max int) int {
+	n := 0
+	for n < max && m.b[from+n] == m.b[i+n] {
+		n++
+	}
+	return n
+}
+
+// find returns the length and offset of the best match at position i, or a
+// length of 0 if there is none. Matches at one of the LRU offsets are
+// preferred, since they are cheaper to encode.
+func (m *matchFinder) find(i int, lru *[3]int) (int, int) {
+	max := len(m.b) - i
+	if max > maxMatch {
+		max = maxMatch
+	}
+	if max < minMatch {
+		return 0, 0
+	}
+
+	var repLen, repOffset int
+	for _, offset := range lru {
+		if offset <= i {
+			if n := m.matchLen(i-offset, i, max); n > repLen {
+				repLen, repOffset = n, offset
+			}
+		}
+	}
+
+	var bestLen, bestOffset int
+	if i+2 < len(m.b) {
+		c := int(m.head[m.hash(i)])
+		for depth := m.p.chain; c >= 0 && depth > 0 && i-c <= m.maxOffset; depth-- {
+			if m.b[c+bestLen] == m.b[i+bestLen] {
+				if n := m.matchLen(c, i, max); n > bestLen {
+					bestLen, bestOffset = n, i-c
+					if n >= m.p.nice || n == max {
+						break
+					}
+				}
+			}
+			c = int(m.prev[c])
+		}
+	}
+	if bestLen < 3 {
+		bestLen = 0
+	}
+
+	if repLen >= minMatch && repLen+1 >= bestLen {
+		return repLen, repOffset
+	}
+	return bestLen, bestOffset
+}
+
+// parse splits b into literals and matches.
+func parse(b []byte, p levelParams, window int) []item {
+	m := &matchFinder{b: b, p: p, maxOffset: window - 3, prev: make([]int32, len(b))}
+	for i := range m.head {
+		m.head[i] = -1
+	}
+	lru := [3]int{1, 1, 1}
+	items := make([]item, 0, len(b)/2)
+
+	i := 0
+	length, offset := m.find(i, &lru)
+	m.insert(i)
+	for i < len(b) {
+		if length == 0 {
+			items = append(items, item{main: uint16(b[i]), length: -1})
+			i++
+			if i < len(b) {
+				length, offset = m.find(i, &lru)
+				m.insert(i)
+			}
+			continue
+		}
+
+		inserted := i + 1
+		if p.lazy && length < p.nice && i+1 < len(b) {
+			nextLength, nextOffset := m.find(i+1, &lru)
+			m.insert(i + 1)
+			inserted++
+			if nextLength > length {
+				items = append(items, item{main: uint16(b[i]), length: -1})
+				i++
+				length, offset = nextLength, nextOffset
+				continue
+			}
+		}
+
+		items = append(items, matchItem(length, offset, &lru))
+		for ; inserted < i+length; inserted++ {
+			m.insert(inserted)
+		}
+		i += length
+		length = 0
+		if i < len(b) {
+			length, offset = m.find(i, &lru)
+			m.insert(i)
+		}
+	}
+	return items
+}
+
+// encodeBlock encodes items, which decode to n bytes, as a single verbatim
+// or aligned offset block, whichever is smaller.
+func encodeBlock(n int, items []item, window int) []byte {
+	mainCount := maincodesplit + 8*positionSlotCount(window)
+	mainFreqs := make([]uint32, mainCount)
+	var lenFreqs [lencodecount]uint32
+	var alignedFreqs [alignedCount]uint32
+	for _, it := range items {
+		mainFreqs[it.main]++
+		if it.length >= 0 {
+			lenFreqs[it.length]++
+		}
+		if it.footerBits >= 3 {
+			alignedFreqs[it.footer&7]++
+		}
+	}
+	mainLens := huffmanLengths(mainFreqs, maxMainCodeLen)
+	lenLens := huffmanLengths(lenFreqs[:], maxMainCodeLen)
+	alignedLens := huffmanLengths(alignedFreqs[:], maxAlignedCodeLen)
+
+	// The aligned offset tree replaces the low 3 footer bits of each offset
+	// with at least 3 footer bits, and costs 24 bits to store.
+	aligned := false
+	alignedCost := 8 * 3
+	for i, f := range alignedFreqs {
+		alignedCost += int(f) * (int(alignedLens[i]) - 3)
+	}
+	if alignedCost < 0 {
+		aligned = true
+	}
+
+	var bw bitWriter
+	if aligned {
+		bw.writeBlockHeader(alignedOffsetBlock, n, window)
+		for _, l := range alignedLens {
+			bw.writeBits(uint32(l), 3)
+		}
+	} else {
+		bw.writeBlockHeader(verbatimBlock, n, window)
+	}
+	zero := make([]byte, mainCount)
+	writeTree(&bw, mainLens[:maincodesplit], zero[:maincodesplit])
+	writeTree(&bw, mainLens[maincodesplit:], zero[maincodesplit:])
+	writeTree(&bw, lenLens, zero[:lencodecount])
+
+	mainCodes := canonicalCodes(mainLens)
+	lenCodes := canonicalCodes(lenLens)
+	alignedCodes := canonicalCodes(alignedLens)
+	for _, it := range items {
+		bw.writeBits(uint32(mainCodes[it.main]), uint(mainLens[it.main]))
+		if it.length >= 0 {
+			bw.writeBits(uint32(lenCodes[it.length]), uint(lenLens[it.length]))
+		}
+		if aligned && it.footerBits >= 3 {
+			bw.writeFooter(it.footer>>3, uint(it.footerBits-3))
+			bw.writeBits(uint32(alignedCodes[it.footer&7]), uint(alignedLens[it.footer&7]))
+		} else if it.footerBits > 0 {
+			bw.writeFooter(it.footer, uint(it.footerBits))
+		}
+	}
+	bw.flush()
+	return bw.out
+}
+
+// treeSymbol is a pretree symbol with its extra bits.
+type treeSymbol struct {
+	sym       byte
+	extra     uint16
+	extraBits byte
+}
+
+// writeTree writes the code lengths lens as a pretree followed by pretree
+// symbols, as read by readTree. prev holds the lengths the decompressor
+// starts from.
+func writeTree(bw *bitWriter, lens, prev []byte) {
+	delta := func(i int, l byte) treeSymbol {
+		return treeSymbol{sym: (prev[i] + 17 - l) % 17}
+	}
+	var syms []treeSymbol
+	for i := 0; i < len(lens); {
+		l := lens[i]
+		run := 1
+		for i+run < len(lens) && lens[i+run] == l {
+			run++
+		}
+		switch {
+		case l == 0 && run >= 4:
+			for run >= 20 {
+				k := run
+				if k > 51 {
+					k = 51
+				}
+				syms = append(syms, treeSymbol{sym: 18, extra: uint16(k - 20), extraBits: 5})
+				i += k
+				run -= k
+			}
+			if run >= 4 {
+				syms = append(syms, treeSymbol{sym: 17, extra: uint16(run - 4), extraBits: 4})
+				i += run
+			}
+		case run >= 4:
+			k := run
+			if k > 5 {
+				k = 5
+			}
+			syms = append(syms, treeSymbol{sym: 19, extra: uint16(k - 4), extraBits: 1}, delta(i, l))
+			i += k
+		default:
+			syms = append(syms, delta(i, l))
+			i++
+		}
+	}
+
+	var freqs [pretreeCount]uint32
+	for _, s := range syms {
+		freqs[s.sym]++
+	}
+	pretreeLens := huffmanLengths(freqs[:], maxPretreeCodeLen)
+	for _, l := range pretreeLens {
+		bw.writeBits(uint32(l), 4)
+	}
+	codes := canonicalCodes(pretreeLens)
+	for _, s := range syms {
+		bw.writeBits(uint32(codes[s.sym]), uint(pretreeLens[s.sym]))
+		if s.extraBits != 0 {
+			bw.writeBits(uint32(s.extra), uint(s.extraBits))
+		}
+	}
+}
+
+// huffmanLengths returns the code lengths of a huffman code for symbols with
+// the given frequencies, with no code longer than maxLen. The code is
+// complete, as the decompressor requires, unless no symbol is used.
+func huffmanLengths(freqs []uint32, maxLen byte) []byte {
+	lens := make([]byte, len(freqs))
+	var syms []int
+	for i, f := range freqs {
+		if f != 0 {
+			syms = append(syms, i)
+		}
+	}
+	switch len(syms) {
+	case 0:
+		return lens
+	case 1:
+		// A complete code needs at least two symbols.
+		lens[syms[0]] = 1
+		if syms[0] == 0 {
+			lens[1] = 1
+		} else {
+			lens[0] = 1
+		}
+		return lens
+	}
+
+	weights := make([]uint32, len(syms))
+	for i, s := range syms {
+		weights[i] = freqs[s]
+	}
+	for {
+		depths := huffmanDepths(weights)
+		ok := true
+		for _, d := range depths {
+			if d > maxLen {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			for i, s := range syms {
+				lens[s] = depths[i]
+			}
+			return lens
+		}
+		// Flatten the distribution until the code is short enough.
+		for i := range weights {
+			weights[i] = weights[i]/2 + 1
+		}
+	}
+}
+
+// huffmanDepths returns the depth of each leaf in a huffman tree built from
+// weights, using the two-queue method.
+func huffmanDepths(weights []uint32) []byte {
+	n := len(weights)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return weights[order[i]] < weights[order[j]] })
+
+	// Leaves are nodes 0..n-1 in order of weight, and internal nodes
+	// follow in the order they are created, which is also by weight.
+	weight := make([]uint64, 2*n-1)
+	parent := make([]int, 2*n-1)
+	for i, s := range order {
+		weight[i] = uint64(weights[s])
+	}
+	leaf, inner, next := 0, n, n
+	pick := func() int {
+		if leaf < n && (inner == next || weight[leaf] <= weight[inner]) {
+			leaf++
+			return leaf - 1
+		}
+		inner++
+		return inner - 1
+	}
+	for ; next < 2*n-1; next++ {
+		a, b := pick(), pick()
+		weight[next] = weight[a] + weight[b]
+		parent[a], parent[b] = next, next
+	}
+
+	depth := make([]byte, 2*n-1)
+	for i := 2*n - 3; i >= 0; i-- {
+		depth[i] = depth[parent[i]] + 1
+	}
+	depths := make([]byte, n)
+	for i, s := range order {
+		depths[s] = depth[i]
+	}
+	return depths
+}
+
+// canonicalCodes assigns canonical huffman codes to the code lengths lens,
+// in the same order as buildTable.
+func canonicalCodes(lens []byte) []uint16 {
+	var count [maxTreePathLen + 1]uint16
+	for _, l := range lens {
+		count[l]++
+	}
+	var next [maxTreePathLen + 1]uint16
+	code := uint16(0)
+	for i := 1; i <= maxTreePathLen; i++ {
+		code <<= 1
+		next[i] = code
+		code += count[i]
+	}
+	codes := make([]uint16, len(lens))
+	for i, l := range lens {
+		if l != 0 {
+			codes[i] = next[l]
+			next[l]++
+		}
+	}
+	return codes
+}
@@ -0,0 +1,604 @@
+// Package regf implements a reader for Windows registry hive files, such as
+// the SOFTWARE and SYSTEM hives in Windows\System32\config.
+//
+// The API mirrors that of golang.org/x/sys/windows/registry, but does not
+// depend on the Windows registry APIs. Changes that are only recorded in the
+// hive's transaction logs are not applied.
+//
+// The format is described at
+// https://github.com/msuhanov/regf/blob/master/Windows%20registry%20file%20format%20specification.md.
+package regf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Registry value types, as in golang.org/x/sys/windows/registry.
+//
+//nolint:revive,stylecheck // match the names used by the registry package
+const (
+	NONE                       = 0
+	SZ                         = 1
+	EXPAND_SZ                  = 2
+	BINARY                     = 3
+	DWORD                      = 4
+	DWORD_BIG_ENDIAN           = 5
+	LINK                       = 6
+	MULTI_SZ                   = 7
+	RESOURCE_LIST              = 8
+	FULL_RESOURCE_DESCRIPTOR   = 9
+	RESOURCE_REQUIREMENTS_LIST = 10
+	QWORD                      = 11
+)
+
+var (
+	// ErrNotExist is returned when a key or value does not exist.
+	ErrNotExist = errors.New("registry key or value does not exist")
+	// ErrUnexpectedType is returned by the Get*Value methods when the value
+	// does not have the expected type.
+	ErrUnexpectedType = errors.New("unexpected registry value type")
+	// ErrCorrupt is wrapped by the errors returned for malformed hives.
+	ErrCorrupt = errors.New("corrupt registry hive")
+)
+
+const (
+	baseBlockSize = 4096
+	pageSize      = 64 * 1024 // the unit in which hive data is read and cached
+
+	keyCompName   = 0x20 // the key name is stored as Latin-1
+	valueCompName = 0x1  // the value name is stored as Latin-1
+
+	dataInline     = 0x80000000 // the value data is stored in the data offset
+	bigDataSegment = 16344      // the size of each segment of a "db" value
+	maxSubkeyDepth = 2          // "ri" lists may only refer to leaf lists
+)
+
+// baseBlock is the start of the hive's first block.
+type baseBlock struct {
+	Signature      [4]byte
+	PrimarySeq     uint32
+	SecondarySeq   uint32
+	LastWritten    uint64
+	MajorVersion   uint32
+	MinorVersion   uint32
+	FileType       uint32
+	FileFormat     uint32
+	RootCellOffset uint32
+	HiveBinsSize   uint32
+}
+
+// keyNode is the fixed part of a key node cell, following its "nk" signature.
+type keyNode struct {
+	Flags              uint16
+	LastWritten        uint64
+	AccessBits         uint32
+	Parent             uint32
+	SubkeyCount        uint32
+	VolatileSubkeys    uint32
+	SubkeyList         uint32
+	VolatileSubkeyList uint32
+	ValueCount         uint32
+	ValueList          uint32
+	Security           uint32
+	Class              uint32
+	MaxSubkeyNameLen   uint32
+	MaxSubkeyClassLen  uint32
+	MaxValueNameLen    uint32
+	MaxValueDataLen    uint32
+	WorkVar            uint32
+	NameLength         uint16
+	ClassLength        uint16
+}
+
+const keyNodeSize = 74
+
+// valueKey is the fixed part of a value key cell, following its "vk"
+// signature.
+type valueKey struct {
+	NameLength uint16
+	DataSize   uint32
+	DataOffset uint32
+	Type       uint32
+	Flags      uint16
+	Spare      uint16
+}
+
+const valueKeySize = 18
+
+func corrupt(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, a...))
+}
+
+// Hive is a registry hive file.
+type Hive struct {
+	r     io.ReaderAt
+	size  int64 // the size of the hive bins data
+	minor uint32
+	root  uint32
+	pages map[int64][]byte
+}
+
+// Open reads the header of the hive file in r. Data is read from r as keys
+// and values are accessed.
+func Open(r io.ReaderAt) (*Hive, error) {
+	b := make([]byte, baseBlockSize)
+	n, err := r.ReadAt(b, 0)
+	if n < 512 {
+		if err == nil || err == io.EOF { //nolint:errorlint
+			err = corrupt("short base block")
+		}
+		return nil, err
+	}
+	var bb baseBlock
+	_ = binary.Read(bytes.NewReader(b), binary.LittleEndian, &bb)
+	if string(bb.Signature[:]) != "regf" {
+		return nil, corrupt("invalid signature")
+	}
+	if bb.MajorVersion != 1 {
+		return nil, fmt.Errorf("unsupported hive version %d.%d", bb.MajorVersion, bb.MinorVersion)
+	}
+	if bb.FileFormat != 1 {
+		return nil, fmt.Errorf("unsupported hive format %d", bb.FileFormat)
+	}
+	var sum uint32
+	for i := 0; i < 508; i += 4 {
+		sum ^= binary.LittleEndian.Uint32(b[i:])
+	}
+	switch sum {
+	case 0:
+		sum = 1
+	case 0xffffffff:
+		sum = 0xfffffffe
+	}
+	if sum != binary.LittleEndian.Uint32(b[508:]) {
+		return nil, corrupt("base block checksum mismatch")
+	}
+	return &Hive{
+		r:     r,
+		size:  int64(bb.HiveBinsSize),
+		minor: bb.MinorVersion,
+		root:  bb.RootCellOffset,
+		pages: make(map[int64][]byte),
+	}, nil
+}
+
+// Root returns the root key of the hive. Paths passed to OpenKey on the root
+// key are relative to the hive, such as `Microsoft\Windows NT\CurrentVersion`
+// in the SOFTWARE hive.
+func (h *Hive) Root() (*Key, error) {
+	return h.key(h.root)
+}
+
+// page returns the cached page of hive bins data at offset off.
+func (h *Hive) page(off int64) ([]byte, error) {
+	if p, ok := h.pages[off]; ok {
+		return p, nil
+	}
+	size := h.size - off
+	if size > pageSize {
+		size = pageSize
+	}
+	p := make([]byte, size)
+	n, err := h.r.ReadAt(p, baseBlockSize+off)
+	if n < len(p) {
+		if err == nil || err == io.EOF { //nolint:errorlint
+			err = corrupt("truncated hive")
+		}
+		return nil, err
+	}
+	h.pages[off] = p
+	return p, nil
+}
+
+// read returns n bytes of hive bins data at offset off. The returned slice
+// must not be modified.
+func (h *Hive) read(off int64, n int) ([]byte, error) {
+	if off < 0 || n < 0 || off+int64(n) > h.size {
+		return nil, corrupt("offset %#x out of range", off)
+	}
+	start := off &^ (pageSize - 1)
+	if off+int64(n) <= start+pageSize {
+		p, err := h.page(start)
+		if err != nil {
+			return nil, err
+		}
+		return p[off-start : off-start+int64(n)], nil
+	}
+	// The buffer grows as pages are read, since n may come from a corrupt
+	// cell size.
+	var b []byte
+	for len(b) < n {
+		p, err := h.page(start)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 {
+			p = p[off-start:]
+		}
+		if len(p) > n-len(b) {
+			p = p[:n-len(b)]
+		}
+		b = append(b, p...)
+		start += pageSize
+	}
+	return b, nil
+}
+
+// cell returns the data of the allocated cell at offset off.
+func (h *Hive) cell(off uint32) ([]byte, error) {
+	b, err := h.read(int64(off), 4)
+	if err != nil {
+		return nil, err
+	}
+	size := int32(binary.LittleEndian.Uint32(b))
+	if size >= 0 {
+		return nil, corrupt("cell %#x is not allocated", off)
+	}
+	if -size < 4 {
+		return nil, corrupt("cell %#x has invalid size", off)
+	}
+	return h.read(int64(off)+4, int(-size)-4)
+}
+
+func (h *Hive) key(off uint32) (*Key, error) {
+	b, err := h.cell(off)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 2+keyNodeSize || string(b[:2]) != "nk" {
+		return nil, corrupt("cell %#x is not a key node", off)
+	}
+	k := &Key{h: h}
+	_ = binary.Read(bytes.NewReader(b[2:]), binary.LittleEndian, &k.nk)
+	name := b[2+keyNodeSize:]
+	if int(k.nk.NameLength) > len(name) {
+		return nil, corrupt("key node %#x has invalid name length", off)
+	}
+	k.name = decodeName(name[:k.nk.NameLength], k.nk.Flags&keyCompName != 0)
+	return k, nil
+}
+
+func decodeName(b []byte, latin1 bool) string {
+	if latin1 {
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		return string(r)
+	}
+	return decodeUTF16(b)
+}
+
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// Key is a registry key in a hive.
+type Key struct {
+	h    *Hive
+	nk   keyNode
+	name string
+}
+
+// Name returns the name of the key.
+func (k *Key) Name() string {
+	return k.name
+}
+
+// ModTime returns the time the key was last written.
+func (k *Key) ModTime() time.Time {
+	// FILETIME counts 100ns intervals since 1601.
+	const epochDelta = 116444736000000000
+	return time.Unix(0, (int64(k.nk.LastWritten)-epochDelta)*100)
+}
+
+// SubKeys returns the subkeys of the key.
+func (k *Key) SubKeys() ([]*Key, error) {
+	if k.nk.SubkeyCount == 0 {
+		return nil, nil
+	}
+	var offsets []uint32
+	err := k.h.subkeyList(k.nk.SubkeyList, 1, func(off uint32) error {
+		if len(offsets) == int(k.nk.SubkeyCount) {
+			return corrupt("too many subkeys")
+		}
+		offsets = append(offsets, off)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*Key, 0, len(offsets))
+	for _, off := range offsets {
+		sk, err := k.h.key(off)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, sk)
+	}
+	return keys, nil
+}
+
+// subkeyList calls fn for the offset of each key node in the subkey list at
+// offset off.
+func (h *Hive) subkeyList(off uint32, depth int, fn func(uint32) error) error {
+	b, err := h.cell(off)
+	if err != nil {
+		return err
+	}
+	if len(b) < 4 {
+		return corrupt("subkey list %#x too short", off)
+	}
+	sig := string(b[:2])
+	n := int(binary.LittleEndian.Uint16(b[2:]))
+	entrySize := 4
+	if sig == "lf" || sig == "lh" {
+		entrySize = 8
+	} else if sig != "li" && sig != "ri" {
+		return corrupt("cell %#x is not a subkey list", off)
+	}
+	if 4+n*entrySize > len(b) {
+		return corrupt("subkey list %#x has invalid count", off)
+	}
+	for i := 0; i < n; i++ {
+		entry := binary.LittleEndian.Uint32(b[4+i*entrySize:])
+		if sig == "ri" {
+			if depth >= maxSubkeyDepth {
+				return corrupt("nested index root %#x", off)
+			}
+			err = h.subkeyList(entry, depth+1, fn)
+		} else {
+			err = fn(entry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSubKeyNames returns the names of the subkeys of the key.
+func (k *Key) ReadSubKeyNames() ([]string, error) {
+	keys, err := k.SubKeys()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(keys))
+	for _, sk := range keys {
+		names = append(names, sk.name)
+	}
+	return names, nil
+}
+
+// OpenKey returns the key at path, which is relative to k and uses '\' as a
+// separator. Names are matched case-insensitively. OpenKey returns an error
+// wrapping ErrNotExist if the key does not exist.
+func (k *Key) OpenKey(path string) (*Key, error) {
+	for _, elem := range strings.Split(path, `\`) {
+		if elem == "" {
+			continue
+		}
+		keys, err := k.SubKeys()
+		if err != nil {
+			return nil, err
+		}
+		var next *Key
+		for _, sk := range keys {
+			if strings.EqualFold(sk.name, elem) {
+				next = sk
+				break
+			}
+		}
+		if next == nil {
+			return nil, fmt.Errorf("%s: %w", path, ErrNotExist)
+		}
+		k = next
+	}
+	return k, nil
+}
+
+// value is a value of a key.
+type value struct {
+	name string
+	vk   valueKey
+}
+
+func (k *Key) values() ([]value, error) {
+	if k.nk.ValueCount == 0 {
+		return nil, nil
+	}
+	b, err := k.h.cell(k.nk.ValueList)
+	if err != nil {
+		return nil, err
+	}
+	if int(k.nk.ValueCount) > len(b)/4 {
+		return nil, corrupt("value list %#x has invalid count", k.nk.ValueList)
+	}
+	values := make([]value, 0, k.nk.ValueCount)
+	for i := 0; i < int(k.nk.ValueCount); i++ {
+		off := binary.LittleEndian.Uint32(b[4*i:])
+		c, err := k.h.cell(off)
+		if err != nil {
+			return nil, err
+		}
+		if len(c) < 2+valueKeySize || string(c[:2]) != "vk" {
+			return nil, corrupt("cell %#x is not a value key", off)
+		}
+		var v value
+		_ = binary.Read(bytes.NewReader(c[2:]), binary.LittleEndian, &v.vk)
+		name := c[2+valueKeySize:]
+		if int(v.vk.NameLength) > len(name) {
+			return nil, corrupt("value key %#x has invalid name length", off)
+		}
+		v.name = decodeName(name[:v.vk.NameLength], v.vk.Flags&valueCompName != 0)
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// ReadValueNames returns the names of the values of the key. The default
+// value has an empty name.
+func (k *Key) ReadValueNames() ([]string, error) {
+	values, err := k.values()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(values))
+	for _, v := range values {
+		names = append(names, v.name)
+	}
+	return names, nil
+}
+
+// GetValue returns the data and type of the value with the given name,
+// matched case-insensitively. It returns an error wrapping ErrNotExist if
+// the value does not exist.
+func (k *Key) GetValue(name string) (data []byte, valtype uint32, err error) {
+	values, err := k.values()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, v := range values {
+		if strings.EqualFold(v.name, name) {
+			data, err := k.h.valueData(&v.vk)
+			return data, v.vk.Type, err
+		}
+	}
+	return nil, 0, fmt.Errorf("%s: %w", name, ErrNotExist)
+}
+
+// valueData returns the data of a value.
+func (h *Hive) valueData(vk *valueKey) ([]byte, error) {
+	if vk.DataSize&dataInline != 0 {
+		size := vk.DataSize &^ dataInline
+		if size > 4 {
+			return nil, corrupt("invalid inline value size %d", size)
+		}
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], vk.DataOffset)
+		return b[:size], nil
+	}
+	if vk.DataSize == 0 {
+		return nil, nil
+	}
+	c, err := h.cell(vk.DataOffset)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(vk.DataSize)
+	if size > bigDataSegment && h.minor >= 4 && len(c) >= 8 && string(c[:2]) == "db" {
+		return h.bigData(c, size)
+	}
+	if size > int64(len(c)) {
+		return nil, corrupt("value data %#x too short", vk.DataOffset)
+	}
+	return c[:size], nil
+}
+
+// bigData returns the data of a value stored in segments, given its "db"
+// cell.
+func (h *Hive) bigData(db []byte, size int64) ([]byte, error) {
+	n := int(binary.LittleEndian.Uint16(db[2:]))
+	if int64(n) != (size+bigDataSegment-1)/bigDataSegment {
+		return nil, corrupt("big data has %d segments for %d bytes", n, size)
+	}
+	list, err := h.cell(binary.LittleEndian.Uint32(db[4:]))
+	if err != nil {
+		return nil, err
+	}
+	if n > len(list)/4 {
+		return nil, corrupt("big data segment list too short")
+	}
+	var data []byte
+	for i := 0; i < n; i++ {
+		seg, err := h.cell(binary.LittleEndian.Uint32(list[4*i:]))
+		if err != nil {
+			return nil, err
+		}
+		want := size - int64(len(data))
+		if want > bigDataSegment {
+			want = bigDataSegment
+		}
+		if int64(len(seg)) < want {
+			return nil, corrupt("big data segment too short")
+		}
+		data = append(data, seg[:want]...)
+	}
+	return data, nil
+}
+
+// GetBinaryValue returns the data of a BINARY value.
+func (k *Key) GetBinaryValue(name string) ([]byte, uint32, error) {
+	data, typ, err := k.GetValue(name)
+	if err != nil {
+		return nil, typ, err
+	}
+	if typ != BINARY {
+		return nil, typ, ErrUnexpectedType
+	}
+	return data, typ, nil
+}
+
+// GetStringValue returns the string data of an SZ or EXPAND_SZ value.
+// Environment variables in EXPAND_SZ values are not expanded.
+func (k *Key) GetStringValue(name string) (string, uint32, error) {
+	data, typ, err := k.GetValue(name)
+	if err != nil {
+		return "", typ, err
+	}
+	if typ != SZ && typ != EXPAND_SZ {
+		return "", typ, ErrUnexpectedType
+	}
+	s := decodeUTF16(data)
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return s, typ, nil
+}
+
+// GetStringsValue returns the strings of a MULTI_SZ value.
+func (k *Key) GetStringsValue(name string) ([]string, uint32, error) {
+	data, typ, err := k.GetValue(name)
+	if err != nil {
+		return nil, typ, err
+	}
+	if typ != MULTI_SZ {
+		return nil, typ, ErrUnexpectedType
+	}
+	s := strings.TrimRight(decodeUTF16(data), "\x00")
+	if s == "" {
+		return []string{}, typ, nil
+	}
+	return strings.Split(s, "\x00"), typ, nil
+}
+
+// GetIntegerValue returns the data of a DWORD, DWORD_BIG_ENDIAN or QWORD
+// value.
+func (k *Key) GetIntegerValue(name string) (uint64, uint32, error) {
+	data, typ, err := k.GetValue(name)
+	if err != nil {
+		return 0, typ, err
+	}
+	switch {
+	case typ == DWORD && len(data) >= 4:
+		return uint64(binary.LittleEndian.Uint32(data)), typ, nil
+	case typ == DWORD_BIG_ENDIAN && len(data) >= 4:
+		return uint64(binary.BigEndian.Uint32(data)), typ, nil
+	case typ == QWORD && len(data) >= 8:
+		return binary.LittleEndian.Uint64(data), typ, nil
+	case typ == DWORD || typ == DWORD_BIG_ENDIAN || typ == QWORD:
+		return 0, typ, corrupt("integer value %q too short", name)
+	}
+	return 0, typ, ErrUnexpectedType
+}
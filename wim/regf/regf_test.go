@@ -0,0 +1,191 @@
+package regf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/go-winio/wim/internal/hivetest"
+)
+
+func openHive(t *testing.T, b []byte) *Key {
+	t.Helper()
+	h, err := Open(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := h.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestValues(t *testing.T) {
+	big := bytes.Repeat([]byte("big data "), 5000)
+	mtime := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	root := openHive(t, hivetest.Build(&hivetest.Key{
+		Name: "ROOT",
+		Subkeys: []*hivetest.Key{{
+			Name:    "Software",
+			ModTime: mtime,
+			Values: []hivetest.Value{
+				hivetest.String("", "default"),
+				hivetest.String("Name", "Windows"),
+				{Name: "Path", Type: EXPAND_SZ, Data: hivetest.String("", `%SystemRoot%\x`).Data},
+				hivetest.MultiString("List", "a", "bc"),
+				hivetest.MultiString("Empty"),
+				hivetest.DWord("Small", 42),
+				hivetest.QWord("Large", 1<<40),
+				{Name: "BigEndian", Type: DWORD_BIG_ENDIAN, Data: []byte{0, 0, 1, 0}},
+				{Name: "Big", Type: BINARY, Data: big},
+				hivetest.String("Größe", "ü"),
+			},
+		}},
+	}))
+	if root.Name() != "ROOT" {
+		t.Errorf("unexpected root name %q", root.Name())
+	}
+	k, err := root.OpenKey(`SOFTWARE`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.ModTime().Equal(mtime) {
+		t.Errorf("unexpected mod time %v", k.ModTime())
+	}
+
+	names, err := k.ReadValueNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"", "Name", "Path", "List", "Empty", "Small", "Large", "BigEndian", "Big", "Größe"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got value names %q, expected %q", names, want)
+	}
+
+	for _, tc := range []struct {
+		name string
+		want string
+		typ  uint32
+	}{
+		{"", "default", SZ},
+		{"name", "Windows", SZ},
+		{"Path", `%SystemRoot%\x`, EXPAND_SZ},
+		{"größe", "ü", SZ},
+	} {
+		s, typ, err := k.GetStringValue(tc.name)
+		if err != nil || s != tc.want || typ != tc.typ {
+			t.Errorf("%q: got %q, %d, %v", tc.name, s, typ, err)
+		}
+	}
+	if ss, _, err := k.GetStringsValue("List"); err != nil || !reflect.DeepEqual(ss, []string{"a", "bc"}) {
+		t.Errorf("List: got %q, %v", ss, err)
+	}
+	if ss, _, err := k.GetStringsValue("Empty"); err != nil || len(ss) != 0 {
+		t.Errorf("Empty: got %q, %v", ss, err)
+	}
+	for name, want := range map[string]uint64{"Small": 42, "Large": 1 << 40, "BigEndian": 256} {
+		if n, _, err := k.GetIntegerValue(name); err != nil || n != want {
+			t.Errorf("%s: got %d, %v", name, n, err)
+		}
+	}
+	if b, _, err := k.GetBinaryValue("Big"); err != nil || !bytes.Equal(b, big) {
+		t.Errorf("Big: content mismatch, %v", err)
+	}
+
+	if _, _, err := k.GetValue("Missing"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	if _, _, err := k.GetStringValue("Small"); !errors.Is(err, ErrUnexpectedType) {
+		t.Errorf("expected ErrUnexpectedType, got %v", err)
+	}
+	if _, _, err := k.GetIntegerValue("Name"); !errors.Is(err, ErrUnexpectedType) {
+		t.Errorf("expected ErrUnexpectedType, got %v", err)
+	}
+}
+
+func TestSubKeys(t *testing.T) {
+	// More than four subkeys are stored in an index root.
+	parent := &hivetest.Key{Name: "Parent"}
+	var want []string
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("Key%d", i)
+		want = append(want, name)
+		parent.Subkeys = append(parent.Subkeys, &hivetest.Key{
+			Name:   name,
+			Values: []hivetest.Value{hivetest.DWord("Index", uint32(i))},
+		})
+	}
+	parent.Subkeys[3].Subkeys = []*hivetest.Key{{Name: "Ключ"}}
+	root := openHive(t, hivetest.Build(&hivetest.Key{Name: "ROOT", Subkeys: []*hivetest.Key{parent}}))
+
+	k, err := root.OpenKey(`parent`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := k.ReadSubKeyNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got subkeys %q, expected %q", names, want)
+	}
+	k, err = root.OpenKey(`\Parent\KEY7\`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := k.GetIntegerValue("Index"); err != nil || n != 7 {
+		t.Errorf("Index: got %d, %v", n, err)
+	}
+	k, err = root.OpenKey(`Parent\Key3\ключ`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Name() != "Ключ" {
+		t.Errorf("unexpected name %q", k.Name())
+	}
+	if _, err := root.OpenKey(`Parent\Key10`); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	b := hivetest.Build(&hivetest.Key{
+		Name:   "ROOT",
+		Values: []hivetest.Value{hivetest.String("Name", "value")},
+	})
+	if _, err := Open(bytes.NewReader(b[:100])); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("short hive: expected ErrCorrupt, got %v", err)
+	}
+
+	bad := append([]byte(nil), b...)
+	bad[100]++
+	if _, err := Open(bytes.NewReader(bad)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("checksum: expected ErrCorrupt, got %v", err)
+	}
+
+	bad = append([]byte(nil), b...)
+	copy(bad, "regx")
+	if _, err := Open(bytes.NewReader(bad)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("signature: expected ErrCorrupt, got %v", err)
+	}
+
+	// Truncating the hive bins makes the root key unreadable.
+	h, err := Open(bytes.NewReader(b[:4200]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Root(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("truncated: expected ErrCorrupt, got %v", err)
+	}
+
+	// Pointing the value list at the root key's cell is an error, not a panic.
+	root := openHive(t, b)
+	root.nk.ValueList = root.h.root
+	if _, _, err := root.GetValue("Name"); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("value list: expected ErrCorrupt, got %v", err)
+	}
+}
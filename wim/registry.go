@@ -0,0 +1,272 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Microsoft/go-winio/wim/regf"
+)
+
+const (
+	softwareHivePath = `Windows\System32\config\SOFTWARE`
+	systemHivePath   = `Windows\System32\config\SYSTEM`
+)
+
+// Processor architectures, as stored in WindowsInfo.Arch.
+var archByName = map[string]byte{
+	"x86":   0,
+	"ARM":   5,
+	"IA64":  6,
+	"AMD64": 9,
+	"ARM64": 12,
+}
+
+// ReadWindowsInfo reads the SOFTWARE and SYSTEM registry hives in the image
+// and returns the image's Windows information updated with what they
+// contain: the product name, edition, version and build, architecture and
+// installed languages. Values that are missing from the hives are left as
+// they are in the image's XML information. The image itself is not
+// modified.
+//
+// ReadWindowsInfo returns an error wrapping fs.ErrNotExist if the image does
+// not contain the hives.
+func (img *Image) ReadWindowsInfo() (*WindowsInfo, error) {
+	info := &WindowsInfo{}
+	if img.Windows != nil {
+		*info = *img.Windows
+	}
+	err := img.readHive(softwareHivePath, func(root *regf.Key) error {
+		return readSoftwareHive(root, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = img.readHive(systemHivePath, func(root *regf.Key) error {
+		return readSystemHive(root, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// readHive opens the hive at path p in the image and passes its root key to
+// fn.
+func (img *Image) readHive(p string, fn func(*regf.Key) error) error {
+	f, err := img.Lookup(p)
+	if err != nil {
+		return err
+	}
+	r, err := f.OpenSeekable()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h, err := regf.Open(r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	root, err := h.Root()
+	if err == nil {
+		err = fn(root)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	return nil
+}
+
+// openKey is like Key.OpenKey, but returns nil without an error if the key
+// does not exist.
+func openKey(k *regf.Key, p string) (*regf.Key, error) {
+	k, err := k.OpenKey(p)
+	if errors.Is(err, regf.ErrNotExist) {
+		return nil, nil
+	}
+	return k, err
+}
+
+// getString sets *s to the string value with the given name, if it exists.
+func getString(k *regf.Key, name string, s *string) error {
+	v, _, err := k.GetStringValue(name)
+	if errors.Is(err, regf.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	*s = v
+	return nil
+}
+
+// getInt sets *n to the integer value with the given name, if it exists.
+// Integers stored as strings are also accepted, and values of other types are
+// ignored as if they did not exist.
+func getInt(k *regf.Key, name string, n *int) error {
+	v, _, err := k.GetIntegerValue(name)
+	if errors.Is(err, regf.ErrUnexpectedType) {
+		var s string
+		s, _, err = k.GetStringValue(name)
+		if errors.Is(err, regf.ErrUnexpectedType) || err == nil && s == "" {
+			return nil
+		}
+		if err == nil {
+			v, err = strconv.ParseUint(s, 10, 32)
+		}
+	}
+	if errors.Is(err, regf.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	*n = int(v)
+	return nil
+}
+
+func readSoftwareHive(root *regf.Key, info *WindowsInfo) error {
+	k, err := openKey(root, `Microsoft\Windows NT\CurrentVersion`)
+	if k == nil {
+		return err
+	}
+	var currentVersion, systemRoot string
+	for _, s := range []struct {
+		name string
+		v    *string
+	}{
+		{"ProductName", &info.ProductName},
+		{"EditionID", &info.EditionID},
+		{"InstallationType", &info.InstallationType},
+		{"BuildBranch", &info.Version.Branch},
+		{"CurrentVersion", &currentVersion},
+		{"SystemRoot", &systemRoot},
+	} {
+		if err := getString(k, s.name, s.v); err != nil {
+			return err
+		}
+	}
+	// Windows 10 and later report 6.3 as CurrentVersion for compatibility,
+	// and store the real version separately.
+	if currentVersion != "" {
+		var major, minor int
+		if _, err := fmt.Sscanf(currentVersion, "%d.%d", &major, &minor); err == nil {
+			info.Version.Major = major
+			info.Version.Minor = minor
+		}
+	}
+	for _, n := range []struct {
+		name string
+		v    *int
+	}{
+		{"CurrentMajorVersionNumber", &info.Version.Major},
+		{"CurrentMinorVersionNumber", &info.Version.Minor},
+		{"CurrentBuild", &info.Version.Build},
+		{"CurrentBuildNumber", &info.Version.Build},
+		{"UBR", &info.Version.SPBuild},
+	} {
+		if err := getInt(k, n.name, n.v); err != nil {
+			return err
+		}
+	}
+	if systemRoot != "" {
+		info.SystemRoot = strings.ToUpper(path.Base(strings.ReplaceAll(systemRoot, `\`, "/")))
+	}
+	return nil
+}
+
+func readSystemHive(root *regf.Key, info *WindowsInfo) error {
+	controlSet := "ControlSet001"
+	sel, err := openKey(root, "Select")
+	if err != nil {
+		return err
+	}
+	if sel != nil {
+		var current int
+		if err := getInt(sel, "Current", &current); err != nil {
+			return err
+		}
+		if current != 0 {
+			controlSet = fmt.Sprintf("ControlSet%03d", current)
+		}
+	}
+	control, err := openKey(root, controlSet+`\Control`)
+	if control == nil {
+		return err
+	}
+
+	k, err := openKey(control, "ProductOptions")
+	if err != nil {
+		return err
+	}
+	if k != nil {
+		if err := getString(k, "ProductType", &info.ProductType); err != nil {
+			return err
+		}
+		suites, _, err := k.GetStringsValue("ProductSuite")
+		if err != nil && !errors.Is(err, regf.ErrNotExist) {
+			return fmt.Errorf("ProductSuite: %w", err)
+		}
+		if len(suites) != 0 {
+			info.ProductSuite = suites[0]
+		}
+	}
+
+	k, err = openKey(control, `Session Manager\Environment`)
+	if err != nil {
+		return err
+	}
+	if k != nil {
+		var arch string
+		if err := getString(k, "PROCESSOR_ARCHITECTURE", &arch); err != nil {
+			return err
+		}
+		for name, v := range archByName {
+			if strings.EqualFold(name, arch) {
+				info.Arch = v
+			}
+		}
+	}
+
+	return readLanguages(control, info)
+}
+
+// readLanguages reads the installed UI languages, and the default language,
+// which is the UI language whose LCID matches the install language.
+func readLanguages(control *regf.Key, info *WindowsInfo) error {
+	k, err := openKey(control, `MUI\UILanguages`)
+	if k == nil {
+		return err
+	}
+	langs, err := k.SubKeys()
+	if err != nil {
+		return err
+	}
+	if len(langs) == 0 {
+		return nil
+	}
+	var installLanguage string
+	nls, err := openKey(control, `Nls\Language`)
+	if err != nil {
+		return err
+	}
+	if nls != nil {
+		if err := getString(nls, "InstallLanguage", &installLanguage); err != nil {
+			return err
+		}
+	}
+	lcid, _ := strconv.ParseUint(installLanguage, 16, 32)
+
+	info.Languages = nil
+	for _, lang := range langs {
+		info.Languages = append(info.Languages, lang.Name())
+		n, _, err := lang.GetIntegerValue("LCID")
+		if err == nil && lcid != 0 && n == lcid {
+			info.DefaultLanguage = lang.Name()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/Microsoft/go-winio/wim/internal/hivetest"
+	"github.com/Microsoft/go-winio/wim/regf"
+)
+
+func testHives() (software, system []byte) {
+	software = hivetest.Build(&hivetest.Key{
+		Name: "ROOT",
+		Subkeys: []*hivetest.Key{{
+			Name: "Microsoft",
+			Subkeys: []*hivetest.Key{{
+				Name: "Windows NT",
+				Subkeys: []*hivetest.Key{{
+					Name: "CurrentVersion",
+					Values: []hivetest.Value{
+						hivetest.String("ProductName", "Windows Server 2022 Datacenter"),
+						hivetest.String("EditionID", "ServerDatacenter"),
+						hivetest.String("InstallationType", "Server Core"),
+						hivetest.String("CurrentVersion", "6.3"),
+						hivetest.DWord("CurrentMajorVersionNumber", 10),
+						hivetest.DWord("CurrentMinorVersionNumber", 0),
+						hivetest.String("CurrentBuild", "20348"),
+						hivetest.String("CurrentBuildNumber", "20348"),
+						hivetest.DWord("UBR", 1906),
+						hivetest.String("BuildBranch", "fe_release"),
+						hivetest.String("SystemRoot", `C:\Windows`),
+					},
+				}},
+			}},
+		}},
+	})
+
+	control := &hivetest.Key{
+		Name: "Control",
+		Subkeys: []*hivetest.Key{
+			{Name: "ProductOptions", Values: []hivetest.Value{
+				hivetest.String("ProductType", "ServerNT"),
+				hivetest.MultiString("ProductSuite", "Enterprise", "DataCenter"),
+			}},
+			{Name: "Session Manager", Subkeys: []*hivetest.Key{{
+				Name:   "Environment",
+				Values: []hivetest.Value{hivetest.String("PROCESSOR_ARCHITECTURE", "AMD64")},
+			}}},
+			{Name: "MUI", Subkeys: []*hivetest.Key{{
+				Name: "UILanguages",
+				Subkeys: []*hivetest.Key{
+					{Name: "de-DE", Values: []hivetest.Value{hivetest.DWord("LCID", 0x407)}},
+					{Name: "en-US", Values: []hivetest.Value{hivetest.DWord("LCID", 0x409)}},
+				},
+			}}},
+			{Name: "Nls", Subkeys: []*hivetest.Key{{
+				Name:   "Language",
+				Values: []hivetest.Value{hivetest.String("InstallLanguage", "0409")},
+			}}},
+		},
+	}
+	system = hivetest.Build(&hivetest.Key{
+		Name: "ROOT",
+		Subkeys: []*hivetest.Key{
+			{Name: "ControlSet001"},
+			{Name: "ControlSet002", Subkeys: []*hivetest.Key{control}},
+			{Name: "Select", Values: []hivetest.Value{hivetest.DWord("Current", 2)}},
+		},
+	})
+	return software, system
+}
+
+func TestReadWindowsInfo(t *testing.T) {
+	software, system := testHives()
+	fsys := testFS()
+	fsys["Windows/System32/config"] = &fstest.MapFile{Mode: fs.ModeDir | 0755}
+	fsys["Windows/System32/config/SOFTWARE"] = &fstest.MapFile{Data: software, Mode: 0644}
+	fsys["Windows/System32/config/SYSTEM"] = &fstest.MapFile{Data: system, Mode: 0644}
+
+	r, err := NewReader(writeTestWIM(t, fsys, testMetadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := r.Image[0]
+	img.Windows = &WindowsInfo{HAL: "acpiapic", Languages: []string{"fr-FR"}}
+	info, err := img.ReadWindowsInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &WindowsInfo{
+		Arch:             9,
+		ProductName:      "Windows Server 2022 Datacenter",
+		EditionID:        "ServerDatacenter",
+		InstallationType: "Server Core",
+		HAL:              "acpiapic",
+		ProductType:      "ServerNT",
+		ProductSuite:     "Enterprise",
+		Languages:        []string{"de-DE", "en-US"},
+		DefaultLanguage:  "en-US",
+		Version:          Version{Major: 10, Build: 20348, SPBuild: 1906, Branch: "fe_release"},
+		SystemRoot:       "WINDOWS",
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("got %+v, expected %+v", info, want)
+	}
+	if img.Windows.ProductName != "" || img.Windows.Languages[0] != "fr-FR" {
+		t.Error("the image's information was modified")
+	}
+
+	r, err = NewReader(writeTestWIM(t, testFS(), testMetadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Image[0].ReadWindowsInfo(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestGetInt(t *testing.T) {
+	hive := hivetest.Build(&hivetest.Key{
+		Name: "ROOT",
+		Values: []hivetest.Value{
+			hivetest.DWord("DWord", 1906),
+			hivetest.String("String", "20348"),
+			hivetest.String("Empty", ""),
+			hivetest.String("NotANumber", "x"),
+			hivetest.Binary("Binary", []byte{1, 2, 3, 4}),
+		},
+	})
+	h, err := regf.Open(bytes.NewReader(hive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := h.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		want int
+	}{
+		{"DWord", 1906},
+		{"String", 20348},
+		{"Empty", -1},
+		{"Binary", -1},
+		{"Missing", -1},
+	} {
+		n := -1
+		if err := getInt(root, tc.name, &n); err != nil || n != tc.want {
+			t.Errorf("%s: got %d, %v, want %d", tc.name, n, err, tc.want)
+		}
+	}
+	n := -1
+	if err := getInt(root, "NotANumber", &n); err == nil {
+		t.Errorf("NotANumber: expected error, got %d", n)
+	}
+}
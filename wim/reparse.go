@@ -0,0 +1,105 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/Microsoft/go-winio"
+)
+
+const (
+	reparseTagMountPoint = 0xA0000003
+	reparseTagSymlink    = 0xA000000C
+)
+
+// HardLinkGroups returns the paths of the files in the image that are hard
+// linked to each other, keyed by LinkID. Paths are as passed to a WalkFunc by
+// Walk, in walk order. Files whose link group has only one member are
+// omitted.
+func (img *Image) HardLinkGroups() (map[int64][]string, error) {
+	m := make(map[int64][]string)
+	err := img.Walk(func(p string, f *File, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.LinkID != 0 && !f.IsDir() {
+			m[f.LinkID] = append(m[f.LinkID], p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for id, paths := range m {
+		if len(paths) < 2 {
+			delete(m, id)
+		}
+	}
+	return m, nil
+}
+
+// ReparsePoint is a file's reparse point.
+type ReparsePoint struct {
+	// Tag is the reparse tag, which identifies the type of reparse point.
+	Tag uint32
+	// Buffer is the complete REPARSE_DATA_BUFFER, including its 8-byte
+	// header, as returned by FSCTL_GET_REPARSE_POINT.
+	Buffer []byte
+	// Link is the decoded target of a symbolic link or junction, and nil
+	// for other reparse points.
+	Link *winio.ReparsePoint
+}
+
+// ReparsePoint returns the file's reparse point, rebuilding the reparse
+// buffer from the reparse tag and the file's unnamed stream, which holds the
+// reparse data. It returns nil if the file is not a reparse point.
+func (f *File) ReparsePoint() (*ReparsePoint, error) {
+	if f.Attributes&FILE_ATTRIBUTE_REPARSE_POINT == 0 {
+		return nil, nil
+	}
+	buf, err := f.reparseBuffer()
+	if err != nil {
+		return nil, err
+	}
+	rp := &ReparsePoint{Tag: f.ReparseTag, Buffer: buf}
+	switch f.ReparseTag {
+	case reparseTagSymlink, reparseTagMountPoint:
+		rp.Link, err = winio.DecodeReparsePoint(buf)
+		if err != nil {
+			return nil, &ParseError{Oper: "reparse point", Path: f.Name, Err: err}
+		}
+	}
+	return rp, nil
+}
+
+// reparseBuffer returns the file's REPARSE_DATA_BUFFER without decoding it.
+func (f *File) reparseBuffer() ([]byte, error) {
+	errTooLarge := &ParseError{Oper: "reparse point", Path: f.Name, Err: errors.New("reparse data too large")}
+	if f.Size > 0xffff {
+		return nil, errTooLarge
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, 0xffff+1))
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0xffff {
+		return nil, errTooLarge
+	}
+
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, f.ReparseTag)
+	_ = binary.Write(&b, binary.LittleEndian, uint16(len(data)))
+	_ = binary.Write(&b, binary.LittleEndian, uint16(f.ReparseReserved))
+	b.Write(data)
+	return b.Bytes(), nil
+}
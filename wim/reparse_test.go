@@ -0,0 +1,112 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/Microsoft/go-winio"
+)
+
+func TestReparsePoint(t *testing.T) {
+	fsys := testFS()
+	fsys["junction"] = &fstest.MapFile{Mode: fs.ModeSymlink}
+	links := map[string]*winio.ReparsePoint{
+		"link":     {Target: `Windows\notepad.exe`},
+		"junction": {Target: `C:\Windows`, IsMountPoint: true},
+	}
+	f := writeTestWIM(t, fsys, func(name string, fi fs.FileInfo) (*FileMetadata, error) {
+		m, err := testMetadata(name, fi)
+		if rp := links[name]; rp != nil {
+			b := winio.EncodeReparsePoint(rp)
+			m.ReparseTag = reparseTagSymlink
+			if rp.IsMountPoint {
+				m.ReparseTag = reparseTagMountPoint
+			}
+			m.ReparseData = b[8:]
+		}
+		return m, err
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range links {
+		file, err := r.Image[0].Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rp, err := file.ReparsePoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rp.Buffer, winio.EncodeReparsePoint(want)) {
+			t.Errorf("%s: reparse buffer mismatch", name)
+		}
+		if !reflect.DeepEqual(rp.Link, want) {
+			t.Errorf("%s: got %+v, want %+v", name, rp.Link, want)
+		}
+	}
+
+	file, err := r.Image[0].Lookup("Windows/notepad.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rp, err := file.ReparsePoint(); rp != nil || err != nil {
+		t.Errorf("expected no reparse point, got %v, %v", rp, err)
+	}
+}
+
+func TestReparsePointTooLarge(t *testing.T) {
+	f := writeTestWIM(t, testFS(), func(name string, fi fs.FileInfo) (*FileMetadata, error) {
+		m, err := testMetadata(name, fi)
+		if name == "link" {
+			m.ReparseData = make([]byte, 0x10000)
+		}
+		return m, err
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := r.Image[0].Lookup("link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var perr *ParseError
+	if _, err := file.ReparsePoint(); !errors.As(err, &perr) {
+		t.Errorf("expected a ParseError, got %v", err)
+	}
+}
+
+func TestHardLinkGroups(t *testing.T) {
+	f := writeTestWIM(t, testFS(), func(name string, fi fs.FileInfo) (*FileMetadata, error) {
+		m, err := testMetadata(name, fi)
+		switch name {
+		case "Windows/System32/cmd.exe", "Windows/System32/copy.exe":
+			m.LinkID = 1
+		case "empty.txt":
+			m.LinkID = 2
+		}
+		return m, err
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := r.Image[0].HardLinkGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64][]string{1: {"Windows/System32/cmd.exe", "Windows/System32/copy.exe"}}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("got %v, want %v", groups, want)
+	}
+}
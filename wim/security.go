@@ -0,0 +1,378 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	winioguid "github.com/Microsoft/go-winio/pkg/guid"
+)
+
+// NoSecurityID is the security ID of a file without a security descriptor.
+const NoSecurityID = 0xffffffff
+
+// SecurityDescriptors returns the image's security descriptor table, in
+// self-relative format. Files refer to entries of the table by their
+// SecurityID.
+func (img *Image) SecurityDescriptors() ([][]byte, error) {
+	_, err := img.Open()
+	if err != nil {
+		return nil, err
+	}
+	return append([][]byte(nil), img.sds...), nil
+}
+
+// FilesBySecurityID returns the paths of the files that use each entry of the
+// image's security table, keyed by security ID. Paths are as passed to a
+// WalkFunc by Walk, and entries used by no file are omitted.
+func (img *Image) FilesBySecurityID() (map[uint32][]string, error) {
+	m := make(map[uint32][]string)
+	err := img.Walk(func(p string, f *File, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.SecurityID != NoSecurityID {
+			m[f.SecurityID] = append(m[f.SecurityID], p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Security descriptor control flags.
+//
+//nolint:revive // var-naming: ALL_CAPS
+const (
+	SE_OWNER_DEFAULTED       = 0x0001
+	SE_GROUP_DEFAULTED       = 0x0002
+	SE_DACL_PRESENT          = 0x0004
+	SE_DACL_DEFAULTED        = 0x0008
+	SE_SACL_PRESENT          = 0x0010
+	SE_SACL_DEFAULTED        = 0x0020
+	SE_DACL_AUTO_INHERIT_REQ = 0x0100
+	SE_SACL_AUTO_INHERIT_REQ = 0x0200
+	SE_DACL_AUTO_INHERITED   = 0x0400
+	SE_SACL_AUTO_INHERITED   = 0x0800
+	SE_DACL_PROTECTED        = 0x1000
+	SE_SACL_PROTECTED        = 0x2000
+	SE_SELF_RELATIVE         = 0x8000
+)
+
+// SecurityDescriptor is a decoded self-relative security descriptor.
+type SecurityDescriptor struct {
+	Revision byte
+	Control  uint16
+	Owner    *SID // nil if the descriptor has no owner
+	Group    *SID // nil if the descriptor has no group
+	DACL     *ACL // nil if the DACL is absent or null
+	SACL     *ACL // nil if the SACL is absent or null
+}
+
+// SID is a security identifier.
+type SID struct {
+	Revision            byte
+	IdentifierAuthority uint64 // 48 bits
+	SubAuthorities      []uint32
+}
+
+// ACL is an access control list.
+type ACL struct {
+	Revision byte
+	ACEs     []ACE
+}
+
+// ACE is an access control entry. ObjectType, InheritedObjectType and
+// ApplicationData are only set for ACE types that have them.
+type ACE struct {
+	Type                byte
+	Flags               byte
+	Mask                uint32
+	SID                 *SID
+	ObjectType          *winioguid.GUID
+	InheritedObjectType *winioguid.GUID
+	ApplicationData     []byte // data following the SID, such as a callback condition
+}
+
+// ACE types whose SID is preceded by object type GUIDs.
+var objectACETypes = map[byte]bool{
+	0x05: true, // ACCESS_ALLOWED_OBJECT_ACE_TYPE
+	0x06: true, // ACCESS_DENIED_OBJECT_ACE_TYPE
+	0x07: true, // SYSTEM_AUDIT_OBJECT_ACE_TYPE
+	0x08: true, // SYSTEM_ALARM_OBJECT_ACE_TYPE
+	0x0b: true, // ACCESS_ALLOWED_CALLBACK_OBJECT_ACE_TYPE
+	0x0c: true, // ACCESS_DENIED_CALLBACK_OBJECT_ACE_TYPE
+	0x0f: true, // SYSTEM_AUDIT_CALLBACK_OBJECT_ACE_TYPE
+	0x10: true, // SYSTEM_ALARM_CALLBACK_OBJECT_ACE_TYPE
+}
+
+const (
+	aceObjectTypePresent          = 1
+	aceInheritedObjectTypePresent = 2
+)
+
+var errInvalidSecurityDescriptor = errors.New("invalid security descriptor")
+
+// DecodeSecurityDescriptor decodes a self-relative security descriptor, such
+// as an entry of an image's security table.
+func DecodeSecurityDescriptor(b []byte) (*SecurityDescriptor, error) {
+	if len(b) < 20 {
+		return nil, errInvalidSecurityDescriptor
+	}
+	sd := &SecurityDescriptor{
+		Revision: b[0],
+		Control:  binary.LittleEndian.Uint16(b[2:]),
+	}
+	if sd.Control&SE_SELF_RELATIVE == 0 {
+		return nil, fmt.Errorf("%w: not self-relative", errInvalidSecurityDescriptor)
+	}
+	var err error
+	if off := binary.LittleEndian.Uint32(b[4:]); off != 0 {
+		sd.Owner, err = decodeSIDAt(b, off)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if off := binary.LittleEndian.Uint32(b[8:]); off != 0 {
+		sd.Group, err = decodeSIDAt(b, off)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if off := binary.LittleEndian.Uint32(b[12:]); off != 0 && sd.Control&SE_SACL_PRESENT != 0 {
+		sd.SACL, err = decodeACLAt(b, off)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if off := binary.LittleEndian.Uint32(b[16:]); off != 0 && sd.Control&SE_DACL_PRESENT != 0 {
+		sd.DACL, err = decodeACLAt(b, off)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sd, nil
+}
+
+func decodeSIDAt(b []byte, off uint32) (*SID, error) {
+	if uint64(off) >= uint64(len(b)) {
+		return nil, errInvalidSecurityDescriptor
+	}
+	sid, _, err := decodeSID(b[off:])
+	return sid, err
+}
+
+// decodeSID decodes the SID at the start of b and returns its length.
+func decodeSID(b []byte) (*SID, int, error) {
+	if len(b) < 8 {
+		return nil, 0, errInvalidSecurityDescriptor
+	}
+	n := int(b[1])
+	size := 8 + 4*n
+	if len(b) < size {
+		return nil, 0, errInvalidSecurityDescriptor
+	}
+	sid := &SID{Revision: b[0]}
+	for _, c := range b[2:8] {
+		sid.IdentifierAuthority = sid.IdentifierAuthority<<8 | uint64(c)
+	}
+	for i := 0; i < n; i++ {
+		sid.SubAuthorities = append(sid.SubAuthorities, binary.LittleEndian.Uint32(b[8+4*i:]))
+	}
+	return sid, size, nil
+}
+
+func decodeACLAt(b []byte, off uint32) (*ACL, error) {
+	if uint64(off)+8 > uint64(len(b)) {
+		return nil, errInvalidSecurityDescriptor
+	}
+	b = b[off:]
+	size := int(binary.LittleEndian.Uint16(b[2:]))
+	count := int(binary.LittleEndian.Uint16(b[4:]))
+	if size < 8 || size > len(b) {
+		return nil, errInvalidSecurityDescriptor
+	}
+	acl := &ACL{Revision: b[0]}
+	b = b[8:size]
+	for i := 0; i < count; i++ {
+		if len(b) < 4 {
+			return nil, errInvalidSecurityDescriptor
+		}
+		aceSize := int(binary.LittleEndian.Uint16(b[2:]))
+		if aceSize < 4 || aceSize > len(b) {
+			return nil, errInvalidSecurityDescriptor
+		}
+		ace, err := decodeACE(b[:aceSize])
+		if err != nil {
+			return nil, err
+		}
+		acl.ACEs = append(acl.ACEs, *ace)
+		b = b[aceSize:]
+	}
+	return acl, nil
+}
+
+func decodeACE(b []byte) (*ACE, error) {
+	ace := &ACE{Type: b[0], Flags: b[1]}
+	if len(b) < 8 {
+		return nil, errInvalidSecurityDescriptor
+	}
+	ace.Mask = binary.LittleEndian.Uint32(b[4:])
+	b = b[8:]
+	if objectACETypes[ace.Type] {
+		if len(b) < 4 {
+			return nil, errInvalidSecurityDescriptor
+		}
+		flags := binary.LittleEndian.Uint32(b)
+		b = b[4:]
+		readGUID := func() (*winioguid.GUID, error) {
+			if len(b) < 16 {
+				return nil, errInvalidSecurityDescriptor
+			}
+			var a [16]byte
+			copy(a[:], b)
+			b = b[16:]
+			g := winioguid.FromWindowsArray(a)
+			return &g, nil
+		}
+		var err error
+		if flags&aceObjectTypePresent != 0 {
+			ace.ObjectType, err = readGUID()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if flags&aceInheritedObjectTypePresent != 0 {
+			ace.InheritedObjectType, err = readGUID()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	sid, n, err := decodeSID(b)
+	if err != nil {
+		return nil, err
+	}
+	ace.SID = sid
+	if len(b) > n {
+		ace.ApplicationData = b[n:]
+	}
+	return ace, nil
+}
+
+// String returns the SID in its S-R-I-S-S... form.
+func (sid *SID) String() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "S-%d-", sid.Revision)
+	if sid.IdentifierAuthority >= 1<<32 {
+		fmt.Fprintf(&s, "0x%012X", sid.IdentifierAuthority)
+	} else {
+		fmt.Fprintf(&s, "%d", sid.IdentifierAuthority)
+	}
+	for _, a := range sid.SubAuthorities {
+		fmt.Fprintf(&s, "-%d", a)
+	}
+	return s.String()
+}
+
+var aceTypeStrings = map[byte]string{
+	0x00: "A",
+	0x01: "D",
+	0x02: "AU",
+	0x03: "AL",
+	0x05: "OA",
+	0x06: "OD",
+	0x07: "OU",
+	0x08: "OL",
+	0x09: "XA",
+	0x0a: "XD",
+	0x0b: "ZA",
+	0x0d: "XU",
+	0x11: "ML",
+	0x12: "RA",
+	0x13: "SP",
+}
+
+var aceFlagStrings = []struct {
+	flag byte
+	s    string
+}{
+	{0x01, "OI"},
+	{0x02, "CI"},
+	{0x04, "NP"},
+	{0x08, "IO"},
+	{0x10, "ID"},
+	{0x40, "SA"},
+	{0x80, "FA"},
+}
+
+// String returns the ACE in SDDL form. SIDs are not abbreviated, access
+// masks are in hexadecimal, and application data is omitted.
+func (ace *ACE) String() string {
+	t, ok := aceTypeStrings[ace.Type]
+	if !ok {
+		t = fmt.Sprintf("0x%x", ace.Type)
+	}
+	var flags strings.Builder
+	for _, f := range aceFlagStrings {
+		if ace.Flags&f.flag != 0 {
+			flags.WriteString(f.s)
+		}
+	}
+	var objectType, inheritedObjectType string
+	if ace.ObjectType != nil {
+		objectType = ace.ObjectType.String()
+	}
+	if ace.InheritedObjectType != nil {
+		inheritedObjectType = ace.InheritedObjectType.String()
+	}
+	return fmt.Sprintf("(%s;%s;0x%x;%s;%s;%s)", t, flags.String(), ace.Mask, objectType, inheritedObjectType, ace.SID)
+}
+
+func aclString(prefix string, acl *ACL, present bool, control, protected, autoInherited, autoInheritReq uint16) string {
+	if !present {
+		return ""
+	}
+	var s strings.Builder
+	s.WriteString(prefix)
+	if control&protected != 0 {
+		s.WriteString("P")
+	}
+	if control&autoInheritReq != 0 {
+		s.WriteString("AR")
+	}
+	if control&autoInherited != 0 {
+		s.WriteString("AI")
+	}
+	if acl == nil {
+		s.WriteString("NO_ACCESS_CONTROL")
+		return s.String()
+	}
+	for i := range acl.ACEs {
+		s.WriteString(acl.ACEs[i].String())
+	}
+	return s.String()
+}
+
+// String returns the security descriptor in SDDL form, as described for
+// ACE.String.
+func (sd *SecurityDescriptor) String() string {
+	var s strings.Builder
+	if sd.Owner != nil {
+		s.WriteString("O:" + sd.Owner.String())
+	}
+	if sd.Group != nil {
+		s.WriteString("G:" + sd.Group.String())
+	}
+	s.WriteString(aclString("D:", sd.DACL, sd.Control&SE_DACL_PRESENT != 0, sd.Control,
+		SE_DACL_PROTECTED, SE_DACL_AUTO_INHERITED, SE_DACL_AUTO_INHERIT_REQ))
+	s.WriteString(aclString("S:", sd.SACL, sd.Control&SE_SACL_PRESENT != 0, sd.Control,
+		SE_SACL_PROTECTED, SE_SACL_AUTO_INHERITED, SE_SACL_AUTO_INHERIT_REQ))
+	return s.String()
+}
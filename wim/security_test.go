@@ -0,0 +1,121 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+func encodeTestSID(b *bytes.Buffer, authority byte, subs ...uint32) {
+	b.Write([]byte{1, byte(len(subs)), 0, 0, 0, 0, 0, authority})
+	_ = binary.Write(b, binary.LittleEndian, subs)
+}
+
+// testDACLSD returns a security descriptor equivalent to
+// O:BAG:SYD:PAI(A;OICI;FA;;;SY)(D;;0x1200a9;;;BU).
+func testDACLSD() []byte {
+	var sids bytes.Buffer
+	encodeTestSID(&sids, 5, 32, 544) // BA, 16 bytes
+	encodeTestSID(&sids, 5, 18)      // SY, 12 bytes
+
+	var aces bytes.Buffer
+	aces.Write([]byte{0, 3, 20, 0})
+	_ = binary.Write(&aces, binary.LittleEndian, uint32(0x1f01ff))
+	encodeTestSID(&aces, 5, 18)
+	aces.Write([]byte{1, 0, 24, 0})
+	_ = binary.Write(&aces, binary.LittleEndian, uint32(0x1200a9))
+	encodeTestSID(&aces, 5, 32, 545)
+
+	var b bytes.Buffer
+	b.Write([]byte{1, 0})
+	_ = binary.Write(&b, binary.LittleEndian, uint16(SE_SELF_RELATIVE|SE_DACL_PRESENT|SE_DACL_PROTECTED|SE_DACL_AUTO_INHERITED))
+	_ = binary.Write(&b, binary.LittleEndian, []uint32{20, 36, 0, 48})
+	b.Write(sids.Bytes())
+	b.Write([]byte{2, 0})
+	_ = binary.Write(&b, binary.LittleEndian, []uint16{uint16(8 + aces.Len()), 2, 0})
+	b.Write(aces.Bytes())
+	return b.Bytes()
+}
+
+func TestDecodeSecurityDescriptor(t *testing.T) {
+	sd, err := DecodeSecurityDescriptor(testDACLSD())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.Owner.String() != "S-1-5-32-544" || sd.Group.String() != "S-1-5-18" || sd.SACL != nil {
+		t.Errorf("unexpected security descriptor %+v", sd)
+	}
+	if sd.DACL == nil || len(sd.DACL.ACEs) != 2 {
+		t.Fatalf("unexpected DACL %+v", sd.DACL)
+	}
+	if ace := sd.DACL.ACEs[1]; ace.Type != 1 || ace.Mask != 0x1200a9 || !reflect.DeepEqual(ace.SID.SubAuthorities, []uint32{32, 545}) {
+		t.Errorf("unexpected ACE %+v", ace)
+	}
+	want := "O:S-1-5-32-544G:S-1-5-18D:PAI(A;OICI;0x1f01ff;;;S-1-5-18)(D;;0x1200a9;;;S-1-5-32-545)"
+	if s := sd.String(); s != want {
+		t.Errorf("expected %s, got %s", want, s)
+	}
+
+	sd, err = DecodeSecurityDescriptor(testSD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A present but null DACL.
+	if sd.Owner != nil || sd.DACL != nil || sd.String() != "D:NO_ACCESS_CONTROL" {
+		t.Errorf("unexpected security descriptor %s", sd)
+	}
+
+	b := testDACLSD()
+	for _, n := range []int{0, 19, 30, 60, len(b) - 1} {
+		if _, err := DecodeSecurityDescriptor(b[:n]); err == nil {
+			t.Errorf("expected error for truncated descriptor of %d bytes", n)
+		}
+	}
+}
+
+func TestFilesBySecurityID(t *testing.T) {
+	sd2 := testDACLSD()
+	f := writeTestWIM(t, testFS(), func(name string, fi fs.FileInfo) (*FileMetadata, error) {
+		m, err := testMetadata(name, fi)
+		if err == nil && name == "Windows/System32/cmd.exe" {
+			m.SecurityDescriptor = sd2
+		} else if err == nil && name == "empty.txt" {
+			m.SecurityDescriptor = nil
+		}
+		return m, err
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := r.Image[0]
+	sds, err := img.SecurityDescriptors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sds) != 2 || !bytes.Equal(sds[0], testSD) || !bytes.Equal(sds[1], sd2) {
+		t.Fatalf("unexpected security table %x", sds)
+	}
+	m, err := img.FilesBySecurityID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := m[1]; !reflect.DeepEqual(files, []string{"Windows/System32/cmd.exe"}) {
+		t.Errorf("unexpected files for security ID 1: %v", files)
+	}
+	if n := len(m[0]); n != 7 {
+		t.Errorf("expected 7 files with security ID 0, got %d", n)
+	}
+	empty, err := img.Lookup("empty.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.SecurityID != NoSecurityID || empty.SecurityDescriptor != nil {
+		t.Errorf("unexpected security for empty.txt: %d %x", empty.SecurityID, empty.SecurityDescriptor)
+	}
+}
@@ -0,0 +1,196 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"errors"
+	"io"
+)
+
+// SeekableReader provides random access to the data of a file or stream.
+// Only the compressed chunks covering the requested data are decompressed.
+type SeekableReader interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+}
+
+// OpenSeekable returns a SeekableReader for the stream's contents. Unlike
+// Open, it never verifies the stream's hash.
+func (s *Stream) OpenSeekable() (SeekableReader, error) {
+	return s.wim.blobSeeker(&s.offset)
+}
+
+// OpenSeekable returns a SeekableReader for the file's contents. Unlike Open,
+// it never verifies the file's hash.
+func (f *File) OpenSeekable() (SeekableReader, error) {
+	return f.img.wim.blobSeeker(&f.offset)
+}
+
+// resourceRange is a range of the uncompressed data of a resource.
+type resourceRange struct {
+	raw    *io.SectionReader // set if the resource is not compressed
+	t      *chunkTable       // set if the resource is compressed
+	base   chunkKey          // location of the compressed resource
+	cache  *chunkCache
+	offset int64 // offset of the range within the resource's data
+	size   int64
+}
+
+// readAt reads len(b) bytes at offset off within the range.
+func (rr *resourceRange) readAt(b []byte, off int64) (int, error) {
+	off += rr.offset
+	if rr.raw != nil {
+		return rr.raw.ReadAt(b, off)
+	}
+	n := 0
+	for n < len(b) {
+		data, err := rr.t.readChunk(int(off/rr.t.chunkSize), rr.base, rr.cache)
+		if err != nil {
+			return n, err
+		}
+		k := copy(b[n:], data[off%rr.t.chunkSize:])
+		n += k
+		off += int64(k)
+	}
+	return n, nil
+}
+
+type seekableReader struct {
+	ranges []resourceRange
+	size   int64
+	pos    int64
+}
+
+func (r *Reader) blobSeeker(b *blob) (*seekableReader, error) {
+	if b.stream {
+		return nil, errStreamData
+	}
+	if b.solid != nil {
+		return r.solidSeeker(b.solid, b.Offset, b.OriginalSize)
+	}
+	section := io.NewSectionReader(r.parts[b.part], b.Offset, b.CompressedSize())
+	rr := resourceRange{size: b.OriginalSize}
+	if b.Flags()&resFlagCompressed == 0 {
+		rr.raw = section
+	} else {
+		t, err := readChunkTable(section, b.OriginalSize, r.compression, r.chunkSize, r.budget)
+		if err != nil {
+			return nil, err
+		}
+		rr.t = t
+		rr.base = chunkKey{part: b.part, offset: b.Offset}
+		rr.cache = newChunkCache()
+	}
+	return &seekableReader{ranges: []resourceRange{rr}, size: rr.size}, nil
+}
+
+// solidSeeker is like solidReader, but returns a seekableReader.
+func (r *Reader) solidSeeker(batch *solidBatch, offset, size int64) (*seekableReader, error) {
+	sr := &seekableReader{size: size}
+	left := size
+	for _, res := range batch.res {
+		if left == 0 {
+			break
+		}
+		if offset >= res.originalSize {
+			offset -= res.originalSize
+			continue
+		}
+		section := io.NewSectionReader(r.parts[res.part], res.Offset, res.CompressedSize())
+		t, err := readSolidChunkTable(section, r.budget)
+		if err != nil {
+			return nil, err
+		}
+		n := res.originalSize - offset
+		if n > left {
+			n = left
+		}
+		sr.ranges = append(sr.ranges, resourceRange{
+			t:      t,
+			base:   chunkKey{part: res.part, offset: res.Offset},
+			cache:  r.cache,
+			offset: offset,
+			size:   n,
+		})
+		left -= n
+		offset = 0
+	}
+	if left != 0 {
+		return nil, errors.New("stream extends past the end of its solid resources")
+	}
+	return sr, nil
+}
+
+func (r *seekableReader) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	var err error
+	if int64(len(b)) > r.size-off {
+		b = b[:r.size-off]
+		err = io.EOF
+	}
+	n := 0
+	var start int64
+	for i := range r.ranges {
+		if n == len(b) {
+			break
+		}
+		rr := &r.ranges[i]
+		end := start + rr.size
+		pos := off + int64(n)
+		if pos < end {
+			p := b[n:]
+			if int64(len(p)) > end-pos {
+				p = p[:end-pos]
+			}
+			k, rerr := rr.readAt(p, pos-start)
+			n += k
+			if rerr != nil {
+				if rerr == io.EOF { //nolint:errorlint
+					rerr = io.ErrUnexpectedEOF
+				}
+				return n, rerr
+			}
+		}
+		start = end
+	}
+	return n, err
+}
+
+func (r *seekableReader) Read(b []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	n, err := r.ReadAt(b, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 { //nolint:errorlint
+		err = nil
+	}
+	return n, err
+}
+
+func (r *seekableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (*seekableReader) Close() error {
+	return nil
+}
@@ -0,0 +1,144 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSeekableReader(t *testing.T) {
+	fsys := testFS()
+	r, err := NewReader(bytes.NewReader(testWIMBytes(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := r.Image[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := findFile(t, findFile(t, findFile(t, root, "Windows"), "System32"), "cmd.exe")
+	sr, err := cmd.OpenSeekable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Close()
+	if err := iotest.TestReader(sr, fsys["Windows/System32/cmd.exe"].Data); err != nil {
+		t.Error(err)
+	}
+
+	// A solid batch spanning two resources with several chunks each.
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 600)
+	batch := &solidBatch{res: []solidResource{
+		appendSolidResource(t, &buf, data[:10000], 4096),
+		appendSolidResource(t, &buf, data[10000:], 8192),
+	}}
+	f := bytes.NewReader(buf.Bytes())
+	r = &Reader{r: f, parts: []io.ReaderAt{f}, cache: newChunkCache()}
+	b := &blob{
+		resourceDescriptor: newResourceDescriptor(resFlagSolid, 3000, 9000, 9000),
+		solid:              batch,
+	}
+	sr, err = r.blobSeeker(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := iotest.TestReader(sr, data[3000:12000]); err != nil {
+		t.Error(err)
+	}
+}
+
+// recordingReaderAt records the ranges read from r.
+type recordingReaderAt struct {
+	r     io.ReaderAt
+	m     sync.Mutex
+	reads [][2]int64
+}
+
+func (r *recordingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	r.m.Lock()
+	r.reads = append(r.reads, [2]int64{off, off + int64(len(b))})
+	r.m.Unlock()
+	return r.r.ReadAt(b, off)
+}
+
+func TestSeekableReaderCompressed(t *testing.T) {
+	var data []byte
+	for i := 0; len(data) < 3*chunkSize+chunkSize/2; i++ {
+		data = append(data, fmt.Sprintf("line %d of a compressed resource\n", i*i%1000)...)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("padding before the resource")
+	res := appendLzxResource(t, &buf, data, chunkSize)
+	rec := &recordingReaderAt{r: bytes.NewReader(buf.Bytes())}
+	r := &Reader{r: rec, parts: []io.ReaderAt{rec}, compression: compressionLzx, chunkSize: chunkSize}
+	b := &blob{resourceDescriptor: res}
+
+	sr, err := r.blobSeeker(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Close()
+	if err := iotest.TestReader(sr, data); err != nil {
+		t.Error(err)
+	}
+
+	// Read a range crossing the boundary between chunks 0 and 1, and one
+	// starting in the middle of chunk 2.
+	sr, err = r.blobSeeker(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Close()
+	for _, tc := range []struct{ off, n int64 }{
+		{chunkSize - 100, 300},
+		{2*chunkSize + 1234, 500},
+	} {
+		got := make([]byte, tc.n)
+		n, err := sr.ReadAt(got, tc.off)
+		if err != nil || int64(n) != tc.n {
+			t.Fatalf("ReadAt(%d, %d): %d, %v", tc.off, tc.n, n, err)
+		}
+		if !bytes.Equal(got, data[tc.off:tc.off+tc.n]) {
+			t.Errorf("ReadAt(%d, %d): content mismatch", tc.off, tc.n)
+		}
+	}
+
+	// Only chunk 2 should be read for a range within it.
+	sr, err = r.blobSeeker(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Close()
+	table, err := readChunkTable(io.NewSectionReader(rec.r, res.Offset, res.CompressedSize()), res.OriginalSize, compressionLzx, chunkSize, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := res.Offset + table.chunks[2]
+	end := res.Offset + table.chunks[3]
+	tableEnd := res.Offset + table.chunks[0]
+	rec.m.Lock()
+	rec.reads = nil
+	rec.m.Unlock()
+	got := make([]byte, 100)
+	if _, err := sr.ReadAt(got, 2*chunkSize+10); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[2*chunkSize+10:2*chunkSize+110]) {
+		t.Error("content mismatch")
+	}
+	if len(rec.reads) == 0 {
+		t.Error("expected chunk 2 to be read")
+	}
+	for _, rd := range rec.reads {
+		if rd[1] > tableEnd && (rd[0] < start || rd[1] > end) {
+			t.Errorf("read [%d, %d) outside chunk 2 at [%d, %d)", rd[0], rd[1], start, end)
+		}
+	}
+}
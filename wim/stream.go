@@ -0,0 +1,457 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+)
+
+// A pipable WIM is a variant of the WIM format, introduced by wimlib, that
+// can be written and read sequentially. It starts with a header that does not
+// locate the offset table or XML data, followed by a copy of the XML data,
+// the metadata resource of each image, and the file data. Each of these
+// resources is preceded by a pipableResourceHeader. The offset table, the
+// XML data and a complete header follow, as normal resources.
+//
+// In compressed resources, each chunk is preceded by its compressed size as a
+// uint32, and the chunk table follows the last chunk.
+
+// pipableImageTag replaces wimImageTag in the header of a pipable WIM.
+var pipableImageTag = [...]byte{'W', 'L', 'P', 'W', 'M', 0, 0, 0}
+
+const pipableResourceMagic = 0x2b9b9ba2443db9d8
+
+type pipableResourceHeader struct {
+	Magic        uint64
+	OriginalSize uint64
+	Hash         SHA1Hash
+	Flags        uint32
+}
+
+var errStreamData = errors.New("file data is only available through StreamReader.Read")
+
+// StreamReader reads a pipable WIM sequentially, without seeking, such as
+// from a network connection or a pipe.
+//
+// The images are read by NewStreamReader. Their directory trees can be
+// walked, but the data of their files cannot be opened: the data of each
+// unique file or stream is instead read in turn with Next and Read, and is
+// identified by its SHA-1 hash. Since the size of the data is not known until
+// it is reached, the Size of files and streams in the images is zero.
+type StreamReader struct {
+	r    io.Reader
+	wim  *Reader   // holds the metadata of the images
+	data io.Reader // the data of the current resource
+	done bool
+
+	XMLInfo string   // The XML information about the WIM.
+	Info    WIMInfo  // The parsed XML information.
+	Image   []*Image // The WIM's images.
+}
+
+// NewStreamReader returns a StreamReader that reads a pipable WIM from r.
+func NewStreamReader(r io.Reader) (*StreamReader, error) {
+	return NewStreamReaderWithOptions(r, ReaderOptions{})
+}
+
+// NewStreamReaderWithOptions returns a StreamReader configured by opts.
+// Concurrency is ignored.
+func NewStreamReaderWithOptions(r io.Reader, opts ReaderOptions) (*StreamReader, error) {
+	sr := &StreamReader{r: r}
+	w := &Reader{opts: opts, stream: true}
+	sr.wim = w
+	err := binary.Read(r, binary.LittleEndian, &w.hdr)
+	if err != nil {
+		return nil, err
+	}
+	if w.hdr.ImageTag == wimImageTag {
+		return nil, errors.New("WIM is not pipable, use NewReader")
+	}
+	if w.hdr.ImageTag != pipableImageTag {
+		return nil, &ParseError{Oper: "image tag", Err: errors.New("not a pipable WIM file")}
+	}
+	if w.hdr.Flags&^supportedHdrFlags != 0 {
+		return nil, fmt.Errorf("unsupported WIM flags %x", w.hdr.Flags&^supportedHdrFlags)
+	}
+	if w.hdr.TotalParts != 1 {
+		return nil, errors.New("split pipable WIM not supported")
+	}
+	err = w.initCompression()
+	if err != nil {
+		return nil, err
+	}
+
+	b, _, err := sr.readMetadata()
+	if err != nil {
+		return nil, &ParseError{Oper: "XML data", Err: err}
+	}
+	sr.XMLInfo, err = decodeXML(b)
+	if err != nil {
+		return nil, &ParseError{Oper: "XML data", Err: err}
+	}
+	err = xml.Unmarshal([]byte(sr.XMLInfo), &sr.Info)
+	if err != nil {
+		return nil, &ParseError{Oper: "XML info", Err: err}
+	}
+
+	// The metadata of all the images precedes the file data. It is kept in
+	// memory, as if it were the contents of an uncompressed WIM.
+	var metadata bytes.Buffer
+	for i := 0; i < int(w.hdr.ImageCount); i++ {
+		b, hash, err := sr.readMetadata()
+		if err != nil {
+			return nil, &ParseError{Oper: "image metadata", Err: err}
+		}
+		img := &Image{
+			wim:    w,
+			offset: newResourceDescriptor(resFlagMetadata, int64(metadata.Len()), int64(len(b)), int64(len(b))),
+			hash:   hash,
+		}
+		if imgInfo := sr.Info.image(i + 1); imgInfo != nil {
+			img.ImageInfo = *imgInfo
+		}
+		metadata.Write(b)
+		sr.Image = append(sr.Image, img)
+	}
+	w.r = bytes.NewReader(metadata.Bytes())
+	w.parts = []io.ReaderAt{w.r}
+	w.partHdrs = []wimHeader{w.hdr}
+	w.Info = sr.Info
+	w.XMLInfo = sr.XMLInfo
+	w.Image = sr.Image
+	return sr, nil
+}
+
+// resourceReader returns a reader for the uncompressed data of the resource
+// following hdr.
+func (sr *StreamReader) resourceReader(hdr *pipableResourceHeader) (io.Reader, error) {
+	if hdr.Magic != pipableResourceMagic {
+		return nil, &ParseError{Oper: "resource header", Err: errors.New("invalid magic")}
+	}
+	if resFlag(hdr.Flags)&^(resFlagMetadata|resFlagCompressed) != 0 || hdr.Flags > 0xff {
+		return nil, &ParseError{Oper: "resource header", Err: fmt.Errorf("unsupported resource flags %x", hdr.Flags)}
+	}
+	if hdr.OriginalSize > math.MaxInt64 {
+		return nil, &ParseError{Oper: "resource header", Err: fmt.Errorf("invalid size %d", hdr.OriginalSize)}
+	}
+	size := int64(hdr.OriginalSize)
+	if resFlag(hdr.Flags)&resFlagCompressed == 0 {
+		return &exactReader{r: io.LimitReader(sr.r, size), n: size}, nil
+	}
+	if sr.wim.compression == compressionNone {
+		return nil, &ParseError{Oper: "resource header", Err: errors.New("compressed resource in uncompressed WIM")}
+	}
+	return &pipableChunkReader{r: sr.r, wim: sr.wim, size: size, left: size}, nil
+}
+
+// readMetadata reads the next resource, which must be a metadata resource,
+// and returns its data and hash.
+func (sr *StreamReader) readMetadata() ([]byte, SHA1Hash, error) {
+	var hdr pipableResourceHeader
+	err := binary.Read(sr.r, binary.LittleEndian, &hdr)
+	if err != nil {
+		return nil, hdr.Hash, unexpectedEOF(err)
+	}
+	rd, err := sr.resourceReader(&hdr)
+	if err != nil {
+		return nil, hdr.Hash, err
+	}
+	if resFlag(hdr.Flags)&resFlagMetadata == 0 {
+		return nil, hdr.Hash, errors.New("expected a metadata resource")
+	}
+	if max := sr.wim.opts.maxMetadataSize(); int64(hdr.OriginalSize) > max {
+		return nil, hdr.Hash, fmt.Errorf("%w: metadata size %d exceeds %d bytes", ErrLimitExceeded, hdr.OriginalSize, max)
+	}
+	b := make([]byte, hdr.OriginalSize)
+	_, err = io.ReadFull(rd, b)
+	if err != nil {
+		return nil, hdr.Hash, err
+	}
+	// Consume any trailing chunk table.
+	_, err = io.Copy(io.Discard, rd)
+	return b, hdr.Hash, err
+}
+
+// Next advances to the data of the next file or stream in the WIM, which
+// can then be read with Read, and returns its SHA-1 hash and uncompressed
+// size. Any unread data of the previous file is skipped. Data shared by
+// several files or streams, in one image or across images, appears once.
+// Next returns io.EOF after the last data in the WIM.
+func (sr *StreamReader) Next() (SHA1Hash, int64, error) {
+	if sr.done {
+		return SHA1Hash{}, 0, io.EOF
+	}
+	if sr.data != nil {
+		_, err := io.Copy(io.Discard, sr.data)
+		sr.data = nil
+		if err != nil {
+			return SHA1Hash{}, 0, err
+		}
+	}
+	var hdr pipableResourceHeader
+	err := binary.Read(sr.r, binary.LittleEndian, &hdr)
+	if err == io.EOF || err == nil && (hdr.Magic != pipableResourceMagic || resFlag(hdr.Flags)&resFlagMetadata != 0) { //nolint:errorlint
+		// The file data is followed by the offset table, which does not
+		// have a resource header.
+		sr.done = true
+		return SHA1Hash{}, 0, io.EOF
+	}
+	if err != nil {
+		return SHA1Hash{}, 0, err
+	}
+	rd, err := sr.resourceReader(&hdr)
+	if err != nil {
+		return SHA1Hash{}, 0, err
+	}
+	if sr.wim.opts.VerifyHashes {
+		rd = &verifyingReader{hr: newHashingReader(rd), c: io.NopCloser(nil), hash: hdr.Hash, name: fmt.Sprintf("%x", hdr.Hash)}
+	}
+	sr.data = rd
+	return hdr.Hash, int64(hdr.OriginalSize), nil
+}
+
+// Read reads from the data of the current file or stream. It returns io.EOF
+// at the end of the data.
+func (sr *StreamReader) Read(b []byte) (int, error) {
+	if sr.data == nil {
+		return 0, io.EOF
+	}
+	return sr.data.Read(b)
+}
+
+// Close releases resources associated with the StreamReader. It does not
+// close the underlying reader.
+func (sr *StreamReader) Close() error {
+	return sr.wim.Close()
+}
+
+// exactReader reads exactly n bytes from r, returning io.ErrUnexpectedEOF if
+// r ends early.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *exactReader) Read(b []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	n, err := r.r.Read(b)
+	r.n -= int64(n)
+	if err == io.EOF && r.n != 0 { //nolint:errorlint
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// pipableChunkReader decompresses a compressed resource of a pipable WIM.
+type pipableChunkReader struct {
+	r     io.Reader
+	wim   *Reader
+	size  int64 // the uncompressed size of the resource
+	left  int64 // the uncompressed size of the chunks not yet read
+	chunk []byte
+	buf   []byte
+	err   error
+}
+
+func (cr *pipableChunkReader) Read(b []byte) (int, error) {
+	for len(cr.chunk) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		cr.err = cr.next()
+	}
+	n := copy(b, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	return n, nil
+}
+
+// next reads the next chunk, or the chunk table after the last chunk.
+func (cr *pipableChunkReader) next() error {
+	chunkSize := cr.wim.chunkSize
+	if cr.left == 0 {
+		// Skip the chunk table, which has an entry for each chunk except
+		// the first.
+		entrySize := int64(4)
+		if cr.size > math.MaxUint32 {
+			entrySize = 8
+		}
+		n := (cr.size + chunkSize - 1) / chunkSize
+		if n > 0 {
+			n--
+		}
+		_, err := io.CopyN(io.Discard, cr.r, n*entrySize)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		return io.EOF
+	}
+
+	var compressedSize uint32
+	err := binary.Read(cr.r, binary.LittleEndian, &compressedSize)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	size := chunkSize
+	if size > cr.left {
+		size = cr.left
+	}
+	if compressedSize == 0 || int64(compressedSize) > size {
+		return &ParseError{Oper: "chunk header", Err: fmt.Errorf("invalid compressed chunk size %d", compressedSize)}
+	}
+	err = cr.wim.budget.take(size)
+	if err != nil {
+		return err
+	}
+	if cr.buf == nil {
+		cr.buf = make([]byte, 2*chunkSize)
+	}
+	compressed := cr.buf[:compressedSize]
+	_, err = io.ReadFull(cr.r, compressed)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	cr.left -= size
+	if int64(compressedSize) == size {
+		cr.chunk = compressed
+		return nil
+	}
+	d, err := cr.wim.compression.newReader(bytes.NewReader(compressed), int(size), chunkSize)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	chunk := cr.buf[chunkSize : chunkSize+size]
+	_, err = io.ReadFull(d, chunk)
+	if err != nil {
+		return &ParseError{Oper: "decompression", Err: unexpectedEOF(err)}
+	}
+	cr.chunk = chunk
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF { //nolint:errorlint
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// StreamWriter writes a pipable WIM, which can be read by a StreamReader, to
+// a writer that does not need to support seeking. The data of each file is
+// read twice: once when its image is added, to compute its hash, and again
+// when the StreamWriter is closed. Resources are not compressed.
+type StreamWriter struct {
+	w *Writer
+}
+
+// NewStreamWriter returns a StreamWriter that writes a new pipable WIM to w.
+// Images are added with AddImage, and the WIM is written by Close.
+func NewStreamWriter(w io.Writer) (*StreamWriter, error) {
+	ww := &Writer{
+		w: w,
+		hdr: wimHeader{
+			ImageTag:   pipableImageTag,
+			Size:       wimHeaderSize,
+			Version:    wimVersion,
+			PartNumber: 1,
+			TotalParts: 1,
+		},
+		streams:  make(map[SHA1Hash]*streamDescriptor),
+		deferred: make(map[SHA1Hash]func() (io.ReadCloser, error)),
+	}
+	err := binary.Read(rand.Reader, binary.LittleEndian, &ww.hdr.WIMGuid)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamWriter{w: ww}, nil
+}
+
+// AddImage adds the directory tree at the root of fsys to the WIM as a new
+// image, as with Writer.AddImage. The files in fsys must not change until the
+// StreamWriter is closed.
+func (sw *StreamWriter) AddImage(fsys fs.FS, info ImageInfo, meta MetadataFunc) error {
+	return sw.w.AddImage(fsys, info, meta)
+}
+
+// SetImageInfo replaces the XML information of the image with the given
+// 1-based index, as with Writer.SetImageInfo.
+func (sw *StreamWriter) SetImageInfo(index int, info ImageInfo) error {
+	return sw.w.SetImageInfo(index, info)
+}
+
+// Close writes the WIM. It does not close the underlying writer.
+func (sw *StreamWriter) Close() error {
+	w := sw.w
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	w.hdr.ImageCount = uint32(len(w.images))
+	err := w.write(&w.hdr)
+	if err != nil {
+		return err
+	}
+	xmlData, err := w.xmlData(0)
+	if err != nil {
+		return err
+	}
+	_, err = w.writePipableResource(xmlData, resFlagMetadata, SHA1Hash{})
+	if err != nil {
+		return err
+	}
+	for _, img := range w.images {
+		img.metadata.resourceDescriptor, err = w.writePipableResource(img.data, resFlagMetadata, img.metadata.Hash)
+		if err != nil {
+			return err
+		}
+		img.data = nil
+	}
+	for _, sd := range w.order {
+		err = w.write(&pipableResourceHeader{
+			Magic:        pipableResourceMagic,
+			OriginalSize: uint64(sd.OriginalSize),
+			Hash:         sd.Hash,
+		})
+		if err != nil {
+			return err
+		}
+		sd.Offset = w.offset
+		err = w.copyStream(w.deferred[sd.Hash], sd)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.writeTables()
+	if err != nil {
+		return err
+	}
+	return w.write(&w.hdr)
+}
+
+// writePipableResource writes b as an uncompressed resource preceded by a
+// resource header.
+func (w *Writer) writePipableResource(b []byte, flags resFlag, h SHA1Hash) (resourceDescriptor, error) {
+	err := w.write(&pipableResourceHeader{
+		Magic:        pipableResourceMagic,
+		OriginalSize: uint64(len(b)),
+		Hash:         h,
+		Flags:        uint32(flags),
+	})
+	if err != nil {
+		return resourceDescriptor{}, err
+	}
+	return w.writeResource(b, flags)
+}
@@ -0,0 +1,180 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/fstest"
+
+	"github.com/Microsoft/go-winio/wim/lzx"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	fsys := testFS()
+	fsys2 := testFS()
+	fsys2["Windows/notepad.exe"] = &fstest.MapFile{Data: []byte("notepad 2"), Mode: 0644}
+
+	var buf bytes.Buffer
+	w, err := NewStreamWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddImage(fsys, ImageInfo{Name: "test"}, testMetadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddImage(fsys2, ImageInfo{Name: "test 2"}, testMetadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewReader(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("expected NewReader to reject a pipable WIM")
+	}
+
+	// Hide the underlying reader's type to check that nothing seeks.
+	r, err := NewStreamReaderWithOptions(struct{ io.Reader }{bytes.NewReader(buf.Bytes())}, ReaderOptions{VerifyHashes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.Image) != 2 || r.Image[0].Name != "test" || r.Image[1].Name != "test 2" {
+		t.Fatalf("unexpected images %+v", r.Info.Images)
+	}
+
+	// Collect the data needed by each image. The contents of alternate
+	// streams and reparse points are only checked against their hashes.
+	want := make(map[SHA1Hash][]byte)
+	for i, fsys := range []fstest.MapFS{fsys, fsys2} {
+		err := r.Image[i].Walk(func(p string, f *File, err error) error {
+			if err != nil {
+				return err
+			}
+			for _, s := range f.Streams {
+				want[s.Hash] = nil
+			}
+			if f.IsDir() || f.Hash == (SHA1Hash{}) {
+				return nil
+			}
+			if _, err := f.Open(); err == nil {
+				t.Errorf("%s: expected Open to fail", p)
+			}
+			if f.Attributes&FILE_ATTRIBUTE_REPARSE_POINT == 0 {
+				want[f.Hash] = fsys[p].Data
+			} else {
+				want[f.Hash] = nil
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := 0
+	for {
+		h, size, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+		// Skip some of the data to check that Next discards it.
+		if n%2 == 0 {
+			continue
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, ok := want[h]
+		if !ok {
+			t.Errorf("unexpected data %x", h)
+		}
+		if int64(len(b)) != size || data != nil && !bytes.Equal(b, data) {
+			t.Errorf("data %x: content mismatch", h)
+		}
+	}
+	if n != len(want) {
+		t.Errorf("expected %d streams, got %d", len(want), n)
+	}
+	if _, _, err := r.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestStreamReaderRejectsWIM(t *testing.T) {
+	if _, err := NewStreamReader(bytes.NewReader(testWIMBytes(t))); err == nil {
+		t.Error("expected NewStreamReader to reject a WIM that is not pipable")
+	}
+}
+
+func TestPipableChunkReader(t *testing.T) {
+	const size = 32768
+	data := bytes.Repeat([]byte("pipable chunks "), 3*size/15)
+
+	var (
+		buf    bytes.Buffer
+		table  []uint32
+		offset uint32
+	)
+	for i := 0; i < len(data); i += size {
+		end := i + size
+		if end > len(data) {
+			end = len(data)
+		}
+		var c bytes.Buffer
+		if i == 0 {
+			// The first chunk is compressed and the others are stored.
+			w, err := lzx.NewWriter(&c, lzx.DefaultCompression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(data[i:end]); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			c.Write(data[i:end])
+		}
+		if i != 0 {
+			table = append(table, offset)
+		}
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(c.Len()))
+		buf.Write(c.Bytes())
+		offset += 4 + uint32(c.Len())
+	}
+	_ = binary.Write(&buf, binary.LittleEndian, table)
+	buf.WriteString("next")
+
+	src := bytes.NewReader(buf.Bytes())
+	r := &Reader{compression: compressionLzx, chunkSize: size}
+	cr := &pipableChunkReader{r: src, wim: r, size: int64(len(data)), left: int64(len(data))}
+	got, err := io.ReadAll(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("content mismatch")
+	}
+	// The chunk table is consumed.
+	if rest, _ := io.ReadAll(src); string(rest) != "next" {
+		t.Errorf("unexpected data after the resource: %q", rest)
+	}
+
+	// A truncated resource is an error.
+	cr = &pipableChunkReader{r: bytes.NewReader(buf.Bytes()[:100]), wim: r, size: int64(len(data)), left: int64(len(data))}
+	if _, err := io.ReadAll(cr); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Lookup returns the file at path p in the image. Path elements may be
+// separated by '/' or '\', and are matched case-insensitively, as on
+// Windows. The empty path refers to the root directory. Lookup returns an
+// error wrapping fs.ErrNotExist if there is no such file.
+func (img *Image) Lookup(p string) (*File, error) {
+	f, err := img.Open()
+	if err != nil {
+		return nil, err
+	}
+	clean := path.Clean("/" + strings.ReplaceAll(p, `\`, "/"))
+	if clean == "/" {
+		return f, nil
+	}
+	for _, elem := range strings.Split(clean[1:], "/") {
+		if !f.IsDir() {
+			return nil, &fs.PathError{Op: "lookup", Path: p, Err: fs.ErrNotExist}
+		}
+		files, err := f.Readdir()
+		if err != nil {
+			return nil, err
+		}
+		f = findName(files, elem)
+		if f == nil {
+			return nil, &fs.PathError{Op: "lookup", Path: p, Err: fs.ErrNotExist}
+		}
+	}
+	return f, nil
+}
+
+// findName returns the file named name, preferring an exact match over a
+// case-insensitive one.
+func findName(files []*File, name string) *File {
+	var match *File
+	for _, f := range files {
+		if f.Name == name {
+			return f
+		}
+		if match == nil && strings.EqualFold(f.Name, name) {
+			match = f
+		}
+	}
+	return match
+}
+
+// WalkFunc is the type of the function called by Image.Walk for each file.
+//
+// The path is relative to the image root, with '/' separators, and is "."
+// for the root itself. If reading a directory fails, the function is called
+// a second time for the directory with the error. If the function returns
+// fs.SkipDir for a directory, Walk skips its contents; for any other file, it
+// skips the remaining files in the parent directory.
+type WalkFunc func(path string, f *File, err error) error
+
+// Walk walks the image's file tree in depth-first order, calling fn for each
+// file or directory, including the root. Directory entries are visited in
+// the order they are stored, which keeps the image's metadata reader moving
+// forward.
+func (img *Image) Walk(fn WalkFunc) error {
+	root, err := img.Open()
+	if err != nil {
+		err = fn(".", nil, err)
+	} else {
+		err = walk(".", root, fn)
+	}
+	if err == fs.SkipDir { //nolint:errorlint
+		return nil
+	}
+	return err
+}
+
+func walk(p string, f *File, fn WalkFunc) error {
+	err := fn(p, f, nil)
+	if err != nil || !f.IsDir() {
+		return err
+	}
+	files, err := f.Readdir()
+	if err != nil {
+		return fn(p, f, err)
+	}
+	for _, child := range files {
+		err = walk(path.Join(p, child.Name), child, fn)
+		if err != nil {
+			if err == fs.SkipDir && !child.IsDir() { //nolint:errorlint
+				break
+			}
+			if err != fs.SkipDir { //nolint:errorlint
+				return err
+			}
+		}
+	}
+	return nil
+}
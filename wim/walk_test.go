@@ -0,0 +1,111 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLookup(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(testWIMBytes(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := r.Image[0]
+	for p, want := range map[string]string{
+		"":                            "",
+		"/":                           "",
+		`windows\system32\CMD.EXE`:    "cmd.exe",
+		"/Windows/notepad.exe":        "notepad.exe",
+		"Windows/../Windows/System32": "System32",
+		"Windows/./notepad.exe/":      "notepad.exe",
+	} {
+		f, err := img.Lookup(p)
+		if err != nil {
+			t.Errorf("%q: %v", p, err)
+			continue
+		}
+		if f.Name != want {
+			t.Errorf("%q: expected %q, got %q", p, want, f.Name)
+		}
+	}
+	for _, p := range []string{"missing", "Windows/notepad.exe/x", `Windows\System32\missing`} {
+		if _, err := img.Lookup(p); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%q: expected fs.ErrNotExist, got %v", p, err)
+		}
+	}
+}
+
+func TestLookupAfterSkip(t *testing.T) {
+	// Listing a directory whose entries are stored after those of other
+	// directories skips forward in the metadata resource, which must leave
+	// the position correct for the next listing.
+	dir := &fstest.MapFile{Mode: fs.ModeDir | 0755}
+	fsys := fstest.MapFS{
+		"A":         dir,
+		"A/B":       dir,
+		"A/B/C":     dir,
+		"A/B/C/x":   &fstest.MapFile{Data: []byte("x")},
+		"Z":         dir,
+		"Z/Y":       dir,
+		"Z/Y/X":     dir,
+		"Z/Y/X/y":   &fstest.MapFile{Data: []byte("y")},
+		"Z/Y/X/z":   &fstest.MapFile{Data: []byte("z")},
+		"Z/Y/other": &fstest.MapFile{Data: []byte("other")},
+	}
+	r, err := NewReader(writeTestWIM(t, fsys, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"Z", "Z/Y", "Z/Y/X", "Z/Y/X/z"} {
+		if _, err := r.Image[0].Lookup(p); err != nil {
+			t.Errorf("%q: %v", p, err)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(testWIMBytes(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	err = r.Image[0].Walk(func(p string, f *File, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, p)
+		if p == "Windows/System32" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ". Windows Windows/System32 Windows/notepad.exe empty empty.txt link"
+	if got := strings.Join(paths, " "); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	paths = nil
+	err = r.Image[0].Walk(func(p string, f *File, err error) error {
+		paths = append(paths, p)
+		if p == "Windows/System32/cmd.exe" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(paths, " "); strings.Contains(got, "copy.exe") || !strings.Contains(got, "notepad.exe") {
+		t.Errorf("unexpected walk after skipping a file: %q", got)
+	}
+}
@@ -1,7 +1,7 @@
 //go:build windows || linux
 // +build windows linux
 
-// Package wim implements a WIM file parser.
+// Package wim implements a WIM file parser and writer.
 //
 // WIM files are used to distribute Windows file system and container images.
 // They are documented at https://msdn.microsoft.com/en-us/library/windows/desktop/dd861280.aspx.
@@ -9,16 +9,19 @@ package wim
 
 import (
 	"bytes"
-	"crypto/sha1" //nolint:gosec // not used for secure application
 	"encoding/binary"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"os"
 	"strconv"
 	"sync"
 	"time"
 	"unicode/utf16"
+
+	"github.com/Microsoft/go-winio"
 )
 
 // File attribute constants from Windows.
@@ -104,11 +107,14 @@ const (
 	resFlagMetadata
 	resFlagCompressed
 	resFlagSpanned
+	resFlagSolid
 )
 
-const validate = false
+// solidResourceMagic is the original size recorded for the resources of a
+// solid resource batch, as opposed to the streams stored in them.
+const solidResourceMagic = 0x100000000
 
-const supportedResFlags = resFlagMetadata | resFlagCompressed
+const supportedResFlags = resFlagMetadata | resFlagCompressed | resFlagSolid
 
 func (r *resourceDescriptor) Flags() resFlag {
 	return resFlag(r.FlagsAndCompressedSize >> 56)
@@ -118,6 +124,12 @@ func (r *resourceDescriptor) CompressedSize() int64 {
 	return int64(r.FlagsAndCompressedSize & 0xffffffffffffff)
 }
 
+// isSolidResource returns whether the descriptor is for a resource of a solid
+// resource batch, rather than a stream stored in one.
+func (r *resourceDescriptor) isSolidResource() bool {
+	return r.Flags()&resFlagSolid != 0 && r.OriginalSize == solidResourceMagic
+}
+
 func (r *resourceDescriptor) String() string {
 	s := fmt.Sprintf("%d bytes at %d", r.CompressedSize(), r.Offset)
 	if r.Flags()&4 != 0 {
@@ -126,6 +138,28 @@ func (r *resourceDescriptor) String() string {
 	return s
 }
 
+// blob describes where the data of a file or stream is stored. Streams in a
+// solid resource batch record their offset within the batch's uncompressed
+// data instead of a file offset.
+type blob struct {
+	resourceDescriptor
+	part   int // index of the WIM part holding the data
+	solid  *solidBatch
+	stream bool // the data is only available through a StreamReader
+}
+
+// solidBatch is a sequence of solid resources whose uncompressed data is
+// concatenated and shared by many streams.
+type solidBatch struct {
+	res []solidResource
+}
+
+type solidResource struct {
+	resourceDescriptor
+	part         int
+	originalSize int64 // from the resource's solid header
+}
+
 // SHA1Hash contains the SHA1 hash of a file or stream.
 type SHA1Hash [20]byte
 
@@ -136,34 +170,39 @@ type streamDescriptor struct {
 	Hash       SHA1Hash
 }
 
-type hdrFlag uint32
+// HeaderFlags are the flags in the header of a WIM.
+type HeaderFlags uint32
 
 //nolint:deadcode,varcheck // need unused variables for iota to work
 const (
-	hdrFlagReserved hdrFlag = 1 << iota
-	hdrFlagCompressed
-	hdrFlagReadOnly
-	hdrFlagSpanned
-	hdrFlagResourceOnly
-	hdrFlagMetadataOnly
-	hdrFlagWriteInProgress
-	hdrFlagRpFix
+	headerFlagReserved HeaderFlags = 1 << iota
+	HeaderFlagCompressed
+	HeaderFlagReadOnly
+	HeaderFlagSpanned         // the WIM is a part of a split WIM
+	HeaderFlagResourceOnly    // the WIM only holds file data for another WIM
+	HeaderFlagMetadataOnly    // the WIM's file data is held by another WIM
+	HeaderFlagWriteInProgress // the WIM is being modified
+	HeaderFlagRpFix           // absolute symbolic links and junctions were fixed up on capture
 )
 
 //nolint:deadcode,varcheck // need unused variables for iota to work
 const (
-	hdrFlagCompressReserved hdrFlag = 1 << (iota + 16)
-	hdrFlagCompressXpress
-	hdrFlagCompressLzx
+	headerFlagCompressReserved HeaderFlags = 1 << (iota + 16)
+	HeaderFlagCompressXpress
+	HeaderFlagCompressLzx
+	HeaderFlagCompressLzms
 )
 
-const supportedHdrFlags = hdrFlagRpFix | hdrFlagReadOnly | hdrFlagCompressed | hdrFlagCompressLzx
+const supportedHdrFlags = HeaderFlagRpFix | HeaderFlagReadOnly | HeaderFlagCompressed | HeaderFlagCompressXpress | HeaderFlagCompressLzx | HeaderFlagCompressLzms | HeaderFlagResourceOnly | HeaderFlagMetadataOnly
+
+// supportedPartHdrFlags are additionally supported in split WIM parts.
+const supportedPartHdrFlags = HeaderFlagSpanned
 
 type wimHeader struct {
 	ImageTag        [8]byte
 	Size            uint32
 	Version         uint32
-	Flags           hdrFlag
+	Flags           HeaderFlags
 	CompressionSize uint32
 	WIMGuid         guid
 	PartNumber      uint16
@@ -173,7 +212,6 @@ type wimHeader struct {
 	XMLData         resourceDescriptor
 	BootMetadata    resourceDescriptor
 	BootIndex       uint32
-	Padding         uint32
 	Integrity       resourceDescriptor
 	Unused          [60]byte
 }
@@ -211,6 +249,78 @@ type streamentry struct {
 
 var streamentrySize = int64(binary.Size(streamentry{}) + 8) // includes an 8-byte length prefix
 
+// Tagged items may follow the names in a directory entry, each aligned to
+// 8 bytes.
+type taggedItemHeader struct {
+	Tag    uint32
+	Length uint32
+}
+
+const (
+	tagObjectID = 1
+	tagXattrs   = 2 // Windows extended attributes
+)
+
+// xattrEntryHeader precedes each extended attribute in a tagXattrs item. It
+// is followed by the null-terminated name and then the value, without
+// padding.
+type xattrEntryHeader struct {
+	ValueLength uint16
+	NameLength  uint8
+	Flags       uint8
+}
+
+// decodeTaggedItems decodes the tagged items in b, returning the extended
+// attributes. Unknown items are ignored.
+func decodeTaggedItems(b []byte) ([]winio.ExtendedAttribute, error) {
+	var eas []winio.ExtendedAttribute
+	for len(b) >= 8 {
+		tag := binary.LittleEndian.Uint32(b)
+		n := binary.LittleEndian.Uint32(b[4:])
+		b = b[8:]
+		if uint64(n) > uint64(len(b)) {
+			return nil, errors.New("tagged item too large")
+		}
+		if tag == tagXattrs {
+			var err error
+			eas, err = decodeXattrs(b[:n])
+			if err != nil {
+				return nil, err
+			}
+		}
+		b = b[n:]
+		if pad := int(align8(int64(n)) - int64(n)); pad <= len(b) {
+			b = b[pad:]
+		} else {
+			break
+		}
+	}
+	return eas, nil
+}
+
+func decodeXattrs(b []byte) ([]winio.ExtendedAttribute, error) {
+	var eas []winio.ExtendedAttribute
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("extended attribute entry too short")
+		}
+		valueLen := int(binary.LittleEndian.Uint16(b))
+		nameLen := int(b[2])
+		flags := b[3]
+		b = b[4:]
+		if len(b) < nameLen+1+valueLen || b[nameLen] != 0 {
+			return nil, errors.New("invalid extended attribute entry")
+		}
+		eas = append(eas, winio.ExtendedAttribute{
+			Name:  string(b[:nameLen]),
+			Value: b[nameLen+1 : nameLen+1+valueLen],
+			Flags: flags,
+		})
+		b = b[nameLen+1+valueLen:]
+	}
+	return eas, nil
+}
+
 // Filetime represents a Windows time.
 type Filetime struct {
 	LowDateTime  uint32
@@ -228,6 +338,16 @@ func (ft *Filetime) Time() time.Time {
 	return time.Unix(0, nsec)
 }
 
+// NewFiletime converts t to a Filetime.
+func NewFiletime(t time.Time) Filetime {
+	// 100-nanosecond intervals since January 1, 1601
+	nsec := t.UnixNano()/100 + 116444736000000000
+	return Filetime{
+		LowDateTime:  uint32(nsec),
+		HighDateTime: uint32(nsec >> 32),
+	}
+}
+
 // UnmarshalXML unmarshalls the time from a WIM XML blob.
 func (ft *Filetime) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	type Time struct {
@@ -254,39 +374,17 @@ func (ft *Filetime) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	return nil
 }
 
-type info struct {
-	Image []ImageInfo `xml:"IMAGE"`
-}
-
-// ImageInfo contains information about the image.
-type ImageInfo struct {
-	Name         string       `xml:"NAME"`
-	Index        int          `xml:"INDEX,attr"`
-	CreationTime Filetime     `xml:"CREATIONTIME"`
-	ModTime      Filetime     `xml:"LASTMODIFICATIONTIME"`
-	Windows      *WindowsInfo `xml:"WINDOWS"`
-}
-
-// WindowsInfo contains information about the Windows installation in the image.
-type WindowsInfo struct {
-	Arch             byte     `xml:"ARCH"`
-	ProductName      string   `xml:"PRODUCTNAME"`
-	EditionID        string   `xml:"EDITIONID"`
-	InstallationType string   `xml:"INSTALLATIONTYPE"`
-	ProductType      string   `xml:"PRODUCTTYPE"`
-	Languages        []string `xml:"LANGUAGES>LANGUAGE"`
-	DefaultLanguage  string   `xml:"LANGUAGES>DEFAULT"`
-	Version          Version  `xml:"VERSION"`
-	SystemRoot       string   `xml:"SYSTEMROOT"`
-}
-
-// Version represents a Windows build version.
-type Version struct {
-	Major   int `xml:"MAJOR"`
-	Minor   int `xml:"MINOR"`
-	Build   int `xml:"BUILD"`
-	SPBuild int `xml:"SPBUILD"`
-	SPLevel int `xml:"SPLEVEL"`
+// MarshalXML marshalls the time into a WIM XML blob.
+func (ft Filetime) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type Time struct {
+		Low  string `xml:"LOWPART"`
+		High string `xml:"HIGHPART"`
+	}
+	t := Time{
+		Low:  fmt.Sprintf("0x%08X", ft.LowDateTime),
+		High: fmt.Sprintf("0x%08X", ft.HighDateTime),
+	}
+	return e.EncodeElement(&t, start)
 }
 
 // ParseError is returned when the WIM cannot be parsed.
@@ -307,11 +405,22 @@ func (e *ParseError) Unwrap() error { return e.Err }
 
 // Reader provides functions to read a WIM file.
 type Reader struct {
-	hdr      wimHeader
-	r        io.ReaderAt
-	fileData map[SHA1Hash]resourceDescriptor
+	hdr         wimHeader
+	r           io.ReaderAt
+	parts       []io.ReaderAt // all parts of a split WIM, in part order, then any resource WIMs; parts[0] == r
+	partHdrs    []wimHeader   // the header of each part; partHdrs[0] == hdr
+	partSizes   []int64       // the size of each part
+	numParts    int           // the number of parts of a split WIM, or 1
+	opts        ReaderOptions
+	fileData    map[SHA1Hash]blob
+	compression compressionType
+	chunkSize   int64
+	cache       *chunkCache
+	budget      *byteBudget
+	stream      bool // file data is only available through a StreamReader
 
 	XMLInfo string   // The XML information about the WIM.
+	Info    WIMInfo  // The parsed XML information.
 	Image   []*Image // The WIM's images.
 }
 
@@ -319,8 +428,10 @@ type Reader struct {
 type Image struct {
 	wim        *Reader
 	offset     resourceDescriptor
+	hash       SHA1Hash // the hash of the metadata resource
 	sds        [][]byte
 	rootOffset int64
+	root       *File
 	r          io.ReadCloser
 	curOffset  int64
 	m          sync.Mutex
@@ -339,7 +450,7 @@ type StreamHeader struct {
 type Stream struct {
 	StreamHeader
 	wim    *Reader
-	offset resourceDescriptor
+	offset blob
 }
 
 // FileHeader contains file metadata.
@@ -356,64 +467,266 @@ type FileHeader struct {
 	LinkID             int64
 	ReparseTag         uint32
 	ReparseReserved    uint32
+	SecurityID         uint32 // index into the image's security table, or NoSecurityID
+	ExtendedAttributes []winio.ExtendedAttribute
 }
 
 // File represents a file or directory in a WIM image.
 type File struct {
 	FileHeader
 	Streams      []*Stream
-	offset       resourceDescriptor
+	offset       blob
 	img          *Image
 	subdirOffset int64
+	parent       *File // the directory the file was read from, if any
+}
+
+// ReaderOptions contains optional settings for a Reader.
+type ReaderOptions struct {
+	// VerifyHashes makes the readers returned by File.Open and Stream.Open
+	// check the SHA-1 hash of the data. On a mismatch, the final Read returns
+	// a *HashMismatchError.
+	VerifyHashes bool
+
+	// Concurrency is the number of chunks of a compressed resource that are
+	// decompressed in parallel ahead of a reader returned by File.Open,
+	// Stream.Open or Image.Open. Each reader buffers at most this many
+	// chunks, and no more chunks than fit in MaxDecompressedBytes if it is
+	// set. Values less than 2 decompress chunks sequentially as they are
+	// read. Solid resources, which are read through a shared chunk cache,
+	// are always decompressed sequentially.
+	Concurrency int
+
+	// The following limits bound the resources used to parse a WIM from an
+	// untrusted source. A zero value selects the default limit, and a
+	// negative value disables the limit. Exceeding a limit results in a
+	// *ParseError wrapping ErrLimitExceeded.
+
+	// MaxMetadataSize is the maximum uncompressed size of each image's
+	// metadata resource, of the offset table and of the XML data. The
+	// default is DefaultMaxMetadataSize.
+	MaxMetadataSize int64
+
+	// MaxEntries is the maximum number of entries in a directory and in an
+	// image's security descriptor table. The default is DefaultMaxEntries.
+	MaxEntries int
+
+	// MaxDepth is the maximum depth of a directory below the image root.
+	// The default is DefaultMaxDepth.
+	MaxDepth int
+
+	// MaxDecompressedBytes is the maximum total number of bytes decompressed
+	// by the Reader, including metadata and file data. WIMs whose chunks are
+	// larger than the limit are rejected before any chunk is decompressed,
+	// which also bounds the memory used for each chunk. By default, there is
+	// no limit.
+	MaxDecompressedBytes int64
+
+	// Resources are additional WIMs from which file data is read when it is
+	// not found in the WIM itself, such as the resource-only WIM holding the
+	// file data of a metadata-only WIM. They must use the same compression
+	// format and chunk size as the WIM, and their images are ignored. It is
+	// not supported by StreamReader.
+	Resources []io.ReaderAt
+}
+
+// Default limits used by a Reader.
+const (
+	DefaultMaxMetadataSize = 1 << 30
+	DefaultMaxEntries      = 1 << 20
+	DefaultMaxDepth        = 4096
+)
+
+// ErrLimitExceeded is wrapped by the error returned when a WIM exceeds one of
+// the limits set in ReaderOptions.
+var ErrLimitExceeded = errors.New("WIM resource limit exceeded")
+
+func (opts *ReaderOptions) maxMetadataSize() int64 {
+	return limit(opts.MaxMetadataSize, DefaultMaxMetadataSize, math.MaxInt64)
+}
+
+func (opts *ReaderOptions) maxEntries() int {
+	return int(limit(int64(opts.MaxEntries), DefaultMaxEntries, math.MaxInt32))
+}
+
+func (opts *ReaderOptions) maxDepth() int {
+	return int(limit(int64(opts.MaxDepth), DefaultMaxDepth, math.MaxInt32))
+}
+
+// limit returns the effective value of a limit set to v.
+func limit(v, def, unlimited int64) int64 {
+	switch {
+	case v == 0:
+		return def
+	case v < 0:
+		return unlimited
+	}
+	return v
 }
 
 // NewReader returns a Reader that can be used to read WIM file data.
 func NewReader(f io.ReaderAt) (*Reader, error) {
-	r := &Reader{r: f}
-	section := io.NewSectionReader(f, 0, 0xffff)
-	err := binary.Read(section, binary.LittleEndian, &r.hdr)
+	return NewReaderWithOptions(f, ReaderOptions{})
+}
+
+// NewReaderWithOptions returns a Reader that can be used to read WIM file
+// data, configured by opts.
+func NewReaderWithOptions(f io.ReaderAt, opts ReaderOptions) (*Reader, error) {
+	r := &Reader{r: f, parts: []io.ReaderAt{f}, opts: opts, cache: newChunkCache()}
+	err := readHeader(f, &r.hdr)
 	if err != nil {
 		return nil, err
 	}
 
-	if r.hdr.ImageTag != wimImageTag {
-		return nil, &ParseError{Oper: "image tag", Err: errors.New("not a WIM file")}
-	}
-
 	if r.hdr.Flags&^supportedHdrFlags != 0 {
 		return nil, fmt.Errorf("unsupported WIM flags %x", r.hdr.Flags&^supportedHdrFlags)
 	}
 
-	if r.hdr.CompressionSize != 0x8000 {
-		return nil, fmt.Errorf("unsupported compression size %d", r.hdr.CompressionSize)
+	if r.hdr.TotalParts != 1 {
+		return nil, errors.New("multi-part WIM not supported, use NewMultiPartReader")
 	}
 
-	if r.hdr.TotalParts != 1 {
-		return nil, errors.New("multi-part WIM not supported")
+	r.partHdrs = []wimHeader{r.hdr}
+	return r.init()
+}
+
+// NewMultiPartReader returns a Reader for a split WIM, given all of its parts
+// in any order. The parts must share the same WIM GUID.
+func NewMultiPartReader(parts []io.ReaderAt) (*Reader, error) {
+	return NewMultiPartReaderWithOptions(parts, ReaderOptions{})
+}
+
+// NewMultiPartReaderWithOptions is like NewMultiPartReader, but the Reader
+// is configured by opts.
+func NewMultiPartReaderWithOptions(parts []io.ReaderAt, opts ReaderOptions) (*Reader, error) {
+	if len(parts) == 0 {
+		return nil, errors.New("no WIM parts")
 	}
+	r := &Reader{parts: make([]io.ReaderAt, len(parts)), opts: opts, cache: newChunkCache()}
+	hdrs := make([]wimHeader, len(parts))
+	for _, f := range parts {
+		var hdr wimHeader
+		err := readHeader(f, &hdr)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Flags&^(supportedHdrFlags|supportedPartHdrFlags) != 0 {
+			return nil, fmt.Errorf("unsupported WIM flags %x", hdr.Flags&^(supportedHdrFlags|supportedPartHdrFlags))
+		}
+		if int(hdr.TotalParts) != len(parts) {
+			return nil, fmt.Errorf("WIM has %d parts, but %d were provided", hdr.TotalParts, len(parts))
+		}
+		n := int(hdr.PartNumber)
+		if n < 1 || n > len(parts) {
+			return nil, &ParseError{Oper: "header", Err: fmt.Errorf("invalid part number %d", n)}
+		}
+		if r.parts[n-1] != nil {
+			return nil, fmt.Errorf("duplicate WIM part %d", n)
+		}
+		r.parts[n-1] = f
+		hdrs[n-1] = hdr
+	}
+
+	r.r = r.parts[0]
+	r.hdr = hdrs[0]
+	r.partHdrs = hdrs
+	for i, hdr := range hdrs {
+		if hdr.WIMGuid != r.hdr.WIMGuid {
+			return nil, fmt.Errorf("WIM part %d has GUID %s, expected %s", i+1, hdr.WIMGuid, r.hdr.WIMGuid)
+		}
+		if hdr.Flags != r.hdr.Flags {
+			return nil, fmt.Errorf("WIM part %d has mismatched flags %x", i+1, hdr.Flags)
+		}
+	}
+
+	return r.init()
+}
 
-	fileData, images, err := r.readOffsetTable(&r.hdr.OffsetTable)
+func readHeader(f io.ReaderAt, hdr *wimHeader) error {
+	section := io.NewSectionReader(f, 0, 0xffff)
+	err := binary.Read(section, binary.LittleEndian, hdr)
+	if err != nil {
+		return err
+	}
+
+	if hdr.ImageTag == pipableImageTag {
+		return errors.New("pipable WIM not supported, use NewStreamReader")
+	}
+	if hdr.ImageTag != wimImageTag {
+		return &ParseError{Oper: "image tag", Err: errors.New("not a WIM file")}
+	}
+	return nil
+}
+
+// init reads the offset tables of each part and the XML data.
+func (r *Reader) init() (*Reader, error) {
+	err := r.initCompression()
 	if err != nil {
 		return nil, err
 	}
 
+	r.numParts = len(r.parts)
+	for i, f := range r.opts.Resources {
+		var hdr wimHeader
+		err := readHeader(f, &hdr)
+		if err != nil {
+			return nil, fmt.Errorf("resource WIM %d: %w", i+1, err)
+		}
+		if hdr.Flags&^supportedHdrFlags != 0 {
+			return nil, fmt.Errorf("resource WIM %d: unsupported WIM flags %x", i+1, hdr.Flags&^supportedHdrFlags)
+		}
+		if hdr.TotalParts != 1 {
+			return nil, fmt.Errorf("resource WIM %d: multi-part WIM not supported", i+1)
+		}
+		const compressionFlags = HeaderFlagCompressed | HeaderFlagCompressXpress | HeaderFlagCompressLzx | HeaderFlagCompressLzms
+		if hdr.Flags&compressionFlags != r.hdr.Flags&compressionFlags ||
+			r.compression != compressionNone && hdr.CompressionSize != r.hdr.CompressionSize {
+			return nil, fmt.Errorf("resource WIM %d: mismatched compression", i+1)
+		}
+		r.parts = append(r.parts, f)
+		r.partHdrs = append(r.partHdrs, hdr)
+	}
+
+	r.partSizes = make([]int64, len(r.parts))
+	for i, f := range r.parts {
+		r.partSizes[i], err = readerAtSize(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fileData := make(map[SHA1Hash]blob)
+	var images []*Image
+	for i := range r.partHdrs {
+		partImages, err := r.readOffsetTable(i, &r.partHdrs[i].OffsetTable, fileData)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, partImages...)
+	}
+
+	if len(images) != int(r.hdr.ImageCount) {
+		return nil, &ParseError{Oper: "offset table", Err: errors.New("mismatched image count")}
+	}
+	if int(r.hdr.BootIndex) > len(images) {
+		return nil, &ParseError{Oper: "header", Err: fmt.Errorf("invalid boot index %d", r.hdr.BootIndex)}
+	}
+
 	xmlinfo, err := r.readXML()
 	if err != nil {
 		return nil, err
 	}
 
-	var inf info
-	err = xml.Unmarshal([]byte(xmlinfo), &inf)
-	if err != nil {
-		return nil, &ParseError{Oper: "XML info", Err: err}
+	if xmlinfo != "" {
+		err = xml.Unmarshal([]byte(xmlinfo), &r.Info)
+		if err != nil {
+			return nil, &ParseError{Oper: "XML info", Err: err}
+		}
 	}
 
 	for i, img := range images {
-		for _, imgInfo := range inf.Image {
-			if imgInfo.Index == i+1 {
-				img.ImageInfo = imgInfo
-				break
-			}
+		if imgInfo := r.Info.image(i + 1); imgInfo != nil {
+			img.ImageInfo = *imgInfo
 		}
 	}
 
@@ -423,6 +736,107 @@ func NewReader(f io.ReaderAt) (*Reader, error) {
 	return r, nil
 }
 
+// readerAtSize returns the size of f. Most readers, such as *os.File and
+// *bytes.Reader, report their size; otherwise it is found by a binary search
+// for the end of the data.
+func readerAtSize(f io.ReaderAt) (int64, error) {
+	switch f := f.(type) {
+	case interface{ Size() int64 }:
+		return f.Size(), nil
+	case interface{ Stat() (os.FileInfo, error) }:
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	var b [1]byte
+	// inside reports whether off is before the end of the data.
+	inside := func(off int64) (bool, error) {
+		n, err := f.ReadAt(b[:], off)
+		if n == 1 {
+			return true, nil
+		}
+		if err == io.EOF || err == nil { //nolint:errorlint
+			return false, nil
+		}
+		return false, err
+	}
+	lo, hi := int64(0), int64(1)
+	for {
+		ok, err := inside(hi - 1)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		lo = hi
+		if hi > math.MaxInt64/2 {
+			return 0, errors.New("WIM size out of range")
+		}
+		hi *= 2
+	}
+	// The size is at least lo and less than hi.
+	for lo+1 < hi {
+		mid := lo + (hi-lo)/2
+		ok, err := inside(mid - 1)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// checkExtent checks that a resource stored in the given part lies within
+// it. The sizes of resources bound the memory used to read them, so they
+// must not be trusted until checked.
+func (r *Reader) checkExtent(part int, res *resourceDescriptor) error {
+	size := r.partSizes[part]
+	if res.Offset < 0 || res.Offset > size || res.CompressedSize() > size-res.Offset {
+		return fmt.Errorf("resource at offset %d of size %d extends past the end of the WIM", res.Offset, res.CompressedSize())
+	}
+	return nil
+}
+
+// initCompression sets up the decompression of resources, as described by
+// the header and the reader options.
+func (r *Reader) initCompression() error {
+	if r.opts.MaxDecompressedBytes > 0 {
+		r.budget = &byteBudget{limit: r.opts.MaxDecompressedBytes}
+	}
+	if r.hdr.Flags&HeaderFlagCompressed != 0 {
+		switch r.hdr.Flags & (HeaderFlagCompressXpress | HeaderFlagCompressLzx | HeaderFlagCompressLzms) {
+		case HeaderFlagCompressXpress:
+			r.compression = compressionXpress
+		case HeaderFlagCompressLzx:
+			r.compression = compressionLzx
+		case HeaderFlagCompressLzms:
+			r.compression = compressionLzms
+		default:
+			return fmt.Errorf("unsupported WIM compression flags %x", r.hdr.Flags)
+		}
+
+		// Most WIMs use 32KB chunks, but LZMS WIMs typically use 128KB
+		// chunks, and other sizes can be chosen when capturing.
+		size := int64(r.hdr.CompressionSize)
+		if !r.compression.validChunkSize(size) {
+			return fmt.Errorf("unsupported %s compression size %d", r.compression, size)
+		}
+		err := r.budget.checkChunkSize(size)
+		if err != nil {
+			return err
+		}
+		r.chunkSize = size
+	}
+	return nil
+}
+
 // Close releases resources associated with the Reader.
 func (r *Reader) Close() error {
 	for _, img := range r.Image {
@@ -436,13 +850,18 @@ func (r *Reader) resourceReader(hdr *resourceDescriptor) (io.ReadCloser, error)
 }
 
 func (r *Reader) resourceReaderWithOffset(hdr *resourceDescriptor, offset int64) (io.ReadCloser, error) {
+	return r.partResourceReader(0, hdr, offset)
+}
+
+// partResourceReader returns a reader for a resource stored in the given part.
+func (r *Reader) partResourceReader(part int, hdr *resourceDescriptor, offset int64) (io.ReadCloser, error) {
 	var sr io.ReadCloser
-	section := io.NewSectionReader(r.r, hdr.Offset, hdr.CompressedSize())
+	section := io.NewSectionReader(r.parts[part], hdr.Offset, hdr.CompressedSize())
 	if hdr.Flags()&resFlagCompressed == 0 {
 		_, _ = section.Seek(offset, 0)
 		sr = io.NopCloser(section)
 	} else {
-		cr, err := newCompressedReader(section, hdr.OriginalSize, offset)
+		cr, err := newCompressedReader(section, hdr.OriginalSize, offset, r.compression, r.chunkSize, r.opts.Concurrency, r.budget)
 		if err != nil {
 			return nil, err
 		}
@@ -452,8 +871,110 @@ func (r *Reader) resourceReaderWithOffset(hdr *resourceDescriptor, offset int64)
 	return sr, nil
 }
 
-func (r *Reader) readResource(hdr *resourceDescriptor) ([]byte, error) {
-	rsrc, err := r.resourceReader(hdr)
+// findBlob returns the location of the data with the given hash.
+func (r *Reader) findBlob(h SHA1Hash) (blob, bool) {
+	if r.stream {
+		return blob{stream: true}, true
+	}
+	b, ok := r.fileData[h]
+	return b, ok
+}
+
+// blobReader returns a reader for the data of a file or stream.
+func (r *Reader) blobReader(b *blob) (io.ReadCloser, error) {
+	if b.stream {
+		return nil, errStreamData
+	}
+	if b.solid == nil {
+		return r.partResourceReader(b.part, &b.resourceDescriptor, 0)
+	}
+	return r.solidReader(b.solid, b.Offset, b.OriginalSize)
+}
+
+// solidReader returns a reader for size bytes starting at offset within the
+// concatenated uncompressed data of a solid resource batch.
+func (r *Reader) solidReader(batch *solidBatch, offset, size int64) (io.ReadCloser, error) {
+	var readers []io.ReadCloser
+	closeAll := func() {
+		for _, rc := range readers {
+			rc.Close()
+		}
+	}
+	left := size
+	for _, res := range batch.res {
+		if left == 0 {
+			break
+		}
+		if offset >= res.originalSize {
+			offset -= res.originalSize
+			continue
+		}
+		section := io.NewSectionReader(r.parts[res.part], res.Offset, res.CompressedSize())
+		cr, err := newSolidReader(section, chunkKey{part: res.part, offset: res.Offset}, offset, r.cache, r.budget)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		n := res.originalSize - offset
+		if n > left {
+			n = left
+		}
+		readers = append(readers, &limitedReadCloser{io.LimitReader(cr, n), cr})
+		left -= n
+		offset = 0
+	}
+	if left != 0 {
+		closeAll()
+		return nil, errors.New("stream extends past the end of its solid resources")
+	}
+	return &multiReadCloser{readers: readers}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type multiReadCloser struct {
+	readers []io.ReadCloser
+}
+
+func (m *multiReadCloser) Read(b []byte) (int, error) {
+	for len(m.readers) > 0 {
+		n, err := m.readers[0].Read(b)
+		if err == io.EOF { //nolint:errorlint
+			m.readers[0].Close()
+			m.readers = m.readers[1:]
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+func (m *multiReadCloser) Close() error {
+	var err error
+	for _, rc := range m.readers {
+		if err1 := rc.Close(); err == nil {
+			err = err1
+		}
+	}
+	m.readers = nil
+	return err
+}
+
+// readMetadataResource reads a resource holding WIM metadata, which is
+// limited to MaxMetadataSize bytes.
+func (r *Reader) readMetadataResource(part int, hdr *resourceDescriptor) ([]byte, error) {
+	if err := r.checkMetadataSize(hdr); err != nil {
+		return nil, err
+	}
+	if err := r.checkExtent(part, hdr); err != nil {
+		return nil, err
+	}
+	rsrc, err := r.partResourceReader(part, hdr, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -461,90 +982,169 @@ func (r *Reader) readResource(hdr *resourceDescriptor) ([]byte, error) {
 	return io.ReadAll(rsrc)
 }
 
+func (r *Reader) checkMetadataSize(hdr *resourceDescriptor) error {
+	size := hdr.OriginalSize
+	if hdr.Flags()&resFlagCompressed == 0 {
+		size = hdr.CompressedSize()
+	}
+	if max := r.opts.maxMetadataSize(); size > max {
+		return fmt.Errorf("%w: metadata size %d exceeds %d bytes", ErrLimitExceeded, size, max)
+	}
+	return nil
+}
+
 func (r *Reader) readXML() (string, error) {
 	if r.hdr.XMLData.CompressedSize() == 0 {
 		return "", nil
 	}
-	rsrc, err := r.resourceReader(&r.hdr.XMLData)
+	b, err := r.readMetadataResource(0, &r.hdr.XMLData)
 	if err != nil {
-		return "", err
+		return "", &ParseError{Oper: "XML data", Err: err}
 	}
-	defer rsrc.Close()
-
-	xmlData := make([]uint16, r.hdr.XMLData.OriginalSize/2)
-	err = binary.Read(rsrc, binary.LittleEndian, xmlData)
+	s, err := decodeXML(b)
 	if err != nil {
 		return "", &ParseError{Oper: "XML data", Err: err}
 	}
+	return s, nil
+}
 
-	// The BOM will always indicate little-endian UTF-16.
-	if xmlData[0] != 0xfeff {
-		return "", &ParseError{Oper: "XML data", Err: errors.New("invalid BOM")}
+// readSolidResource reads the header of a resource in a solid resource batch.
+func (r *Reader) readSolidResource(part int, res *resourceDescriptor) (solidResource, error) {
+	var hdr solidHeader
+	section := io.NewSectionReader(r.parts[part], res.Offset, res.CompressedSize())
+	err := binary.Read(section, binary.LittleEndian, &hdr)
+	if err != nil {
+		return solidResource{}, err
+	}
+	if hdr.OriginalSize > 1<<62 {
+		return solidResource{}, errors.New("invalid solid resource size")
 	}
-	return string(utf16.Decode(xmlData[1:])), nil
+	return solidResource{resourceDescriptor: *res, part: part, originalSize: int64(hdr.OriginalSize)}, nil
 }
 
-func (r *Reader) readOffsetTable(res *resourceDescriptor) (map[SHA1Hash]resourceDescriptor, []*Image, error) {
-	fileData := make(map[SHA1Hash]resourceDescriptor)
+// readOffsetTable reads the offset table stored in part tablePart, adding its
+// streams to fileData and returning its images. Each part of a split WIM has
+// its own offset table, whose entries may refer to any part.
+func (r *Reader) readOffsetTable(tablePart int, res *resourceDescriptor, fileData map[SHA1Hash]blob) ([]*Image, error) {
 	var images []*Image
 
-	offsetTable, err := r.readResource(res)
+	// Consecutive solid resource entries form a batch, and the solid stream
+	// entries that follow refer to the most recent batch. Stream entries
+	// that precede any batch belong to the next one.
+	var (
+		batch        *solidBatch
+		pending      []SHA1Hash
+		inSolidBatch bool
+	)
+
+	offsetTable, err := r.readMetadataResource(tablePart, res)
 	if err != nil {
-		return nil, nil, &ParseError{Oper: "offset table", Err: err}
+		return nil, &ParseError{Oper: "offset table", Err: err}
 	}
 
 	br := bytes.NewReader(offsetTable)
-	for i := 0; ; i++ {
+	for {
 		var res streamDescriptor
 		err := binary.Read(br, binary.LittleEndian, &res)
 		if err == io.EOF { //nolint:errorlint
 			break
 		}
 		if err != nil {
-			return nil, nil, &ParseError{Oper: "offset table", Err: err}
+			return nil, &ParseError{Oper: "offset table", Err: err}
 		}
-		if res.Flags()&^supportedResFlags != 0 {
-			return nil, nil, &ParseError{Oper: "offset table", Err: errors.New("unsupported resource flag")}
+		flags := supportedResFlags
+		if r.numParts > 1 {
+			flags |= resFlagSpanned
+		}
+		if res.Flags()&^flags != 0 {
+			return nil, &ParseError{Oper: "offset table", Err: errors.New("unsupported resource flag")}
 		}
 
-		// Validation for ad-hoc testing
-		if validate {
-			sec, err := r.resourceReader(&res.resourceDescriptor)
-			if err != nil {
-				panic(fmt.Sprint(i, err))
+		part := int(res.PartNumber) - 1
+		switch {
+		case tablePart >= r.numParts:
+			// The entries of a resource WIM refer to the resource WIM
+			// itself, and its images are ignored.
+			if res.Flags()&resFlagMetadata != 0 {
+				continue
 			}
-			hash := sha1.New() //nolint:gosec // not used for secure application
-			_, err = io.Copy(hash, sec)
-			sec.Close()
+			part = tablePart
+		case r.numParts == 1:
+			part = 0
+		case part < 0 || part >= r.numParts:
+			return nil, &ParseError{Oper: "offset table", Err: fmt.Errorf("invalid part number %d", res.PartNumber)}
+		}
+		if _, ok := fileData[res.Hash]; ok && res.Flags()&resFlagMetadata == 0 && !res.isSolidResource() {
+			// Split WIM parts may list the same stream.
+			continue
+		}
+		if res.Flags()&resFlagSolid == 0 || res.isSolidResource() {
+			// Solid stream entries hold an offset within their batch
+			// rather than within the part.
+			err := r.checkExtent(part, &res.resourceDescriptor)
 			if err != nil {
-				panic(fmt.Sprint(i, err))
+				return nil, &ParseError{Oper: "offset table", Err: err}
+			}
+		}
+
+		if res.Flags()&resFlagSolid != 0 {
+			if res.isSolidResource() {
+				if !inSolidBatch {
+					batch = &solidBatch{}
+					for _, h := range pending {
+						b := fileData[h]
+						b.solid = batch
+						fileData[h] = b
+					}
+					pending = nil
+				}
+				sr, err := r.readSolidResource(part, &res.resourceDescriptor)
+				if err != nil {
+					return nil, &ParseError{Oper: "solid resource", Err: err}
+				}
+				batch.res = append(batch.res, sr)
+				inSolidBatch = true
+				continue
+			}
+			inSolidBatch = false
+			if res.Flags()&resFlagMetadata != 0 {
+				return nil, &ParseError{Oper: "offset table", Err: errors.New("metadata resource in solid resource")}
 			}
-			var cmphash SHA1Hash
-			copy(cmphash[:], hash.Sum(nil))
-			if cmphash != res.Hash {
-				panic(fmt.Sprint(i, "hash mismatch"))
+			if batch == nil {
+				pending = append(pending, res.Hash)
 			}
+			fileData[res.Hash] = blob{resourceDescriptor: res.resourceDescriptor, part: part, solid: batch}
+			continue
 		}
+		inSolidBatch = false
 
 		if res.Flags()&resFlagMetadata != 0 {
+			if part != 0 {
+				return nil, &ParseError{Oper: "offset table", Err: errors.New("metadata resource outside the first part")}
+			}
+			if tablePart != 0 {
+				// Images are taken from the first part's table.
+				continue
+			}
 			image := &Image{
 				wim:    r,
 				offset: res.resourceDescriptor,
+				hash:   res.Hash,
 			}
 			images = append(images, image)
 		} else {
-			fileData[res.Hash] = res.resourceDescriptor
+			fileData[res.Hash] = blob{resourceDescriptor: res.resourceDescriptor, part: part}
 		}
 	}
 
-	if len(images) != int(r.hdr.ImageCount) {
-		return nil, nil, &ParseError{Oper: "offset table", Err: errors.New("mismatched image count")}
+	if len(pending) != 0 {
+		return nil, &ParseError{Oper: "offset table", Err: errors.New("solid stream entry without solid resource")}
 	}
 
-	return fileData, images, nil
+	return images, nil
 }
 
-func (*Reader) readSecurityDescriptors(rsrc io.Reader) (sds [][]byte, n int64, err error) {
+func (r *Reader) readSecurityDescriptors(rsrc io.Reader, metadataSize int64) (sds [][]byte, n int64, err error) {
 	var secBlock securityblockDisk
 	err = binary.Read(rsrc, binary.LittleEndian, &secBlock)
 	if err != nil {
@@ -553,17 +1153,29 @@ func (*Reader) readSecurityDescriptors(rsrc io.Reader) (sds [][]byte, n int64, e
 
 	n += securityblockDiskSize
 
+	// Check the sizes before allocating anything.
+	if max := r.opts.maxEntries(); int64(secBlock.NumEntries) > int64(max) {
+		return sds, n, &ParseError{Oper: "security table", Err: fmt.Errorf("%w: %d security descriptors exceeds %d", ErrLimitExceeded, secBlock.NumEntries, max)}
+	}
+	if n+int64(secBlock.NumEntries)*8 > metadataSize {
+		return sds, n, &ParseError{Oper: "security table", Err: errors.New("security table larger than metadata resource")}
+	}
+
 	secSizes := make([]int64, secBlock.NumEntries)
 	err = binary.Read(rsrc, binary.LittleEndian, &secSizes)
 	if err != nil {
 		return sds, n, &ParseError{Oper: "security table sizes", Err: err}
 	}
 
-	n += int64(secBlock.NumEntries * 8)
+	n += int64(secBlock.NumEntries) * 8
 
 	sds = make([][]byte, secBlock.NumEntries)
 	for i, size := range secSizes {
-		sd := make([]byte, size&0xffffffff)
+		size &= 0xffffffff
+		if n+size > metadataSize {
+			return sds, n, &ParseError{Oper: "security descriptor", Err: errors.New("security descriptor larger than metadata resource")}
+		}
+		sd := make([]byte, size)
 		_, err = io.ReadFull(rsrc, sd)
 		if err != nil {
 			return sds, n, &ParseError{Oper: "security descriptor", Err: err}
@@ -589,11 +1201,15 @@ func (*Reader) readSecurityDescriptors(rsrc io.Reader) (sds [][]byte, n int64, e
 // Open parses the image and returns the root directory.
 func (img *Image) Open() (*File, error) {
 	if img.sds == nil {
+		err := img.wim.checkMetadataSize(&img.offset)
+		if err != nil {
+			return nil, &ParseError{Oper: "image metadata", Err: err}
+		}
 		rsrc, err := img.wim.resourceReaderWithOffset(&img.offset, img.rootOffset)
 		if err != nil {
 			return nil, err
 		}
-		sds, n, err := img.wim.readSecurityDescriptors(rsrc)
+		sds, n, err := img.wim.readSecurityDescriptors(rsrc, img.metadataSize())
 		if err != nil {
 			rsrc.Close()
 			return nil, err
@@ -604,14 +1220,23 @@ func (img *Image) Open() (*File, error) {
 		img.curOffset = n
 	}
 
-	f, err := img.readdir(img.rootOffset)
-	if err != nil {
-		return nil, err
-	}
-	if len(f) != 1 {
-		return nil, &ParseError{Oper: "root directory", Err: errors.New("expected exactly 1 root directory entry")}
+	if img.root == nil {
+		f, err := img.readdir(img.rootOffset)
+		if err != nil {
+			return nil, err
+		}
+		if len(f) != 1 {
+			return nil, &ParseError{Oper: "root directory", Err: errors.New("expected exactly 1 root directory entry")}
+		}
+		img.root = f[0]
 	}
-	return f[0], err
+	root := *img.root
+	return &root, nil
+}
+
+// metadataSize returns the uncompressed size of the image's metadata resource.
+func (img *Image) metadataSize() int64 {
+	return img.offset.OriginalSize
 }
 
 func (img *Image) reset() {
@@ -647,9 +1272,11 @@ func (img *Image) readdir(offset int64) ([]*File, error) {
 			}
 			return nil, err
 		}
+		img.curOffset = offset
 	}
 
 	var entries []*File
+	max := img.wim.opts.maxEntries()
 	for {
 		e, n, err := img.readNextEntry(img.r)
 		img.curOffset += n
@@ -660,6 +1287,10 @@ func (img *Image) readdir(offset int64) ([]*File, error) {
 			img.reset()
 			return nil, err
 		}
+		if len(entries) == max {
+			img.reset()
+			return nil, &ParseError{Oper: "directory", Err: fmt.Errorf("%w: more than %d directory entries", ErrLimitExceeded, max)}
+		}
 		entries = append(entries, e)
 	}
 	return entries, nil
@@ -689,7 +1320,7 @@ func (img *Image) readNextEntry(r io.Reader) (*File, int64, error) {
 
 	left -= direntrySize
 
-	namesLen := int64(dentry.FileNameLength + 2 + dentry.ShortNameLength)
+	namesLen := int64(dentry.FileNameLength) + 2 + int64(dentry.ShortNameLength)
 	if left < namesLen {
 		return nil, 0, &ParseError{Oper: "directory entry", Err: errors.New("size too short for names")}
 	}
@@ -711,11 +1342,11 @@ func (img *Image) readNextEntry(r io.Reader) (*File, int64, error) {
 		shortName = string(utf16.Decode(names[dentry.FileNameLength/2+1:]))
 	}
 
-	var offset resourceDescriptor
+	var offset blob
 	zerohash := SHA1Hash{}
 	if dentry.Hash != zerohash {
 		var ok bool
-		offset, ok = img.wim.fileData[dentry.Hash]
+		offset, ok = img.wim.findBlob(dentry.Hash)
 		if !ok {
 			return nil, 0, &ParseError{
 				Oper: "directory entry",
@@ -758,18 +1389,39 @@ func (img *Image) readNextEntry(r io.Reader) (*File, int64, error) {
 		return nil, 0, &ParseError{Oper: "directory entry", Path: name, Err: errors.New("no subdirectory data for directory")}
 	} else if !isDir && f.subdirOffset != 0 {
 		return nil, 0, &ParseError{Oper: "directory entry", Path: name, Err: errors.New("unexpected subdirectory data for non-directory")}
+	} else if f.subdirOffset < 0 || f.subdirOffset >= img.metadataSize() {
+		return nil, 0, &ParseError{Oper: "directory entry", Path: name, Err: errors.New("subdirectory offset outside metadata resource")}
 	}
 
-	if dentry.SecurityID != 0xffffffff {
+	f.SecurityID = dentry.SecurityID
+	if dentry.SecurityID != NoSecurityID {
+		if uint64(dentry.SecurityID) >= uint64(len(img.sds)) {
+			return nil, 0, &ParseError{Oper: "directory entry", Path: name, Err: fmt.Errorf("invalid security ID %d", dentry.SecurityID)}
+		}
 		f.SecurityDescriptor = img.sds[dentry.SecurityID]
 	}
 
-	_, err = io.CopyN(io.Discard, r, left)
+	// The remainder of the entry is padding, possibly followed by tagged
+	// items starting at the next 8-byte boundary after the names. The entry
+	// size is not trusted for the allocation, so that a corrupt size fails
+	// at the end of the metadata instead.
+	extra, err := io.ReadAll(io.LimitReader(r, left))
+	if err == nil && int64(len(extra)) != left {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
-		if err == io.EOF { //nolint:errorlint
-			err = io.ErrUnexpectedEOF
+		return nil, 0, &ParseError{Oper: "directory entry", Path: name, Err: err}
+	}
+	consumed := direntrySize + namesLen
+	tagged := consumed + 2
+	if dentry.ShortNameLength == 0 {
+		tagged -= 2
+	}
+	if skip := align8(tagged) - consumed; skip < int64(len(extra)) {
+		f.ExtendedAttributes, err = decodeTaggedItems(extra[skip:])
+		if err != nil {
+			return nil, 0, &ParseError{Oper: "tagged items", Path: name, Err: err}
 		}
-		return nil, 0, err
 	}
 
 	if dentry.StreamCount > 0 {
@@ -792,7 +1444,7 @@ func (img *Image) readNextEntry(r io.Reader) (*File, int64, error) {
 		f.Streams = streams
 	}
 
-	if dentry.Attributes&FILE_ATTRIBUTE_REPARSE_POINT != 0 && f.Size == 0 {
+	if dentry.Attributes&FILE_ATTRIBUTE_REPARSE_POINT != 0 && f.Size == 0 && !f.offset.stream {
 		return nil, 0, &ParseError{
 			Oper: "directory entry",
 			Path: name,
@@ -826,6 +1478,9 @@ func (img *Image) readNextStream(r io.Reader) (*Stream, int64, error) {
 
 	left -= streamentrySize
 
+	if sentry.NameLength < 0 || sentry.NameLength%2 != 0 {
+		return nil, 0, &ParseError{Oper: "stream entry", Err: errors.New("invalid name length")}
+	}
 	if left < int64(sentry.NameLength) {
 		return nil, 0, &ParseError{Oper: "stream entry", Err: errors.New("size too short for name")}
 	}
@@ -839,10 +1494,10 @@ func (img *Image) readNextStream(r io.Reader) (*Stream, int64, error) {
 	left -= int64(sentry.NameLength)
 	name := string(utf16.Decode(names))
 
-	var offset resourceDescriptor
+	var offset blob
 	if sentry.Hash != (SHA1Hash{}) {
 		var ok bool
-		offset, ok = img.wim.fileData[sentry.Hash]
+		offset, ok = img.wim.findBlob(sentry.Hash)
 		if !ok {
 			return nil, 0, &ParseError{
 				Oper: "stream entry",
@@ -875,12 +1530,12 @@ func (img *Image) readNextStream(r io.Reader) (*Stream, int64, error) {
 
 // Open returns an io.ReadCloser that can be used to read the stream's contents.
 func (s *Stream) Open() (io.ReadCloser, error) {
-	return s.wim.resourceReader(&s.offset)
+	return s.wim.openBlob(&s.offset, s.Hash, s.Name)
 }
 
 // Open returns an io.ReadCloser that can be used to read the file's contents.
 func (f *File) Open() (io.ReadCloser, error) {
-	return f.img.wim.resourceReader(&f.offset)
+	return f.img.wim.openBlob(&f.offset, f.Hash, f.Name)
 }
 
 // Readdir reads the directory entries.
@@ -888,7 +1543,26 @@ func (f *File) Readdir() ([]*File, error) {
 	if !f.IsDir() {
 		return nil, errors.New("not a directory")
 	}
-	return f.img.readdir(f.subdirOffset)
+	// Check that the directory is not its own ancestor, which would make
+	// walking the tree loop forever, and that its entries are not too deep.
+	depth := 0
+	for p := f.parent; p != nil; p = p.parent {
+		if p.subdirOffset == f.subdirOffset {
+			return nil, &ParseError{Oper: "directory", Path: f.Name, Err: errors.New("directory cycle")}
+		}
+		depth++
+	}
+	if max := f.img.wim.opts.maxDepth(); depth >= max {
+		return nil, &ParseError{Oper: "directory", Path: f.Name, Err: fmt.Errorf("%w: directory depth exceeds %d", ErrLimitExceeded, max)}
+	}
+	files, err := f.img.readdir(f.subdirOffset)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range files {
+		child.parent = f
+	}
+	return files, nil
 }
 
 // IsDir returns whether the given file is a directory. It returns false when it
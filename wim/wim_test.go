@@ -0,0 +1,243 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// testWIMBytes returns the contents of a WIM built from testFS.
+func testWIMBytes(t *testing.T) []byte {
+	t.Helper()
+	f := writeTestWIM(t, testFS(), testMetadata)
+	b, err := io.ReadAll(io.NewSectionReader(f, 0, 1<<30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// splitTestWIM splits a single-part WIM into two parts. Both parts share the
+// offset table, which places all file data in the second part, and the data
+// in the first part is zeroed out.
+func splitTestWIM(t *testing.T, b []byte) (part1, part2 []byte) {
+	t.Helper()
+	var hdr wimHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	part1 = append([]byte(nil), b...)
+	part2 = append([]byte(nil), b...)
+
+	table := part1[hdr.OffsetTable.Offset : hdr.OffsetTable.Offset+hdr.OffsetTable.CompressedSize()]
+	for i := 0; i < len(table); i += binary.Size(streamDescriptor{}) {
+		var sd streamDescriptor
+		if err := binary.Read(bytes.NewReader(table[i:]), binary.LittleEndian, &sd); err != nil {
+			t.Fatal(err)
+		}
+		if sd.Flags()&resFlagMetadata == 0 {
+			sd.PartNumber = 2
+			for j := sd.Offset; j < sd.Offset+sd.CompressedSize(); j++ {
+				part1[j] = 0
+			}
+		}
+		var buf bytes.Buffer
+		_ = binary.Write(&buf, binary.LittleEndian, &sd)
+		copy(table[i:], buf.Bytes())
+	}
+	copy(part2[hdr.OffsetTable.Offset:], table)
+
+	for i, part := range [][]byte{part1, part2} {
+		h := hdr
+		h.Flags |= HeaderFlagSpanned
+		h.PartNumber = uint16(i + 1)
+		h.TotalParts = 2
+		var buf bytes.Buffer
+		_ = binary.Write(&buf, binary.LittleEndian, &h)
+		copy(part, buf.Bytes())
+	}
+	return part1, part2
+}
+
+func TestMultiPartReader(t *testing.T) {
+	fsys := testFS()
+	part1, part2 := splitTestWIM(t, testWIMBytes(t))
+
+	if _, err := NewReader(bytes.NewReader(part1)); err == nil {
+		t.Error("expected NewReader to reject a split WIM part")
+	}
+	if _, err := NewMultiPartReader([]io.ReaderAt{bytes.NewReader(part1)}); err == nil {
+		t.Error("expected error for missing WIM part")
+	}
+
+	other := append([]byte(nil), part2...)
+	other[24]++ // WIM GUID
+	if _, err := NewMultiPartReader([]io.ReaderAt{bytes.NewReader(part1), bytes.NewReader(other)}); err == nil {
+		t.Error("expected error for mismatched WIM GUID")
+	}
+
+	// Parts may be given in any order.
+	r, err := NewMultiPartReader([]io.ReaderAt{bytes.NewReader(part2), bytes.NewReader(part1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.Image) != 1 {
+		t.Fatalf("expected 1 image, got %d", len(r.Image))
+	}
+	root, err := r.Image[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	system32 := findFile(t, findFile(t, root, "Windows"), "System32")
+	cmd := findFile(t, system32, "cmd.exe")
+	if b := readAll(t, cmd.Open); !bytes.Equal(b, fsys["Windows/System32/cmd.exe"].Data) {
+		t.Error("cmd.exe: content mismatch")
+	}
+}
+
+func TestReaderLimits(t *testing.T) {
+	b := testWIMBytes(t)
+	walk := func(r *Reader) error {
+		return r.Image[0].Walk(func(_ string, _ *File, err error) error { return err })
+	}
+	for _, tc := range []struct {
+		name string
+		opts ReaderOptions
+	}{
+		{"metadata size", ReaderOptions{MaxMetadataSize: 100}},
+		{"entries", ReaderOptions{MaxEntries: 2}},
+		{"depth", ReaderOptions{MaxDepth: 1}},
+	} {
+		r, err := NewReaderWithOptions(bytes.NewReader(b), tc.opts)
+		if err == nil {
+			err = walk(r)
+		}
+		var perr *ParseError
+		if !errors.Is(err, ErrLimitExceeded) || !errors.As(err, &perr) {
+			t.Errorf("%s: expected a ParseError wrapping ErrLimitExceeded, got %v", tc.name, err)
+		}
+	}
+
+	// Negative limits disable the checks.
+	r, err := NewReaderWithOptions(bytes.NewReader(b), ReaderOptions{MaxMetadataSize: -1, MaxEntries: -1, MaxDepth: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := walk(r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxDecompressedBytes(t *testing.T) {
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte("0123456789abcdef"), 100)
+	res := appendCompressedResource(t, &buf, data, 64)
+	f := bytes.NewReader(buf.Bytes())
+	r := &Reader{
+		r:           f,
+		parts:       []io.ReaderAt{f},
+		compression: compressionLzx,
+		chunkSize:   64,
+		budget:      &byteBudget{limit: int64(len(data)) + 100},
+	}
+	readAll(t, func() (io.ReadCloser, error) { return r.resourceReader(&res) })
+	rc, err := r.resourceReader(&res)
+	if err == nil {
+		_, err = io.ReadAll(rc)
+		rc.Close()
+	}
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected ErrLimitExceeded, got %v", err)
+	}
+}
+
+func TestMaxDecompressedBytesChunkSize(t *testing.T) {
+	r := &Reader{opts: ReaderOptions{MaxDecompressedBytes: 1 << 20}}
+	r.hdr.Flags = HeaderFlagCompressed | HeaderFlagCompressLzms
+	r.hdr.CompressionSize = 1 << 26
+	if err := r.initCompression(); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected ErrLimitExceeded for chunks larger than the limit, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte("solid"), 2000)
+	batch := &solidBatch{res: []solidResource{appendSolidResource(t, &buf, data, 1<<13)}}
+	f := bytes.NewReader(buf.Bytes())
+	r = &Reader{r: f, parts: []io.ReaderAt{f}, cache: newChunkCache(), budget: &byteBudget{limit: 1 << 12}}
+	b := &blob{resourceDescriptor: newResourceDescriptor(resFlagSolid, 0, 10, 10), solid: batch}
+	if _, err := r.blobReader(b); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected ErrLimitExceeded for solid chunks larger than the limit, got %v", err)
+	}
+}
+
+func TestResourceExtent(t *testing.T) {
+	// File data claiming to extend far past the end of the WIM, which would
+	// otherwise have a huge chunk table.
+	b := filterOffsetTable(t, testWIMBytes(t), func(sd *streamDescriptor) bool {
+		if sd.Flags()&resFlagMetadata == 0 {
+			sd.resourceDescriptor = newResourceDescriptor(resFlagCompressed, sd.Offset, 1<<50, 1<<50)
+		}
+		return true
+	})
+	var perr *ParseError
+	if _, err := NewReader(bytes.NewReader(b)); !errors.As(err, &perr) {
+		t.Errorf("expected a ParseError, got %v", err)
+	}
+	// Readers that do not report their size are measured.
+	if _, err := NewReader(struct{ io.ReaderAt }{bytes.NewReader(b)}); !errors.As(err, &perr) {
+		t.Errorf("expected a ParseError, got %v", err)
+	}
+}
+
+func TestReaderAtSize(t *testing.T) {
+	for _, size := range []int{0, 1, 5, 4096, 4097, 100000} {
+		got, err := readerAtSize(struct{ io.ReaderAt }{bytes.NewReader(make([]byte, size))})
+		if err != nil || got != int64(size) {
+			t.Errorf("got size %d, %v, want %d", got, err, size)
+		}
+	}
+}
+
+func TestDirectoryCycle(t *testing.T) {
+	b := testWIMBytes(t)
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := r.Image[0]
+	windows, err := img.Lookup("Windows")
+	if err != nil {
+		t.Fatal(err)
+	}
+	system32, err := img.Lookup("Windows/System32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Point System32 back at the contents of its parent directory.
+	var from, to [8]byte
+	binary.LittleEndian.PutUint64(from[:], uint64(system32.subdirOffset))
+	binary.LittleEndian.PutUint64(to[:], uint64(windows.subdirOffset))
+	metadata := b[img.offset.Offset : img.offset.Offset+img.offset.CompressedSize()]
+	i := bytes.Index(metadata, from[:])
+	if i < 0 {
+		t.Fatal("subdirectory offset not found")
+	}
+	copy(metadata[i:], to[:])
+
+	r, err = NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Image[0].Walk(func(_ string, _ *File, err error) error { return err })
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Err.Error() != "directory cycle" {
+		t.Errorf("expected a directory cycle ParseError, got %v", err)
+	}
+}
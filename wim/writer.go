@@ -0,0 +1,833 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // not used for secure application
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+	"unicode/utf16"
+
+	"github.com/Microsoft/go-winio"
+)
+
+const (
+	wimVersion    = 0x10d00
+	wimHeaderSize = 208
+)
+
+// FileMetadata contains the Windows metadata for a file or directory added
+// to a WIM by a Writer.
+type FileMetadata struct {
+	Attributes         uint32
+	SecurityDescriptor []byte
+	CreationTime       Filetime
+	LastAccessTime     Filetime
+	LastWriteTime      Filetime
+	ShortName          string
+	LinkID             int64
+	ReparseTag         uint32
+	ReparseReserved    uint32
+	// ReparseData contains the reparse buffer, without the 8-byte
+	// REPARSE_DATA_BUFFER header. It is only used when ReparseTag is non-zero.
+	ReparseData        []byte
+	Streams            []AlternateStream
+	ExtendedAttributes []winio.ExtendedAttribute
+}
+
+// AlternateStream describes an alternate data stream to add to a file.
+type AlternateStream struct {
+	Name string
+	Open func() (io.ReadCloser, error)
+}
+
+// MetadataFunc returns the Windows metadata for the file at name in an
+// fs.FS being added to a WIM. It may return nil to use metadata derived from fi.
+type MetadataFunc func(name string, fi fs.FileInfo) (*FileMetadata, error)
+
+// Writer writes a new WIM file, or adds images to an existing one.
+type Writer struct {
+	w       io.Writer
+	seeker  io.Seeker // w, except for the Writer used by a StreamWriter
+	hdr     wimHeader
+	base    int64 // the offset of the WIM within w
+	offset  int64 // the current offset relative to base
+	streams map[SHA1Hash]*streamDescriptor
+	order   []*streamDescriptor
+	images  []*writerImage
+	closed  bool
+
+	info WIMInfo // the XML information of the images before this Writer's
+
+	// Set when appending to an existing WIM.
+	prevTable []*streamDescriptor // the existing offset table entries
+	integrity io.ReaderAt         // used to rebuild the integrity table, if any
+
+	// Set for the Writer used by a StreamWriter, which writes the data of
+	// each stream when it is closed.
+	deferred map[SHA1Hash]func() (io.ReadCloser, error)
+}
+
+type writerImage struct {
+	metadata streamDescriptor
+	info     ImageInfo
+	links    map[int64]bool // the hard link groups seen so far
+	data     []byte         // the metadata resource, until written by a StreamWriter
+}
+
+// writerDentry is a directory entry that has been collected by a Writer but
+// not yet encoded.
+type writerDentry struct {
+	name         string
+	meta         FileMetadata
+	hash         SHA1Hash
+	size         int64
+	streams      []writerStream
+	children     []*writerDentry
+	isDir        bool
+	subdirOffset int64
+}
+
+type writerStream struct {
+	name string
+	hash SHA1Hash
+	size int64
+}
+
+// NewWriter returns a Writer that writes a new WIM file to w, starting at
+// the current offset. Images are added with AddImage, and the WIM is not
+// valid until Close is called.
+func NewWriter(w io.WriteSeeker) (*Writer, error) {
+	base, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	ww := &Writer{
+		w:      w,
+		seeker: w,
+		base:   base,
+		hdr: wimHeader{
+			ImageTag:   wimImageTag,
+			Size:       wimHeaderSize,
+			Version:    wimVersion,
+			Flags:      HeaderFlagWriteInProgress,
+			PartNumber: 1,
+			TotalParts: 1,
+		},
+		streams: make(map[SHA1Hash]*streamDescriptor),
+	}
+	err = binary.Read(rand.Reader, binary.LittleEndian, &ww.hdr.WIMGuid)
+	if err != nil {
+		return nil, err
+	}
+	// Write a placeholder header to be replaced by Close.
+	err = ww.write(&ww.hdr)
+	if err != nil {
+		return nil, err
+	}
+	return ww, nil
+}
+
+// NewAppendWriter returns a Writer that adds images to the existing WIM read
+// by r, which must be stored at the start of w. Streams whose SHA-1 hash is
+// already present in the WIM are referenced rather than written again. New
+// data is written after the end of the existing WIM, and the existing
+// header is only replaced by Close, so the WIM remains valid until then.
+//
+// If the WIM has an integrity table, Close rebuilds it by reading back the
+// data written to w through r.
+func NewAppendWriter(w io.WriteSeeker, r *Reader) (*Writer, error) {
+	if r.numParts != 1 {
+		return nil, errors.New("cannot append to a split WIM")
+	}
+	if r.hdr.Flags&(HeaderFlagResourceOnly|HeaderFlagMetadataOnly) != 0 || len(r.parts) != 1 {
+		return nil, errors.New("cannot append to a WIM whose file data is stored separately")
+	}
+	if r.hdr.Flags&HeaderFlagReadOnly != 0 {
+		return nil, errors.New("WIM is read-only")
+	}
+	rsrc, err := r.resourceReader(&r.hdr.OffsetTable)
+	if err != nil {
+		return nil, &ParseError{Oper: "offset table", Err: err}
+	}
+	table, err := io.ReadAll(rsrc)
+	rsrc.Close()
+	if err != nil {
+		return nil, &ParseError{Oper: "offset table", Err: err}
+	}
+	end, err := w.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	ww := &Writer{
+		w:       w,
+		seeker:  w,
+		hdr:     r.hdr,
+		offset:  end,
+		streams: make(map[SHA1Hash]*streamDescriptor),
+		info:    r.Info,
+	}
+	ww.info.Images = append([]ImageInfo(nil), r.Info.Images...)
+	br := bytes.NewReader(table)
+	for br.Len() != 0 {
+		sd := &streamDescriptor{}
+		err = binary.Read(br, binary.LittleEndian, sd)
+		if err != nil {
+			return nil, &ParseError{Oper: "offset table", Err: err}
+		}
+		ww.prevTable = append(ww.prevTable, sd)
+		if sd.Flags()&resFlagMetadata != 0 || sd.isSolidResource() {
+			continue
+		}
+		if _, ok := ww.streams[sd.Hash]; !ok {
+			ww.streams[sd.Hash] = sd
+		}
+	}
+	if r.hdr.Integrity.CompressedSize() != 0 {
+		ww.integrity = r.r
+	}
+	return ww, nil
+}
+
+func (w *Writer) write(data interface{}) error {
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, data)
+	return w.writeBytes(b.Bytes())
+}
+
+func (w *Writer) writeBytes(b []byte) error {
+	n, err := w.w.Write(b)
+	w.offset += int64(n)
+	return err
+}
+
+func newResourceDescriptor(flags resFlag, offset, compressedSize, originalSize int64) resourceDescriptor {
+	return resourceDescriptor{
+		FlagsAndCompressedSize: uint64(flags)<<56 | uint64(compressedSize),
+		Offset:                 offset,
+		OriginalSize:           originalSize,
+	}
+}
+
+// writeResource writes b as a new uncompressed resource.
+func (w *Writer) writeResource(b []byte, flags resFlag) (resourceDescriptor, error) {
+	res := newResourceDescriptor(flags, w.offset, int64(len(b)), int64(len(b)))
+	return res, w.writeBytes(b)
+}
+
+// hashingReader computes the SHA1 hash and size of the data read through it.
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, h: sha1.New()} //nolint:gosec // not used for secure application
+}
+
+func (r *hashingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.h.Write(b[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *hashingReader) Sum() (h SHA1Hash) {
+	copy(h[:], r.h.Sum(nil))
+	return h
+}
+
+func hashStream(open func() (io.ReadCloser, error)) (SHA1Hash, int64, error) {
+	f, err := open()
+	if err != nil {
+		return SHA1Hash{}, 0, err
+	}
+	defer f.Close()
+	hr := newHashingReader(f)
+	_, err = io.Copy(io.Discard, hr)
+	if err != nil {
+		return SHA1Hash{}, 0, err
+	}
+	return hr.Sum(), hr.n, nil
+}
+
+// addStream adds the stream returned by open to the WIM, unless a stream with
+// the same contents has already been added. open may be called more than once.
+func (w *Writer) addStream(open func() (io.ReadCloser, error)) (SHA1Hash, int64, error) {
+	h, size, err := hashStream(open)
+	if err != nil {
+		return h, 0, err
+	}
+	if size == 0 {
+		return SHA1Hash{}, 0, nil
+	}
+	if sd, ok := w.streams[h]; ok {
+		sd.RefCount++
+		return h, size, nil
+	}
+
+	sd := &streamDescriptor{
+		resourceDescriptor: newResourceDescriptor(0, w.offset, size, size),
+		PartNumber:         1,
+		RefCount:           1,
+		Hash:               h,
+	}
+	if w.deferred != nil {
+		w.deferred[h] = open
+	} else {
+		err = w.copyStream(open, sd)
+		if err != nil {
+			return h, 0, err
+		}
+	}
+	w.streams[h] = sd
+	w.order = append(w.order, sd)
+	return h, size, nil
+}
+
+// copyStream writes the data returned by open, which must match the hash and
+// size of sd.
+func (w *Writer) copyStream(open func() (io.ReadCloser, error), sd *streamDescriptor) error {
+	f, err := open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size := sd.OriginalSize
+	hr := newHashingReader(io.LimitReader(f, size))
+	_, err = io.Copy(writerFunc(w.writeBytes), hr)
+	if err != nil {
+		return err
+	}
+	if hr.n != size || hr.Sum() != sd.Hash {
+		return errors.New("stream contents changed while being written")
+	}
+	return nil
+}
+
+type writerFunc func([]byte) error
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	err := f(b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func bytesOpener(b []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+}
+
+// defaultMetadata returns the metadata used for a file when the MetadataFunc
+// does not provide any.
+func defaultMetadata(fi fs.FileInfo) *FileMetadata {
+	t := NewFiletime(fi.ModTime())
+	m := &FileMetadata{
+		CreationTime:   t,
+		LastAccessTime: t,
+		LastWriteTime:  t,
+	}
+	switch {
+	case fi.IsDir():
+		m.Attributes = FILE_ATTRIBUTE_DIRECTORY
+	case fi.Mode().Perm()&0200 == 0:
+		m.Attributes = FILE_ATTRIBUTE_READONLY
+	default:
+		m.Attributes = FILE_ATTRIBUTE_NORMAL
+	}
+	return m
+}
+
+// AddImage adds the directory tree at the root of fsys to the WIM as a new
+// image described by info. meta, if non-nil, is called for each file to
+// retrieve its Windows metadata.
+func (w *Writer) AddImage(fsys fs.FS, info ImageInfo, meta MetadataFunc) error {
+	if w.closed {
+		return errors.New("WIM writer is closed")
+	}
+	img := &writerImage{info: info, links: make(map[int64]bool)}
+	img.info.DirCount = 0
+	img.info.FileCount = 0
+	img.info.TotalBytes = 0
+	img.info.HardLinkBytes = 0
+	root, err := w.collect(fsys, ".", "", meta, img)
+	if err != nil {
+		return err
+	}
+	if !root.isDir {
+		return errors.New("image root is not a directory")
+	}
+
+	metadata := encodeMetadata(root)
+	img.metadata = streamDescriptor{
+		PartNumber: 1,
+		RefCount:   1,
+		Hash:       sha1.Sum(metadata), //nolint:gosec // not used for secure application
+	}
+	if w.deferred != nil {
+		img.data = metadata
+	} else {
+		img.metadata.resourceDescriptor, err = w.writeResource(metadata, resFlagMetadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := NewFiletime(time.Now())
+	img.info.Index = int(w.hdr.ImageCount) + len(w.images) + 1
+	if img.info.CreationTime == (Filetime{}) {
+		img.info.CreationTime = now
+	}
+	if img.info.ModTime == (Filetime{}) {
+		img.info.ModTime = now
+	}
+	w.images = append(w.images, img)
+	return nil
+}
+
+// SetImageInfo replaces the XML information of the image with the given
+// 1-based index, which may be an image of the WIM being appended to. The
+// index and the counts computed by the Writer are not changed.
+func (w *Writer) SetImageInfo(index int, info ImageInfo) error {
+	if w.closed {
+		return errors.New("WIM writer is closed")
+	}
+	var cur *ImageInfo
+	if n := index - int(w.hdr.ImageCount); n > 0 && n <= len(w.images) {
+		cur = &w.images[n-1].info
+	} else {
+		cur = w.info.image(index)
+	}
+	if cur == nil {
+		return fmt.Errorf("image %d not found", index)
+	}
+	info.Index = cur.Index
+	info.DirCount = cur.DirCount
+	info.FileCount = cur.FileCount
+	info.TotalBytes = cur.TotalBytes
+	info.HardLinkBytes = cur.HardLinkBytes
+	*cur = info
+	return nil
+}
+
+// collect builds the directory entry for the file p in fsys, adding its
+// streams to the WIM.
+func (w *Writer) collect(fsys fs.FS, p string, name string, meta MetadataFunc, img *writerImage) (*writerDentry, error) {
+	fi, err := fs.Stat(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	var m *FileMetadata
+	if meta != nil {
+		m, err = meta(p, fi)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m == nil {
+		m = defaultMetadata(fi)
+	}
+
+	d := &writerDentry{
+		name: name,
+		meta: *m,
+	}
+	switch {
+	case m.ReparseTag != 0:
+		d.meta.Attributes |= FILE_ATTRIBUTE_REPARSE_POINT
+		if len(m.ReparseData) == 0 {
+			return nil, fmt.Errorf("%s: reparse point is missing reparse data", p)
+		}
+		d.hash, d.size, err = w.addStream(bytesOpener(m.ReparseData))
+	case fi.IsDir():
+		d.isDir = true
+		d.meta.Attributes |= FILE_ATTRIBUTE_DIRECTORY
+	case fi.Mode().IsRegular():
+		d.hash, d.size, err = w.addStream(func() (io.ReadCloser, error) { return fsys.Open(p) })
+	default:
+		return nil, fmt.Errorf("%s: unsupported file mode %s", p, fi.Mode())
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The data of additional links to a file is counted separately.
+	info := &img.info
+	total := &info.TotalBytes
+	if d.isDir {
+		info.DirCount++
+	} else {
+		info.FileCount++
+		if d.meta.LinkID != 0 {
+			if img.links[d.meta.LinkID] {
+				total = &info.HardLinkBytes
+			}
+			img.links[d.meta.LinkID] = true
+		}
+	}
+	*total += d.size
+
+	for _, ea := range m.ExtendedAttributes {
+		if len(ea.Name) > 0xff || len(ea.Value) > 0xffff {
+			return nil, fmt.Errorf("%s: extended attribute %q too large", p, ea.Name)
+		}
+	}
+
+	for _, s := range m.Streams {
+		if s.Name == "" {
+			return nil, fmt.Errorf("%s: alternate stream has no name", p)
+		}
+		h, size, err := w.addStream(s.Open)
+		if err != nil {
+			return nil, err
+		}
+		d.streams = append(d.streams, writerStream{name: s.Name, hash: h, size: size})
+		*total += size
+	}
+
+	if d.isDir {
+		entries, err := fs.ReadDir(fsys, p)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			child, err := w.collect(fsys, path.Join(p, e.Name()), e.Name(), meta, img)
+			if err != nil {
+				return nil, err
+			}
+			d.children = append(d.children, child)
+		}
+	}
+	return d, nil
+}
+
+func align8(n int64) int64 {
+	return (n + 7) &^ 7
+}
+
+func encodeName(s string) []uint16 {
+	return utf16.Encode([]rune(s))
+}
+
+// length returns the size of the encoded directory entry, excluding its
+// stream entries.
+func (d *writerDentry) length() int64 {
+	n := direntrySize + int64(len(encodeName(d.name))*2) + 2
+	if d.meta.ShortName != "" {
+		n += int64(len(encodeName(d.meta.ShortName))*2) + 2
+	}
+	n = align8(n)
+	if len(d.meta.ExtendedAttributes) != 0 {
+		n += align8(8 + xattrsLength(d.meta.ExtendedAttributes))
+	}
+	return n
+}
+
+func xattrsLength(eas []winio.ExtendedAttribute) int64 {
+	var n int64
+	for _, ea := range eas {
+		n += 4 + int64(len(ea.Name)) + 1 + int64(len(ea.Value))
+	}
+	return n
+}
+
+// encodeXattrs writes eas to b as a tagged item.
+func encodeXattrs(b *bytes.Buffer, eas []winio.ExtendedAttribute) {
+	_ = binary.Write(b, binary.LittleEndian, &taggedItemHeader{Tag: tagXattrs, Length: uint32(xattrsLength(eas))})
+	for _, ea := range eas {
+		_ = binary.Write(b, binary.LittleEndian, &xattrEntryHeader{
+			ValueLength: uint16(len(ea.Value)),
+			NameLength:  uint8(len(ea.Name)),
+			Flags:       ea.Flags,
+		})
+		b.WriteString(ea.Name)
+		b.WriteByte(0)
+		b.Write(ea.Value)
+	}
+}
+
+// hasStreamEntries returns whether the unnamed stream must be stored in a
+// stream entry rather than in the directory entry itself.
+func (d *writerDentry) hasStreamEntries() bool {
+	return len(d.streams) != 0
+}
+
+// totalLength returns the size of the encoded directory entry, including its
+// stream entries.
+func (d *writerDentry) totalLength() int64 {
+	n := d.length()
+	if d.hasStreamEntries() {
+		n += streamLength("")
+		for _, s := range d.streams {
+			n += streamLength(s.name)
+		}
+	}
+	return n
+}
+
+func streamLength(name string) int64 {
+	n := streamentrySize
+	if name != "" {
+		n += int64(len(encodeName(name))*2) + 2
+	}
+	return align8(n)
+}
+
+// assignSubdirOffsets assigns offsets to the child lists of d and its
+// subdirectories, starting at offset, and returns the offset following them.
+func (d *writerDentry) assignSubdirOffsets(offset int64) int64 {
+	d.subdirOffset = offset
+	for _, c := range d.children {
+		offset += c.totalLength()
+	}
+	offset += 8 // end of directory marker
+	for _, c := range d.children {
+		if c.isDir {
+			offset = c.assignSubdirOffsets(offset)
+		}
+	}
+	return offset
+}
+
+func (d *writerDentry) encode(b *bytes.Buffer, sds *securityTableWriter) {
+	start := b.Len()
+	name := encodeName(d.name)
+	shortName := encodeName(d.meta.ShortName)
+	length := d.length()
+	de := direntry{
+		Attributes:      d.meta.Attributes,
+		SecurityID:      sds.add(d.meta.SecurityDescriptor),
+		CreationTime:    d.meta.CreationTime,
+		LastAccessTime:  d.meta.LastAccessTime,
+		LastWriteTime:   d.meta.LastWriteTime,
+		ReparseHardLink: d.meta.LinkID,
+		ShortNameLength: uint16(len(shortName) * 2),
+		FileNameLength:  uint16(len(name) * 2),
+	}
+	if d.isDir {
+		de.SubdirOffset = d.subdirOffset
+	}
+	if d.meta.ReparseTag != 0 {
+		de.ReparseHardLink = int64(d.meta.ReparseReserved)<<32 | int64(d.meta.ReparseTag)
+	}
+	if d.hasStreamEntries() {
+		de.StreamCount = uint16(len(d.streams) + 1)
+	} else {
+		de.Hash = d.hash
+	}
+	_ = binary.Write(b, binary.LittleEndian, length)
+	_ = binary.Write(b, binary.LittleEndian, &de)
+	_ = binary.Write(b, binary.LittleEndian, name)
+	_ = binary.Write(b, binary.LittleEndian, uint16(0))
+	if len(shortName) != 0 {
+		_ = binary.Write(b, binary.LittleEndian, shortName)
+		_ = binary.Write(b, binary.LittleEndian, uint16(0))
+	}
+	if len(d.meta.ExtendedAttributes) != 0 {
+		pad(b, int(align8(int64(b.Len()))))
+		encodeXattrs(b, d.meta.ExtendedAttributes)
+	}
+	pad(b, start+int(length))
+
+	if d.hasStreamEntries() {
+		encodeStream(b, "", d.hash)
+		for _, s := range d.streams {
+			encodeStream(b, s.name, s.hash)
+		}
+	}
+}
+
+func encodeStream(b *bytes.Buffer, name string, h SHA1Hash) {
+	start := b.Len()
+	name16 := encodeName(name)
+	length := streamLength(name)
+	_ = binary.Write(b, binary.LittleEndian, length)
+	_ = binary.Write(b, binary.LittleEndian, &streamentry{
+		Hash:       h,
+		NameLength: int16(len(name16) * 2),
+	})
+	if len(name16) != 0 {
+		_ = binary.Write(b, binary.LittleEndian, name16)
+		_ = binary.Write(b, binary.LittleEndian, uint16(0))
+	}
+	pad(b, start+int(length))
+}
+
+// pad writes zeroes to b until it is n bytes long.
+func pad(b *bytes.Buffer, n int) {
+	for b.Len() < n {
+		b.WriteByte(0)
+	}
+}
+
+func (d *writerDentry) encodeChildren(b *bytes.Buffer, sds *securityTableWriter) {
+	for _, c := range d.children {
+		c.encode(b, sds)
+	}
+	_ = binary.Write(b, binary.LittleEndian, int64(0))
+	for _, c := range d.children {
+		if c.isDir {
+			c.encodeChildren(b, sds)
+		}
+	}
+}
+
+// securityTableWriter collects the unique security descriptors of an image.
+type securityTableWriter struct {
+	sds   [][]byte
+	index map[string]uint32
+}
+
+func (t *securityTableWriter) add(sd []byte) uint32 {
+	if len(sd) == 0 {
+		return NoSecurityID
+	}
+	if i, ok := t.index[string(sd)]; ok {
+		return i
+	}
+	i := uint32(len(t.sds))
+	t.index[string(sd)] = i
+	t.sds = append(t.sds, sd)
+	return i
+}
+
+func (t *securityTableWriter) length() int64 {
+	n := int64(securityblockDiskSize + len(t.sds)*8)
+	for _, sd := range t.sds {
+		n += int64(len(sd))
+	}
+	return n
+}
+
+func (t *securityTableWriter) encode(b *bytes.Buffer) {
+	length := t.length()
+	_ = binary.Write(b, binary.LittleEndian, &securityblockDisk{
+		TotalLength: uint32(length),
+		NumEntries:  uint32(len(t.sds)),
+	})
+	for _, sd := range t.sds {
+		_ = binary.Write(b, binary.LittleEndian, int64(len(sd)))
+	}
+	for _, sd := range t.sds {
+		b.Write(sd)
+	}
+	pad(b, int(align8(length)))
+}
+
+// encodeMetadata encodes the metadata resource for the image rooted at root.
+func encodeMetadata(root *writerDentry) []byte {
+	sds := &securityTableWriter{index: make(map[string]uint32)}
+	var collectSDs func(d *writerDentry)
+	collectSDs = func(d *writerDentry) {
+		sds.add(d.meta.SecurityDescriptor)
+		for _, c := range d.children {
+			collectSDs(c)
+		}
+	}
+	collectSDs(root)
+
+	rootOffset := align8(sds.length())
+	root.assignSubdirOffsets(rootOffset + root.totalLength() + 8)
+
+	var b bytes.Buffer
+	sds.encode(&b)
+	root.encode(&b, sds)
+	_ = binary.Write(&b, binary.LittleEndian, int64(0))
+	root.encodeChildren(&b, sds)
+	return b.Bytes()
+}
+
+// Close finishes writing the WIM by writing the offset table, the XML data,
+// and the final header. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	tableEnd, err := w.writeTables()
+	if err != nil {
+		return err
+	}
+
+	if w.integrity != nil {
+		integrity, err := buildIntegrityTable(w.integrity, tableEnd, defaultIntegrityChunkSize)
+		if err != nil {
+			return err
+		}
+		w.hdr.Integrity, err = w.writeResource(integrity, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	end := w.offset
+	w.hdr.Flags &^= HeaderFlagWriteInProgress
+	w.hdr.ImageCount += uint32(len(w.images))
+	_, err = w.seeker.Seek(w.base, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	w.offset = 0
+	err = w.write(&w.hdr)
+	if err != nil {
+		return err
+	}
+	w.offset = end
+	_, err = w.seeker.Seek(w.base+end, io.SeekStart)
+	return err
+}
+
+// writeTables writes the offset table and the XML data, and returns the
+// offset of the end of the offset table.
+func (w *Writer) writeTables() (int64, error) {
+	var table bytes.Buffer
+	for _, sd := range w.prevTable {
+		_ = binary.Write(&table, binary.LittleEndian, sd)
+	}
+	for _, img := range w.images {
+		_ = binary.Write(&table, binary.LittleEndian, &img.metadata)
+	}
+	for _, sd := range w.order {
+		_ = binary.Write(&table, binary.LittleEndian, sd)
+	}
+	var err error
+	w.hdr.OffsetTable, err = w.writeResource(table.Bytes(), 0)
+	if err != nil {
+		return 0, err
+	}
+
+	tableEnd := w.offset
+	xmlData, err := w.xmlData(w.offset)
+	if err != nil {
+		return 0, err
+	}
+	w.hdr.XMLData, err = w.writeResource(xmlData, 0)
+	if err != nil {
+		return 0, err
+	}
+	return tableEnd, nil
+}
+
+// xmlData returns the encoded XML information for the WIM.
+func (w *Writer) xmlData(totalBytes int64) ([]byte, error) {
+	x := w.info
+	x.TotalBytes = totalBytes
+	for _, img := range w.images {
+		x.Images = append(x.Images, img.info)
+	}
+	return x.MarshalBinary()
+}
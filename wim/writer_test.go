@@ -0,0 +1,332 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+)
+
+var testSD = []byte{1, 0, 4, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+func testFS() fstest.MapFS {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	return fstest.MapFS{
+		"Windows":                   &fstest.MapFile{Mode: fs.ModeDir | 0755, ModTime: mtime},
+		"Windows/System32":          &fstest.MapFile{Mode: fs.ModeDir | 0755, ModTime: mtime},
+		"Windows/System32/cmd.exe":  &fstest.MapFile{Data: bytes.Repeat([]byte("cmd"), 50000), Mode: 0644, ModTime: mtime},
+		"Windows/System32/copy.exe": &fstest.MapFile{Data: bytes.Repeat([]byte("cmd"), 50000), Mode: 0644, ModTime: mtime},
+		"Windows/notepad.exe":       &fstest.MapFile{Data: []byte("notepad"), Mode: 0444, ModTime: mtime},
+		"empty":                     &fstest.MapFile{Mode: fs.ModeDir | 0755, ModTime: mtime},
+		"empty.txt":                 &fstest.MapFile{Mode: 0644, ModTime: mtime},
+		"link":                      &fstest.MapFile{Mode: fs.ModeSymlink, ModTime: mtime},
+	}
+}
+
+func testMetadata(name string, fi fs.FileInfo) (*FileMetadata, error) {
+	m := defaultMetadata(fi)
+	m.SecurityDescriptor = testSD
+	switch name {
+	case "Windows/notepad.exe":
+		m.ShortName = "NOTEPAD.EXE"
+		m.Streams = []AlternateStream{{Name: "Zone.Identifier", Open: bytesOpener([]byte("[ZoneTransfer]"))}}
+		m.ExtendedAttributes = []winio.ExtendedAttribute{{Name: "KERNEL.PURGE.ESBCACHE", Value: []byte{1, 2, 3}, Flags: 0x80}}
+	case "link":
+		m.Attributes = FILE_ATTRIBUTE_REPARSE_POINT
+		m.ReparseTag = 0xA000000C
+		m.ReparseData = []byte("reparse data")
+	}
+	return m, nil
+}
+
+func writeTestWIM(t *testing.T, fsys fs.FS, meta MetadataFunc) *os.File {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.wim"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	w, err := NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddImage(fsys, ImageInfo{Name: "test"}, meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func readAll(t *testing.T, open func() (io.ReadCloser, error)) []byte {
+	t.Helper()
+	r, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func findFile(t *testing.T, dir *File, name string) *File {
+	t.Helper()
+	files, err := dir.Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Name == name {
+			return f
+		}
+	}
+	t.Fatalf("%s not found in %s", name, dir.Name)
+	return nil
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	fsys := testFS()
+	f := writeTestWIM(t, fsys, testMetadata)
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.Image) != 1 {
+		t.Fatalf("expected 1 image, got %d", len(r.Image))
+	}
+	img := r.Image[0]
+	if img.Name != "test" || img.Index != 1 {
+		t.Errorf("unexpected image info %+v", img.ImageInfo)
+	}
+
+	root, err := img.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.IsDir() || !bytes.Equal(root.SecurityDescriptor, testSD) {
+		t.Errorf("unexpected root %+v", root.FileHeader)
+	}
+	files, err := root.Readdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Errorf("expected 4 root entries, got %d", len(files))
+	}
+
+	windows := findFile(t, root, "Windows")
+	system32 := findFile(t, windows, "System32")
+	for _, name := range []string{"cmd.exe", "copy.exe"} {
+		file := findFile(t, system32, name)
+		if b := readAll(t, file.Open); !bytes.Equal(b, fsys["Windows/System32/"+name].Data) {
+			t.Errorf("%s: content mismatch", name)
+		}
+	}
+	if len(r.fileData) != 4 {
+		t.Errorf("expected 4 unique streams, got %d", len(r.fileData))
+	}
+
+	notepad := findFile(t, windows, "notepad.exe")
+	if notepad.ShortName != "NOTEPAD.EXE" || notepad.Attributes != FILE_ATTRIBUTE_READONLY {
+		t.Errorf("unexpected notepad.exe header %+v", notepad.FileHeader)
+	}
+	if want := NewFiletime(fsys["Windows/notepad.exe"].ModTime); notepad.LastWriteTime != want {
+		t.Errorf("expected last write time %v, got %v", want, notepad.LastWriteTime)
+	}
+	if eas := notepad.ExtendedAttributes; len(eas) != 1 || eas[0].Name != "KERNEL.PURGE.ESBCACHE" || eas[0].Flags != 0x80 || !bytes.Equal(eas[0].Value, []byte{1, 2, 3}) {
+		t.Errorf("unexpected extended attributes %+v", eas)
+	}
+	if b := readAll(t, notepad.Open); string(b) != "notepad" {
+		t.Errorf("unexpected notepad.exe content %q", b)
+	}
+	if len(notepad.Streams) != 1 || notepad.Streams[0].Name != "Zone.Identifier" {
+		t.Fatalf("unexpected streams %+v", notepad.Streams)
+	}
+	if b := readAll(t, notepad.Streams[0].Open); string(b) != "[ZoneTransfer]" {
+		t.Errorf("unexpected stream content %q", b)
+	}
+
+	link := findFile(t, root, "link")
+	if link.ReparseTag != 0xA000000C || link.IsDir() {
+		t.Errorf("unexpected link header %+v", link.FileHeader)
+	}
+	if b := readAll(t, link.Open); string(b) != "reparse data" {
+		t.Errorf("unexpected reparse data %q", b)
+	}
+
+	empty := findFile(t, root, "empty")
+	if files, err := empty.Readdir(); err != nil || len(files) != 0 {
+		t.Errorf("unexpected empty directory contents %v, %v", files, err)
+	}
+}
+
+func TestAppendWriter(t *testing.T) {
+	fsys := testFS()
+	f := writeTestWIM(t, fsys, testMetadata)
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(addIntegrityTable(t, b, 4096), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys2 := testFS()
+	fsys2["Windows/notepad.exe"] = &fstest.MapFile{Data: []byte("notepad 2"), Mode: 0644}
+	w, err := NewAppendWriter(f, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddImage(fsys2, ImageInfo{Name: "test 2"}, testMetadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Image) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(r.Image))
+	}
+	for i, name := range []string{"test", "test 2"} {
+		if img := r.Image[i]; img.Name != name || img.Index != i+1 {
+			t.Errorf("unexpected image info %+v", img.ImageInfo)
+		}
+	}
+	if err := r.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Only the new notepad.exe contents are added.
+	if len(r.fileData) != 5 {
+		t.Errorf("expected 5 unique streams, got %d", len(r.fileData))
+	}
+
+	for i, fsys := range []fstest.MapFS{fsys, fsys2} {
+		root, err := r.Image[i].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		windows := findFile(t, root, "Windows")
+		notepad := findFile(t, windows, "notepad.exe")
+		if b := readAll(t, notepad.Open); !bytes.Equal(b, fsys["Windows/notepad.exe"].Data) {
+			t.Errorf("image %d: unexpected notepad.exe content %q", i+1, b)
+		}
+		cmd := findFile(t, findFile(t, windows, "System32"), "cmd.exe")
+		if b := readAll(t, cmd.Open); !bytes.Equal(b, fsys["Windows/System32/cmd.exe"].Data) {
+			t.Errorf("image %d: cmd.exe content mismatch", i+1)
+		}
+	}
+
+	// The streams shared by both images have their reference counts updated.
+	rsrc, err := r.resourceReader(&r.hdr.OffsetTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsrc.Close()
+	refs := make(map[SHA1Hash]uint32)
+	for {
+		var sd streamDescriptor
+		if err := binary.Read(rsrc, binary.LittleEndian, &sd); err != nil {
+			break
+		}
+		refs[sd.Hash] += sd.RefCount
+	}
+	root, err := r.Image[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := findFile(t, findFile(t, findFile(t, root, "Windows"), "System32"), "cmd.exe")
+	if refs[cmd.Hash] != 4 {
+		t.Errorf("expected 4 references to cmd.exe contents, got %d", refs[cmd.Hash])
+	}
+}
+
+// putResource stores a resource header at b[off:] in the on-disk format: a
+// 7-byte compressed size, a flags byte, the offset and the original size.
+func putResource(b []byte, off int, flags resFlag, offset, compressedSize, originalSize int64) {
+	binary.LittleEndian.PutUint64(b[off:], uint64(compressedSize)|uint64(flags)<<56)
+	binary.LittleEndian.PutUint64(b[off+8:], uint64(offset))
+	binary.LittleEndian.PutUint64(b[off+16:], uint64(originalSize))
+}
+
+func TestHandBuiltHeader(t *testing.T) {
+	if n := binary.Size(wimHeader{}); n != 208 {
+		t.Fatalf("header is %d bytes, expected 208", n)
+	}
+
+	// Take the resources from a WIM written by Writer, add an integrity
+	// table, and replace the header with one built field by field at the
+	// offsets given in the format documentation.
+	b := testWIMBytes(t)
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := r.hdr
+	tableEnd := src.OffsetTable.Offset + src.OffsetTable.CompressedSize()
+	integrity, err := buildIntegrityTable(bytes.NewReader(b), tableEnd, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	integrityOffset := int64(len(b))
+	b = append(b, integrity...)
+
+	hdr := b[:208]
+	for i := range hdr {
+		hdr[i] = 0
+	}
+	copy(hdr[0:], "MSWIM\x00\x00\x00")
+	binary.LittleEndian.PutUint32(hdr[8:], 208)
+	binary.LittleEndian.PutUint32(hdr[12:], 0x10d00)
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(HeaderFlagRpFix))
+	binary.LittleEndian.PutUint32(hdr[20:], 0) // chunk size
+	copy(hdr[24:40], "0123456789abcdef")       // GUID
+	binary.LittleEndian.PutUint16(hdr[40:], 1) // part number
+	binary.LittleEndian.PutUint16(hdr[42:], 1) // total parts
+	binary.LittleEndian.PutUint32(hdr[44:], 1) // image count
+	putResource(hdr, 48, 0, src.OffsetTable.Offset, src.OffsetTable.CompressedSize(), src.OffsetTable.OriginalSize)
+	putResource(hdr, 72, 0, src.XMLData.Offset, src.XMLData.CompressedSize(), src.XMLData.OriginalSize)
+	putResource(hdr, 96, resFlagMetadata, r.Image[0].offset.Offset, r.Image[0].offset.CompressedSize(), r.Image[0].offset.OriginalSize)
+	binary.LittleEndian.PutUint32(hdr[120:], 1) // boot index
+	putResource(hdr, 124, 0, integrityOffset, int64(len(integrity)), int64(len(integrity)))
+
+	r, err = NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := r.hdr.Integrity
+	if got.Offset != integrityOffset || got.CompressedSize() != int64(len(integrity)) || got.OriginalSize != int64(len(integrity)) {
+		t.Errorf("unexpected integrity descriptor %+v", got)
+	}
+	h := r.Header()
+	if h.Flags != HeaderFlagRpFix || h.ImageCount != 1 || h.BootIndex != 1 || h.BootMetadata.Offset != r.Image[0].offset.Offset {
+		t.Errorf("unexpected header %+v", h)
+	}
+	if err := r.Verify(context.Background()); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+}
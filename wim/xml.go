@@ -0,0 +1,142 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"unicode/utf16"
+)
+
+// WIMInfo is the XML information stored in a WIM. Elements that are not
+// otherwise modeled are preserved in the Unknown fields of each type, so that
+// information read from a WIM can be modified and written back.
+type WIMInfo struct {
+	XMLName    xml.Name     `xml:"WIM"`
+	TotalBytes int64        `xml:"TOTALBYTES"`
+	Images     []ImageInfo  `xml:"IMAGE"`
+	Unknown    []XMLElement `xml:",any"`
+}
+
+// ImageInfo contains information about the image.
+type ImageInfo struct {
+	Index              int          `xml:"INDEX,attr"`
+	DirCount           int64        `xml:"DIRCOUNT"`
+	FileCount          int64        `xml:"FILECOUNT"`
+	TotalBytes         int64        `xml:"TOTALBYTES"`
+	HardLinkBytes      int64        `xml:"HARDLINKBYTES"`
+	CreationTime       Filetime     `xml:"CREATIONTIME"`
+	ModTime            Filetime     `xml:"LASTMODIFICATIONTIME"`
+	WIMBoot            int          `xml:"WIMBOOT,omitempty"` // 1 if the image is used for WIMBoot
+	Windows            *WindowsInfo `xml:"WINDOWS"`
+	Name               string       `xml:"NAME"`
+	Description        string       `xml:"DESCRIPTION,omitempty"`
+	Flags              string       `xml:"FLAGS,omitempty"` // typically the edition ID
+	DisplayName        string       `xml:"DISPLAYNAME,omitempty"`
+	DisplayDescription string       `xml:"DISPLAYDESCRIPTION,omitempty"`
+	Unknown            []XMLElement `xml:",any"`
+}
+
+// WindowsInfo contains information about the Windows installation in the image.
+type WindowsInfo struct {
+	Arch             byte           `xml:"ARCH"`
+	ProductName      string         `xml:"PRODUCTNAME,omitempty"`
+	EditionID        string         `xml:"EDITIONID,omitempty"`
+	InstallationType string         `xml:"INSTALLATIONTYPE,omitempty"`
+	ServicingData    *ServicingData `xml:"SERVICINGDATA"`
+	HAL              string         `xml:"HAL,omitempty"`
+	ProductType      string         `xml:"PRODUCTTYPE,omitempty"`
+	ProductSuite     string         `xml:"PRODUCTSUITE,omitempty"`
+	Languages        []string       `xml:"LANGUAGES>LANGUAGE,omitempty"`
+	DefaultLanguage  string         `xml:"LANGUAGES>DEFAULT,omitempty"`
+	Version          Version        `xml:"VERSION"`
+	SystemRoot       string         `xml:"SYSTEMROOT,omitempty"`
+	Unknown          []XMLElement   `xml:",any"`
+}
+
+// ServicingData contains the servicing state of a Windows image.
+type ServicingData struct {
+	GDRDURevision     int          `xml:"GDRDUREVISION"`
+	PKeyConfigVersion string       `xml:"PKEYCONFIGVERSION,omitempty"`
+	ImageState        string       `xml:"IMAGESTATE,omitempty"`
+	Unknown           []XMLElement `xml:",any"`
+}
+
+// Version represents a Windows build version.
+type Version struct {
+	Major   int          `xml:"MAJOR"`
+	Minor   int          `xml:"MINOR"`
+	Build   int          `xml:"BUILD"`
+	SPBuild int          `xml:"SPBUILD"`
+	SPLevel int          `xml:"SPLEVEL"`
+	Branch  string       `xml:"BRANCH,omitempty"`
+	Unknown []XMLElement `xml:",any"`
+}
+
+// XMLElement is an XML element that is preserved as is.
+type XMLElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	InnerXML string     `xml:",innerxml"`
+}
+
+// ParseWIMInfo parses XML information as stored in Reader.XMLInfo.
+func ParseWIMInfo(s string) (*WIMInfo, error) {
+	info := &WIMInfo{}
+	err := xml.Unmarshal([]byte(s), info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// MarshalBinary encodes the information as it is stored in a WIM: UTF-16LE
+// XML preceded by a byte order mark.
+func (info *WIMInfo) MarshalBinary() ([]byte, error) {
+	x, err := xml.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	x16 := append([]uint16{0xfeff}, utf16.Encode([]rune(string(x)))...)
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, x16)
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary decodes information stored in a WIM, as encoded by
+// MarshalBinary.
+func (info *WIMInfo) UnmarshalBinary(b []byte) error {
+	s, err := decodeXML(b)
+	if err != nil {
+		return err
+	}
+	*info = WIMInfo{}
+	return xml.Unmarshal([]byte(s), info)
+}
+
+// decodeXML decodes UTF-16LE XML data with a byte order mark.
+func decodeXML(b []byte) (string, error) {
+	if len(b) < 2 || len(b)%2 != 0 {
+		return "", errors.New("invalid XML data length")
+	}
+	x16 := make([]uint16, len(b)/2)
+	_ = binary.Read(bytes.NewReader(b), binary.LittleEndian, x16)
+	// The BOM will always indicate little-endian UTF-16.
+	if x16[0] != 0xfeff {
+		return "", errors.New("invalid BOM")
+	}
+	return string(utf16.Decode(x16[1:])), nil
+}
+
+// image returns the information for the image with the given 1-based index.
+func (info *WIMInfo) image(index int) *ImageInfo {
+	for i := range info.Images {
+		if info.Images[i].Index == index {
+			return &info.Images[i]
+		}
+	}
+	return nil
+}
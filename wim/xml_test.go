@@ -0,0 +1,132 @@
+//go:build windows || linux
+// +build windows linux
+
+package wim
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+const testXMLInfo = `<WIM><TOTALBYTES>3952421</TOTALBYTES>` +
+	`<IMAGE INDEX="1"><DIRCOUNT>10</DIRCOUNT><FILECOUNT>20</FILECOUNT><TOTALBYTES>3000</TOTALBYTES><HARDLINKBYTES>100</HARDLINKBYTES>` +
+	`<CREATIONTIME><HIGHPART>0x01D5C1A3</HIGHPART><LOWPART>0x12345678</LOWPART></CREATIONTIME>` +
+	`<LASTMODIFICATIONTIME><HIGHPART>0x01D5C1A3</HIGHPART><LOWPART>0x12345679</LOWPART></LASTMODIFICATIONTIME>` +
+	`<WIMBOOT>1</WIMBOOT>` +
+	`<WINDOWS><ARCH>9</ARCH><PRODUCTNAME>Microsoft® Windows® Operating System</PRODUCTNAME><EDITIONID>Professional</EDITIONID>` +
+	`<INSTALLATIONTYPE>Client</INSTALLATIONTYPE><SERVICINGDATA><GDRDUREVISION>0</GDRDUREVISION><PKEYCONFIGVERSION>10.0.19041.1</PKEYCONFIGVERSION><FUTURE>x</FUTURE></SERVICINGDATA>` +
+	`<HAL>acpiapic</HAL><PRODUCTTYPE>WinNT</PRODUCTTYPE><PRODUCTSUITE>Terminal Server</PRODUCTSUITE>` +
+	`<LANGUAGES><LANGUAGE>en-US</LANGUAGE><LANGUAGE>de-DE</LANGUAGE><DEFAULT>en-US</DEFAULT></LANGUAGES>` +
+	`<VERSION><MAJOR>10</MAJOR><MINOR>0</MINOR><BUILD>19041</BUILD><SPBUILD>1</SPBUILD><SPLEVEL>0</SPLEVEL><BRANCH>vb_release</BRANCH></VERSION>` +
+	`<SYSTEMROOT>WINDOWS</SYSTEMROOT><EXTRA attr="a">extra <B>data</B></EXTRA></WINDOWS>` +
+	`<NAME>Windows 10 Pro</NAME><DESCRIPTION>Windows 10 Pro</DESCRIPTION><FLAGS>Professional</FLAGS>` +
+	`<DISPLAYNAME>Windows 10 Pro</DISPLAYNAME><DISPLAYDESCRIPTION>Windows 10 Pro</DISPLAYDESCRIPTION></IMAGE>` +
+	`<ESD><ENCRYPTED>0</ENCRYPTED></ESD></WIM>`
+
+func TestWIMInfoRoundTrip(t *testing.T) {
+	info, err := ParseWIMInfo(testXMLInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.TotalBytes != 3952421 || len(info.Images) != 1 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	img := info.Images[0]
+	if img.Index != 1 || img.DirCount != 10 || img.FileCount != 20 || img.TotalBytes != 3000 || img.HardLinkBytes != 100 ||
+		img.WIMBoot != 1 || img.Name != "Windows 10 Pro" || img.Flags != "Professional" || img.DisplayName != "Windows 10 Pro" {
+		t.Errorf("unexpected image info %+v", img)
+	}
+	if img.CreationTime.HighDateTime != 0x01D5C1A3 || img.CreationTime.LowDateTime != 0x12345678 {
+		t.Errorf("unexpected creation time %+v", img.CreationTime)
+	}
+	win := img.Windows
+	if win == nil || win.Arch != 9 || win.EditionID != "Professional" || win.HAL != "acpiapic" ||
+		win.DefaultLanguage != "en-US" || len(win.Languages) != 2 || win.Version.Build != 19041 || win.Version.Branch != "vb_release" {
+		t.Fatalf("unexpected Windows info %+v", win)
+	}
+	if win.ServicingData == nil || win.ServicingData.PKeyConfigVersion != "10.0.19041.1" || len(win.ServicingData.Unknown) != 1 {
+		t.Errorf("unexpected servicing data %+v", win.ServicingData)
+	}
+	if len(win.Unknown) != 1 || win.Unknown[0].XMLName.Local != "EXTRA" || win.Unknown[0].InnerXML != "extra <B>data</B>" {
+		t.Errorf("unexpected unknown elements %+v", win.Unknown)
+	}
+	if len(info.Unknown) != 1 || info.Unknown[0].XMLName.Local != "ESD" {
+		t.Errorf("unexpected unknown elements %+v", info.Unknown)
+	}
+
+	b, err := info.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte{0xff, 0xfe, '<', 0}) {
+		t.Errorf("missing byte order mark: %x", b[:4])
+	}
+	var info2 WIMInfo
+	if err := info2.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	x1, err := xml.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x2, err := xml.Marshal(&info2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(x1, x2) {
+		t.Errorf("round trip mismatch:\n%s\n%s", x1, x2)
+	}
+	for _, s := range []string{`<EXTRA attr="a">extra <B>data</B></EXTRA>`, `<FUTURE>x</FUTURE>`, `<ESD><ENCRYPTED>0</ENCRYPTED></ESD>`} {
+		if !strings.Contains(string(x1), s) {
+			t.Errorf("%s not preserved in %s", s, x1)
+		}
+	}
+}
+
+func TestWriterXMLInfo(t *testing.T) {
+	f := writeTestWIM(t, testFS(), testMetadata)
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := r.Image[0].ImageInfo
+	// Windows, System32, empty and the root.
+	if img.DirCount != 4 || img.FileCount != 5 {
+		t.Errorf("unexpected counts %+v", img)
+	}
+	// cmd.exe, copy.exe, notepad.exe and its stream, and the reparse data.
+	if want := int64(150000*2 + 7 + 14 + 12); img.TotalBytes != want {
+		t.Errorf("expected %d total bytes, got %d", want, img.TotalBytes)
+	}
+	if r.Info.TotalBytes == 0 || len(r.Info.Images) != 1 {
+		t.Errorf("unexpected WIM info %+v", r.Info)
+	}
+
+	w, err := NewAppendWriter(f, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := img
+	info.Description = "edited"
+	info.Windows = &WindowsInfo{EditionID: "ServerCore"}
+	info.DirCount = 1
+	if err := w.SetImageInfo(1, info); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetImageInfo(2, info); err == nil {
+		t.Error("expected error for missing image")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err = NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img = r.Image[0].ImageInfo
+	if img.Description != "edited" || img.Windows == nil || img.Windows.EditionID != "ServerCore" || img.DirCount != 4 {
+		t.Errorf("unexpected edited image info %+v", img)
+	}
+}
@@ -0,0 +1,195 @@
+// Package xpress implements a decompressor for the WIM variant of the
+// XPRESS Huffman compression algorithm.
+//
+// The algorithm is documented as "LZ77+Huffman" in [MS-XCA] at
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-xca.
+package xpress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	numSymbols = 512
+	maxCodeLen = 15
+	tableBits  = maxCodeLen
+	lenShift   = 9
+	symbolMask = 1<<lenShift - 1
+
+	maxChunkSize = 65536
+	minMatchLen  = 3
+)
+
+var errCorrupt = errors.New("XPRESS data corrupt")
+
+type decompressor struct {
+	r            io.Reader
+	uncompressed int
+	outReader    *bytes.Reader
+	in           []byte
+	table        [1 << tableBits]uint16
+}
+
+// buildTable builds a huffman decoding table from the 4-bit code lengths
+// at the start of the compressed data. Each table entry contains the symbol
+// and its code length, and entries with a length of zero are invalid.
+func (d *decompressor) buildTable(lens []byte) error {
+	pos := 0
+	for l := uint16(1); l <= maxCodeLen; l++ {
+		for sym := 0; sym < numSymbols; sym++ {
+			cl := lens[sym/2]
+			if sym%2 == 0 {
+				cl &= 0xf
+			} else {
+				cl >>= 4
+			}
+			if uint16(cl) != l {
+				continue
+			}
+			n := 1 << (tableBits - l)
+			if pos+n > len(d.table) {
+				return errCorrupt
+			}
+			v := l<<lenShift | uint16(sym)
+			for i := pos; i < pos+n; i++ {
+				d.table[i] = v
+			}
+			pos += n
+		}
+	}
+	for i := pos; i < len(d.table); i++ {
+		d.table[i] = 0
+	}
+	return nil
+}
+
+// read16 returns the little-endian 16-bit word at offset i of the input,
+// treating data past the end of the input as zeroes.
+func (d *decompressor) read16(i int) uint32 {
+	if i+1 < len(d.in) {
+		return uint32(binary.LittleEndian.Uint16(d.in[i:]))
+	}
+	return uint32(d.readByte(i))
+}
+
+func (d *decompressor) readByte(i int) byte {
+	if i < len(d.in) {
+		return d.in[i]
+	}
+	return 0
+}
+
+// decompress decodes the input into out, stopping once out is full.
+func (d *decompressor) decompress(out []byte) error {
+	if len(d.in) < numSymbols/2 {
+		return errCorrupt
+	}
+	err := d.buildTable(d.in[:numSymbols/2])
+	if err != nil {
+		return err
+	}
+
+	pos := numSymbols / 2
+	nextBits := d.read16(pos)<<16 | d.read16(pos+2)
+	pos += 4
+	extraBits := 16
+
+	// consume removes n bits from the bit buffer, refilling it from the
+	// input when fewer than 16 bits remain.
+	consume := func(n int) {
+		nextBits <<= n
+		extraBits -= n
+		if extraBits < 0 {
+			nextBits |= d.read16(pos) << -extraBits
+			extraBits += 16
+			pos += 2
+		}
+	}
+
+	o := 0
+	for o < len(out) {
+		entry := d.table[nextBits>>(32-tableBits)]
+		n := int(entry >> lenShift)
+		if n == 0 {
+			return errCorrupt
+		}
+		consume(n)
+		sym := int(entry & symbolMask)
+		if sym < 256 {
+			out[o] = byte(sym)
+			o++
+			continue
+		}
+
+		// This is a match. The low 4 bits of the symbol encode the
+		// length, and the high bits the number of offset bits.
+		sym -= 256
+		matchLen := sym & 15
+		offsetBits := sym >> 4
+		if matchLen == 15 {
+			matchLen = int(d.readByte(pos))
+			pos++
+			if matchLen == 255 {
+				matchLen = int(d.read16(pos))
+				pos += 2
+				if matchLen < 15 {
+					return errCorrupt
+				}
+				matchLen -= 15
+			}
+			matchLen += 15
+		}
+		matchLen += minMatchLen
+
+		offset := int(nextBits>>(32-offsetBits)) + 1<<offsetBits
+		consume(offsetBits)
+
+		if offset > o || matchLen > len(out)-o {
+			return errCorrupt
+		}
+		for end := o + matchLen; o < end; o++ {
+			out[o] = out[o-offset]
+		}
+	}
+	return nil
+}
+
+func (d *decompressor) Read(b []byte) (int, error) {
+	// Read and uncompress everything.
+	if d.outReader == nil {
+		var err error
+		d.in, err = io.ReadAll(d.r)
+		if err != nil {
+			return 0, err
+		}
+		out := make([]byte, d.uncompressed)
+		err = d.decompress(out)
+		if err != nil {
+			return 0, err
+		}
+		d.outReader = bytes.NewReader(out)
+	}
+
+	// Just read directly from the output.
+	return d.outReader.Read(b)
+}
+
+func (*decompressor) Close() error {
+	return nil
+}
+
+// NewReader returns a new io.ReadCloser that decompresses a
+// WIM XPRESS stream until uncompressedSize bytes have been returned.
+func NewReader(r io.Reader, uncompressedSize int) (io.ReadCloser, error) {
+	if uncompressedSize > maxChunkSize {
+		return nil, errors.New("uncompressed size is limited to 64KB")
+	}
+	d := &decompressor{
+		uncompressed: uncompressedSize,
+		r:            r,
+	}
+	return d, nil
+}
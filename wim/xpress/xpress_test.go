@@ -0,0 +1,129 @@
+package xpress
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/go-winio/wim/internal/xpresstest"
+)
+
+// compressed returns XPRESS data with the given code lengths, followed by
+// the bit stream and other input data in rest.
+func compressed(lens map[int]byte, rest ...byte) []byte {
+	b := make([]byte, numSymbols/2, numSymbols/2+len(rest))
+	for sym, l := range lens {
+		b[sym/2] |= l << (4 * (sym % 2))
+	}
+	return append(b, rest...)
+}
+
+func TestDecompress(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		out  string
+	}{
+		{
+			// 'a' = 0, 'b' = 10, match of length 3 at offset 1 = 11.
+			// The bit stream is 0 10 11 0.
+			name: "short match",
+			in:   compressed(map[int]byte{'a': 1, 'b': 2, 256: 2}, 0x00, 0x58, 0, 0),
+			out:  "abbbba",
+		},
+		{
+			// 'a' = 0, match with extended length at offset 1 = 1. The
+			// bit stream is 0 1, followed by the length byte.
+			name: "long match",
+			in:   compressed(map[int]byte{'a': 1, 256 + 15: 1}, 0x00, 0x40, 0, 0, 2),
+			out:  "aaaaaaaaaaaaaaaaaaaaa",
+		},
+		{
+			// As above, but the length byte is 255, so the length
+			// minus 3 follows as a 16-bit word.
+			name: "16-bit match length",
+			in:   compressed(map[int]byte{'a': 1, 256 + 15: 1}, 0x00, 0x40, 0, 0, 255, 0x29, 0x01),
+			out:  strings.Repeat("a", 301),
+		},
+		{
+			// The longest match, filling a 64KB chunk.
+			name: "longest match",
+			in:   compressed(map[int]byte{'a': 1, 256 + 15: 1}, 0x00, 0x40, 0, 0, 255, 0xfc, 0xff),
+			out:  strings.Repeat("a", maxChunkSize),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(tt.in), len(tt.out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.out {
+				t.Errorf("expected %q, got %q", tt.out, b)
+			}
+		})
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	// A match at offset 1 with no preceding output.
+	in := compressed(map[int]byte{'a': 1, 256: 1}, 0x00, 0x80, 0, 0)
+	r, err := NewReader(bytes.NewReader(in), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != errCorrupt { //nolint:errorlint // sentinel error
+		t.Errorf("expected corruption error, got %v", err)
+	}
+}
+
+func TestDecompressCompressed(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	words := strings.Fields("the quick brown fox jumps over lazy dog Windows System32 config")
+	var text []byte
+	for len(text) < maxChunkSize {
+		text = append(text, words[rng.Intn(len(words))]...)
+		text = append(text, ' ')
+	}
+	random := make([]byte, maxChunkSize)
+	rng.Read(random)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"short", []byte("abcabcabcabcd")},
+		{"text", text[:10000]},
+		{"full chunk of text", text[:maxChunkSize]},
+		{"full chunk of one byte", bytes.Repeat([]byte{0}, maxChunkSize)},
+		{"random", random[:maxChunkSize-1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := xpresstest.Compress(tt.data)
+			r, err := NewReader(bytes.NewReader(in), len(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, tt.data) {
+				t.Error("content mismatch")
+			}
+		})
+	}
+}
+
+func TestChunkSizeLimit(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader(nil), maxChunkSize+1); err == nil {
+		t.Error("expected error for chunk larger than 64KB")
+	}
+}